@@ -0,0 +1,171 @@
+// Package client implements the client side of the blind CSP flow: it walks the
+// authentication steps of the election handler, blinds the payload, requests the
+// blind signature and unblinds and verifies it.
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+	"github.com/vocdoni/blind-csp/receipt"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+// DefaultTimeout is the default timeout of the requests to the CSP.
+const DefaultTimeout = 30 * time.Second
+
+// StepFunc returns the authData for the authentication step. The field describes the
+// step (as published by the handler info, nil if not described) and response is the
+// handler response of the previous step (nil for the first one).
+type StepFunc = func(step int, field *types.AuthField, response []string) (authData []string, err error)
+
+// Client is a blind CSP client.
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// New returns a client for the CSP API served at url, i.e
+// https://server/v1/auth/elections
+func New(url string) (*Client, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid CSP url %q", url)
+	}
+	return &Client{
+		url:  strings.TrimSuffix(url, "/"),
+		http: &http.Client{Timeout: DefaultTimeout},
+	}, nil
+}
+
+// Info returns the description of the handler used for processID and the CSP root keys.
+func (c *Client) Info(processID []byte) (*types.Message, error) {
+	return c.request("GET", fmt.Sprintf("%x/info", processID), nil)
+}
+
+// Auth walks all the authentication steps of the election handler for signType,
+// calling stepFn for getting the authData of each step. It returns the response of
+// the last step, which includes the token for requesting the signature.
+func (c *Client) Auth(processID []byte, signType string, stepFn StepFunc) (*types.Message, error) {
+	info, err := c.Info(processID)
+	if err != nil {
+		return nil, err
+	}
+	req := &types.Message{}
+	var response []string
+	for step := 0; ; step++ {
+		var field *types.AuthField
+		if step < len(info.AuthSteps) {
+			field = info.AuthSteps[step]
+		}
+		if req.AuthData, err = stepFn(step, field, response); err != nil {
+			return nil, fmt.Errorf("auth step %d: %w", step, err)
+		}
+		resp, err := c.request("POST", fmt.Sprintf("%x/%s/auth/%d", processID, signType, step), req)
+		if err != nil {
+			return nil, fmt.Errorf("auth step %d: %w", step, err)
+		}
+		if resp.AuthToken == nil {
+			return resp, nil
+		}
+		req.AuthToken = resp.AuthToken
+		response = resp.Response
+	}
+}
+
+// SignBlind gets the blind signature of hash for processID, authenticating with stepFn.
+// The signature is unblinded and verified for the election salted key of any of the
+// CSP root keys. It returns the receipt of the signature, whose Signature is the
+// unblinded signature (65 bytes compressed).
+func (c *Client) SignBlind(processID, hash []byte, stepFn StepFunc) (*types.Receipt, error) {
+	auth, err := c.Auth(processID, types.SignatureTypeBlind, stepFn)
+	if err != nil {
+		return nil, err
+	}
+	// the R point is provided uncompressed for blindsecp256k1-js compatibility
+	signerR, err := blind.NewPointFromBytesUncompressed(auth.TokenR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid R point: %w", err)
+	}
+	m := new(big.Int).SetBytes(hash)
+	msgBlinded, userSecretData, err := blind.Blind(m, signerR)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.request("POST", fmt.Sprintf("%x/%s/sign", processID, types.SignatureTypeBlind),
+		&types.Message{TokenR: auth.TokenR, Payload: msgBlinded.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	signature := blind.Unblind(new(big.Int).SetBytes(resp.Signature), userSecretData)
+	return c.Verify(processID, types.SignatureTypeBlind, m.FillBytes(make([]byte, 32)), signature.Bytes())
+}
+
+// Verify checks that signature of payload was issued by the CSP for processID, with
+// the election salted key of any of the current CSP root keys. It returns the receipt
+// of the signature.
+func (c *Client) Verify(processID []byte, signType string, payload, signature []byte) (*types.Receipt, error) {
+	info, err := c.Info(processID)
+	if err != nil {
+		return nil, err
+	}
+	saltVersion := saltedkey.SaltVersion1
+	if info.SaltVersion != 0 {
+		saltVersion = saltedkey.SaltVersion(info.SaltVersion)
+	}
+	for i := range info.Keys {
+		pubKey, err := receipt.SaltedPubKey(&info.Keys[i], saltVersion, processID, signType)
+		if err != nil {
+			return nil, err
+		}
+		r := &types.Receipt{
+			Version:       types.ReceiptVersion,
+			ElectionID:    processID,
+			SignatureType: signType,
+			KeyID:         info.Keys[i].ID,
+			PubKey:        pubKey,
+			Payload:       payload,
+			Signature:     signature,
+			SaltVersion:   uint32(saltVersion),
+		}
+		if receipt.VerifyReceipt(r, &info.Keys[i], saltVersion) == nil {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("signature is not valid for any CSP root key")
+}
+
+// request sends req to the CSP path and returns the response message.
+func (c *Client) request(method, path string, req *types.Message) (*types.Message, error) {
+	var body io.Reader
+	if req != nil {
+		body = bytes.NewReader(req.Marshal())
+	}
+	hreq, err := http.NewRequest(method, c.url+"/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	hresp, err := c.http.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+	data, err := io.ReadAll(hresp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", hresp.Status, strings.TrimSpace(string(data)))
+	}
+	resp := &types.Message{}
+	if err := resp.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("cannot decode response: %w", err)
+	}
+	return resp, nil
+}
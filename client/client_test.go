@@ -0,0 +1,112 @@
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/csp"
+	"github.com/vocdoni/blind-csp/handlers"
+	"github.com/vocdoni/blind-csp/receipt"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/httprouter"
+)
+
+func TestClientSimpleMath(t *testing.T) {
+	// In process CSP with the simpleMath handler
+	rk, err := saltedkey.NewRootKey("test", fmt.Sprintf("%x", randomBytes(32)), time.Now().Add(-time.Minute), time.Time{})
+	qt.Assert(t, err, qt.IsNil)
+	keyring, err := saltedkey.NewKeyRing(rk)
+	qt.Assert(t, err, qt.IsNil)
+	store := csp.NewMemoryTokenStore()
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	handler := &handlers.SimpleMathHandler{}
+	qt.Assert(t, handler.Init(&router, "/v1/auth/elections", t.TempDir()), qt.IsNil)
+	cs, err := csp.NewBlindCSP(keyring, store, csp.BlindCSPcallbacks{
+		Name: handler.Name(),
+		Auth: handler.Auth,
+		Info: handler.Info,
+	})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(cs.Close)
+	qt.Assert(t, cs.ServeAPI(&router, "/v1/auth/elections"), qt.IsNil)
+
+	c, err := New(fmt.Sprintf("http://%s/v1/auth/elections", router.Address()))
+	qt.Assert(t, err, qt.IsNil)
+	pid := randomBytes(32)
+	info, err := c.Info(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, info.AuthSteps, qt.HasLen, 2)
+
+	// The user provides the name and then solves the challenge
+	solveMath := func(step int, field *types.AuthField, response []string) ([]string, error) {
+		switch step {
+		case 0:
+			qt.Assert(t, field.Title, qt.Equals, "Name")
+			return []string{"John Smith"}, nil
+		case 1:
+			qt.Assert(t, field.Title, qt.Equals, "Solution")
+			if len(response) != 2 {
+				return nil, fmt.Errorf("unexpected challenge %v", response)
+			}
+			r1, err := strconv.Atoi(response[0])
+			if err != nil {
+				return nil, err
+			}
+			r2, err := strconv.Atoi(response[1])
+			if err != nil {
+				return nil, err
+			}
+			return []string{strconv.Itoa(r1 + r2)}, nil
+		}
+		return nil, fmt.Errorf("unexpected step %d", step)
+	}
+
+	hash := ethereum.HashRaw(randomBytes(128))
+	r, err := c.SignBlind(pid, hash, solveMath)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, r.KeyID, qt.Equals, "test")
+	qt.Assert(t, receipt.VerifyReceipt(r, &info.Keys[0], saltedkey.DefaultSaltVersion), qt.IsNil)
+
+	// The signature is valid for the election salted key
+	pubKey, err := blind.NewPublicKeyFromBytes(mustHex(t, cs.PubKeyBlind(pid)))
+	qt.Assert(t, err, qt.IsNil)
+	signature, err := blind.NewSignatureFromBytes(r.Signature)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, blind.Verify(new(big.Int).SetBytes(hash), signature, pubKey), qt.IsTrue)
+
+	// A wrong solution fails the authentication
+	_, err = c.SignBlind(pid, hash, func(step int, field *types.AuthField, response []string) ([]string, error) {
+		if step == 1 {
+			return []string{"0"}, nil
+		}
+		return solveMath(step, field, response)
+	})
+	qt.Assert(t, err, qt.ErrorMatches, ".*invalid math challenge solution.*")
+
+	// The signature is not valid for other elections
+	_, err = c.Verify(randomBytes(32), types.SignatureTypeBlind, r.Payload, r.Signature)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	var b types.HexBytes
+	qt.Assert(t, b.FromString(s), qt.IsNil)
+	return b
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -1,17 +1,19 @@
 package csp
 
 import (
+	"context"
+	"crypto/rsa"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/vocdoni/blind-csp/handlers"
 	"github.com/vocdoni/blind-csp/saltedkey"
-	"go.vocdoni.io/dvote/db"
-	"go.vocdoni.io/dvote/db/metadb"
+	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/httprouter"
 	"go.vocdoni.io/dvote/httprouter/apirest"
-	"go.vocdoni.io/dvote/log"
 )
 
 const (
@@ -20,43 +22,241 @@ const (
 
 	// RandomTokenSize is the maximum size of the random token for auth queries
 	RandomTokenSize = 32
+
+	// DefaultKeysTTL is the default time a request key (R point or ECDSA token) remains
+	// valid after being issued to the client.
+	DefaultKeysTTL = 30 * time.Minute
+
+	// RSAKeyBits is the size of the election RSA keys used for blind RSA signatures.
+	RSAKeyBits = 2048
+	// RSAKeyPoolSize is the number of election RSA keys generated in advance.
+	RSAKeyPoolSize = 2
+
+	// VOPRFMaxBatch is the maximum number of VOPRF tokens issued for a single authentication.
+	VOPRFMaxBatch = 32
+
+	// DefaultKeysGCInterval is the default period between two executions of the
+	// request keys garbage collector.
+	DefaultKeysGCInterval = 5 * time.Minute
 )
 
+// ErrHandlerUnavailable is returned when none of the handlers configured for an
+// election is registered on the CSP.
+var ErrHandlerUnavailable = fmt.Errorf("election handler not available")
+
 // BlindCSP is the blind signature API service for certification authorities
 type BlindCSP struct {
+	// callbacks is the default handler, used if the election does not resolve to
+	// any other registered handler.
 	callbacks *BlindCSPcallbacks
+	handlers  map[string]*BlindCSPcallbacks
+	resolver  ElectionResolverFunc
+	salts     SaltVersionResolverFunc
+	admin     string
 	router    *httprouter.HTTProuter
 	api       *apirest.API
-	signer    *saltedkey.SaltedKey
-	keys      db.Database
+	keyring   *saltedkey.KeyRing
+	keys      TokenStore
 	keysLock  sync.RWMutex
+	keysTTL   time.Duration
+	sessions  *sessionManager
+	rsaKeys   chan *rsa.PrivateKey
+	// ctx is canceled by Close, stopping the background tasks
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ElectionResolverFunc returns the names of the handlers configured for an election,
+// by order of preference. An empty list means the election uses the default handler.
+type ElectionResolverFunc = func(electionID types.HexBytes) (handlers []string, err error)
+
+// SaltVersionResolverFunc returns the salt derivation version of an election (see
+// saltedkey.ElectionSalt). The version of an election must never change once it has
+// been used, as it determines the election salted keys.
+type SaltVersionResolverFunc = func(electionID types.HexBytes) (saltedkey.SaltVersion, error)
+
+// FixedSaltVersion returns a salt version resolver that uses version for all elections.
+func FixedSaltVersion(version saltedkey.SaltVersion) SaltVersionResolverFunc {
+	return func(types.HexBytes) (saltedkey.SaltVersion, error) {
+		return version, nil
+	}
 }
 
 type BlindCSPcallbacks struct {
+	// Name identifies the handler, request keys are bound to the handler issuing them
+	Name    string
 	Auth    handlers.AuthFunc
 	Info    handlers.InfoFunc
 	Indexer handlers.IndexerFunc
 }
 
-// NewBlindCSP creates and initializes the CSP API with a private key (64 digits hexadecimal string)
-// and a custom callback authorization function.
-func NewBlindCSP(privKey, dataDir string, handlerCallbacks BlindCSPcallbacks) (*BlindCSP, error) {
-	if len(privKey) != PrivKeyHexSize {
-		return nil, fmt.Errorf("private key size is incorrect %d", len(privKey))
+// NewBlindCSP creates and initializes the CSP API with a key ring holding the root keys,
+// an initialized token store for the request keys and a custom callback authorization function.
+func NewBlindCSP(keyring *saltedkey.KeyRing, keys TokenStore,
+	handlerCallbacks BlindCSPcallbacks,
+) (*BlindCSP, error) {
+	if keyring == nil {
+		return nil, fmt.Errorf("key ring is nil")
+	}
+	if _, err := keyring.Active(time.Now()); err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("token store is nil")
 	}
 	csp := new(BlindCSP)
 	csp.callbacks = &handlerCallbacks
-	var err error
-	// ECDSA/Blind signer
-	if csp.signer, err = saltedkey.NewSaltedKey(privKey); err != nil {
-		return nil, err
+	csp.handlers = map[string]*BlindCSPcallbacks{handlerCallbacks.Name: csp.callbacks}
+	csp.keyring = keyring
+	csp.keys = keys
+	csp.keysTTL = DefaultKeysTTL
+	csp.sessions = newSessionManager(keys, DefaultSessionTTL)
+	csp.rsaKeys = make(chan *rsa.PrivateKey, RSAKeyPoolSize)
+	csp.ctx, csp.cancel = context.WithCancel(context.Background())
+
+	// Remove the request keys abandoned by the clients
+	go csp.keysGC(DefaultKeysGCInterval)
+	go csp.sessionsGC(DefaultKeysGCInterval)
+	go csp.rsaKeysGenerator()
+
+	return csp, nil
+}
+
+// Close stops the background tasks of the CSP (the request keys and sessions
+// garbage collectors and the RSA keys generator). The token store is not closed.
+func (csp *BlindCSP) Close() {
+	csp.cancel()
+}
+
+// AddHandler registers an additional handler. The handler is used for the elections
+// whose configuration (see SetElectionResolver) includes the handler name.
+// It must be called before ServeAPI.
+func (csp *BlindCSP) AddHandler(handlerCallbacks BlindCSPcallbacks) error {
+	if handlerCallbacks.Auth == nil {
+		return fmt.Errorf("handler %s has no auth callback", handlerCallbacks.Name)
+	}
+	if _, ok := csp.handlers[handlerCallbacks.Name]; ok {
+		return fmt.Errorf("handler %s already registered", handlerCallbacks.Name)
+	}
+	csp.handlers[handlerCallbacks.Name] = &handlerCallbacks
+	return nil
+}
+
+// SetElectionResolver sets the function used for finding out which of the registered
+// handlers must be used for each election. If it is not set, the default handler
+// (the one provided to NewBlindCSP) is used for all elections.
+func (csp *BlindCSP) SetElectionResolver(resolver ElectionResolverFunc) {
+	csp.resolver = resolver
+}
+
+// SetSaltVersionResolver sets the function used for finding out the salt version of
+// each election. If it is not set, saltedkey.DefaultSaltVersion is used for all elections.
+// The version resolved is bound to the election together with its root key, so later
+// changes of the resolver do not modify the keys of the election. It must be called
+// before ServeAPI.
+func (csp *BlindCSP) SetSaltVersionResolver(resolver SaltVersionResolverFunc) {
+	csp.salts = resolver
+}
+
+// SetAdminToken sets the bearer token of the admin endpoints (i.e revocations). The
+// admin endpoints are not served if it is not set. It must be called before ServeAPI.
+func (csp *BlindCSP) SetAdminToken(token string) {
+	csp.admin = token
+}
+
+// SaltVersion returns the salt derivation version used for processID. It is the
+// version bound to the election if any, else the one of the resolver (without binding it).
+func (csp *BlindCSP) SaltVersion(processID []byte) (saltedkey.SaltVersion, error) {
+	version, err := csp.keys.BindSaltVersion(processID, 0)
+	if err == nil {
+		return version, nil
 	}
+	if !errors.Is(err, ErrKeyUnknown) {
+		return 0, fmt.Errorf("cannot get election salt version: %w", err)
+	}
+	return csp.resolveSaltVersion(processID)
+}
 
-	// Storage
-	log.Debugf("initializing persistent storage on %s", dataDir)
-	csp.keys, err = metadb.New(db.TypePebble, dataDir)
+// bindSaltVersion returns the salt version of processID, binding the one of the
+// resolver if the election has none yet.
+func (csp *BlindCSP) bindSaltVersion(processID []byte) (saltedkey.SaltVersion, error) {
+	version, err := csp.keys.BindSaltVersion(processID, 0)
+	if err == nil {
+		return version, nil
+	}
+	if !errors.Is(err, ErrKeyUnknown) {
+		return 0, fmt.Errorf("cannot get election salt version: %w", err)
+	}
+	if version, err = csp.resolveSaltVersion(processID); err != nil {
+		return 0, err
+	}
+	if version, err = csp.keys.BindSaltVersion(processID, version); err != nil {
+		return 0, fmt.Errorf("cannot bind election salt version: %w", err)
+	}
+	return version, nil
+}
 
-	return csp, err
+// resolveSaltVersion returns the salt version of the resolver for processID.
+func (csp *BlindCSP) resolveSaltVersion(processID []byte) (saltedkey.SaltVersion, error) {
+	if csp.salts == nil {
+		return saltedkey.DefaultSaltVersion, nil
+	}
+	version, err := csp.salts(processID)
+	if err != nil {
+		return 0, fmt.Errorf("cannot resolve election salt version: %w", err)
+	}
+	return version, nil
+}
+
+// electionSalt returns the salt of processID for its salt version.
+func (csp *BlindCSP) electionSalt(processID []byte) (saltedkey.Salt, error) {
+	version, err := csp.SaltVersion(processID)
+	if err != nil {
+		return saltedkey.Salt{}, err
+	}
+	return saltedkey.ElectionSalt(version, processID)
+}
+
+// electionHandler returns the handler for processID.
+func (csp *BlindCSP) electionHandler(processID []byte) (*BlindCSPcallbacks, error) {
+	if csp.resolver == nil || len(csp.handlers) == 1 {
+		return csp.callbacks, nil
+	}
+	names, err := csp.resolver(processID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve election handler: %w", err)
+	}
+	if len(names) == 0 {
+		return csp.callbacks, nil
+	}
+	for _, name := range names {
+		if h, ok := csp.handlers[name]; ok {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrHandlerUnavailable, names)
+}
+
+// SetKeysTTL sets the time a new request key remains valid after being issued.
+// Keys already stored keep the TTL they were created with.
+func (csp *BlindCSP) SetKeysTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid keys TTL %s", ttl)
+	}
+	csp.keysLock.Lock()
+	defer csp.keysLock.Unlock()
+	csp.keysTTL = ttl
+	return nil
+}
+
+// SetSessionTTL sets the time an authentication session remains valid after
+// its last successful step.
+func (csp *BlindCSP) SetSessionTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid session TTL %s", ttl)
+	}
+	csp.sessions.setTTL(ttl)
+	return nil
 }
 
 // ServeAPI registers the API handlers into the router under the baseRoute path
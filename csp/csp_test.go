@@ -2,18 +2,33 @@ package csp
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"math/big"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/arnaucube/go-blindsecp256k1"
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"github.com/cloudflare/circl/ecc/bls12381"
+	"github.com/cloudflare/circl/oprf"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
 	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/receipt"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/translog"
 	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/httprouter"
 )
 
 func TestBlindCA(t *testing.T) {
@@ -28,19 +43,20 @@ func TestBlindCA(t *testing.T) {
 
 	// Use the key generated for initialize the CA with a dummy handler
 	// Create the blind CA API and assign the IP auth function
-	ca, err := NewBlindCSP(priv, t.TempDir(), BlindCSPcallbacks{Auth: testAuthHandler})
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testPebbleTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
 	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+
+	// Get a processId (will be used for salting the root key)
+	pid := randomBytes(processIDSize)
 
 	// Generate a new R point for blinding
-	signerR, err := ca.NewBlindRequestKey()
+	signerR, err := ca.NewBlindRequestKey(pid)
 	qt.Assert(t, err, qt.IsNil)
 
 	// Prepare the hash that will be signed
 	hash := ethereum.HashRaw(randomBytes(128))
 
-	// Get a processId (will be used for salting the root key)
-	pid := randomBytes(processIDSize)
-
 	// Transform it to big.Int
 	m := new(big.Int).SetBytes(hash)
 
@@ -104,6 +120,1003 @@ func TestBlindCA(t *testing.T) {
 	)
 }
 
+func TestRequestKeysTTL(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	qt.Assert(t, ca.SetKeysTTL(time.Millisecond*100), qt.IsNil)
+
+	// Issue two blind keys and one ECDSA token
+	pid := randomBytes(processIDSize)
+	signerR, err := ca.NewBlindRequestKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = ca.NewBlindRequestKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	token := ca.NewRequestKey(pid)
+	qt.Assert(t, token, qt.Not(qt.IsNil))
+
+	// Nothing to purge yet
+	removed, err := ca.PurgeExpiredKeys()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, removed, qt.Equals, 0)
+
+	// Once the TTL is reached, the keys cannot be used anymore
+	time.Sleep(time.Millisecond * 150)
+	hash := ethereum.HashRaw(randomBytes(128))
+	_, err = ca.SignBlind(signerR, hash, pid)
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyExpired)
+	_, err = ca.SignECDSA(token, hash, pid)
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyExpired)
+
+	// And the garbage collector reclaims all of them
+	removed, err = ca.PurgeExpiredKeys()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, removed, qt.Equals, 3)
+	removed, err = ca.PurgeExpiredKeys()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, removed, qt.Equals, 0)
+}
+
+func TestRequestKeysBinding(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Name: "test", Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+
+	pidA := randomBytes(processIDSize)
+	pidB := randomBytes(processIDSize)
+	hash := ethereum.HashRaw(randomBytes(128))
+
+	// A blind R point issued for election A cannot be redeemed on election B
+	signerR, err := ca.NewBlindRequestKey(pidA)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = ca.SignBlind(signerR, hash, pidB)
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyMismatch)
+
+	// An ECDSA token issued for election A cannot be redeemed on election B
+	token := ca.NewRequestKey(pidA)
+	_, err = ca.SignECDSA(token, hash, pidB)
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyMismatch)
+
+	// Tokens cannot be redeemed with a different signature type
+	_, err = ca.SignECDSA([]byte(signerR.X.String()+signerR.Y.String()), hash, pidA)
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyMismatch)
+
+	// The mismatching requests do not consume the keys
+	_, err = ca.SignBlind(signerR, hash, pidA)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = ca.SignECDSA(token, hash, pidA)
+	qt.Assert(t, err, qt.IsNil)
+}
+
+func TestConcurrentSign(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testPebbleTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+
+	pid := types.HexBytes(randomBytes(processIDSize))
+	hash := ethereum.HashRaw(randomBytes(128))
+
+	// Blind signature: the same R point is redeemed by many concurrent requests
+	signerR, err := ca.NewBlindRequestKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	msgBlinded, _, err := blindsecp256k1.Blind(new(big.Int).SetBytes(hash), signerR)
+	qt.Assert(t, err, qt.IsNil)
+	req := types.Message{TokenR: signerR.BytesUncompressed(), Payload: msgBlinded.Bytes()}
+	qt.Assert(t, testConcurrentSign(t, fmt.Sprintf("%s/%s/blind/sign", url, pid), &req, 50), qt.Equals, int32(1))
+
+	// ECDSA signature: the same token is redeemed by many concurrent requests
+	req = types.Message{TokenR: ca.NewRequestKey(pid), Payload: hash}
+	qt.Assert(t, testConcurrentSign(t, fmt.Sprintf("%s/%s/ecdsa/sign", url, pid), &req, 50), qt.Equals, int32(1))
+}
+
+func TestElectionHandlers(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	electionA := types.Election{ElectionID: randomBytes(processIDSize)}
+	electionB := types.Election{ElectionID: randomBytes(processIDSize)}
+	electionC := types.Election{ElectionID: randomBytes(processIDSize)}
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{
+		Name:    "default",
+		Auth:    testAuthHandler,
+		Info:    func() *types.Message { return &types.Message{Title: "default"} },
+		Indexer: func(types.HexBytes) []types.Election { return []types.Election{electionA, electionB} },
+	})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	// The handler info is returned by the CSP without modifying it
+	twoStepsInfo := &types.Message{Title: "twoSteps"}
+	qt.Assert(t, ca.AddHandler(BlindCSPcallbacks{
+		Name:    "twoSteps",
+		Auth:    testTwoStepsAuthHandler,
+		Info:    func() *types.Message { return twoStepsInfo },
+		Indexer: func(types.HexBytes) []types.Election { return []types.Election{electionB, electionC} },
+	}), qt.IsNil)
+	qt.Assert(t, ca.AddHandler(BlindCSPcallbacks{Name: "twoSteps", Auth: testAuthHandler}),
+		qt.Not(qt.IsNil))
+
+	pidDefault := types.HexBytes(randomBytes(processIDSize))
+	pidTwoSteps := types.HexBytes(randomBytes(processIDSize))
+	pidUnavailable := types.HexBytes(randomBytes(processIDSize))
+	ca.SetElectionResolver(func(electionID types.HexBytes) ([]string, error) {
+		switch {
+		case bytes.Equal(electionID, pidTwoSteps):
+			return []string{"sms", "twoSteps"}, nil
+		case bytes.Equal(electionID, pidUnavailable):
+			return []string{"sms"}, nil
+		}
+		return nil, nil
+	})
+
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+
+	// The info endpoint describes the handler of each election
+	for pid, title := range map[string]string{
+		"":                         "default",
+		pidDefault.String() + "/":  "default",
+		pidTwoSteps.String() + "/": "twoSteps",
+	} {
+		resp, err := http.Get(fmt.Sprintf("%s/%sinfo", url, pid))
+		qt.Assert(t, err, qt.IsNil)
+		body, err := io.ReadAll(resp.Body)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, resp.Body.Close(), qt.IsNil)
+		msg := types.Message{}
+		qt.Assert(t, msg.Unmarshal(body), qt.IsNil)
+		qt.Assert(t, msg.Title, qt.Equals, title)
+		qt.Assert(t, msg.Keys, qt.Not(qt.HasLen), 0)
+	}
+	qt.Assert(t, twoStepsInfo.Keys, qt.IsNil)
+
+	// The indexer lists the elections of all the handlers, in order and only once
+	for i := 0; i < 5; i++ {
+		indexed, status := testRequest(t, "GET", fmt.Sprintf("%s/indexer/%x", url, randomBytes(20)), nil)
+		qt.Assert(t, status, qt.Equals, http.StatusOK)
+		qt.Assert(t, indexed.Elections, qt.DeepEquals, []types.Election{electionA, electionB, electionC})
+	}
+
+	// The default handler signs on the first step, the twoSteps one requires two
+	resp, err := ca.auth(nil, &types.Message{}, pidDefault, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.AuthToken, qt.IsNil)
+	resp, err = ca.auth(nil, &types.Message{}, pidTwoSteps, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.AuthToken, qt.Not(qt.IsNil))
+	_, err = ca.auth(nil, &types.Message{}, pidUnavailable, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.ErrorIs, ErrHandlerUnavailable)
+
+	// Request keys are bound to the election handler
+	hash := ethereum.HashRaw(randomBytes(128))
+	token := ca.NewRequestKey(pidTwoSteps)
+	_, err = ca.SignECDSA(token, hash, pidTwoSteps)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = ca.NewBlindRequestKey(pidUnavailable)
+	qt.Assert(t, err, qt.ErrorIs, ErrHandlerUnavailable)
+}
+
+func TestRootKeyRotation(t *testing.T) {
+	keyring := testKeyRing(t, fmt.Sprintf("%x", randomBytes(32)))
+	ca, err := NewBlindCSP(keyring, testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+
+	// Election A is registered while the first key is active
+	pidA := types.HexBytes(randomBytes(processIDSize))
+	_, err = ca.auth(nil, &types.Message{}, pidA, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	pubKeyA := ca.PubKeyBlind(pidA)
+
+	// The public keys of election C are queried, but the key is only bound on auth
+	pidC := types.HexBytes(randomBytes(processIDSize))
+	qt.Assert(t, ca.PubKeyBlind(pidC), qt.Not(qt.Equals), "")
+	_, err = ca.ElectionKey(pidC)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = ca.RevocationList(pidC)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = ca.keys.BindRootKey(pidC, "")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyUnknown)
+
+	// Rotate the root key, new elections get the new key
+	newKey, err := saltedkey.NewRootKey("new", fmt.Sprintf("%x", randomBytes(32)), time.Now(), time.Time{})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, keyring.Add(newKey), qt.IsNil)
+	pidB := types.HexBytes(randomBytes(processIDSize))
+	salt, err := saltedkey.ElectionSalt(saltedkey.DefaultSaltVersion, pidB)
+	qt.Assert(t, err, qt.IsNil)
+	pubKeyB, err := saltedkey.BlindPubKeyWithSalt(newKey.BlindPubKey(), salt)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, ca.PubKeyBlind(pidB), qt.Equals, fmt.Sprintf("%x", pubKeyB.Bytes()))
+	_, err = ca.auth(nil, &types.Message{}, pidC, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	keyC, err := ca.ElectionKey(pidC)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, keyC.KeyID, qt.Equals, "new")
+
+	// The election A keeps using the previous key
+	qt.Assert(t, ca.PubKeyBlind(pidA), qt.Equals, pubKeyA)
+	hash := ethereum.HashRaw(randomBytes(128))
+	m := new(big.Int).SetBytes(hash)
+	signerR, err := ca.NewBlindRequestKey(pidA)
+	qt.Assert(t, err, qt.IsNil)
+	msgBlinded, userSecretData, err := blindsecp256k1.Blind(m, signerR)
+	qt.Assert(t, err, qt.IsNil)
+	blindedSignature, err := ca.SignBlind(signerR, msgBlinded.Bytes(), pidA)
+	qt.Assert(t, err, qt.IsNil)
+	signature := blindsecp256k1.Unblind(new(big.Int).SetBytes(blindedSignature), userSecretData)
+	pubKeyBytes, err := hex.DecodeString(pubKeyA)
+	qt.Assert(t, err, qt.IsNil)
+	pubKey, err := blindsecp256k1.NewPublicKeyFromBytes(pubKeyBytes)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, blindsecp256k1.Verify(m, signature, pubKey), qt.IsTrue)
+
+	// Both keys are published
+	keys := ca.RootKeys()
+	qt.Assert(t, keys, qt.HasLen, 2)
+	qt.Assert(t, keys[0].Active, qt.IsFalse)
+	qt.Assert(t, keys[1].ID, qt.Equals, "new")
+	qt.Assert(t, keys[1].Active, qt.IsTrue)
+}
+
+func TestExternalSigner(t *testing.T) {
+	// The root key is held by an external signer (i.e a KMS), the CSP never sees it
+	sk, err := saltedkey.NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+	kms := &testKMSSigner{signer: sk}
+	rk, err := saltedkey.NewRootKeyWithSigner("kms", kms, time.Now().Add(-time.Minute), time.Time{})
+	qt.Assert(t, err, qt.IsNil)
+	keyring, err := saltedkey.NewKeyRing(rk)
+	qt.Assert(t, err, qt.IsNil)
+	ca, err := NewBlindCSP(keyring, testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+
+	pid := randomBytes(processIDSize)
+	hash := ethereum.HashRaw(randomBytes(128))
+	m := new(big.Int).SetBytes(hash)
+	signerR, err := ca.NewBlindRequestKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	msgBlinded, userSecretData, err := blindsecp256k1.Blind(m, signerR)
+	qt.Assert(t, err, qt.IsNil)
+	blindedSignature, err := ca.SignBlind(signerR, msgBlinded.Bytes(), pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, atomic.LoadInt32(&kms.signatures), qt.Equals, int32(1))
+
+	signature := blindsecp256k1.Unblind(new(big.Int).SetBytes(blindedSignature), userSecretData)
+	salt, err := saltedkey.ElectionSalt(saltedkey.DefaultSaltVersion, pid)
+	qt.Assert(t, err, qt.IsNil)
+	pubKey, err := saltedkey.BlindPubKeyWithSalt(sk.BlindPubKey(), salt)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, blindsecp256k1.Verify(m, signature, pubKey), qt.IsTrue)
+
+	// The external signer does not support BLS signatures
+	_, err = ca.NewBlindBLSRequestKey(pid)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+// testKMSSigner is a local stand-in for a signer provided by an external process.
+type testKMSSigner struct {
+	signer     saltedkey.Signer
+	signatures int32
+}
+
+func (s *testKMSSigner) SignECDSAWithSalt(salt saltedkey.Salt, msg []byte) ([]byte, error) {
+	atomic.AddInt32(&s.signatures, 1)
+	return s.signer.SignECDSAWithSalt(salt, msg)
+}
+
+func (s *testKMSSigner) SignBlindWithSalt(salt saltedkey.Salt, msgBlinded []byte,
+	secretK *big.Int,
+) ([]byte, error) {
+	atomic.AddInt32(&s.signatures, 1)
+	return s.signer.SignBlindWithSalt(salt, msgBlinded, secretK)
+}
+
+func (s *testKMSSigner) BlindPubKey() *blindsecp256k1.PublicKey {
+	return s.signer.BlindPubKey()
+}
+
+func (s *testKMSSigner) ECDSAPubKey() (*ecdsa.PublicKey, error) {
+	return s.signer.ECDSAPubKey()
+}
+
+// testConcurrentSign sends n concurrent sign requests and returns the number of successful ones.
+func testConcurrentSign(t *testing.T, url string, req *types.Message, n int) int32 {
+	var success int32
+	wg := sync.WaitGroup{}
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			resp, err := http.Post(url, "application/json", bytes.NewReader(req.Marshal()))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			msg := types.Message{}
+			if err := msg.Unmarshal(body); err != nil || len(msg.Signature) == 0 {
+				t.Errorf("invalid sign response: %s", body)
+				return
+			}
+			atomic.AddInt32(&success, 1)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return success
+}
+
+func TestBlindRSA(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+	pid := types.HexBytes(randomBytes(processIDSize))
+
+	// The election RSA key is generated once the first client is authenticated
+	resp, status := testRequest(t, "GET", fmt.Sprintf("%s/%s/info", url, pid), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.RSAPubKey, qt.IsNil)
+	auth, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/blindrsa/auth/0", url, pid), &types.Message{})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, auth.TokenR, qt.Not(qt.IsNil))
+	resp, _ = testRequest(t, "GET", fmt.Sprintf("%s/%s/info", url, pid), nil)
+	qt.Assert(t, resp.RSAPubKey, qt.DeepEquals, auth.RSAPubKey)
+	pk, err := x509.ParsePKIXPublicKey(auth.RSAPubKey)
+	qt.Assert(t, err, qt.IsNil)
+	rsaPubKey := pk.(*rsa.PublicKey)
+
+	// Client: prepares and blinds the message (RSABSSA-SHA384-PSS-Randomized)
+	msg, err := saltedkey.PrepareBlindRSA(randomBytes(128))
+	qt.Assert(t, err, qt.IsNil)
+	verifier := blindrsa.NewVerifier(rsaPubKey, crypto.SHA384)
+	msgBlinded, state, err := verifier.Blind(rand.Reader, msg)
+	qt.Assert(t, err, qt.IsNil)
+
+	// CSP: signs the blinded message, the token is only valid once
+	req := &types.Message{TokenR: auth.TokenR, Payload: msgBlinded}
+	resp, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blindrsa/sign", url, pid), req)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blindrsa/sign", url, pid), req)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	// Client: finalizes the signature, which is a standard RSA-PSS signature
+	signature, err := state.Finalize(resp.Signature)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, saltedkey.VerifyBlindRSA(rsaPubKey, msg, signature), qt.IsNil)
+	qt.Assert(t, saltedkey.VerifyBlindRSA(rsaPubKey, msg[saltedkey.BlindRSAPrefixSize:], signature),
+		qt.Not(qt.IsNil))
+	qt.Assert(t, saltedkey.VerifyBlindRSA(rsaPubKey, randomBytes(160), signature), qt.Not(qt.IsNil))
+
+	// The same key is used for the election, a different one for other elections
+	_, pubKey, err := ca.NewBlindRSARequestKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, types.HexBytes(pubKey), qt.DeepEquals, auth.RSAPubKey)
+	_, pubKey, err = ca.NewBlindRSARequestKey(randomBytes(processIDSize))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, types.HexBytes(pubKey), qt.Not(qt.DeepEquals), auth.RSAPubKey)
+
+	// The election RSA key is sealed on the token store
+	sealed, err := ca.keys.BindRSAKey(pid, nil)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = x509.ParsePKCS1PrivateKey(sealed)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+func TestBlindBLS(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+
+	// The root BLS public key is published with the root keys
+	info, status := testRequest(t, "GET", url+"/info", nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, info.Keys, qt.HasLen, 1)
+	qt.Assert(t, info.Keys[0].BLSPubKey, qt.HasLen, saltedkey.BLSPubKeySize)
+	rootPubKey := new(bls12381.G2)
+	qt.Assert(t, rootPubKey.SetBytes(info.Keys[0].BLSPubKey), qt.IsNil)
+
+	// Several voters of two elections get their proofs signed
+	pubKeys := []*bls12381.G2{}
+	msgs := [][]byte{}
+	signatures := [][]byte{}
+	for e := 0; e < 2; e++ {
+		pid := types.HexBytes(randomBytes(processIDSize))
+		salt, err := saltedkey.ElectionSalt(saltedkey.DefaultSaltVersion, pid)
+		qt.Assert(t, err, qt.IsNil)
+		pubKey, err := saltedkey.SaltBLSPubKey(rootPubKey, salt)
+		qt.Assert(t, err, qt.IsNil)
+		electionPubKey, err := ca.PubKeyBLS(pid)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, electionPubKey, qt.DeepEquals, pubKey.BytesCompressed())
+
+		for i := 0; i < 3; i++ {
+			auth, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/blindbls/auth/0", url, pid), &types.Message{})
+			qt.Assert(t, status, qt.Equals, http.StatusOK)
+			msg := randomBytes(32)
+			msgBlinded, r, err := saltedkey.BlindBLS(msg)
+			qt.Assert(t, err, qt.IsNil)
+			req := &types.Message{TokenR: auth.TokenR, Payload: msgBlinded}
+			resp, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/blindbls/sign", url, pid), req)
+			qt.Assert(t, status, qt.Equals, http.StatusOK)
+			_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blindbls/sign", url, pid), req)
+			qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+			signature, err := saltedkey.UnblindBLS(resp.Signature, r)
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, saltedkey.VerifyBLS(pubKey, msg, signature), qt.IsTrue)
+			pubKeys = append(pubKeys, pubKey)
+			msgs = append(msgs, msg)
+			signatures = append(signatures, signature)
+		}
+	}
+
+	// The tally verifier checks all the proofs at once
+	qt.Assert(t, saltedkey.VerifyBLSBatch(pubKeys, msgs, signatures), qt.IsNil)
+	msgs[0] = randomBytes(32)
+	qt.Assert(t, saltedkey.VerifyBLSBatch(pubKeys, msgs, signatures), qt.Not(qt.IsNil))
+}
+
+func TestVOPRF(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+	pid := types.HexBytes(randomBytes(processIDSize))
+
+	auth, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/voprf/auth/0", url, pid), &types.Message{})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	pubKey := new(oprf.PublicKey)
+	qt.Assert(t, pubKey.UnmarshalBinary(saltedkey.VOPRFSuite, auth.VOPRFPubKey), qt.IsNil)
+
+	// Client: blinds a batch of random token inputs
+	inputs := [][]byte{randomBytes(32), randomBytes(32), randomBytes(32)}
+	client := oprf.NewVerifiableClient(saltedkey.VOPRFSuite, pubKey)
+	finData, evalReq, err := client.Blind(inputs)
+	qt.Assert(t, err, qt.IsNil)
+	blinded, err := saltedkey.MarshalVOPRFElements(evalReq.Elements)
+	qt.Assert(t, err, qt.IsNil)
+	req := &types.Message{TokenR: auth.TokenR}
+	for _, e := range blinded {
+		req.Elements = append(req.Elements, e)
+	}
+
+	// CSP: evaluates the batch, the token is only valid once
+	resp, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/voprf/sign", url, pid), req)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/voprf/sign", url, pid), req)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	// Client: verifies the proof and finalizes the tokens
+	evaluated := make([][]byte, len(resp.Elements))
+	for i, e := range resp.Elements {
+		evaluated[i] = e
+	}
+	elements, err := saltedkey.UnmarshalVOPRFElements(evaluated)
+	qt.Assert(t, err, qt.IsNil)
+	proof, err := saltedkey.UnmarshalVOPRFProof(resp.Proof)
+	qt.Assert(t, err, qt.IsNil)
+	outputs, err := client.Finalize(finData, &oprf.Evaluation{Elements: elements, Proof: proof})
+	qt.Assert(t, err, qt.IsNil)
+
+	// Relying service: each token is redeemed once
+	for i := range inputs {
+		redeem := &types.Message{Payload: inputs[i], Signature: outputs[i]}
+		_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/redeem", url, pid), redeem)
+		qt.Assert(t, status, qt.Equals, http.StatusOK)
+		_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/redeem", url, pid), redeem)
+		qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+	}
+	qt.Assert(t, ca.RedeemVOPRF(inputs[0], outputs[0], pid), qt.ErrorIs, ErrTokenSpent)
+	qt.Assert(t, ca.RedeemVOPRF(randomBytes(32), outputs[0], pid), qt.Not(qt.IsNil))
+	qt.Assert(t, ca.RedeemVOPRF(inputs[0], outputs[0], randomBytes(processIDSize)), qt.Not(qt.IsNil))
+
+	// The batch size is limited
+	token, _, err := ca.NewVOPRFRequestKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	_, _, err = ca.EvaluateVOPRF(token, make([][]byte, VOPRFMaxBatch+1), pid)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+func TestBlindSignBatch(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	quotaAuthHandler := func(r *http.Request, m *types.Message,
+		pid types.HexBytes, st string, step int,
+	) types.AuthResponse {
+		return types.AuthResponse{Success: true, Quota: 3}
+	}
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: quotaAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+	pid := types.HexBytes(randomBytes(processIDSize))
+
+	// More R points than the quota are requested, only the quota is issued
+	auth, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/blind/auth/0", url, pid), &types.Message{Count: 5})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, auth.Tokens, qt.HasLen, 3)
+
+	// Client: blinds a different payload with each R point
+	req := &types.Message{Tokens: auth.Tokens}
+	hashes := []*big.Int{}
+	secrets := []*blindsecp256k1.UserSecretData{}
+	for _, token := range auth.Tokens {
+		signerR, err := blindsecp256k1.NewPointFromBytesUncompressed(token)
+		qt.Assert(t, err, qt.IsNil)
+		m := new(big.Int).SetBytes(ethereum.HashRaw(randomBytes(128)))
+		msgBlinded, userSecretData, err := blindsecp256k1.Blind(m, signerR)
+		qt.Assert(t, err, qt.IsNil)
+		req.Payloads = append(req.Payloads, msgBlinded.Bytes())
+		hashes = append(hashes, m)
+		secrets = append(secrets, userSecretData)
+	}
+
+	// The number of R points and payloads must match
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blind/signBatch", url, pid),
+		&types.Message{Tokens: req.Tokens, Payloads: req.Payloads[:2]})
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	// A batch with an invalid entry in the middle fails without redeeming any R point
+	_, unknownR, err := blindsecp256k1.NewRequestParameters()
+	qt.Assert(t, err, qt.IsNil)
+	tokens := append([]types.HexBytes{}, req.Tokens...)
+	tokens[1] = unknownR.BytesUncompressed()
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blind/signBatch", url, pid),
+		&types.Message{Tokens: tokens, Payloads: req.Payloads})
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+	payloads := append([]types.HexBytes{}, req.Payloads...)
+	payloads[1] = []byte{0}
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blind/signBatch", url, pid),
+		&types.Message{Tokens: req.Tokens, Payloads: payloads})
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	// CSP: signs all the payloads, the R points are only valid once
+	resp, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/blind/signBatch", url, pid), req)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Signatures, qt.HasLen, 3)
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blind/signBatch", url, pid), req)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	salt, err := saltedkey.ElectionSalt(saltedkey.DefaultSaltVersion, pid)
+	qt.Assert(t, err, qt.IsNil)
+	pubKey, err := saltedkey.BlindPubKeyWithSalt(ca.keyring.Keys(time.Now())[0].BlindPubKey(), salt)
+	qt.Assert(t, err, qt.IsNil)
+	for i, s := range resp.Signatures {
+		signature := blindsecp256k1.Unblind(new(big.Int).SetBytes(s), secrets[i])
+		qt.Assert(t, blindsecp256k1.Verify(hashes[i], signature, pubKey), qt.IsTrue)
+	}
+
+	// Without count, a single R point is issued as usual
+	auth, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/blind/auth/0", url, pid), &types.Message{})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, auth.TokenR, qt.Not(qt.IsNil))
+	qt.Assert(t, auth.Tokens, qt.HasLen, 0)
+}
+
+func TestReceipts(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+	pid := types.HexBytes(randomBytes(processIDSize))
+	info, status := testRequest(t, "GET", url+"/info", nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, info.Keys, qt.HasLen, 1)
+
+	// ecdsa signature
+	auth, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/ecdsa/auth/0", url, pid), &types.Message{})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	payload := randomBytes(32)
+	resp, status := testRequest(t, "POST", fmt.Sprintf("%s/%s/ecdsa/sign", url, pid),
+		&types.Message{TokenR: auth.TokenR, Payload: payload})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Receipt, qt.Not(qt.IsNil))
+	qt.Assert(t, []byte(resp.Receipt.Payload), qt.DeepEquals, payload)
+	qt.Assert(t, resp.Receipt.Signature, qt.DeepEquals, resp.Signature)
+	qt.Assert(t, receipt.VerifyReceipt(resp.Receipt, &info.Keys[0], saltedkey.DefaultSaltVersion), qt.IsNil)
+
+	// shared key
+	resp, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/sharedkey/0", url, pid), &types.Message{})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Receipt.Signature, qt.DeepEquals, resp.SharedKey)
+	qt.Assert(t, receipt.VerifyReceipt(resp.Receipt, &info.Keys[0], saltedkey.DefaultSaltVersion), qt.IsNil)
+}
+
+func TestPubKeyEndpoint(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+	pid := types.HexBytes(randomBytes(processIDSize))
+
+	// Root public keys
+	resp, status := testRequest(t, "GET", url+"/pubkey", nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.PubKey.KeyID, qt.Equals, "test")
+	qt.Assert(t, []byte(resp.PubKey.ECDSAPubKey), qt.DeepEquals, []byte(signer.PublicKey()))
+	qt.Assert(t, resp.PubKey.Address, qt.Equals, signer.Address().Hex())
+	rootECDSA, err := hex.DecodeString(ca.PubKeyECDSA(nil))
+	qt.Assert(t, err, qt.IsNil)
+	pk, err := ethcrypto.UnmarshalPubkey(rootECDSA)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, ethcrypto.CompressPubkey(pk), qt.DeepEquals, []byte(signer.PublicKey()))
+
+	// Election salted public keys
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/pubkey", url, pid), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.PubKey.KeyID, qt.Equals, "test")
+	qt.Assert(t, hex.EncodeToString(resp.PubKey.BlindPubKey), qt.Equals, ca.PubKeyBlind(pid))
+	saltedECDSA, err := hex.DecodeString(ca.PubKeyECDSA(pid))
+	qt.Assert(t, err, qt.IsNil)
+	pk, err = ethcrypto.UnmarshalPubkey(saltedECDSA)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, []byte(resp.PubKey.ECDSAPubKey), qt.DeepEquals, ethcrypto.CompressPubkey(pk))
+	qt.Assert(t, resp.PubKey.BLSPubKey, qt.HasLen, saltedkey.BLSPubKeySize)
+
+	// The address is the signer of the election ECDSA signatures
+	sharedKey, err := ca.SharedKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	addr, err := ethereum.AddrFromSignature(pid, sharedKey)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.PubKey.Address, qt.Equals, addr.Hex())
+
+	_, status = testRequest(t, "GET", fmt.Sprintf("%s/%x/pubkey", url, randomBytes(8)), nil)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+}
+
+func TestSaltVersion(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	// Elections whose ID starts with 0x02 use the salt version 2
+	ca.SetSaltVersionResolver(func(electionID types.HexBytes) (saltedkey.SaltVersion, error) {
+		switch electionID[0] {
+		case 0x02:
+			return saltedkey.SaltVersion2, nil
+		case 0xff:
+			return 0, fmt.Errorf("election storage unavailable")
+		}
+		return saltedkey.SaltVersion1, nil
+	})
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+
+	// Two elections sharing the first 20 bytes for each salt version
+	electionIDs := func(prefix byte) (types.HexBytes, types.HexBytes) {
+		a := randomBytes(processIDSize)
+		a[0] = prefix
+		b := append([]byte{}, a...)
+		b[processIDSize-1] ^= 1
+		return a, b
+	}
+	pidA, pidB := electionIDs(0x01)
+	qt.Assert(t, ca.PubKeyECDSA(pidA), qt.Equals, ca.PubKeyECDSA(pidB))
+	qt.Assert(t, ca.PubKeyBlind(pidA), qt.Equals, ca.PubKeyBlind(pidB))
+	pidA, pidB = electionIDs(0x02)
+	qt.Assert(t, ca.PubKeyECDSA(pidA), qt.Not(qt.Equals), ca.PubKeyECDSA(pidB))
+	qt.Assert(t, ca.PubKeyBlind(pidA), qt.Not(qt.Equals), ca.PubKeyBlind(pidB))
+
+	// The salt version is published, and the public keys match the signatures
+	resp, status := testRequest(t, "GET", fmt.Sprintf("%s/%s/info", url, pidA), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.SaltVersion, qt.Equals, uint8(saltedkey.SaltVersion2))
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/pubkey", url, pidA), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.PubKey.SaltVersion, qt.Equals, uint8(saltedkey.SaltVersion2))
+	sharedKey, err := ca.SharedKey(pidA)
+	qt.Assert(t, err, qt.IsNil)
+	addr, err := ethereum.AddrFromSignature(pidA, sharedKey)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.PubKey.Address, qt.Equals, addr.Hex())
+
+	r, err := ca.Receipt(pidA, types.SignatureTypeSharedKey, pidA, sharedKey)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, r.SaltVersion, qt.Equals, uint32(saltedkey.SaltVersion2))
+	qt.Assert(t, receipt.VerifyReceipt(r, &ca.RootKeys()[0], saltedkey.SaltVersion2), qt.IsNil)
+	qt.Assert(t, receipt.VerifyReceipt(r, &ca.RootKeys()[0], saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+
+	// The salt version is bound on the first signature, changing the resolver does
+	// not modify the keys of the election (only the ones of the unused elections)
+	pubKeyA := ca.PubKeyECDSA(pidA)
+	pidC, pidD := electionIDs(0x02)
+	pubKeyC := ca.PubKeyECDSA(pidC)
+	ca.SetSaltVersionResolver(FixedSaltVersion(saltedkey.SaltVersion1))
+	version, err := ca.SaltVersion(pidA)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, version, qt.Equals, saltedkey.SaltVersion2)
+	qt.Assert(t, ca.PubKeyECDSA(pidA), qt.Equals, pubKeyA)
+	qt.Assert(t, ca.PubKeyECDSA(pidC), qt.Not(qt.Equals), pubKeyC)
+	qt.Assert(t, ca.PubKeyECDSA(pidC), qt.Equals, ca.PubKeyECDSA(pidD))
+	l, err := ca.RevocationList(pidA)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, l.SaltVersion, qt.Equals, uint32(saltedkey.SaltVersion2))
+
+	// The signatures fail if the salt version cannot be resolved
+	ca.SetSaltVersionResolver(func(types.HexBytes) (saltedkey.SaltVersion, error) {
+		return 0, fmt.Errorf("election storage unavailable")
+	})
+	_, err = ca.SharedKey(pidC)
+	qt.Assert(t, err, qt.ErrorMatches, ".*election storage unavailable")
+	_, err = ca.SharedKey(pidA)
+	qt.Assert(t, err, qt.IsNil)
+}
+
+func TestRevocations(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	ca.SetAdminToken("admin-token")
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+	pid := types.HexBytes(randomBytes(processIDSize))
+	rootKey := &ca.RootKeys()[0]
+
+	// Issue two ecdsa signatures
+	payload1, payload2 := randomBytes(20), randomBytes(20)
+	for _, payload := range [][]byte{payload1, payload2} {
+		_, err := ca.SignECDSA(ca.NewRequestKey(pid), payload, pid)
+		qt.Assert(t, err, qt.IsNil)
+	}
+
+	// The revocation list is empty and signed
+	resp, status := testRequest(t, "GET", fmt.Sprintf("%s/%s/revocations", url, pid), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Revocations.Revoked, qt.HasLen, 0)
+	qt.Assert(t, receipt.VerifyRevocationList(resp.Revocations, rootKey, saltedkey.DefaultSaltVersion), qt.IsNil)
+
+	// Only the admin can revoke, and only the issued signatures
+	req := &types.Message{Payload: payload1}
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/revocations", url, pid), req)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+	_, status = testAuthRequest(t, "POST", fmt.Sprintf("%s/%s/revocations", url, pid), "other", req)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+	_, status = testAuthRequest(t, "POST", fmt.Sprintf("%s/%s/revocations", url, pid), "admin-token",
+		&types.Message{Payload: randomBytes(20)})
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+	resp, status = testAuthRequest(t, "POST", fmt.Sprintf("%s/%s/revocations", url, pid), "admin-token", req)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Revocations.Revoked, qt.HasLen, 1)
+
+	// The tally verifiers check the list and the revoked signatures
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/revocations", url, pid), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	list := resp.Revocations
+	qt.Assert(t, receipt.VerifyRevocationList(list, rootKey, saltedkey.DefaultSaltVersion), qt.IsNil)
+	qt.Assert(t, receipt.IsRevoked(list, payload1), qt.IsTrue)
+	qt.Assert(t, receipt.IsRevoked(list, payload2), qt.IsFalse)
+	address, err := ethereum.AddrFromSignature(list.SignedData(), list.Signature)
+	qt.Assert(t, err, qt.IsNil)
+	election, err := ca.ElectionKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, address.Hex(), qt.Equals, election.Address)
+
+	// The revocations are per election
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%x/revocations", url, randomBytes(processIDSize)), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Revocations.Revoked, qt.HasLen, 0)
+
+	// The admin endpoint is not served without admin token
+	ca2, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca2.Close)
+	router2 := httprouter.HTTProuter{}
+	qt.Assert(t, router2.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca2.ServeAPI(&router2, "/v1"), qt.IsNil)
+	_, err = ca2.SignECDSA(ca2.NewRequestKey(pid), payload1, pid)
+	qt.Assert(t, err, qt.IsNil)
+	_, status = testRequest(t, "POST", fmt.Sprintf("http://%s/v1/%s/revocations", router2.Address(), pid), req)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+	list, err = ca2.RevocationList(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, list.Revoked, qt.HasLen, 0)
+}
+
+func TestTransparencyLog(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t), BlindCSPcallbacks{Auth: testAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, ca.ServeAPI(&router, "/v1"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1", router.Address())
+	pid := types.HexBytes(randomBytes(processIDSize))
+	rootKey := &ca.RootKeys()[0]
+
+	// The log of a new election is empty
+	resp, status := testRequest(t, "GET", fmt.Sprintf("%s/%s/log/count", url, pid), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Count, qt.Equals, 0)
+
+	// Issue a blind and an ecdsa signature
+	signerR, err := ca.NewBlindRequestKey(pid)
+	qt.Assert(t, err, qt.IsNil)
+	blinded := randomBytes(32)
+	_, err = ca.SignBlind(signerR, blinded, pid)
+	qt.Assert(t, err, qt.IsNil)
+	payload := randomBytes(20)
+	_, err = ca.SignECDSA(ca.NewRequestKey(pid), payload, pid)
+	qt.Assert(t, err, qt.IsNil)
+
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/log/count", url, pid), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Count, qt.Equals, 2)
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/log", url, pid), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	head := resp.TreeHead
+	qt.Assert(t, head.Size, qt.Equals, uint64(2))
+	qt.Assert(t, receipt.VerifyTreeHead(head, rootKey, saltedkey.DefaultSaltVersion), qt.IsNil)
+
+	// The voters check that their signatures are on the log
+	leaf := translog.LeafHash(types.SignatureTypeBlind, blinded)
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/log/proof/%x", url, pid, leaf), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, receipt.VerifyTreeHead(resp.TreeHead, rootKey, saltedkey.DefaultSaltVersion), qt.IsNil)
+	qt.Assert(t, resp.LogProof.LeafIndex, qt.Equals, uint64(0))
+	qt.Assert(t, receipt.VerifyLogInclusion(resp.TreeHead, resp.LogProof, types.SignatureTypeBlind, blinded), qt.IsNil)
+	qt.Assert(t, receipt.VerifyLogInclusion(resp.TreeHead, resp.LogProof, types.SignatureTypeEthereum, blinded),
+		qt.Not(qt.IsNil))
+	leaf = translog.LeafHash(types.SignatureTypeEthereum, payload)
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/log/proof/%x", url, pid, leaf), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, receipt.VerifyLogInclusion(resp.TreeHead, resp.LogProof, types.SignatureTypeEthereum, payload), qt.IsNil)
+	_, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/log/proof/%x", url, pid, randomBytes(32)), nil)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	// The auditors check that the log only grows
+	_, err = ca.SignECDSA(ca.NewRequestKey(pid), randomBytes(20), pid)
+	qt.Assert(t, err, qt.IsNil)
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/log/consistency/%d", url, pid, head.Size), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.TreeHead.Size, qt.Equals, uint64(3))
+	qt.Assert(t, receipt.VerifyTreeHead(resp.TreeHead, rootKey, saltedkey.DefaultSaltVersion), qt.IsNil)
+	qt.Assert(t, receipt.VerifyLogConsistency(head, resp.TreeHead, resp.LogProof), qt.IsNil)
+	rewritten := *head
+	rewritten.RootHash = randomBytes(32)
+	qt.Assert(t, receipt.VerifyLogConsistency(&rewritten, resp.TreeHead, resp.LogProof), qt.Not(qt.IsNil))
+	_, status = testRequest(t, "GET", fmt.Sprintf("%s/%s/log/consistency/4", url, pid), nil)
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	// A tampered tree head is rejected
+	tampered := *resp.TreeHead
+	tampered.Size++
+	qt.Assert(t, receipt.VerifyTreeHead(&tampered, rootKey, saltedkey.DefaultSaltVersion), qt.Not(qt.IsNil))
+
+	// The logs are per election
+	resp, status = testRequest(t, "GET", fmt.Sprintf("%s/%x/log", url, randomBytes(processIDSize)), nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.TreeHead.Size, qt.Equals, uint64(0))
+}
+
+// testRequest sends req to url and returns the response message (only decoded
+// for successful responses) and the HTTP status code.
+func testRequest(t *testing.T, method, url string, req *types.Message) (*types.Message, int) {
+	return testAuthRequest(t, method, url, "", req)
+}
+
+// testAuthRequest is testRequest with a bearer token (if not empty).
+func testAuthRequest(t *testing.T, method, url, token string, req *types.Message) (*types.Message, int) {
+	var body io.Reader
+	if req != nil {
+		body = bytes.NewReader(req.Marshal())
+	}
+	hreq, err := http.NewRequest(method, url, body)
+	qt.Assert(t, err, qt.IsNil)
+	if token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+token)
+	}
+	hresp, err := http.DefaultClient.Do(hreq)
+	qt.Assert(t, err, qt.IsNil)
+	defer hresp.Body.Close()
+	data, err := io.ReadAll(hresp.Body)
+	qt.Assert(t, err, qt.IsNil)
+	resp := &types.Message{}
+	if hresp.StatusCode == http.StatusOK {
+		qt.Assert(t, resp.Unmarshal(data), qt.IsNil)
+	}
+	return resp, hresp.StatusCode
+}
+
 func testAuthHandler(r *http.Request, m *types.Message,
 	pid types.HexBytes, st string, step int,
 ) types.AuthResponse {
@@ -113,6 +1126,24 @@ func testAuthHandler(r *http.Request, m *types.Message,
 	}
 }
 
+func testKeyRing(t *testing.T, privKey string) *saltedkey.KeyRing {
+	rk, err := saltedkey.NewRootKey("test", privKey, time.Now().Add(-time.Minute), time.Time{})
+	qt.Assert(t, err, qt.IsNil)
+	kr, err := saltedkey.NewKeyRing(rk)
+	qt.Assert(t, err, qt.IsNil)
+	return kr
+}
+
+func testMemoryTokenStore(t *testing.T) TokenStore {
+	return NewMemoryTokenStore()
+}
+
+func testPebbleTokenStore(t *testing.T) TokenStore {
+	store, err := NewTokenStore(TokenStorePebble, t.TempDir())
+	qt.Assert(t, err, qt.IsNil)
+	return store
+}
+
 func randomBytes(n int) []byte {
 	bytes := make([]byte, n)
 	if _, err := io.ReadFull(rand.Reader, bytes); err != nil {
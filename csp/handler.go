@@ -2,10 +2,13 @@ package csp
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 
 	"github.com/arnaucube/go-blindsecp256k1"
+	"github.com/vocdoni/blind-csp/saltedkey"
 	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/httprouter"
 	"go.vocdoni.io/dvote/httprouter/apirest"
@@ -34,6 +37,33 @@ func (csp *BlindCSP) registerHandlers() error {
 		return err
 	}
 
+	if err := csp.api.RegisterMethod(
+		"/{processId}/info",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.info,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/pubkey",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.pubKey,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/{processId}/pubkey",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.pubKey,
+	); err != nil {
+		return err
+	}
+
 	if err := csp.api.RegisterMethod(
 		"/indexer/{userId}",
 		"GET",
@@ -70,6 +100,82 @@ func (csp *BlindCSP) registerHandlers() error {
 		return err
 	}
 
+	if err := csp.api.RegisterMethod(
+		"/{processId}/blind/signBatch",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		csp.signatureBatch,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/{processId}/redeem",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		csp.redeem,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/{processId}/revocations",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.revocations,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/{processId}/log",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.treeHead,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/{processId}/log/count",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.logCount,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/{processId}/log/proof/{leafHash}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.logProof,
+	); err != nil {
+		return err
+	}
+
+	if err := csp.api.RegisterMethod(
+		"/{processId}/log/consistency/{size}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		csp.logConsistency,
+	); err != nil {
+		return err
+	}
+
+	// The admin access type accepts any request if the admin token is empty
+	if csp.admin != "" {
+		csp.api.SetAdminToken(csp.admin)
+		if err := csp.api.RegisterMethod(
+			"/{processId}/revocations",
+			"POST",
+			apirest.MethodAccessTypeAdmin,
+			csp.revoke,
+		); err != nil {
+			return err
+		}
+	}
+
 	if err := csp.api.RegisterMethod(
 		"/{processId}/sharedkey/{step}",
 		"POST",
@@ -113,14 +219,33 @@ func (csp *BlindCSP) signatureReq(msg *apirest.APIdata, ctx *httprouter.HTTPCont
 	}
 
 	// Signature type and auth callback
-	var authResp types.AuthResponse
 	var resp types.Message
 	signType := ctx.URLParam("signType")
-	if authResp = csp.callbacks.Auth(ctx.Request, req, pid, signType, step); authResp.Success {
+	authResp, err := csp.auth(ctx.Request, req, pid, signType, step)
+	if err != nil {
+		return fmt.Errorf("unauthorized: %w", err)
+	}
+	if authResp.Success {
 		switch signType {
 		case types.SignatureTypeBlind:
-			if authResp.AuthToken == nil {
-				r, err := csp.NewBlindRequestKey()
+			if authResp.AuthToken == nil && req.Count > 1 {
+				// Several R points requested, up to the quota granted by the handler
+				count := req.Count
+				if count > authResp.Quota {
+					count = authResp.Quota
+				}
+				if count < 1 {
+					count = 1
+				}
+				points, err := csp.NewBlindRequestKeys(pid, count)
+				if err != nil {
+					return err
+				}
+				for _, r := range points {
+					resp.Tokens = append(resp.Tokens, r.BytesUncompressed())
+				}
+			} else if authResp.AuthToken == nil {
+				r, err := csp.NewBlindRequestKey(pid)
 				if err != nil {
 					return err
 				}
@@ -128,7 +253,27 @@ func (csp *BlindCSP) signatureReq(msg *apirest.APIdata, ctx *httprouter.HTTPCont
 			}
 		case types.SignatureTypeEthereum:
 			if authResp.AuthToken == nil {
-				resp.TokenR = csp.NewRequestKey()
+				resp.TokenR = csp.NewRequestKey(pid)
+			}
+		case types.SignatureTypeBlindRSA:
+			if authResp.AuthToken == nil {
+				resp.TokenR, resp.RSAPubKey, err = csp.NewBlindRSARequestKey(pid)
+				if err != nil {
+					return err
+				}
+			}
+		case types.SignatureTypeBlindBLS:
+			if authResp.AuthToken == nil {
+				if resp.TokenR, err = csp.NewBlindBLSRequestKey(pid); err != nil {
+					return err
+				}
+			}
+		case types.SignatureTypeVOPRF:
+			if authResp.AuthToken == nil {
+				resp.TokenR, resp.VOPRFPubKey, err = csp.NewVOPRFRequestKey(pid)
+				if err != nil {
+					return err
+				}
 			}
 		default:
 			return fmt.Errorf("invalid signature type")
@@ -153,7 +298,7 @@ func (csp *BlindCSP) signature(msg *apirest.APIdata, ctx *httprouter.HTTPContext
 	if req.TokenR == nil {
 		return fmt.Errorf("token is empty")
 	}
-	if len(req.Payload) == 0 {
+	if len(req.Payload) == 0 && len(req.Elements) == 0 {
 		return fmt.Errorf("message is empty")
 	}
 	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
@@ -182,12 +327,104 @@ func (csp *BlindCSP) signature(msg *apirest.APIdata, ctx *httprouter.HTTPContext
 		if err != nil {
 			return err
 		}
+		if resp.Receipt, err = csp.Receipt(pid, types.SignatureTypeEthereum, req.Payload, resp.Signature); err != nil {
+			return err
+		}
+	case types.SignatureTypeBlindRSA:
+		var err error
+		resp.Signature, err = csp.SignBlindRSA(req.TokenR, req.Payload, pid)
+		if err != nil {
+			return err
+		}
+	case types.SignatureTypeBlindBLS:
+		var err error
+		resp.Signature, err = csp.SignBlindBLS(req.TokenR, req.Payload, pid)
+		if err != nil {
+			return err
+		}
+	case types.SignatureTypeVOPRF:
+		blinded := make([][]byte, len(req.Elements))
+		for i, e := range req.Elements {
+			blinded[i] = e
+		}
+		evaluated, proof, err := csp.EvaluateVOPRF(req.TokenR, blinded, pid)
+		if err != nil {
+			return err
+		}
+		for _, e := range evaluated {
+			resp.Elements = append(resp.Elements, e)
+		}
+		resp.Proof = proof
 	default:
 		return fmt.Errorf("invalid signature type")
 	}
 	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
 }
 
+// https://server/v1/auth/processes/<processId>/blind/signBatch
+
+// signatureBatch performs the blind signatures of several payloads, each one with
+// the R point (tokens) of the same position.
+func (csp *BlindCSP) signatureBatch(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	req := &types.Message{}
+	if err := req.Unmarshal(msg.Data); err != nil {
+		return err
+	}
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	points := make([]*blindsecp256k1.Point, len(req.Tokens))
+	for i, t := range req.Tokens {
+		// use Uncompressed for blindsecp256k1-js compatibility
+		if points[i], err = blindsecp256k1.NewPointFromBytesUncompressed(t); err != nil {
+			return fmt.Errorf("invalid R point %d: %w", i, err)
+		}
+	}
+	hashes := make([][]byte, len(req.Payloads))
+	for i, p := range req.Payloads {
+		hashes[i] = p
+	}
+	signatures, err := csp.SignBlindBatch(points, hashes, pid)
+	if err != nil {
+		return err
+	}
+	resp := types.Message{}
+	for _, s := range signatures {
+		resp.Signatures = append(resp.Signatures, s)
+	}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// https://server/v1/auth/processes/<processId>/redeem
+
+// redeem checks a VOPRF token (the token input as payload and its output as signature)
+// and marks it as spent, so it cannot be redeemed again.
+func (csp *BlindCSP) redeem(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	req := &types.Message{}
+	if err := req.Unmarshal(msg.Data); err != nil {
+		return err
+	}
+	if len(req.Payload) == 0 || len(req.Signature) == 0 {
+		return fmt.Errorf("token is empty")
+	}
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	if err := csp.RedeemVOPRF(req.Payload, req.Signature, pid); err != nil {
+		return err
+	}
+	resp := &types.Message{Response: []string{"Ok"}}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
 // https://server/v1/auth/processes/<processId>/sharedkey
 
 // sharedKeyReq is the shared key request handler.
@@ -213,19 +450,19 @@ func (csp *BlindCSP) sharedKeyReq(msg *apirest.APIdata, ctx *httprouter.HTTPCont
 	}
 
 	var resp types.Message
-	var authResp types.AuthResponse
-	if authResp = csp.callbacks.Auth(
-		ctx.Request,
-		req,
-		pid,
-		types.SignatureTypeSharedKey,
-		step,
-	); authResp.Success {
+	authResp, err := csp.auth(ctx.Request, req, pid, types.SignatureTypeSharedKey, step)
+	if err != nil {
+		return fmt.Errorf("unauthorized: %w", err)
+	}
+	if authResp.Success {
 		if authResp.AuthToken == nil {
 			resp.SharedKey, err = csp.SharedKey(pid)
 			if err != nil {
 				return err
 			}
+			if resp.Receipt, err = csp.Receipt(pid, types.SignatureTypeSharedKey, pid, resp.SharedKey); err != nil {
+				return err
+			}
 		}
 	} else {
 		return fmt.Errorf("unauthorized")
@@ -235,27 +472,234 @@ func (csp *BlindCSP) sharedKeyReq(msg *apirest.APIdata, ctx *httprouter.HTTPCont
 	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
 }
 
+// https://server/v1/auth/processes/<processId>/info
+
+// info returns the handler description, auth steps and root public keys. If the processId is provided,
+// the handler used for the election is described, else the default one. The election RSA public key
+// is also included, if it is already generated.
 func (csp *BlindCSP) info(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
-	if csp.callbacks.Info == nil {
-		return ctx.Send(nil, apirest.HTTPstatusOK)
+	handler := csp.callbacks
+	var rsaPubKey []byte
+	var saltVersion saltedkey.SaltVersion
+	if ctx.URLParam("processId") != "" {
+		pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+		if err != nil {
+			return fmt.Errorf("cannot decode processId: %w", err)
+		}
+		if len(pid) != processIDSize {
+			return fmt.Errorf("wrong process id: %x", pid)
+		}
+		if handler, err = csp.electionHandler(pid); err != nil {
+			return err
+		}
+		rsaPubKey, err = csp.PubKeyBlindRSA(pid)
+		if err != nil && !errors.Is(err, ErrKeyUnknown) {
+			return err
+		}
+		if saltVersion, err = csp.SaltVersion(pid); err != nil {
+			return err
+		}
 	}
-	resp := csp.callbacks.Info()
-	if resp == nil {
-		return ctx.Send(nil, apirest.HTTPstatusOK)
+	resp := &types.Message{}
+	if handler.Info != nil {
+		if info := handler.Info(); info != nil {
+			// The handler might return the same message on every call, keep it untouched
+			infoCopy := *info
+			resp = &infoCopy
+		}
 	}
+	resp.RSAPubKey = rsaPubKey
+	resp.SaltVersion = uint8(saltVersion)
+	// Publish all the current root keys, so the clients can verify the signatures
+	// of any ongoing election
+	resp.Keys = csp.RootKeys()
 	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
 }
 
-func (csp *BlindCSP) indexer(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
-	if csp.callbacks.Indexer == nil {
-		return ctx.Send(nil, apirest.HTTPstatusOK)
+// https://server/v1/auth/processes/<processId>/pubkey
+
+// pubKey returns the salted public keys of the election, or the active root public
+// keys if the processId is not provided.
+func (csp *BlindCSP) pubKey(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	var pid []byte
+	if ctx.URLParam("processId") != "" {
+		var err error
+		pid, err = hex.DecodeString(trimHex(ctx.URLParam("processId")))
+		if err != nil {
+			return fmt.Errorf("cannot decode processId: %w", err)
+		}
+		if len(pid) != processIDSize {
+			return fmt.Errorf("wrong process id: %x", pid)
+		}
+	}
+	key, err := csp.ElectionKey(pid)
+	if err != nil {
+		return err
+	}
+	resp := &types.Message{PubKey: key}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// https://server/v1/auth/processes/<processId>/revocations
+
+// revocations returns the signed revocation list of the election.
+func (csp *BlindCSP) revocations(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	list, err := csp.RevocationList(pid)
+	if err != nil {
+		return err
+	}
+	resp := &types.Message{Revocations: list}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// revoke adds the ecdsa signature of the payload to the election revocation list
+// (admin only) and returns the updated list.
+func (csp *BlindCSP) revoke(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	req := &types.Message{}
+	if err := req.Unmarshal(msg.Data); err != nil {
+		return err
+	}
+	if len(req.Payload) == 0 {
+		return fmt.Errorf("payload is empty")
+	}
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
 	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	if err := csp.RevokeSignature(pid, req.Payload); err != nil {
+		return err
+	}
+	return csp.revocations(msg, ctx)
+}
+
+// https://server/v1/auth/processes/<processId>/log
+
+// treeHead returns the signed tree head of the election transparency log.
+func (csp *BlindCSP) treeHead(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	th, err := csp.TreeHead(pid)
+	if err != nil {
+		return err
+	}
+	resp := &types.Message{TreeHead: th}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// https://server/v1/auth/processes/<processId>/log/count
+
+// logCount returns the number of signatures issued for the election.
+func (csp *BlindCSP) logCount(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	size, err := csp.LogSize(pid)
+	if err != nil {
+		return err
+	}
+	resp := &types.Message{Count: int(size)}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// https://server/v1/auth/processes/<processId>/log/proof/<leafHash>
+
+// logProof returns the signed tree head and the inclusion proof of the leaf hash.
+func (csp *BlindCSP) logProof(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	leafHash, err := hex.DecodeString(trimHex(ctx.URLParam("leafHash")))
+	if err != nil {
+		return fmt.Errorf("cannot decode leafHash: %w", err)
+	}
+	th, proof, err := csp.InclusionProof(pid, leafHash)
+	if err != nil {
+		return err
+	}
+	resp := &types.Message{TreeHead: th, LogProof: proof}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// https://server/v1/auth/processes/<processId>/log/consistency/<size>
+
+// logConsistency returns the signed tree head and the consistency proof of the log
+// of the first size leaves.
+func (csp *BlindCSP) logConsistency(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return fmt.Errorf("wrong process id: %x", pid)
+	}
+	size, err := strconv.ParseUint(ctx.URLParam("size"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("cannot decode size: %w", err)
+	}
+	th, proof, err := csp.ConsistencyProof(pid, size)
+	if err != nil {
+		return err
+	}
+	resp := &types.Message{TreeHead: th, LogProof: proof}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// indexer returns the elections of the user, for all the registered handlers. The
+// handlers are queried by name order, and each election is only listed once (the
+// same handler might be served alone and inside a chain).
+func (csp *BlindCSP) indexer(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	userID, err := hex.DecodeString(trimHex(ctx.URLParam("userId")))
 	if err != nil {
 		return fmt.Errorf("cannot get user id: %w", err)
 	}
+	names := make([]string, 0, len(csp.handlers))
+	for name := range csp.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	var resp types.Message
-	resp.Elections = csp.callbacks.Indexer(userID)
+	indexed := false
+	listed := make(map[string]bool)
+	for _, name := range names {
+		handler := csp.handlers[name]
+		if handler.Indexer == nil {
+			continue
+		}
+		for _, election := range handler.Indexer(userID) {
+			if listed[election.ElectionID.String()] {
+				continue
+			}
+			listed[election.ElectionID.String()] = true
+			resp.Elections = append(resp.Elections, election)
+		}
+		indexed = true
+	}
+	if !indexed {
+		return ctx.Send(nil, apirest.HTTPstatusOK)
+	}
 	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
 }
 
@@ -2,24 +2,40 @@ package csp
 
 import (
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"math/big"
+	"time"
 
 	blind "github.com/arnaucube/go-blindsecp256k1"
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+	"github.com/cloudflare/circl/oprf"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/vocdoni/blind-csp/receipt"
 	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/log"
 )
 
 // PubKeyBlind returns the public key of the blind CSP signer.
-// If processID is nil, returns the root public key.
-// If processID is not nil, returns the salted public key.
+// If processID is nil, returns the active root public key.
+// If processID is not nil, returns the salted public key of the election root key.
 func (csp *BlindCSP) PubKeyBlind(processID []byte) string {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return ""
+	}
 	if processID == nil {
-		return fmt.Sprintf("%x", csp.signer.BlindPubKey())
+		return fmt.Sprintf("%x", rk.BlindPubKey())
 	}
-	var salt [saltedkey.SaltSize]byte
-	copy(salt[:], processID[:saltedkey.SaltSize])
-	pk, err := saltedkey.SaltBlindPubKey(csp.signer.BlindPubKey(), salt)
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return ""
+	}
+	pk, err := saltedkey.BlindPubKeyWithSalt(rk.BlindPubKey(), salt)
 	if err != nil {
 		return ""
 	}
@@ -27,35 +43,162 @@ func (csp *BlindCSP) PubKeyBlind(processID []byte) string {
 }
 
 // PubKeyECDSA returns the public key of the plain CSP signer
-// If processID is nil, returns the root public key.
-// If processID is not nil, returns the salted public key.
+// If processID is nil, returns the active root public key.
+// If processID is not nil, returns the salted public key of the election root key.
 func (csp *BlindCSP) PubKeyECDSA(processID []byte) string {
-	k, err := csp.signer.ECDSAPubKey()
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return ""
+	}
+	k, err := rk.ECDSAPubKey()
 	if err != nil {
 		return ""
 	}
 	if processID == nil {
-		return fmt.Sprintf("%x", k)
+		return fmt.Sprintf("%x", ethcrypto.FromECDSAPub(k))
 	}
-	var salt [saltedkey.SaltSize]byte
-	copy(salt[:], processID[:saltedkey.SaltSize])
-	pk, err := saltedkey.SaltECDSAPubKey(k, salt)
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return ""
+	}
+	pk, err := saltedkey.ECDSAPubKeyWithSalt(k, salt)
 	if err != nil {
 		return ""
 	}
 	return fmt.Sprintf("%x", pk)
 }
 
+// RootKeys returns the public information of the root keys currently valid.
+func (csp *BlindCSP) RootKeys() []types.RootKey {
+	now := time.Now()
+	active, err := csp.keyring.Active(now)
+	if err != nil {
+		return nil
+	}
+	keys := []types.RootKey{}
+	for _, rk := range csp.keyring.Keys(now) {
+		key, err := rootKeyInfo(rk)
+		if err != nil {
+			continue
+		}
+		key.Active = rk.ID == active.ID
+		keys = append(keys, *key)
+	}
+	return keys
+}
+
+// ElectionKey returns the salted public keys used for the signatures of processID,
+// and the root key they are derived from. If processID is nil, the public keys of
+// the active root key are returned.
+func (csp *BlindCSP) ElectionKey(processID []byte) (*types.ElectionKey, error) {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, err := rootKeyInfo(rk)
+	if err != nil {
+		return nil, err
+	}
+	key := &types.ElectionKey{
+		KeyID:       rk.ID,
+		BlindPubKey: rootKey.BlindPubKey,
+		ECDSAPubKey: rootKey.ECDSAPubKey,
+		BLSPubKey:   rootKey.BLSPubKey,
+	}
+	if processID != nil {
+		saltVersion, err := csp.SaltVersion(processID)
+		if err != nil {
+			return nil, err
+		}
+		key.SaltVersion = uint8(saltVersion)
+		key.BlindPubKey, err = receipt.SaltedPubKey(rootKey, saltVersion, processID, types.SignatureTypeBlind)
+		if err != nil {
+			return nil, err
+		}
+		key.ECDSAPubKey, err = receipt.SaltedPubKey(rootKey, saltVersion, processID, types.SignatureTypeEthereum)
+		if err != nil {
+			return nil, err
+		}
+		if rootKey.BLSPubKey != nil {
+			key.BLSPubKey, err = receipt.SaltedPubKey(rootKey, saltVersion, processID, types.SignatureTypeBlindBLS)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	pk, err := ethcrypto.DecompressPubkey(key.ECDSAPubKey)
+	if err != nil {
+		return nil, err
+	}
+	key.Address = ethcrypto.PubkeyToAddress(*pk).Hex()
+	return key, nil
+}
+
+// rootKeyInfo returns the public information of the root key. Active is not set.
+func rootKeyInfo(rk *saltedkey.RootKey) (*types.RootKey, error) {
+	pk, err := rk.ECDSAPubKey()
+	if err != nil {
+		return nil, err
+	}
+	key := &types.RootKey{
+		ID:          rk.ID,
+		BlindPubKey: rk.BlindPubKey().Bytes(),
+		ECDSAPubKey: ethcrypto.CompressPubkey(pk),
+		NotBefore:   rk.NotBefore,
+	}
+	if !rk.NotAfter.IsZero() {
+		notAfter := rk.NotAfter
+		key.NotAfter = &notAfter
+	}
+	if bls, ok := rk.Signer.(saltedkey.BLSSigner); ok {
+		key.BLSPubKey = bls.BLSPubKey().BytesCompressed()
+	}
+	return key, nil
+}
+
+// Receipt returns the receipt of a signature of signType issued for processID (see
+// receipt.VerifyReceipt). The payload and signature must be the final (unblinded) ones,
+// so the CSP can only produce the receipts of the ecdsa and sharedkey signatures.
+func (csp *BlindCSP) Receipt(processID []byte, signType string, payload, signature []byte) (*types.Receipt, error) {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, err := rootKeyInfo(rk)
+	if err != nil {
+		return nil, err
+	}
+	saltVersion, err := csp.SaltVersion(processID)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := receipt.SaltedPubKey(rootKey, saltVersion, processID, signType)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Receipt{
+		Version:       types.ReceiptVersion,
+		ElectionID:    processID,
+		SignatureType: signType,
+		KeyID:         rk.ID,
+		PubKey:        pubKey,
+		Payload:       payload,
+		Signature:     signature,
+		SaltVersion:   uint32(saltVersion),
+	}, nil
+}
+
 // NewBlindRequestKey generates a new request key for blinding a content on the client side.
+// The key is bound to processID and can only be redeemed for a blind signature on it.
 // It returns SignerR and SignerQ values.
-func (csp *BlindCSP) NewBlindRequestKey() (*blind.Point, error) {
+func (csp *BlindCSP) NewBlindRequestKey(processID []byte) (*blind.Point, error) {
 	k, signerR, err := blind.NewRequestParameters()
 	if err != nil {
 		log.Warn(err)
 		return nil, err
 	}
 	index := signerR.X.String() + signerR.Y.String()
-	if err := csp.addKey(index, k); err != nil {
+	if err := csp.addKey([]byte(index), k, processID, types.SignatureTypeBlind); err != nil {
 		log.Warn(err)
 		return nil, err
 	}
@@ -65,15 +208,30 @@ func (csp *BlindCSP) NewBlindRequestKey() (*blind.Point, error) {
 	return signerR, nil
 }
 
+// NewBlindRequestKeys generates n request keys (see NewBlindRequestKey) for the
+// blind signature of several payloads with a single authentication.
+func (csp *BlindCSP) NewBlindRequestKeys(processID []byte, n int) ([]*blind.Point, error) {
+	points := make([]*blind.Point, n)
+	for i := range points {
+		var err error
+		if points[i], err = csp.NewBlindRequestKey(processID); err != nil {
+			return nil, err
+		}
+	}
+	return points, nil
+}
+
 // NewRequestKey generates a new request key for blinding a content on the client side.
+// The key is bound to processID and can only be redeemed for an ECDSA signature on it.
 // It returns SignerR and SignerQ values.
-func (csp *BlindCSP) NewRequestKey() []byte {
+func (csp *BlindCSP) NewRequestKey(processID []byte) []byte {
 	b := make([]byte, 32)
 	_, err := rand.Read(b)
 	if err != nil {
 		panic(err)
 	}
-	if err := csp.addKey(string(b), new(big.Int).SetUint64(0)); err != nil {
+	if err := csp.addKey(b, new(big.Int).SetUint64(0),
+		processID, types.SignatureTypeEthereum); err != nil {
 		log.Warn(err)
 		return nil
 	}
@@ -81,80 +239,552 @@ func (csp *BlindCSP) NewRequestKey() []byte {
 }
 
 // SignECDSA performs a blind signature over hash(msg). Also checks if token is valid
-// and removes it from the local storage.
+// and removes it from the local storage. The signature is recorded, so it can be
+// revoked later (see RevokeSignature), and appended to the transparency log.
 func (csp *BlindCSP) SignECDSA(token, msg []byte, processID []byte) ([]byte, error) {
-	if k, err := csp.getKey(string(token)); err != nil || k == nil {
-		return nil, fmt.Errorf("token not found")
+	rk, err := csp.rootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
 	}
-	defer func() {
-		if err := csp.delKey(string(token)); err != nil {
-			log.Warn(err)
+	if _, err := csp.consumeKey(token, processID, types.SignatureTypeEthereum); err != nil {
+		if errors.Is(err, ErrKeyExpired) || errors.Is(err, ErrKeyMismatch) {
+			return nil, err
 		}
-	}()
-	var salt [saltedkey.SaltSize]byte
-	copy(salt[:], processID[:saltedkey.SaltSize])
-	return csp.signer.SignECDSA(salt, msg)
+		return nil, fmt.Errorf("token not found")
+	}
+	// The signature is recorded before being issued, so it can always be revoked
+	if err := csp.keys.AddIssued(processID, receipt.RevocationHash(msg)); err != nil {
+		return nil, err
+	}
+	if err := csp.appendLog(processID, types.SignatureTypeEthereum, msg); err != nil {
+		return nil, err
+	}
+	return rk.SignECDSAWithSalt(salt, msg)
 }
 
 // SignBlind performs a blind signature over hash. Also checks if R point is valid
-// and removes it from the local storage if err=nil.
+// and removes it from the local storage. The R point is consumed before signing,
+// so it cannot be used again even if the signature fails (k must never be reused).
 func (csp *BlindCSP) SignBlind(signerR *blind.Point, hash, processID []byte) ([]byte, error) {
+	root, err := csp.rootKey(processID)
+	if err != nil {
+		return nil, err
+	}
 	key := signerR.X.String() + signerR.Y.String()
-	k, err := csp.getKey(key)
-	if k == nil || err != nil {
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	rk, err := csp.consumeKey([]byte(key), processID, types.SignatureTypeBlind)
+	if err != nil {
+		if errors.Is(err, ErrKeyExpired) || errors.Is(err, ErrKeyMismatch) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("unknown R point")
 	}
-	var salt [saltedkey.SaltSize]byte
-	copy(salt[:], processID[:saltedkey.SaltSize])
-	signature, err := csp.signer.SignBlind(salt, hash, k)
+	if err := csp.appendLog(processID, types.SignatureTypeBlind, hash); err != nil {
+		return nil, err
+	}
+	return root.SignBlindWithSalt(salt, hash, new(big.Int).SetBytes(rk.K))
+}
+
+// SignBlindBatch performs the blind signatures of several hashes, each one with the
+// R point of the same position (see SignBlind). The batch is atomic: all the R points
+// are redeemed before signing and, if any of them or any signature fails, the R points
+// already redeemed are restored, so the client can retry the whole batch.
+func (csp *BlindCSP) SignBlindBatch(signersR []*blind.Point, hashes [][]byte, processID []byte) ([][]byte, error) {
+	if len(signersR) == 0 || len(signersR) != len(hashes) {
+		return nil, fmt.Errorf("the batch must have the same (non zero) number of R points and payloads")
+	}
+	keys := make([][]byte, len(signersR))
+	seen := make(map[string]bool)
+	for i, r := range signersR {
+		m := new(big.Int).SetBytes(hashes[i])
+		if m.Sign() == 0 || m.Cmp(blind.N) != -1 {
+			return nil, fmt.Errorf("payload %d is not a valid blinded message", i)
+		}
+		keys[i] = []byte(r.X.String() + r.Y.String())
+		if seen[string(keys[i])] {
+			return nil, fmt.Errorf("R point %d is repeated", i)
+		}
+		seen[string(keys[i])] = true
+	}
+	root, err := csp.rootKey(processID)
 	if err != nil {
 		return nil, err
 	}
-	if err := csp.delKey(key); err != nil {
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
 		return nil, err
 	}
-	return signature, nil
+	consumed := make([]*RequestKey, 0, len(keys))
+	restore := func() {
+		for i, rk := range consumed {
+			if err := csp.keys.Add(keys[i], rk); err != nil {
+				log.Warnf("cannot restore R point %d of the batch: %v", i, err)
+			}
+		}
+	}
+	for i := range keys {
+		rk, err := csp.consumeKey(keys[i], processID, types.SignatureTypeBlind)
+		if err != nil {
+			restore()
+			if errors.Is(err, ErrKeyExpired) || errors.Is(err, ErrKeyMismatch) {
+				return nil, fmt.Errorf("R point %d: %w", i, err)
+			}
+			return nil, fmt.Errorf("unknown R point %d", i)
+		}
+		consumed = append(consumed, rk)
+	}
+	// The signatures are not disclosed until the whole batch is signed, so the k
+	// values can be safely restored if any of them fails
+	signatures := make([][]byte, len(hashes))
+	for i, rk := range consumed {
+		if signatures[i], err = root.SignBlindWithSalt(salt, hashes[i], new(big.Int).SetBytes(rk.K)); err != nil {
+			restore()
+			return nil, fmt.Errorf("payload %d: %w", i, err)
+		}
+	}
+	for _, hash := range hashes {
+		if err := csp.appendLog(processID, types.SignatureTypeBlind, hash); err != nil {
+			return nil, err
+		}
+	}
+	return signatures, nil
 }
 
 // SharedKey performs a signature over processId which might be used as shared key
 // for all users belonging to the same process.
 func (csp *BlindCSP) SharedKey(processID []byte) ([]byte, error) {
-	var salt [saltedkey.SaltSize]byte
-	copy(salt[:], processID[:saltedkey.SaltSize])
-	return csp.signer.SignECDSA(salt, processID)
+	rk, err := csp.rootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	return rk.SignECDSAWithSalt(salt, processID)
+}
+
+// PubKeyBlindRSA returns the RSA public key (PKIX DER) used for the blind RSA
+// signatures of processID. It returns ErrKeyUnknown if the election has no RSA key
+// yet (it is bound when the first client is authenticated).
+func (csp *BlindCSP) PubKeyBlindRSA(processID []byte) ([]byte, error) {
+	sk, err := csp.electionRSAKey(processID, false)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(&sk.PublicKey)
+}
+
+// NewBlindRSARequestKey generates a new token redeemable for a blind RSA signature
+// on processID. The election RSA key is bound if it does not exist yet.
+// It returns the token and the election RSA public key (PKIX DER).
+func (csp *BlindCSP) NewBlindRSARequestKey(processID []byte) ([]byte, []byte, error) {
+	sk, err := csp.electionRSAKey(processID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, nil, err
+	}
+	if err := csp.addKey(token, new(big.Int).SetUint64(0),
+		processID, types.SignatureTypeBlindRSA); err != nil {
+		return nil, nil, err
+	}
+	return token, pubKey, nil
+}
+
+// SignBlindRSA performs a RSA blind signature (RFC 9474, RSABSSA-SHA384-PSS-Randomized)
+// over the blinded message with the election RSA key. Also checks if token is valid and removes it from the
+// local storage.
+func (csp *BlindCSP) SignBlindRSA(token, msgBlinded, processID []byte) ([]byte, error) {
+	if _, err := csp.consumeKey(token, processID, types.SignatureTypeBlindRSA); err != nil {
+		if errors.Is(err, ErrKeyExpired) || errors.Is(err, ErrKeyMismatch) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("token not found")
+	}
+	sk, err := csp.electionRSAKey(processID, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := csp.appendLog(processID, types.SignatureTypeBlindRSA, msgBlinded); err != nil {
+		return nil, err
+	}
+	return blindrsa.NewSigner(sk).BlindSign(msgBlinded)
+}
+
+// PubKeyBLS returns the BLS public key (compressed G2 point) of the CSP signer.
+// If processID is nil, returns the active root public key.
+// If processID is not nil, returns the salted public key of the election root key.
+func (csp *BlindCSP) PubKeyBLS(processID []byte) ([]byte, error) {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	bls, err := blsSigner(rk)
+	if err != nil {
+		return nil, err
+	}
+	if processID == nil {
+		return bls.BLSPubKey().BytesCompressed(), nil
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := saltedkey.SaltBLSPubKey(bls.BLSPubKey(), salt)
+	if err != nil {
+		return nil, err
+	}
+	return pk.BytesCompressed(), nil
+}
+
+// NewBlindBLSRequestKey generates a new token redeemable for a blind BLS signature
+// on processID. It fails if the election root key does not support BLS signatures.
+func (csp *BlindCSP) NewBlindBLSRequestKey(processID []byte) ([]byte, error) {
+	rk, err := csp.rootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blsSigner(rk); err != nil {
+		return nil, err
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	if err := csp.addKey(token, new(big.Int).SetUint64(0),
+		processID, types.SignatureTypeBlindBLS); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// SignBlindBLS performs a BLS blind signature over the blinded message (compressed
+// G1 point) with the salted election root key. Also checks if token is valid and
+// removes it from the local storage.
+func (csp *BlindCSP) SignBlindBLS(token, msgBlinded, processID []byte) ([]byte, error) {
+	rk, err := csp.rootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	bls, err := blsSigner(rk)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := csp.consumeKey(token, processID, types.SignatureTypeBlindBLS); err != nil {
+		if errors.Is(err, ErrKeyExpired) || errors.Is(err, ErrKeyMismatch) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("token not found")
+	}
+	if err := csp.appendLog(processID, types.SignatureTypeBlindBLS, msgBlinded); err != nil {
+		return nil, err
+	}
+	return bls.SignBlindBLS(salt, msgBlinded)
+}
+
+// blsSigner returns the BLS signer of the root key, if supported.
+func blsSigner(rk *saltedkey.RootKey) (saltedkey.BLSSigner, error) {
+	bls, ok := rk.Signer.(saltedkey.BLSSigner)
+	if !ok {
+		return nil, fmt.Errorf("root key %s does not support BLS signatures", rk.ID)
+	}
+	return bls, nil
+}
+
+// PubKeyVOPRF returns the VOPRF public key (RFC 9497, ristretto255-SHA512) of processID.
+func (csp *BlindCSP) PubKeyVOPRF(processID []byte) ([]byte, error) {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := voprfSigner(rk)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := signer.VOPRFPubKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return pk.MarshalBinary()
+}
+
+// NewVOPRFRequestKey generates a new token redeemable for a batch of (up to VOPRFMaxBatch)
+// VOPRF evaluations on processID. It returns the token and the election VOPRF public key.
+func (csp *BlindCSP) NewVOPRFRequestKey(processID []byte) ([]byte, []byte, error) {
+	if _, err := csp.rootKey(processID); err != nil {
+		return nil, nil, err
+	}
+	pubKey, err := csp.PubKeyVOPRF(processID)
+	if err != nil {
+		return nil, nil, err
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, nil, err
+	}
+	if err := csp.addKey(token, new(big.Int).SetUint64(0),
+		processID, types.SignatureTypeVOPRF); err != nil {
+		return nil, nil, err
+	}
+	return token, pubKey, nil
+}
+
+// EvaluateVOPRF evaluates the blinded elements with the election VOPRF key. Also checks
+// if token is valid and removes it from the local storage, so a single batch is issued
+// per token. It returns the evaluated elements and the proof of the key used.
+func (csp *BlindCSP) EvaluateVOPRF(token []byte, blinded [][]byte, processID []byte) ([][]byte, []byte, error) {
+	if len(blinded) == 0 || len(blinded) > VOPRFMaxBatch {
+		return nil, nil, fmt.Errorf("the batch must have between 1 and %d elements", VOPRFMaxBatch)
+	}
+	elements, err := saltedkey.UnmarshalVOPRFElements(blinded)
+	if err != nil {
+		return nil, nil, err
+	}
+	rk, err := csp.rootKey(processID)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := voprfSigner(rk)
+	if err != nil {
+		return nil, nil, err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := csp.consumeKey(token, processID, types.SignatureTypeVOPRF); err != nil {
+		if errors.Is(err, ErrKeyExpired) || errors.Is(err, ErrKeyMismatch) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("token not found")
+	}
+	for _, element := range blinded {
+		if err := csp.appendLog(processID, types.SignatureTypeVOPRF, element); err != nil {
+			return nil, nil, err
+		}
+	}
+	eval, err := signer.EvaluateVOPRF(salt, &oprf.EvaluationRequest{Elements: elements})
+	if err != nil {
+		return nil, nil, err
+	}
+	evaluated, err := saltedkey.MarshalVOPRFElements(eval.Elements)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := eval.Proof.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return evaluated, proof, nil
+}
+
+// RedeemVOPRF checks that output is the VOPRF output of input for processID and
+// marks the token as spent. Returns ErrTokenSpent if the token was already redeemed.
+func (csp *BlindCSP) RedeemVOPRF(input, output, processID []byte) error {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return err
+	}
+	signer, err := voprfSigner(rk)
+	if err != nil {
+		return err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return err
+	}
+	if !signer.VerifyVOPRF(salt, input, output) {
+		return fmt.Errorf("invalid token")
+	}
+	spent := sha256.Sum256(input)
+	return csp.keys.Spend(processID, spent[:])
+}
+
+// voprfSigner returns the VOPRF signer of the root key, if supported.
+func voprfSigner(rk *saltedkey.RootKey) (saltedkey.VOPRFSigner, error) {
+	signer, ok := rk.Signer.(saltedkey.VOPRFSigner)
+	if !ok {
+		return nil, fmt.Errorf("root key %s does not support VOPRF tokens", rk.ID)
+	}
+	return signer, nil
+}
+
+// electionRSAKey returns the RSA key of processID. If create is true and the
+// election has no RSA key, a pre-generated one is bound to the election. The keys
+// are stored sealed with the election root key and salt (see saltedkey.SecretSealer).
+func (csp *BlindCSP) electionRSAKey(processID []byte, create bool) (*rsa.PrivateKey, error) {
+	lookup := csp.lookupRootKey
+	if create {
+		lookup = csp.rootKey
+	}
+	rk, err := lookup(processID)
+	if err != nil {
+		return nil, err
+	}
+	sealer, ok := rk.Signer.(saltedkey.SecretSealer)
+	if !ok {
+		return nil, fmt.Errorf("root key %s does not support blind RSA keys", rk.ID)
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := csp.keys.BindRSAKey(processID, nil)
+	if errors.Is(err, ErrKeyUnknown) && create {
+		var sk *rsa.PrivateKey
+		select {
+		case sk = <-csp.rsaKeys:
+		case <-csp.ctx.Done():
+			return nil, fmt.Errorf("blind RSA keys generator stopped")
+		}
+		if sealed, err = sealer.SealSecret(salt, x509.MarshalPKCS1PrivateKey(sk)); err != nil {
+			return nil, err
+		}
+		// If two keys are bound concurrently, only the first one is used
+		sealed, err = csp.keys.BindRSAKey(processID, sealed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealer.OpenSecret(salt, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS1PrivateKey(key)
+}
+
+// rsaKeysGenerator keeps RSAKeyPoolSize election RSA keys generated in advance, so
+// the slow RSA key generation does not delay the authentication of the clients.
+func (csp *BlindCSP) rsaKeysGenerator() {
+	for {
+		sk, err := rsa.GenerateKey(rand.Reader, RSAKeyBits)
+		if err != nil {
+			log.Warnf("cannot generate blind RSA key: %v", err)
+			select {
+			case <-csp.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		select {
+		case csp.rsaKeys <- sk:
+		case <-csp.ctx.Done():
+			return
+		}
+	}
+}
+
+// rootKey returns the root key of processID. The active root key and the salt version
+// are bound to the election the first time it is used for authentication or signing, so
+// the election keeps its keys after the root key is rotated or the salt version changed.
+// If processID is nil, the active key is returned.
+func (csp *BlindCSP) rootKey(processID []byte) (*saltedkey.RootKey, error) {
+	active, err := csp.keyring.Active(time.Now())
+	if err != nil || processID == nil {
+		return active, err
+	}
+	if _, err := csp.bindSaltVersion(processID); err != nil {
+		return nil, err
+	}
+	keyID, err := csp.keys.BindRootKey(processID, active.ID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get election root key: %w", err)
+	}
+	return csp.keyring.Key(keyID)
 }
 
-// SyncMap helpers
-func (csp *BlindCSP) addKey(index string, point *big.Int) error {
-	csp.keysLock.Lock()
-	defer csp.keysLock.Unlock()
-	tx := csp.keys.WriteTx()
-	defer tx.Discard()
-	if err := tx.Set([]byte(index), point.Bytes()); err != nil {
-		log.Error(err)
+// lookupRootKey returns the root key of processID like rootKey, but without binding
+// the active root key to the election if it has none yet (so it is safe for the
+// read-only endpoints). If processID is nil, the active key is returned.
+func (csp *BlindCSP) lookupRootKey(processID []byte) (*saltedkey.RootKey, error) {
+	if processID == nil {
+		return csp.keyring.Active(time.Now())
 	}
-	return tx.Commit()
+	keyID, err := csp.keys.BindRootKey(processID, "")
+	if errors.Is(err, ErrKeyUnknown) {
+		return csp.keyring.Active(time.Now())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot get election root key: %w", err)
+	}
+	return csp.keyring.Key(keyID)
 }
 
-func (csp *BlindCSP) delKey(index string) error {
-	csp.keysLock.Lock()
-	defer csp.keysLock.Unlock()
-	tx := csp.keys.WriteTx()
-	defer tx.Discard()
-	if err := tx.Delete([]byte(index)); err != nil {
-		log.Error(err)
+// PurgeExpiredKeys removes all the request keys whose TTL is reached from the
+// token store. Returns the number of keys removed.
+func (csp *BlindCSP) PurgeExpiredKeys() (int, error) {
+	return csp.keys.PurgeExpired()
+}
+
+// keysGC periodically removes the expired request keys from the token store.
+func (csp *BlindCSP) keysGC(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-csp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		removed, err := csp.PurgeExpiredKeys()
+		if err != nil {
+			log.Warnf("cannot purge expired request keys: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Infof("removed %d expired request keys", removed)
+		}
 	}
-	return tx.Commit()
 }
 
-func (csp *BlindCSP) getKey(index string) (*big.Int, error) {
+// Token store helpers
+func (csp *BlindCSP) addKey(index []byte, point *big.Int, processID []byte, signType string) error {
+	handler, err := csp.electionHandler(processID)
+	if err != nil {
+		return err
+	}
 	csp.keysLock.RLock()
-	defer csp.keysLock.RUnlock()
-	tx := csp.keys.WriteTx()
-	defer tx.Discard()
-	p, err := tx.Get([]byte(index))
+	ttl := csp.keysTTL
+	csp.keysLock.RUnlock()
+	return csp.keys.Add(index, &RequestKey{
+		K:         point.Bytes(),
+		ProcessID: processID,
+		SignType:  signType,
+		Handler:   handler.Name,
+		CreatedAt: time.Now(),
+		TTL:       ttl,
+	})
+}
+
+// consumeKey atomically fetches and removes the request key stored at index, only if
+// it is not expired and it was issued for processID, signType and the election handler.
+func (csp *BlindCSP) consumeKey(index, processID []byte, signType string) (*RequestKey, error) {
+	handler, err := csp.electionHandler(processID)
 	if err != nil {
 		return nil, err
 	}
-	return new(big.Int).SetBytes(p), nil
+	return csp.keys.Consume(index, processID, signType, handler.Name)
 }
@@ -0,0 +1,227 @@
+package csp
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/blind-csp/saltedkey"
+)
+
+// MemoryTokenStore keeps the request keys in memory. Everything is lost if the CSP
+// is restarted (including the spent tokens and the election keys), so it is only
+// intended for testing and cannot be selected with NewTokenStore.
+type MemoryTokenStore struct {
+	keys     map[string]RequestKey
+	sessions map[string]AuthSession
+	rootKeys map[string]string
+	salts    map[string]saltedkey.SaltVersion
+	rsaKeys  map[string][]byte
+	spent    map[string]struct{}
+	issued   map[string]map[string]bool // processID -> hash -> revoked
+	logs     map[string][][]byte
+	keysLock sync.Mutex
+}
+
+// NewMemoryTokenStore returns an initialized MemoryTokenStore.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	ms := &MemoryTokenStore{}
+	_ = ms.Init("")
+	return ms
+}
+
+// Init does nothing with the dataDir on this storage
+func (ms *MemoryTokenStore) Init(dataDir string) error {
+	ms.keys = make(map[string]RequestKey)
+	ms.sessions = make(map[string]AuthSession)
+	ms.rootKeys = make(map[string]string)
+	ms.salts = make(map[string]saltedkey.SaltVersion)
+	ms.rsaKeys = make(map[string][]byte)
+	ms.spent = make(map[string]struct{})
+	ms.issued = make(map[string]map[string]bool)
+	ms.logs = make(map[string][][]byte)
+	return nil
+}
+
+func (ms *MemoryTokenStore) Add(index []byte, rk *RequestKey) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ms.keys[string(index)] = *rk
+	return nil
+}
+
+func (ms *MemoryTokenStore) Consume(index, processID []byte,
+	signType, handler string,
+) (*RequestKey, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	rk, ok := ms.keys[string(index)]
+	if !ok {
+		return nil, ErrKeyUnknown
+	}
+	if rk.Expired(time.Now()) {
+		return nil, ErrKeyExpired
+	}
+	if err := rk.Matches(processID, signType, handler); err != nil {
+		return nil, err
+	}
+	delete(ms.keys, string(index))
+	return &rk, nil
+}
+
+func (ms *MemoryTokenStore) PurgeExpired() (int, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	now := time.Now()
+	removed := 0
+	for index, rk := range ms.keys {
+		if rk.Expired(now) {
+			delete(ms.keys, index)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (ms *MemoryTokenStore) AddSession(authToken []byte, session *AuthSession) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ms.sessions[string(authToken)] = *session
+	return nil
+}
+
+func (ms *MemoryTokenStore) ConsumeSession(authToken, processID []byte,
+	signType, handler string, step int,
+) (*AuthSession, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	session, ok := ms.sessions[string(authToken)]
+	if !ok {
+		return nil, ErrSessionUnknown
+	}
+	if session.Expired(time.Now()) {
+		return nil, ErrSessionExpired
+	}
+	if err := session.Check(processID, signType, handler, step); err != nil {
+		return nil, err
+	}
+	delete(ms.sessions, string(authToken))
+	return &session, nil
+}
+
+func (ms *MemoryTokenStore) PurgeExpiredSessions() (int, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	now := time.Now()
+	removed := 0
+	for token, session := range ms.sessions {
+		if session.Expired(now) {
+			delete(ms.sessions, token)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (ms *MemoryTokenStore) BindRootKey(processID []byte, keyID string) (string, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	if bound, ok := ms.rootKeys[string(processID)]; ok {
+		return bound, nil
+	}
+	if keyID == "" {
+		return "", ErrKeyUnknown
+	}
+	ms.rootKeys[string(processID)] = keyID
+	return keyID, nil
+}
+
+func (ms *MemoryTokenStore) BindSaltVersion(processID []byte,
+	version saltedkey.SaltVersion,
+) (saltedkey.SaltVersion, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	if bound, ok := ms.salts[string(processID)]; ok {
+		return bound, nil
+	}
+	if version == 0 {
+		return 0, ErrKeyUnknown
+	}
+	ms.salts[string(processID)] = version
+	return version, nil
+}
+
+func (ms *MemoryTokenStore) BindRSAKey(processID, key []byte) ([]byte, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	if bound, ok := ms.rsaKeys[string(processID)]; ok {
+		return bound, nil
+	}
+	if key == nil {
+		return nil, ErrKeyUnknown
+	}
+	ms.rsaKeys[string(processID)] = key
+	return key, nil
+}
+
+func (ms *MemoryTokenStore) Spend(processID, token []byte) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	key := string(electionKey(processID, token))
+	if _, ok := ms.spent[key]; ok {
+		return ErrTokenSpent
+	}
+	ms.spent[key] = struct{}{}
+	return nil
+}
+
+func (ms *MemoryTokenStore) AddIssued(processID, hash []byte) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	issued, ok := ms.issued[string(processID)]
+	if !ok {
+		issued = make(map[string]bool)
+		ms.issued[string(processID)] = issued
+	}
+	if _, ok := issued[string(hash)]; !ok {
+		issued[string(hash)] = false
+	}
+	return nil
+}
+
+func (ms *MemoryTokenStore) Revoke(processID, hash []byte) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	if _, ok := ms.issued[string(processID)][string(hash)]; !ok {
+		return ErrSignatureUnknown
+	}
+	ms.issued[string(processID)][string(hash)] = true
+	return nil
+}
+
+func (ms *MemoryTokenStore) Revoked(processID []byte) ([][]byte, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	hashes := [][]byte{}
+	for hash, revoked := range ms.issued[string(processID)] {
+		if revoked {
+			hashes = append(hashes, []byte(hash))
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+	return hashes, nil
+}
+
+func (ms *MemoryTokenStore) AppendLeaf(processID, leaf []byte) (uint64, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ms.logs[string(processID)] = append(ms.logs[string(processID)], bytes.Clone(leaf))
+	return uint64(len(ms.logs[string(processID)]) - 1), nil
+}
+
+func (ms *MemoryTokenStore) Leaves(processID []byte) ([][]byte, error) {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	return append([][]byte{}, ms.logs[string(processID)]...), nil
+}
@@ -0,0 +1,487 @@
+package csp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.vocdoni.io/dvote/log"
+)
+
+// MongoTokenStore uses an external MongoDB service for storing the request keys.
+// Several CSP replicas can share the same store, so a request key issued by one
+// of them can be redeemed on any other.
+type MongoTokenStore struct {
+	keys     *mongo.Collection
+	sessions *mongo.Collection
+	rootKeys *mongo.Collection
+	salts    *mongo.Collection
+	rsaKeys  *mongo.Collection
+	spent    *mongo.Collection
+	issued   *mongo.Collection
+	logs     *mongo.Collection
+}
+
+// mongoSession is the MongoDB document representation of an authentication session.
+type mongoSession struct {
+	AuthToken   []byte `bson:"_id"`
+	AuthSession `bson:",inline"`
+}
+
+// mongoRootKey is the MongoDB document binding an election to a root key.
+type mongoRootKey struct {
+	ProcessID []byte `bson:"_id"`
+	KeyID     string `bson:"keyid"`
+}
+
+// mongoSaltVersion is the MongoDB document binding an election to a salt version.
+type mongoSaltVersion struct {
+	ProcessID []byte `bson:"_id"`
+	Version   uint8  `bson:"version"`
+}
+
+// mongoRSAKey is the MongoDB document binding an election to its RSA key.
+type mongoRSAKey struct {
+	ProcessID []byte `bson:"_id"`
+	Key       []byte `bson:"key"`
+}
+
+// mongoSpentToken is the MongoDB document of a spent token.
+type mongoSpentToken struct {
+	ID      []byte    `bson:"_id"` // electionKey(processID, token)
+	SpentAt time.Time `bson:"spentat"`
+}
+
+// mongoIssuedSignature is the MongoDB document of an issued signature.
+type mongoIssuedSignature struct {
+	ID        []byte `bson:"_id"` // electionKey(processID, hash)
+	ProcessID []byte `bson:"processid"`
+	Hash      []byte `bson:"hash"`
+	Revoked   bool   `bson:"revoked"`
+}
+
+// mongoLogLeaf is the MongoDB document of a transparency log leaf.
+type mongoLogLeaf struct {
+	ID        []byte `bson:"_id"` // electionKey(processID, index)
+	ProcessID []byte `bson:"processid"`
+	Index     int64  `bson:"index"`
+	Leaf      []byte `bson:"leaf"`
+}
+
+// mongoRequestKey is the MongoDB document representation of a request key.
+type mongoRequestKey struct {
+	Index      []byte `bson:"_id"`
+	RequestKey `bson:",inline"`
+	ExpiresAt  time.Time `bson:"expiresat"`
+}
+
+func (ms *MongoTokenStore) Init(dataDir string) error {
+	url := os.Getenv("CSP_MONGODB_URL")
+	if url == "" {
+		return fmt.Errorf("CSP_MONGODB_URL env var is not defined")
+	}
+	database := os.Getenv("CSP_DATABASE")
+	if database == "" {
+		return fmt.Errorf("CSP_DATABASE for mongodb is not defined")
+	}
+	log.Infof("connecting to mongodb %s@%s", url, database)
+	opts := options.Client()
+	opts.ApplyURI(url)
+	opts.SetMaxConnecting(20)
+	timeout := time.Second * 10
+	opts.ConnectTimeout = &timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return err
+	}
+	// Shutdown database connection when SIGTERM received
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		log.Warnf("received SIGTERM, disconnecting mongo database")
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		if err := client.Disconnect(ctx); err != nil {
+			log.Warn(err)
+		}
+		cancel()
+	}()
+
+	ctx, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("cannot connect to mongodb: %w", err)
+	}
+	ms.keys = client.Database(database).Collection("tokens")
+	ms.sessions = client.Database(database).Collection("sessions")
+	ms.rootKeys = client.Database(database).Collection("rootkeys")
+	ms.salts = client.Database(database).Collection("saltversions")
+	ms.rsaKeys = client.Database(database).Collection("rsakeys")
+	ms.spent = client.Database(database).Collection("spent")
+	ms.issued = client.Database(database).Collection("issued")
+	ms.logs = client.Database(database).Collection("logs")
+
+	// Let MongoDB remove the expired request keys and sessions by itself
+	ctx, cancel3 := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel3()
+	for _, collection := range []*mongo.Collection{ms.keys, ms.sessions} {
+		if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}); err != nil {
+			return err
+		}
+	}
+	// The last leaf of an election is looked up on every append
+	if _, err := ms.logs.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "processid", Value: 1}, {Key: "index", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ms *MongoTokenStore) Add(index []byte, rk *RequestKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := ms.keys.InsertOne(ctx, mongoRequestKey{
+		Index:      index,
+		RequestKey: *rk,
+		ExpiresAt:  rk.CreatedAt.Add(rk.TTL),
+	})
+	return err
+}
+
+func (ms *MongoTokenStore) Consume(index, processID []byte,
+	signType, handler string,
+) (*RequestKey, error) {
+	// The filter acts as the compare, so the document is only removed if it matches.
+	// FindOneAndDelete is atomic, concurrent calls cannot consume the same document.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{
+		"_id":       index,
+		"processid": processID,
+		"signtype":  signType,
+		"handler":   handler,
+		"expiresat": bson.M{"$gt": time.Now()},
+	}
+	var doc mongoRequestKey
+	err := ms.keys.FindOneAndDelete(ctx, filter).Decode(&doc)
+	if err == nil {
+		return &doc.RequestKey, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	// Find out why the request key was not consumed
+	ctx, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := ms.keys.FindOne(ctx, bson.M{"_id": index}).Decode(&doc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrKeyUnknown
+		}
+		return nil, err
+	}
+	if doc.Expired(time.Now()) {
+		return nil, ErrKeyExpired
+	}
+	if err := doc.Matches(processID, signType, handler); err != nil {
+		return nil, err
+	}
+	// The request key has been consumed concurrently
+	return nil, ErrKeyUnknown
+}
+
+// PurgeExpired removes the expired request keys. MongoDB already removes them by
+// itself (TTL index), but its background task only runs every 60 seconds.
+func (ms *MongoTokenStore) PurgeExpired() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := ms.keys.DeleteMany(ctx, bson.M{"expiresat": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+func (ms *MongoTokenStore) AddSession(authToken []byte, session *AuthSession) error {
+	// A failed step restores the session, so it might already exist
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := ms.sessions.ReplaceOne(ctx, bson.M{"_id": authToken},
+		mongoSession{AuthToken: authToken, AuthSession: *session},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (ms *MongoTokenStore) ConsumeSession(authToken, processID []byte,
+	signType, handler string, step int,
+) (*AuthSession, error) {
+	// Same as Consume, the filter acts as the compare of FindOneAndDelete
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := bson.M{
+		"_id":       authToken,
+		"processid": processID,
+		"signtype":  signType,
+		"handler":   handler,
+		"laststep":  step - 1,
+		"expiresat": bson.M{"$gt": time.Now()},
+	}
+	var doc mongoSession
+	err := ms.sessions.FindOneAndDelete(ctx, filter).Decode(&doc)
+	if err == nil {
+		return &doc.AuthSession, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	// Find out why the session was not consumed
+	ctx, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := ms.sessions.FindOne(ctx, bson.M{"_id": authToken}).Decode(&doc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrSessionUnknown
+		}
+		return nil, err
+	}
+	if doc.Expired(time.Now()) {
+		return nil, ErrSessionExpired
+	}
+	if err := doc.Check(processID, signType, handler, step); err != nil {
+		return nil, err
+	}
+	// The session has been consumed concurrently
+	return nil, ErrSessionUnknown
+}
+
+// PurgeExpiredSessions removes the expired sessions, see PurgeExpired.
+func (ms *MongoTokenStore) PurgeExpiredSessions() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := ms.sessions.DeleteMany(ctx, bson.M{"expiresat": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+func (ms *MongoTokenStore) BindRootKey(processID []byte, keyID string) (string, error) {
+	// The upsert only sets the key ID if the document is created, so concurrent calls
+	// (even from different replicas) always return the first key ID bound.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var doc mongoRootKey
+	if keyID == "" {
+		err := ms.rootKeys.FindOne(ctx, bson.M{"_id": processID}).Decode(&doc)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", ErrKeyUnknown
+		}
+		return doc.KeyID, err
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := ms.rootKeys.FindOneAndUpdate(ctx,
+		bson.M{"_id": processID},
+		bson.M{"$setOnInsert": bson.M{"keyid": keyID}},
+		opts,
+	).Decode(&doc)
+	if mongo.IsDuplicateKeyError(err) {
+		// Two upserts raced, the document is already created by the other one
+		err = ms.rootKeys.FindOne(ctx, bson.M{"_id": processID}).Decode(&doc)
+	}
+	if err != nil {
+		return "", err
+	}
+	return doc.KeyID, nil
+}
+
+func (ms *MongoTokenStore) BindSaltVersion(processID []byte,
+	version saltedkey.SaltVersion,
+) (saltedkey.SaltVersion, error) {
+	// Same as BindRootKey, the first version bound is kept
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var doc mongoSaltVersion
+	if version == 0 {
+		err := ms.salts.FindOne(ctx, bson.M{"_id": processID}).Decode(&doc)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, ErrKeyUnknown
+		}
+		return saltedkey.SaltVersion(doc.Version), err
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := ms.salts.FindOneAndUpdate(ctx,
+		bson.M{"_id": processID},
+		bson.M{"$setOnInsert": bson.M{"version": uint8(version)}},
+		opts,
+	).Decode(&doc)
+	if mongo.IsDuplicateKeyError(err) {
+		err = ms.salts.FindOne(ctx, bson.M{"_id": processID}).Decode(&doc)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return saltedkey.SaltVersion(doc.Version), nil
+}
+
+func (ms *MongoTokenStore) BindRSAKey(processID, key []byte) ([]byte, error) {
+	// Same as BindRootKey, the first key bound is kept
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var doc mongoRSAKey
+	if key == nil {
+		err := ms.rsaKeys.FindOne(ctx, bson.M{"_id": processID}).Decode(&doc)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrKeyUnknown
+		}
+		return doc.Key, err
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := ms.rsaKeys.FindOneAndUpdate(ctx,
+		bson.M{"_id": processID},
+		bson.M{"$setOnInsert": bson.M{"key": key}},
+		opts,
+	).Decode(&doc)
+	if mongo.IsDuplicateKeyError(err) {
+		err = ms.rsaKeys.FindOne(ctx, bson.M{"_id": processID}).Decode(&doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.Key, nil
+}
+
+func (ms *MongoTokenStore) Spend(processID, token []byte) error {
+	// The unique _id makes the insertion fail if the token is already spent
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := ms.spent.InsertOne(ctx, mongoSpentToken{
+		ID:      electionKey(processID, token),
+		SpentAt: time.Now(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrTokenSpent
+	}
+	return err
+}
+
+func (ms *MongoTokenStore) AddIssued(processID, hash []byte) error {
+	// The upsert only creates the document, so the revocation status is kept
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id := electionKey(processID, hash)
+	_, err := ms.issued.UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$setOnInsert": bson.M{"processid": processID, "hash": hash, "revoked": false}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (ms *MongoTokenStore) Revoke(processID, hash []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := ms.issued.UpdateOne(ctx,
+		bson.M{"_id": electionKey(processID, hash)},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSignatureUnknown
+	}
+	return nil
+}
+
+func (ms *MongoTokenStore) Revoked(processID []byte) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// MongoDB sorts the binary values by length first, all the hashes have the same one
+	cursor, err := ms.issued.Find(ctx, bson.M{"processid": processID, "revoked": true},
+		options.Find().SetSort(bson.M{"hash": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoIssuedSignature
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	hashes := make([][]byte, len(docs))
+	for i, doc := range docs {
+		hashes[i] = doc.Hash
+	}
+	return hashes, nil
+}
+
+func (ms *MongoTokenStore) AppendLeaf(processID, leaf []byte) (uint64, error) {
+	// The leaf is inserted next to the last one. The unique _id makes the insertion
+	// fail if a concurrent append (even from a different replica) took the index, so
+	// it is retried with the next one. An index is only used once it is inserted, so
+	// the log never has gaps.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		var last mongoLogLeaf
+		index := uint64(0)
+		err := ms.logs.FindOne(ctx, bson.M{"processid": processID},
+			options.FindOne().SetSort(bson.D{{Key: "index", Value: -1}})).Decode(&last)
+		if err == nil {
+			index = uint64(last.Index) + 1
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, err
+		}
+		_, err = ms.logs.InsertOne(ctx, mongoLogLeaf{
+			ID:        electionKey(processID, binary.BigEndian.AppendUint64(nil, index)),
+			ProcessID: processID,
+			Index:     int64(index),
+			Leaf:      leaf,
+		})
+		if !mongo.IsDuplicateKeyError(err) {
+			return index, err
+		}
+	}
+}
+
+// Leaves returns the leaves ordered by index. AppendLeaf never leaves gaps, so a
+// missing index is returned as an error instead of a truncated log.
+func (ms *MongoTokenStore) Leaves(processID []byte) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cursor, err := ms.logs.Find(ctx, bson.M{"processid": processID},
+		options.Find().SetSort(bson.D{{Key: "index", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoLogLeaf
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	leaves := make([][]byte, len(docs))
+	for i, doc := range docs {
+		if doc.Index != int64(i) {
+			return nil, fmt.Errorf("transparency log of %x is missing the leaf %d", processID, i)
+		}
+		leaves[i] = doc.Leaf
+	}
+	return leaves, nil
+}
@@ -0,0 +1,439 @@
+package csp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+	"go.vocdoni.io/dvote/log"
+)
+
+var (
+	// pebble database prefixes
+	requestKeysPrefix = []byte("k/")
+	sessionsPrefix    = []byte("t/")
+	rootKeysPrefix    = []byte("r/")
+	saltsPrefix       = []byte("v/")
+	rsaKeysPrefix     = []byte("a/")
+	spentPrefix       = []byte("s/")
+	issuedPrefix      = []byte("i/")
+	logsPrefix        = []byte("l/")
+	// transparency log sub-prefixes
+	logLeavesPrefix = []byte("e/")
+	logSizesPrefix  = []byte("n/")
+	// pebblePrefixes are all the prefixes in use, the other keys are purged on Init
+	pebblePrefixes = [][]byte{
+		requestKeysPrefix, sessionsPrefix, rootKeysPrefix, saltsPrefix,
+		rsaKeysPrefix, spentPrefix, issuedPrefix, logsPrefix,
+	}
+)
+
+// PebbleTokenStore uses a local KV database (Pebble) for storing the request keys.
+// JSON is used for data serialization.
+type PebbleTokenStore struct {
+	kv       db.Database
+	sessions db.Database
+	rootKeys db.Database
+	salts    db.Database
+	rsaKeys  db.Database
+	spent    db.Database
+	issued   db.Database
+	logs     db.Database
+	keysLock sync.RWMutex
+}
+
+func (ps *PebbleTokenStore) Init(dataDir string) error {
+	log.Debugf("initializing persistent token storage on %s", dataDir)
+	database, err := metadb.New(db.TypePebble, filepath.Clean(dataDir))
+	if err != nil {
+		return err
+	}
+	if err := purgeUnprefixed(database); err != nil {
+		return fmt.Errorf("cannot purge legacy keys: %w", err)
+	}
+	ps.kv = prefixeddb.NewPrefixedDatabase(database, requestKeysPrefix)
+	ps.sessions = prefixeddb.NewPrefixedDatabase(database, sessionsPrefix)
+	ps.rootKeys = prefixeddb.NewPrefixedDatabase(database, rootKeysPrefix)
+	ps.salts = prefixeddb.NewPrefixedDatabase(database, saltsPrefix)
+	ps.rsaKeys = prefixeddb.NewPrefixedDatabase(database, rsaKeysPrefix)
+	ps.spent = prefixeddb.NewPrefixedDatabase(database, spentPrefix)
+	ps.issued = prefixeddb.NewPrefixedDatabase(database, issuedPrefix)
+	ps.logs = prefixeddb.NewPrefixedDatabase(database, logsPrefix)
+	return nil
+}
+
+// purgeUnprefixed removes the keys without any of the pebblePrefixes. The previous
+// versions stored the request keys (R points) at the root of the database, they
+// would never expire nor be purged otherwise.
+func purgeUnprefixed(database db.Database) error {
+	var legacy [][]byte
+	if err := database.Iterate(nil, func(key, value []byte) bool {
+		for _, prefix := range pebblePrefixes {
+			if bytes.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		legacy = append(legacy, bytes.Clone(key))
+		return true
+	}); err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	tx := database.WriteTx()
+	defer tx.Discard()
+	for _, key := range legacy {
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof("purged %d legacy request keys from the token store", len(legacy))
+	return nil
+}
+
+func (ps *PebbleTokenStore) Add(index []byte, rk *RequestKey) error {
+	data, err := json.Marshal(rk)
+	if err != nil {
+		return err
+	}
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.kv.WriteTx()
+	defer tx.Discard()
+	if err := tx.Set(index, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ps *PebbleTokenStore) Consume(index, processID []byte,
+	signType, handler string,
+) (*RequestKey, error) {
+	// The whole operation is performed holding the write lock, so concurrent calls
+	// with the same index are serialized.
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.kv.WriteTx()
+	defer tx.Discard()
+	data, err := tx.Get(index)
+	if err != nil {
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return nil, ErrKeyUnknown
+		}
+		return nil, err
+	}
+	rk := RequestKey{}
+	if err := json.Unmarshal(data, &rk); err != nil {
+		return nil, err
+	}
+	if rk.Expired(time.Now()) {
+		return nil, ErrKeyExpired
+	}
+	if err := rk.Matches(processID, signType, handler); err != nil {
+		return nil, err
+	}
+	if err := tx.Delete(index); err != nil {
+		return nil, err
+	}
+	return &rk, tx.Commit()
+}
+
+// PurgeExpired removes the expired request keys, and those that cannot be decoded.
+func (ps *PebbleTokenStore) PurgeExpired() (int, error) {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	now := time.Now()
+	expired := [][]byte{}
+	if err := ps.kv.Iterate(nil, func(key, value []byte) bool {
+		rk := RequestKey{}
+		if err := json.Unmarshal(value, &rk); err != nil || rk.Expired(now) {
+			expired = append(expired, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	tx := ps.kv.WriteTx()
+	defer tx.Discard()
+	for _, key := range expired {
+		if err := tx.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), tx.Commit()
+}
+
+func (ps *PebbleTokenStore) AddSession(authToken []byte, session *AuthSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.sessions.WriteTx()
+	defer tx.Discard()
+	if err := tx.Set(authToken, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ps *PebbleTokenStore) ConsumeSession(authToken, processID []byte,
+	signType, handler string, step int,
+) (*AuthSession, error) {
+	// Same as Consume, the write lock serializes concurrent calls
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.sessions.WriteTx()
+	defer tx.Discard()
+	data, err := tx.Get(authToken)
+	if err != nil {
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return nil, ErrSessionUnknown
+		}
+		return nil, err
+	}
+	session := AuthSession{}
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if session.Expired(time.Now()) {
+		return nil, ErrSessionExpired
+	}
+	if err := session.Check(processID, signType, handler, step); err != nil {
+		return nil, err
+	}
+	if err := tx.Delete(authToken); err != nil {
+		return nil, err
+	}
+	return &session, tx.Commit()
+}
+
+// PurgeExpiredSessions removes the expired sessions, and those that cannot be decoded.
+func (ps *PebbleTokenStore) PurgeExpiredSessions() (int, error) {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	now := time.Now()
+	expired := [][]byte{}
+	if err := ps.sessions.Iterate(nil, func(key, value []byte) bool {
+		session := AuthSession{}
+		if err := json.Unmarshal(value, &session); err != nil || session.Expired(now) {
+			expired = append(expired, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	tx := ps.sessions.WriteTx()
+	defer tx.Discard()
+	for _, key := range expired {
+		if err := tx.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), tx.Commit()
+}
+
+func (ps *PebbleTokenStore) BindRootKey(processID []byte, keyID string) (string, error) {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.rootKeys.WriteTx()
+	defer tx.Discard()
+	bound, err := tx.Get(processID)
+	if err == nil {
+		return string(bound), nil
+	}
+	if !errors.Is(err, db.ErrKeyNotFound) {
+		return "", err
+	}
+	if keyID == "" {
+		return "", ErrKeyUnknown
+	}
+	if err := tx.Set(processID, []byte(keyID)); err != nil {
+		return "", err
+	}
+	return keyID, tx.Commit()
+}
+
+func (ps *PebbleTokenStore) BindSaltVersion(processID []byte,
+	version saltedkey.SaltVersion,
+) (saltedkey.SaltVersion, error) {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.salts.WriteTx()
+	defer tx.Discard()
+	bound, err := tx.Get(processID)
+	if err == nil {
+		if len(bound) != 1 {
+			return 0, fmt.Errorf("invalid salt version of %x", processID)
+		}
+		return saltedkey.SaltVersion(bound[0]), nil
+	}
+	if !errors.Is(err, db.ErrKeyNotFound) {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, ErrKeyUnknown
+	}
+	if err := tx.Set(processID, []byte{byte(version)}); err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+func (ps *PebbleTokenStore) BindRSAKey(processID, key []byte) ([]byte, error) {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.rsaKeys.WriteTx()
+	defer tx.Discard()
+	bound, err := tx.Get(processID)
+	if err == nil {
+		return bytes.Clone(bound), nil
+	}
+	if !errors.Is(err, db.ErrKeyNotFound) {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrKeyUnknown
+	}
+	if err := tx.Set(processID, key); err != nil {
+		return nil, err
+	}
+	return key, tx.Commit()
+}
+
+func (ps *PebbleTokenStore) Spend(processID, token []byte) error {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.spent.WriteTx()
+	defer tx.Discard()
+	key := electionKey(processID, token)
+	_, err := tx.Get(key)
+	if err == nil {
+		return ErrTokenSpent
+	}
+	if !errors.Is(err, db.ErrKeyNotFound) {
+		return err
+	}
+	if err := tx.Set(key, []byte{}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// issued signatures values
+var (
+	issuedValue  = []byte{0}
+	revokedValue = []byte{1}
+)
+
+func (ps *PebbleTokenStore) AddIssued(processID, hash []byte) error {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.issued.WriteTx()
+	defer tx.Discard()
+	key := electionKey(processID, hash)
+	_, err := tx.Get(key)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, db.ErrKeyNotFound) {
+		return err
+	}
+	if err := tx.Set(key, issuedValue); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ps *PebbleTokenStore) Revoke(processID, hash []byte) error {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.issued.WriteTx()
+	defer tx.Discard()
+	key := electionKey(processID, hash)
+	if _, err := tx.Get(key); err != nil {
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return ErrSignatureUnknown
+		}
+		return err
+	}
+	if err := tx.Set(key, revokedValue); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ps *PebbleTokenStore) Revoked(processID []byte) ([][]byte, error) {
+	ps.keysLock.RLock()
+	defer ps.keysLock.RUnlock()
+	hashes := [][]byte{}
+	// The keys are iterated in order, so the hashes are sorted
+	if err := ps.issued.Iterate(electionKey(processID, nil), func(key, value []byte) bool {
+		if bytes.Equal(value, revokedValue) {
+			hashes = append(hashes, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// AppendLeaf stores the leaf at electionKey(processID, index) (big endian, so the
+// leaves are iterated in order) and the log size at processID, on the same transaction.
+func (ps *PebbleTokenStore) AppendLeaf(processID, leaf []byte) (uint64, error) {
+	ps.keysLock.Lock()
+	defer ps.keysLock.Unlock()
+	tx := ps.logs.WriteTx()
+	defer tx.Discard()
+	sizes := prefixeddb.NewPrefixedWriteTx(tx, logSizesPrefix)
+	size := uint64(0)
+	data, err := sizes.Get(processID)
+	if err == nil {
+		size = binary.BigEndian.Uint64(data)
+	} else if !errors.Is(err, db.ErrKeyNotFound) {
+		return 0, err
+	}
+	leaves := prefixeddb.NewPrefixedWriteTx(tx, logLeavesPrefix)
+	if err := leaves.Set(electionKey(processID, binary.BigEndian.AppendUint64(nil, size)), leaf); err != nil {
+		return 0, err
+	}
+	if err := sizes.Set(processID, binary.BigEndian.AppendUint64(nil, size+1)); err != nil {
+		return 0, err
+	}
+	return size, tx.Commit()
+}
+
+func (ps *PebbleTokenStore) Leaves(processID []byte) ([][]byte, error) {
+	ps.keysLock.RLock()
+	defer ps.keysLock.RUnlock()
+	leaves := [][]byte{}
+	prefix := append(bytes.Clone(logLeavesPrefix), electionKey(processID, nil)...)
+	if err := ps.logs.Iterate(prefix, func(key, value []byte) bool {
+		leaves = append(leaves, bytes.Clone(value))
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
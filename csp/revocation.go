@@ -0,0 +1,58 @@
+package csp
+
+import (
+	"time"
+
+	"github.com/vocdoni/blind-csp/receipt"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+// RevokeSignature adds the ecdsa signature of payload issued for processID to the
+// election revocation list. Returns ErrSignatureUnknown if it was not issued.
+func (csp *BlindCSP) RevokeSignature(processID, payload []byte) error {
+	return csp.keys.Revoke(processID, receipt.RevocationHash(payload))
+}
+
+// RevocationList returns the revocation list of processID, signed with the election
+// salted ECDSA key (see receipt.VerifyRevocationList).
+func (csp *BlindCSP) RevocationList(processID []byte) (*types.RevocationList, error) {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, err := rootKeyInfo(rk)
+	if err != nil {
+		return nil, err
+	}
+	saltVersion, err := csp.SaltVersion(processID)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := receipt.SaltedPubKey(rootKey, saltVersion, processID, types.SignatureTypeEthereum)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := csp.keys.Revoked(processID)
+	if err != nil {
+		return nil, err
+	}
+	l := &types.RevocationList{
+		ElectionID:  processID,
+		KeyID:       rk.ID,
+		SaltVersion: uint32(saltVersion),
+		PubKey:      pubKey,
+		Revoked:     make([]types.HexBytes, len(hashes)),
+		Timestamp:   time.Now().Unix(),
+	}
+	for i, h := range hashes {
+		l.Revoked[i] = h
+	}
+	if l.Signature, err = rk.SignECDSAWithSalt(salt, l.SignedData()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,196 @@
+package csp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/log"
+)
+
+// DefaultSessionTTL is the default time an authentication session remains valid
+// after its last successful step.
+const DefaultSessionTTL = 15 * time.Minute
+
+// MaxSessionFailures is the number of times a step can fail before the session is
+// dropped, so the client must start the authentication again from step 0.
+const MaxSessionFailures = 3
+
+var (
+	// ErrSessionUnknown is returned when a step greater than 0 is requested with an
+	// authToken that does not belong to any active session.
+	ErrSessionUnknown = fmt.Errorf("unknown auth session")
+	// ErrSessionExpired is returned when the session TTL is reached before the next step.
+	ErrSessionExpired = fmt.Errorf("auth session expired")
+	// ErrSessionMismatch is returned when the session is continued for a different
+	// election, signature type or handler than the ones it was started for.
+	ErrSessionMismatch = fmt.Errorf("auth session started for a different election or signature type")
+	// ErrSessionStep is returned when the requested step is not the next one of the session.
+	ErrSessionStep = fmt.Errorf("invalid auth step")
+)
+
+// AuthSession is the progress of a client through the authentication steps. It is
+// stored on the token store indexed by the authToken issued on its last step, so the
+// next step can be performed by any CSP replica sharing the store, even after a restart.
+type AuthSession struct {
+	ProcessID types.HexBytes `json:"processId" bson:"processid"`
+	SignType  string         `json:"signType" bson:"signtype"`
+	Handler   string         `json:"handler" bson:"handler"`
+	LastStep  int            `json:"lastStep" bson:"laststep"`
+	// State is the handler state for the next step (see types.AuthResponse.SessionState)
+	State     []byte    `json:"state,omitempty" bson:"state,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresat"`
+	// Failures is the number of failed attempts of the next step
+	Failures int `json:"failures,omitempty" bson:"failures,omitempty"`
+}
+
+// Expired returns true if the session TTL is reached at the given time.
+func (s *AuthSession) Expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
+}
+
+// Check returns nil if the session can perform step for processID, signature type
+// and handler, else returns ErrSessionMismatch or ErrSessionStep.
+func (s *AuthSession) Check(processID []byte, signType, handler string, step int) error {
+	if !bytes.Equal(s.ProcessID, processID) || s.SignType != signType || s.Handler != handler {
+		return ErrSessionMismatch
+	}
+	if step != s.LastStep+1 {
+		return fmt.Errorf("%w %d, expected %d", ErrSessionStep, step, s.LastStep+1)
+	}
+	return nil
+}
+
+// sessionManager keeps the authentication sessions on the token store, indexed by
+// authToken. It makes sure the handler steps are performed serially, and only once,
+// for the election, signature type and handler the session was started for.
+type sessionManager struct {
+	store TokenStore
+	ttl   time.Duration
+	lock  sync.RWMutex
+}
+
+func newSessionManager(store TokenStore, ttl time.Duration) *sessionManager {
+	return &sessionManager{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+// take checks the session of authToken can perform step and removes it, so no
+// concurrent request can use it. Step 0 does not require any session.
+// The session returned must be given back to finish once the handler is executed.
+func (sm *sessionManager) take(authToken *uuid.UUID, processID []byte,
+	signType, handler string, step int,
+) (*AuthSession, error) {
+	if step < 0 {
+		return nil, fmt.Errorf("%w %d", ErrSessionStep, step)
+	}
+	if step == 0 {
+		return nil, nil
+	}
+	if authToken == nil {
+		return nil, fmt.Errorf("%w: authToken is required for step %d", ErrSessionUnknown, step)
+	}
+	return sm.store.ConsumeSession(authToken[:], processID, signType, handler, step)
+}
+
+// finish updates the session after the handler executed step. If the handler
+// returned a new authToken the session moves to the next step. On failure the
+// previous session (if any) is restored, so the client can retry the same step,
+// up to MaxSessionFailures times.
+func (sm *sessionManager) finish(authToken *uuid.UUID, previous *AuthSession,
+	processID []byte, signType, handler string, step int, authResp *types.AuthResponse,
+) error {
+	if !authResp.Success {
+		if previous == nil || authToken == nil {
+			return nil
+		}
+		previous.Failures++
+		if previous.Failures >= MaxSessionFailures {
+			log.Debugf("auth session dropped after %d failed attempts of step %d", previous.Failures, step)
+			return nil
+		}
+		return sm.store.AddSession(authToken[:], previous)
+	}
+	if authResp.AuthToken == nil {
+		// Authentication finished
+		return nil
+	}
+	sm.lock.RLock()
+	ttl := sm.ttl
+	sm.lock.RUnlock()
+	return sm.store.AddSession(authResp.AuthToken[:], &AuthSession{
+		ProcessID: processID,
+		SignType:  signType,
+		Handler:   handler,
+		LastStep:  step,
+		State:     authResp.SessionState,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+}
+
+// purgeExpired removes the expired sessions and returns how many were removed.
+func (sm *sessionManager) purgeExpired() (int, error) {
+	return sm.store.PurgeExpiredSessions()
+}
+
+func (sm *sessionManager) setTTL(ttl time.Duration) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.ttl = ttl
+}
+
+// auth executes the Auth callback of the election handler for the step, enforcing the session state machine.
+func (csp *BlindCSP) auth(r *http.Request, req *types.Message, processID types.HexBytes,
+	signType string, step int,
+) (types.AuthResponse, error) {
+	handler, err := csp.electionHandler(processID)
+	if err != nil {
+		return types.AuthResponse{}, err
+	}
+	// Register the election root key before the client gets any token
+	if _, err := csp.rootKey(processID); err != nil {
+		return types.AuthResponse{}, err
+	}
+	session, err := csp.sessions.take(req.AuthToken, processID, signType, handler.Name, step)
+	if err != nil {
+		return types.AuthResponse{}, err
+	}
+	// The handler state is only provided by the session, never by the client
+	req.SessionState = nil
+	if session != nil {
+		req.SessionState = session.State
+	}
+	authResp := handler.Auth(r, req, processID, signType, step)
+	if err := csp.sessions.finish(req.AuthToken, session, processID, signType,
+		handler.Name, step, &authResp); err != nil {
+		return types.AuthResponse{}, fmt.Errorf("cannot store auth session: %w", err)
+	}
+	return authResp, nil
+}
+
+// sessionsGC removes the abandoned authentication sessions every interval.
+func (csp *BlindCSP) sessionsGC(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-csp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		removed, err := csp.sessions.purgeExpired()
+		if err != nil {
+			log.Warnf("cannot purge expired auth sessions: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Debugf("removed %d expired auth sessions", removed)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package csp
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestAuthSession(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	ca, err := NewBlindCSP(testKeyRing(t, priv), testMemoryTokenStore(t),
+		BlindCSPcallbacks{Name: "test", Auth: testTwoStepsAuthHandler})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca.Close)
+
+	pidA := types.HexBytes(randomBytes(processIDSize))
+	pidB := types.HexBytes(randomBytes(processIDSize))
+
+	// Step 1 requires an authToken issued by step 0
+	unknown := uuid.New()
+	_, err = ca.auth(nil, &types.Message{AuthData: []string{"ok"}}, pidA, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionUnknown)
+	_, err = ca.auth(nil, &types.Message{AuthToken: &unknown, AuthData: []string{"ok"}},
+		pidA, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionUnknown)
+
+	resp, err := ca.auth(nil, &types.Message{}, pidA, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	qt.Assert(t, resp.AuthToken, qt.Not(qt.IsNil))
+	token := resp.AuthToken
+
+	// Out of order steps are rejected
+	_, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ok"}},
+		pidA, types.SignatureTypeBlind, 2)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionStep)
+
+	// The session cannot be continued on a different election or signature type
+	_, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ok"}},
+		pidB, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionMismatch)
+	_, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ok"}},
+		pidA, types.SignatureTypeEthereum, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionMismatch)
+
+	// A failed step can be retried
+	resp, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ko"}},
+		pidA, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+	resp, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ok"}},
+		pidA, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+
+	// But a successful step cannot be replayed
+	_, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ok"}},
+		pidA, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionUnknown)
+
+	// A step can only fail MaxSessionFailures times, then the session is dropped
+	resp, err = ca.auth(nil, &types.Message{}, pidA, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	token = resp.AuthToken
+	for i := 0; i < MaxSessionFailures; i++ {
+		resp, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ko"}},
+			pidA, types.SignatureTypeBlind, 1)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, resp.Success, qt.IsFalse)
+	}
+	_, err = ca.auth(nil, &types.Message{AuthToken: token, AuthData: []string{"ok"}},
+		pidA, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionUnknown)
+
+	// Stale sessions expire
+	qt.Assert(t, ca.SetSessionTTL(time.Millisecond*100), qt.IsNil)
+	resp, err = ca.auth(nil, &types.Message{}, pidA, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	time.Sleep(time.Millisecond * 150)
+	_, err = ca.auth(nil, &types.Message{AuthToken: resp.AuthToken, AuthData: []string{"ok"}},
+		pidA, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionExpired)
+
+	_, err = ca.auth(nil, &types.Message{}, pidA, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	time.Sleep(time.Millisecond * 150)
+	removed, err := ca.sessions.purgeExpired()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, removed, qt.Equals, 2)
+}
+
+func TestAuthSessionReplicas(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	// Two replicas sharing the token store (or a restarted CSP)
+	store := testPebbleTokenStore(t)
+	callbacks := BlindCSPcallbacks{Name: "test", Auth: testTwoStepsAuthHandler}
+	ca1, err := NewBlindCSP(testKeyRing(t, priv), store, callbacks)
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca1.Close)
+	ca2, err := NewBlindCSP(testKeyRing(t, priv), store, callbacks)
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(ca2.Close)
+
+	pid := types.HexBytes(randomBytes(processIDSize))
+	resp, err := ca1.auth(nil, &types.Message{}, pid, types.SignatureTypeBlind, 0)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.AuthToken, qt.Not(qt.IsNil))
+
+	// The step started on a replica is continued on the other one, only once
+	resp, err = ca2.auth(nil, &types.Message{AuthToken: resp.AuthToken, AuthData: []string{"ok"}},
+		pid, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	_, err = ca1.auth(nil, &types.Message{AuthToken: resp.AuthToken, AuthData: []string{"ok"}},
+		pid, types.SignatureTypeBlind, 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionUnknown)
+}
+
+// testTwoStepsAuthHandler issues an authToken (and a session state) on step 0 and
+// accepts step 1 if the auth data is "ok" and the session state is provided.
+func testTwoStepsAuthHandler(r *http.Request, m *types.Message,
+	pid types.HexBytes, st string, step int,
+) types.AuthResponse {
+	switch step {
+	case 0:
+		token := uuid.New()
+		return types.AuthResponse{Success: true, AuthToken: &token, SessionState: []byte("step0")}
+	case 1:
+		if string(m.SessionState) != "step0" {
+			return types.AuthResponse{Response: []string{"invalid session state"}}
+		}
+		if len(m.AuthData) == 1 && m.AuthData[0] == "ok" {
+			return types.AuthResponse{Success: true}
+		}
+	}
+	return types.AuthResponse{Response: []string{"invalid auth data"}}
+}
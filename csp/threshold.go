@@ -0,0 +1,205 @@
+package csp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/httprouter"
+	"go.vocdoni.io/dvote/httprouter/apirest"
+)
+
+// ThresholdCoordinator combines the blind signatures of the CSP nodes holding a
+// share of a threshold root key. Each node runs a regular CSP using its share as
+// root key, so the client authenticates on each of them and gets their R points
+// and partial signatures. The coordinator is stateless and does not hold any
+// secret, it can be run by the client itself.
+//
+// The flow for a threshold blind signature is:
+//  1. The client authenticates on (at least) threshold nodes and gets their R points.
+//  2. The coordinator combines the R points (/{processId}/token) for the client blinding.
+//  3. The client requests the partial signatures of the blinded message to the same nodes.
+//  4. The coordinator verifies and combines the partial signatures (/{processId}/sign).
+//
+// The combined signature is verified with the usual salted root public key.
+type ThresholdCoordinator struct {
+	key   *saltedkey.ThresholdKey
+	api   *apirest.API
+	salts SaltVersionResolverFunc
+}
+
+// NewThresholdCoordinator returns a coordinator for the threshold key.
+func NewThresholdCoordinator(key *saltedkey.ThresholdKey) (*ThresholdCoordinator, error) {
+	if key == nil || key.Threshold() == 0 {
+		return nil, fmt.Errorf("invalid threshold key")
+	}
+	return &ThresholdCoordinator{key: key}, nil
+}
+
+// SetSaltVersionResolver sets the function used for finding out the salt version of
+// each election, which must be the same one used by the nodes. If it is not set,
+// saltedkey.DefaultSaltVersion is used for all elections.
+func (tc *ThresholdCoordinator) SetSaltVersionResolver(resolver SaltVersionResolverFunc) {
+	tc.salts = resolver
+}
+
+// ServeAPI registers the coordinator API handlers into the router under the baseRoute path
+func (tc *ThresholdCoordinator) ServeAPI(r *httprouter.HTTProuter, baseRoute string) error {
+	if len(baseRoute) == 0 || baseRoute[0] != '/' {
+		return fmt.Errorf("invalid base route (%s), it must start with /", baseRoute)
+	}
+	if len(baseRoute) > 1 {
+		baseRoute = strings.TrimSuffix(baseRoute, "/")
+	}
+	if r == nil {
+		return fmt.Errorf("router is nil")
+	}
+	var err error
+	tc.api, err = apirest.NewAPI(r, baseRoute)
+	if err != nil {
+		return err
+	}
+	if err := tc.api.RegisterMethod(
+		"/info",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		tc.info,
+	); err != nil {
+		return err
+	}
+	if err := tc.api.RegisterMethod(
+		"/{processId}/token",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		tc.token,
+	); err != nil {
+		return err
+	}
+	return tc.api.RegisterMethod(
+		"/{processId}/sign",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		tc.sign,
+	)
+}
+
+// CombineSignerR returns the R point for blinding, combining the R points issued by the nodes.
+func (tc *ThresholdCoordinator) CombineSignerR(partials []types.PartialSignature) (*blind.Point, error) {
+	points := make(map[int]*blind.Point)
+	for _, p := range partials {
+		if _, ok := points[p.Index]; ok {
+			return nil, fmt.Errorf("share %d is repeated", p.Index)
+		}
+		r, err := blind.NewPointFromBytesUncompressed(p.TokenR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid R point of share %d: %w", p.Index, err)
+		}
+		points[p.Index] = r
+	}
+	return tc.key.CombineSignerR(points)
+}
+
+// CombineBlindSignatures verifies the partial signatures of msgBlinded issued by the
+// nodes for processID and combines them into the blind signature of the root key.
+func (tc *ThresholdCoordinator) CombineBlindSignatures(processID, msgBlinded []byte,
+	partials []types.PartialSignature,
+) ([]byte, error) {
+	saltVersion := saltedkey.DefaultSaltVersion
+	if tc.salts != nil {
+		var err error
+		if saltVersion, err = tc.salts(processID); err != nil {
+			return nil, fmt.Errorf("cannot resolve election salt version: %w", err)
+		}
+	}
+	salt, err := saltedkey.ElectionSalt(saltVersion, processID)
+	if err != nil {
+		return nil, err
+	}
+	signatures := make(map[int][]byte)
+	for _, p := range partials {
+		if _, ok := signatures[p.Index]; ok {
+			return nil, fmt.Errorf("share %d is repeated", p.Index)
+		}
+		r, err := blind.NewPointFromBytesUncompressed(p.TokenR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid R point of share %d: %w", p.Index, err)
+		}
+		if err := tc.key.VerifyPartialBlindSignature(p.Index, salt, msgBlinded, r, p.Signature); err != nil {
+			return nil, err
+		}
+		signatures[p.Index] = p.Signature
+	}
+	return tc.key.CombineBlindSignatures(signatures)
+}
+
+// https://server/v1/threshold/info
+
+// info returns the threshold key public information.
+func (tc *ThresholdCoordinator) info(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	key := &types.ThresholdKey{
+		Threshold: tc.key.Threshold(),
+		Shares:    tc.key.Shares,
+		PubKey:    tc.key.PubKey().Bytes(),
+	}
+	for _, c := range tc.key.Commitments {
+		key.Commitments = append(key.Commitments, c.Bytes())
+	}
+	resp := &types.Message{Threshold: key}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// https://server/v1/threshold/<processId>/token
+
+// token combines the R points issued by the nodes into the R point used for blinding.
+func (tc *ThresholdCoordinator) token(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	req := &types.Message{}
+	if err := req.Unmarshal(msg.Data); err != nil {
+		return err
+	}
+	if _, err := thresholdProcessID(ctx); err != nil {
+		return err
+	}
+	r, err := tc.CombineSignerR(req.Partials)
+	if err != nil {
+		return err
+	}
+	// use Uncompressed for blindsecp256k1-js compatibility
+	resp := &types.Message{TokenR: r.BytesUncompressed()}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+// https://server/v1/threshold/<processId>/sign
+
+// sign verifies and combines the partial signatures of the blinded payload.
+func (tc *ThresholdCoordinator) sign(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	req := &types.Message{}
+	if err := req.Unmarshal(msg.Data); err != nil {
+		return err
+	}
+	if len(req.Payload) == 0 {
+		return fmt.Errorf("message is empty")
+	}
+	pid, err := thresholdProcessID(ctx)
+	if err != nil {
+		return err
+	}
+	resp := &types.Message{}
+	if resp.Signature, err = tc.CombineBlindSignatures(pid, req.Payload, req.Partials); err != nil {
+		return err
+	}
+	return ctx.Send(resp.Marshal(), apirest.HTTPstatusOK)
+}
+
+func thresholdProcessID(ctx *httprouter.HTTPContext) ([]byte, error) {
+	pid, err := hex.DecodeString(trimHex(ctx.URLParam("processId")))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode processId: %w", err)
+	}
+	if len(pid) != processIDSize {
+		return nil, fmt.Errorf("wrong process id: %x", pid)
+	}
+	return pid, nil
+}
@@ -0,0 +1,100 @@
+package csp
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/arnaucube/go-blindsecp256k1"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/httprouter"
+)
+
+func TestThresholdCoordinator(t *testing.T) {
+	signer := ethereum.SignKeys{}
+	err := signer.Generate()
+	qt.Assert(t, err, qt.IsNil)
+	_, priv := signer.HexString()
+
+	// Split the root key among 3 CSP nodes, 2 of them are required for signing
+	root, err := saltedkey.NewSaltedKey(priv)
+	qt.Assert(t, err, qt.IsNil)
+	shares, tk, err := saltedkey.SplitKey(root, 2, 3)
+	qt.Assert(t, err, qt.IsNil)
+	nodes := []*BlindCSP{}
+	for _, share := range shares {
+		node, err := NewBlindCSP(testKeyRing(t, share.Hex()), testMemoryTokenStore(t),
+			BlindCSPcallbacks{Auth: testAuthHandler})
+		qt.Assert(t, err, qt.IsNil)
+		t.Cleanup(node.Close)
+		nodes = append(nodes, node)
+	}
+
+	tc, err := NewThresholdCoordinator(tk)
+	qt.Assert(t, err, qt.IsNil)
+	router := httprouter.HTTProuter{}
+	qt.Assert(t, router.Init("127.0.0.1", 0), qt.IsNil)
+	qt.Assert(t, tc.ServeAPI(&router, "/v1/threshold"), qt.IsNil)
+	url := fmt.Sprintf("http://%s/v1/threshold", router.Address())
+
+	resp, status := testRequest(t, "GET", url+"/info", nil)
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Threshold.Threshold, qt.Equals, 2)
+	qt.Assert(t, resp.Threshold.Shares, qt.Equals, 3)
+	qt.Assert(t, []byte(resp.Threshold.PubKey), qt.DeepEquals, tk.PubKey().Bytes())
+
+	pid := types.HexBytes(randomBytes(processIDSize))
+	hash := ethereum.HashRaw(randomBytes(128))
+
+	// Nodes 1 and 3 issue their R points
+	partials := []types.PartialSignature{}
+	for _, i := range []int{0, 2} {
+		r, err := nodes[i].NewBlindRequestKey(pid)
+		qt.Assert(t, err, qt.IsNil)
+		partials = append(partials, types.PartialSignature{Index: shares[i].Index, TokenR: r.BytesUncompressed()})
+	}
+
+	// A single R point is not enough
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/token", url, pid),
+		&types.Message{Partials: partials[:1]})
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+	resp, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/token", url, pid),
+		&types.Message{Partials: partials})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+	signerR, err := blindsecp256k1.NewPointFromBytesUncompressed(resp.TokenR)
+	qt.Assert(t, err, qt.IsNil)
+
+	// The client blinds with the combined R point and gets the partial signatures
+	m := new(big.Int).SetBytes(hash)
+	msgBlinded, userSecretData, err := blindsecp256k1.Blind(m, signerR)
+	qt.Assert(t, err, qt.IsNil)
+	for j, i := range []int{0, 2} {
+		r, err := blindsecp256k1.NewPointFromBytesUncompressed(partials[j].TokenR)
+		qt.Assert(t, err, qt.IsNil)
+		partials[j].Signature, err = nodes[i].SignBlind(r, msgBlinded.Bytes(), pid)
+		qt.Assert(t, err, qt.IsNil)
+	}
+
+	// A tampered partial signature is rejected
+	tampered := append([]types.PartialSignature{}, partials...)
+	tampered[0].Signature = randomBytes(32)
+	_, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/sign", url, pid),
+		&types.Message{Payload: msgBlinded.Bytes(), Partials: tampered})
+	qt.Assert(t, status, qt.Not(qt.Equals), http.StatusOK)
+
+	resp, status = testRequest(t, "POST", fmt.Sprintf("%s/%s/sign", url, pid),
+		&types.Message{Payload: msgBlinded.Bytes(), Partials: partials})
+	qt.Assert(t, status, qt.Equals, http.StatusOK)
+
+	// The combined signature is valid for the salted root public key
+	signature := blindsecp256k1.Unblind(new(big.Int).SetBytes(resp.Signature), userSecretData)
+	salt, err := saltedkey.ElectionSalt(saltedkey.DefaultSaltVersion, pid)
+	qt.Assert(t, err, qt.IsNil)
+	pubKey, err := saltedkey.BlindPubKeyWithSalt(tk.PubKey(), salt)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, blindsecp256k1.Verify(m, signature, pubKey), qt.IsTrue)
+}
@@ -0,0 +1,151 @@
+package csp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+const (
+	// TokenStorePebble stores the request keys on a local Pebble database.
+	TokenStorePebble = "pebble"
+	// TokenStoreMongoDB stores the request keys on an external MongoDB service,
+	// so they can be shared among several CSP replicas.
+	TokenStoreMongoDB = "mongodb"
+)
+
+// TokenStores is a helper list that includes all available token store backends.
+// The MemoryTokenStore is not available, since the token store keeps durable state
+// (root key bindings, RSA keys, spent tokens...) that must survive a restart.
+var TokenStores = []string{TokenStorePebble, TokenStoreMongoDB}
+
+var (
+	// ErrKeyUnknown is returned when the request key is not found in the token store.
+	ErrKeyUnknown = fmt.Errorf("request key not found")
+	// ErrKeyExpired is returned when the request key TTL is reached before the signature is requested.
+	ErrKeyExpired = fmt.Errorf("request key expired")
+	// ErrKeyMismatch is returned when the request key is redeemed for a different election,
+	// signature type or handler than the ones it was issued for.
+	ErrKeyMismatch = fmt.Errorf("request key issued for a different election or signature type")
+	// ErrTokenSpent is returned when a redeemable token has already been spent.
+	ErrTokenSpent = fmt.Errorf("token already spent")
+	// ErrSignatureUnknown is returned when revoking a signature not issued for the election.
+	ErrSignatureUnknown = fmt.Errorf("signature not issued for the election")
+)
+
+// RequestKey is the data stored for each request key (token) issued to a client.
+type RequestKey struct {
+	K         []byte         `json:"k" bson:"k"`
+	ProcessID types.HexBytes `json:"processId" bson:"processid"`
+	SignType  string         `json:"signType" bson:"signtype"`
+	Handler   string         `json:"handler" bson:"handler"`
+	CreatedAt time.Time      `json:"createdAt" bson:"createdat"`
+	TTL       time.Duration  `json:"ttl" bson:"ttl"`
+}
+
+// Expired returns true if the request key TTL is reached at the given time.
+func (rk *RequestKey) Expired(now time.Time) bool {
+	return now.After(rk.CreatedAt.Add(rk.TTL))
+}
+
+// Matches returns nil if the request key was issued for the processID, signature
+// type and handler provided, else returns ErrKeyMismatch.
+func (rk *RequestKey) Matches(processID []byte, signType, handler string) error {
+	if !bytes.Equal(rk.ProcessID, processID) {
+		return fmt.Errorf("%w: issued for election %x", ErrKeyMismatch, rk.ProcessID)
+	}
+	if rk.SignType != signType {
+		return fmt.Errorf("%w: issued for signature type %s", ErrKeyMismatch, rk.SignType)
+	}
+	if rk.Handler != handler {
+		return fmt.Errorf("%w: issued by handler %s", ErrKeyMismatch, rk.Handler)
+	}
+	return nil
+}
+
+// TokenStore is the storage layer for the request keys issued by the CSP, the
+// authentication sessions, the root key used by each election, the election RSA keys, the spent tokens, the
+// issued (and revoked) signatures and the election transparency logs.
+// Implementations must be safe for concurrent use.
+type TokenStore interface {
+	// Init initializes the token store. The dataDir might be ignored by the
+	// implementations that do not use the local filesystem.
+	Init(dataDir string) (err error)
+	// Add stores a new request key indexed by index.
+	Add(index []byte, rk *RequestKey) (err error)
+	// Consume atomically fetches and removes the request key stored at index, only if
+	// it is not expired and it was issued for processID, signType and handler.
+	// A request key can only be consumed once, even under concurrent calls.
+	Consume(index, processID []byte, signType, handler string) (rk *RequestKey, err error)
+	// PurgeExpired removes all the expired request keys and returns how many were removed.
+	PurgeExpired() (removed int, err error)
+	// AddSession stores the authentication session indexed by authToken.
+	AddSession(authToken []byte, session *AuthSession) (err error)
+	// ConsumeSession atomically fetches and removes the session stored at authToken,
+	// only if it is not expired and it can perform step for processID, signType and
+	// handler (see AuthSession.Check). A session step can only be performed once, even
+	// under concurrent calls.
+	ConsumeSession(authToken, processID []byte, signType, handler string,
+		step int) (session *AuthSession, err error)
+	// PurgeExpiredSessions removes all the expired sessions and returns how many were removed.
+	PurgeExpiredSessions() (removed int, err error)
+	// BindRootKey returns the ID of the root key bound to processID. If the election
+	// has no root key yet, keyID is atomically bound to it and returned. If keyID is
+	// empty, the election key is only looked up (ErrKeyUnknown if it has none).
+	BindRootKey(processID []byte, keyID string) (boundKeyID string, err error)
+	// BindSaltVersion returns the salt version bound to processID. If the election
+	// has no salt version yet, version is atomically bound to it and returned. If
+	// version is zero, the election version is only looked up (ErrKeyUnknown if it has none).
+	BindSaltVersion(processID []byte, version saltedkey.SaltVersion) (bound saltedkey.SaltVersion, err error)
+	// BindRSAKey returns the RSA private key (PKCS#1 DER) of processID. If the election
+	// has no RSA key yet, key is atomically bound to it and returned. If key is nil,
+	// the election key is only looked up (ErrKeyUnknown if it has none).
+	BindRSAKey(processID, key []byte) (boundKey []byte, err error)
+	// Spend atomically marks the token of processID as spent. Returns ErrTokenSpent if
+	// it was already spent. The spent tokens are never removed.
+	Spend(processID, token []byte) (err error)
+	// AddIssued records that a signature of the payload hash was issued for processID.
+	// Recording the same hash again does not modify its revocation status.
+	AddIssued(processID, hash []byte) (err error)
+	// Revoke marks the issued signature of hash on processID as revoked. Returns
+	// ErrSignatureUnknown if it was not issued for the election.
+	Revoke(processID, hash []byte) (err error)
+	// Revoked returns the hashes of the revoked signatures of processID, sorted in
+	// ascending order.
+	Revoked(processID []byte) (hashes [][]byte, err error)
+	// AppendLeaf atomically appends the leaf hash to the transparency log of processID
+	// and returns its index. The log is append-only, the leaves are never removed.
+	AppendLeaf(processID, leaf []byte) (index uint64, err error)
+	// Leaves returns the leaf hashes of the transparency log of processID, ordered by
+	// index.
+	Leaves(processID []byte) (leaves [][]byte, err error)
+}
+
+// electionKey returns the storage key of the entry of processID identified by id.
+// The processID is length prefixed, so the keys of an election are never a prefix of
+// the keys of another election whose ID starts with the same bytes. The keys of all
+// the entries of processID start with electionKey(processID, nil).
+func electionKey(processID, id []byte) []byte {
+	key := binary.AppendUvarint(nil, uint64(len(processID)))
+	key = append(key, processID...)
+	return append(key, id...)
+}
+
+// NewTokenStore returns an initialized token store of the given type.
+// Available types are listed in TokenStores.
+func NewTokenStore(storeType, dataDir string) (TokenStore, error) {
+	var store TokenStore
+	switch storeType {
+	case TokenStorePebble:
+		store = &PebbleTokenStore{}
+	case TokenStoreMongoDB:
+		store = &MongoTokenStore{}
+	default:
+		return nil, fmt.Errorf("unknown token store %q, available: %v", storeType, TokenStores)
+	}
+	return store, store.Init(dataDir)
+}
@@ -0,0 +1,309 @@
+package csp
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/test"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+)
+
+func TestTokenStoreMemory(t *testing.T) {
+	testTokenStore(t, &MemoryTokenStore{})
+}
+
+func TestTokenStorePebble(t *testing.T) {
+	testTokenStore(t, &PebbleTokenStore{})
+}
+
+func TestPebbleLegacyKeys(t *testing.T) {
+	// A database with the request keys of a previous version stored unprefixed
+	database := metadb.NewTest(t)
+	rootKey := append(bytes.Clone(rootKeysPrefix), "pid"...)
+	tx := database.WriteTx()
+	qt.Assert(t, tx.Set([]byte("02abcdef"), []byte{1}), qt.IsNil)
+	qt.Assert(t, tx.Set([]byte("03fedcba"), []byte{2}), qt.IsNil)
+	qt.Assert(t, tx.Set(rootKey, []byte("key1")), qt.IsNil)
+	qt.Assert(t, tx.Commit(), qt.IsNil)
+
+	// The legacy keys are purged, the prefixed ones are kept
+	qt.Assert(t, purgeUnprefixed(database), qt.IsNil)
+	_, err := database.Get([]byte("02abcdef"))
+	qt.Assert(t, err, qt.ErrorIs, db.ErrKeyNotFound)
+	_, err = database.Get([]byte("03fedcba"))
+	qt.Assert(t, err, qt.ErrorIs, db.ErrKeyNotFound)
+	value, err := database.Get(rootKey)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(value), qt.Equals, "key1")
+}
+
+func TestTokenStoreMongoDB(t *testing.T) {
+	ctx := context.Background()
+	container, err := test.StartMongoContainer(ctx)
+	qt.Assert(t, err, qt.IsNil)
+	defer func() { _ = container.Terminate(ctx) }()
+
+	mongoURI, err := container.Endpoint(ctx, "mongodb")
+	qt.Assert(t, err, qt.IsNil)
+
+	_ = os.Setenv("CSP_MONGODB_URL", mongoURI)
+	_ = os.Setenv("CSP_DATABASE", test.RandomDatabaseName())
+
+	testTokenStore(t, &MongoTokenStore{})
+}
+
+func testTokenStore(t *testing.T, store TokenStore) {
+	qt.Assert(t, store.Init(t.TempDir()), qt.IsNil)
+
+	pid := types.HexBytes(randomBytes(processIDSize))
+	newKey := func(ttl time.Duration) *RequestKey {
+		return &RequestKey{
+			K:         randomBytes(32),
+			ProcessID: pid,
+			SignType:  types.SignatureTypeBlind,
+			Handler:   "test",
+			CreatedAt: time.Now(),
+			TTL:       ttl,
+		}
+	}
+
+	// Unknown key
+	_, err := store.Consume([]byte("unknown"), pid, types.SignatureTypeBlind, "test")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyUnknown)
+
+	// Consume a valid key, only the first time
+	rk := newKey(time.Minute)
+	qt.Assert(t, store.Add([]byte("key1"), rk), qt.IsNil)
+	_, err = store.Consume([]byte("key1"), randomBytes(processIDSize), types.SignatureTypeBlind, "test")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyMismatch)
+	_, err = store.Consume([]byte("key1"), pid, types.SignatureTypeEthereum, "test")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyMismatch)
+	_, err = store.Consume([]byte("key1"), pid, types.SignatureTypeBlind, "other")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyMismatch)
+	consumed, err := store.Consume([]byte("key1"), pid, types.SignatureTypeBlind, "test")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, consumed.K, qt.DeepEquals, rk.K)
+	_, err = store.Consume([]byte("key1"), pid, types.SignatureTypeBlind, "test")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyUnknown)
+
+	// Concurrent consumers of the same key, only one succeeds
+	qt.Assert(t, store.Add([]byte("key2"), newKey(time.Minute)), qt.IsNil)
+	var success int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Consume([]byte("key2"), pid, types.SignatureTypeBlind, "test"); err == nil {
+				atomic.AddInt32(&success, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	qt.Assert(t, success, qt.Equals, int32(1))
+
+	// Sessions are consumed once, only for the next step of the same election,
+	// signature type and handler
+	newSession := func(ttl time.Duration) *AuthSession {
+		return &AuthSession{
+			ProcessID: pid,
+			SignType:  types.SignatureTypeBlind,
+			Handler:   "test",
+			LastStep:  0,
+			ExpiresAt: time.Now().Add(ttl),
+		}
+	}
+	_, err = store.ConsumeSession([]byte("session1"), pid, types.SignatureTypeBlind, "test", 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionUnknown)
+	qt.Assert(t, store.AddSession([]byte("session1"), newSession(time.Minute)), qt.IsNil)
+	_, err = store.ConsumeSession([]byte("session1"), randomBytes(processIDSize),
+		types.SignatureTypeBlind, "test", 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionMismatch)
+	_, err = store.ConsumeSession([]byte("session1"), pid, types.SignatureTypeBlind, "other", 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionMismatch)
+	_, err = store.ConsumeSession([]byte("session1"), pid, types.SignatureTypeBlind, "test", 2)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionStep)
+	session, err := store.ConsumeSession([]byte("session1"), pid, types.SignatureTypeBlind, "test", 1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, session.Handler, qt.Equals, "test")
+	_, err = store.ConsumeSession([]byte("session1"), pid, types.SignatureTypeBlind, "test", 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionUnknown)
+	qt.Assert(t, store.AddSession([]byte("session2"), newSession(time.Millisecond*50)), qt.IsNil)
+	qt.Assert(t, store.AddSession([]byte("session3"), newSession(time.Minute)), qt.IsNil)
+	time.Sleep(time.Millisecond * 100)
+	_, err = store.ConsumeSession([]byte("session2"), pid, types.SignatureTypeBlind, "test", 1)
+	qt.Assert(t, err, qt.ErrorIs, ErrSessionExpired)
+	removed, err := store.PurgeExpiredSessions()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, removed, qt.Equals, 1)
+	_, err = store.ConsumeSession([]byte("session3"), pid, types.SignatureTypeBlind, "test", 1)
+	qt.Assert(t, err, qt.IsNil)
+
+	// The first root key bound to an election is kept
+	_, err = store.BindRootKey(pid, "")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyUnknown)
+	keyID, err := store.BindRootKey(pid, "key-a")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, keyID, qt.Equals, "key-a")
+	keyID, err = store.BindRootKey(pid, "key-b")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, keyID, qt.Equals, "key-a")
+	keyID, err = store.BindRootKey(pid, "")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, keyID, qt.Equals, "key-a")
+
+	// The first salt version bound to an election is kept
+	_, err = store.BindSaltVersion(pid, 0)
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyUnknown)
+	version, err := store.BindSaltVersion(pid, saltedkey.SaltVersion2)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, version, qt.Equals, saltedkey.SaltVersion2)
+	version, err = store.BindSaltVersion(pid, saltedkey.SaltVersion1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, version, qt.Equals, saltedkey.SaltVersion2)
+	version, err = store.BindSaltVersion(pid, 0)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, version, qt.Equals, saltedkey.SaltVersion2)
+
+	// Expired keys cannot be consumed and are purged
+	qt.Assert(t, store.Add([]byte("key3"), newKey(time.Millisecond*50)), qt.IsNil)
+	qt.Assert(t, store.Add([]byte("key4"), newKey(time.Millisecond*50)), qt.IsNil)
+	qt.Assert(t, store.Add([]byte("key5"), newKey(time.Minute)), qt.IsNil)
+	time.Sleep(time.Millisecond * 100)
+	_, err = store.Consume([]byte("key3"), pid, types.SignatureTypeBlind, "test")
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyExpired)
+	removed, err = store.PurgeExpired()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, removed, qt.Equals, 2)
+	_, err = store.Consume([]byte("key5"), pid, types.SignatureTypeBlind, "test")
+	qt.Assert(t, err, qt.IsNil)
+
+	// Root key bindings are not affected by the purge
+	keyID, err = store.BindRootKey(pid, "key-b")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, keyID, qt.Equals, "key-a")
+
+	// The first RSA key bound to an election is kept
+	_, err = store.BindRSAKey(pid, nil)
+	qt.Assert(t, err, qt.ErrorIs, ErrKeyUnknown)
+	rsaKey, err := store.BindRSAKey(pid, []byte("rsa-a"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, rsaKey, qt.DeepEquals, []byte("rsa-a"))
+	rsaKey, err = store.BindRSAKey(pid, []byte("rsa-b"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, rsaKey, qt.DeepEquals, []byte("rsa-a"))
+	rsaKey, err = store.BindRSAKey(pid, nil)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, rsaKey, qt.DeepEquals, []byte("rsa-a"))
+
+	// A token can only be spent once per election
+	token := randomBytes(32)
+	qt.Assert(t, store.Spend(pid, token), qt.IsNil)
+	qt.Assert(t, store.Spend(pid, token), qt.ErrorIs, ErrTokenSpent)
+	qt.Assert(t, store.Spend(randomBytes(processIDSize), token), qt.IsNil)
+
+	// Only the issued signatures can be revoked, the revocation is kept if the
+	// signature is issued again
+	hash1, hash2 := randomBytes(32), randomBytes(32)
+	revoked, err := store.Revoked(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, revoked, qt.HasLen, 0)
+	qt.Assert(t, store.Revoke(pid, hash1), qt.ErrorIs, ErrSignatureUnknown)
+	qt.Assert(t, store.AddIssued(pid, hash1), qt.IsNil)
+	qt.Assert(t, store.AddIssued(pid, hash2), qt.IsNil)
+	qt.Assert(t, store.AddIssued(randomBytes(processIDSize), hash2), qt.IsNil)
+	qt.Assert(t, store.Revoke(pid, hash1), qt.IsNil)
+	qt.Assert(t, store.AddIssued(pid, hash1), qt.IsNil)
+	qt.Assert(t, store.Revoke(randomBytes(processIDSize), hash1), qt.ErrorIs, ErrSignatureUnknown)
+	revoked, err = store.Revoked(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, revoked, qt.DeepEquals, [][]byte{hash1})
+
+	// The transparency log leaves are appended in order, per election
+	leaves, err := store.Leaves(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, leaves, qt.HasLen, 0)
+	expected := [][]byte{}
+	for i := 0; i < 3; i++ {
+		leaf := randomBytes(32)
+		index, err := store.AppendLeaf(pid, leaf)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, index, qt.Equals, uint64(i))
+		expected = append(expected, leaf)
+	}
+	index, err := store.AppendLeaf(randomBytes(processIDSize), randomBytes(32))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, index, qt.Equals, uint64(0))
+	leaves, err = store.Leaves(pid)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, leaves, qt.DeepEquals, expected)
+
+	// Concurrent appends get consecutive indexes, without gaps
+	concurrent := randomBytes(processIDSize)
+	indexes := make([]bool, 20)
+	var mu sync.Mutex
+	for i := 0; i < len(indexes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			index, err := store.AppendLeaf(concurrent, randomBytes(32))
+			if err != nil || index >= uint64(len(indexes)) {
+				t.Errorf("unexpected append result: %d, %v", index, err)
+				return
+			}
+			mu.Lock()
+			indexes[index] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for i, ok := range indexes {
+		qt.Assert(t, ok, qt.IsTrue, qt.Commentf("index %d", i))
+	}
+	leaves, err = store.Leaves(concurrent)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, leaves, qt.HasLen, len(indexes))
+
+	// The revoked hashes are sorted
+	qt.Assert(t, store.Revoke(pid, hash2), qt.IsNil)
+	revoked, err = store.Revoked(pid)
+	qt.Assert(t, err, qt.IsNil)
+	if bytes.Compare(hash1, hash2) > 0 {
+		hash1, hash2 = hash2, hash1
+	}
+	qt.Assert(t, revoked, qt.DeepEquals, [][]byte{hash1, hash2})
+
+	// The entries of an election are not visible from an election whose ID is a
+	// prefix of it, nor the other way around
+	short := randomBytes(processIDSize)
+	long := append(bytes.Clone(short), 0xff)
+	token = randomBytes(32)
+	qt.Assert(t, store.Spend(short, append([]byte{0xff}, token...)), qt.IsNil)
+	qt.Assert(t, store.Spend(long, token), qt.IsNil)
+	hash := randomBytes(32)
+	qt.Assert(t, store.AddIssued(long, hash), qt.IsNil)
+	qt.Assert(t, store.Revoke(long, hash), qt.IsNil)
+	qt.Assert(t, store.Revoke(short, append([]byte{0xff}, hash...)), qt.ErrorIs, ErrSignatureUnknown)
+	revoked, err = store.Revoked(short)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, revoked, qt.HasLen, 0)
+	_, err = store.AppendLeaf(long, randomBytes(32))
+	qt.Assert(t, err, qt.IsNil)
+	leaves, err = store.Leaves(short)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, leaves, qt.HasLen, 0)
+	_, err = store.AppendLeaf(short, randomBytes(32))
+	qt.Assert(t, err, qt.IsNil)
+	leaves, err = store.Leaves(long)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, leaves, qt.HasLen, 1)
+}
@@ -0,0 +1,138 @@
+package csp
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/vocdoni/blind-csp/receipt"
+	"github.com/vocdoni/blind-csp/translog"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+// appendLog appends the leaf of the signature of signType over data (the blinded
+// message or the payload) to the transparency log of processID.
+func (csp *BlindCSP) appendLog(processID []byte, signType string, data []byte) error {
+	_, err := csp.keys.AppendLeaf(processID, translog.LeafHash(signType, data))
+	return err
+}
+
+// LogSize returns the number of signatures issued for processID, as recorded on the
+// transparency log.
+func (csp *BlindCSP) LogSize(processID []byte) (uint64, error) {
+	leaves, err := csp.keys.Leaves(processID)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(leaves)), nil
+}
+
+// TreeHead returns the current head of the transparency log of processID, signed with
+// the election salted ECDSA key (see receipt.VerifyTreeHead).
+func (csp *BlindCSP) TreeHead(processID []byte) (*types.TreeHead, error) {
+	leaves, err := csp.keys.Leaves(processID)
+	if err != nil {
+		return nil, err
+	}
+	return csp.signTreeHead(processID, leaves)
+}
+
+// InclusionProof returns the current tree head of the transparency log of processID
+// and the inclusion proof of leafHash (see translog.LeafHash) on it.
+func (csp *BlindCSP) InclusionProof(processID, leafHash []byte) (*types.TreeHead, *types.LogProof, error) {
+	leaves, err := csp.keys.Leaves(processID)
+	if err != nil {
+		return nil, nil, err
+	}
+	index := -1
+	for i := range leaves {
+		if bytes.Equal(leaves[i], leafHash) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, nil, fmt.Errorf("leaf not found on the election log")
+	}
+	path, err := translog.InclusionProof(leaves, uint64(index))
+	if err != nil {
+		return nil, nil, err
+	}
+	th, err := csp.signTreeHead(processID, leaves)
+	if err != nil {
+		return nil, nil, err
+	}
+	return th, &types.LogProof{
+		TreeSize:  th.Size,
+		LeafIndex: uint64(index),
+		LeafHash:  leafHash,
+		Path:      hexPath(path),
+	}, nil
+}
+
+// ConsistencyProof returns the current tree head of the transparency log of processID
+// and the proof that the log of its first size leaves is a prefix of it.
+func (csp *BlindCSP) ConsistencyProof(processID []byte, size uint64) (*types.TreeHead, *types.LogProof, error) {
+	leaves, err := csp.keys.Leaves(processID)
+	if err != nil {
+		return nil, nil, err
+	}
+	path, err := translog.ConsistencyProof(leaves, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	th, err := csp.signTreeHead(processID, leaves)
+	if err != nil {
+		return nil, nil, err
+	}
+	return th, &types.LogProof{
+		TreeSize: th.Size,
+		FromSize: size,
+		Path:     hexPath(path),
+	}, nil
+}
+
+// signTreeHead returns the tree head of the log leaves of processID.
+func (csp *BlindCSP) signTreeHead(processID []byte, leaves [][]byte) (*types.TreeHead, error) {
+	rk, err := csp.lookupRootKey(processID)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, err := rootKeyInfo(rk)
+	if err != nil {
+		return nil, err
+	}
+	saltVersion, err := csp.SaltVersion(processID)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := csp.electionSalt(processID)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := receipt.SaltedPubKey(rootKey, saltVersion, processID, types.SignatureTypeEthereum)
+	if err != nil {
+		return nil, err
+	}
+	th := &types.TreeHead{
+		ElectionID:  processID,
+		KeyID:       rk.ID,
+		SaltVersion: uint32(saltVersion),
+		PubKey:      pubKey,
+		Size:        uint64(len(leaves)),
+		RootHash:    translog.RootHash(leaves),
+		Timestamp:   time.Now().Unix(),
+	}
+	if th.Signature, err = rk.SignECDSAWithSalt(salt, th.SignedData()); err != nil {
+		return nil, err
+	}
+	return th, nil
+}
+
+func hexPath(path [][]byte) []types.HexBytes {
+	h := make([]types.HexBytes, len(path))
+	for i := range path {
+		h[i] = path[i]
+	}
+	return h
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/httprouter"
+	"go.vocdoni.io/dvote/log"
+)
+
+// ChainSeparator is the character used to join the handler names of a chain,
+// i.e sms+idCat.
+const ChainSeparator = "+"
+
+// ChainHandler is a composite handler that runs several handlers in sequence.
+// The client must pass the authentication of all of them (in order) for getting
+// the signature token. The steps of the handlers are mapped to a single global
+// numbering, so the steps of the second handler follow the last step of the first.
+// The chain progress is kept on the CSP auth session (types.AuthResponse.SessionState),
+// which also binds it to the election and signature type and expires it.
+type ChainHandler struct {
+	handlers []AuthHandler
+}
+
+// chainState tracks which handler (and handler step) of the chain a client is on.
+type chainState struct {
+	// Handler is the index of the handler currently being executed
+	Handler int `json:"handler"`
+	// Offset is the global step where the current handler started
+	Offset int `json:"offset"`
+	// Token is the authToken issued by the current handler (if any)
+	Token *uuid.UUID `json:"token,omitempty"`
+	// Quota is the smallest blind signature quota of the handlers already completed
+	Quota int `json:"quota"`
+}
+
+// NewChainHandler returns a handler that executes the given handlers in order.
+// The blind signature quota granted by the chain is the smallest one of its handlers.
+func NewChainHandler(handlers ...AuthHandler) (*ChainHandler, error) {
+	if len(handlers) < 2 {
+		return nil, fmt.Errorf("a handler chain requires at least two handlers")
+	}
+	names := make(map[string]bool)
+	for _, h := range handlers {
+		if h == nil {
+			return nil, fmt.Errorf("nil handler in chain")
+		}
+		if names[h.Name()] {
+			return nil, fmt.Errorf("handler %s is repeated in the chain", h.Name())
+		}
+		names[h.Name()] = true
+	}
+	return &ChainHandler{handlers: handlers}, nil
+}
+
+// Init initializes all the handlers of the chain. The first option is the data
+// directory, each handler gets its own subdirectory. The rest of options are
+// passed to all handlers.
+func (ch *ChainHandler) Init(r *httprouter.HTTProuter, baseURL string, opts ...string) error {
+	if len(opts) == 0 {
+		return fmt.Errorf("no data dir provided")
+	}
+	for _, h := range ch.handlers {
+		hopts := append([]string{filepath.Join(opts[0], h.Name())}, opts[1:]...)
+		if err := h.Init(r, baseURL, hopts...); err != nil {
+			return fmt.Errorf("cannot initialize handler %s: %w", h.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the handler, built with the names of the chained handlers.
+func (ch *ChainHandler) Name() string {
+	names := []string{}
+	for _, h := range ch.handlers {
+		names = append(names, h.Name())
+	}
+	return strings.Join(names, ChainSeparator)
+}
+
+// Info returns the handler options and required auth steps. The auth steps of
+// all handlers are merged and only the signature types supported by all of them
+// are returned.
+func (ch *ChainHandler) Info() *types.Message {
+	titles := []string{}
+	signTypes := types.AllSignatures
+	steps := []*types.AuthField{}
+	for _, h := range ch.handlers {
+		info := h.Info()
+		if info == nil {
+			continue
+		}
+		titles = append(titles, info.Title)
+		steps = append(steps, info.AuthSteps...)
+		supported := []string{}
+		for _, st := range signTypes {
+			for _, hst := range info.SignType {
+				if st == hst {
+					supported = append(supported, st)
+					break
+				}
+			}
+		}
+		signTypes = supported
+	}
+	return &types.Message{
+		Title:     strings.Join(titles, " + "),
+		AuthType:  "auth",
+		SignType:  signTypes,
+		AuthSteps: steps,
+	}
+}
+
+// Indexer returns the elections where the user is elegible for all the handlers
+// of the chain implementing an indexer.
+func (ch *ChainHandler) Indexer(userID types.HexBytes) []types.Election {
+	var elections []types.Election
+	indexed := false
+	for _, h := range ch.handlers {
+		hElections := h.Indexer(userID)
+		if hElections == nil {
+			continue
+		}
+		if !indexed {
+			elections = hElections
+			indexed = true
+			continue
+		}
+		common := []types.Election{}
+		for _, e := range elections {
+			for _, he := range hElections {
+				if bytes.Equal(e.ElectionID, he.ElectionID) {
+					common = append(common, e)
+					break
+				}
+			}
+		}
+		elections = common
+	}
+	return elections
+}
+
+// Auth executes the global step on the handler of the chain it belongs to.
+// An authToken is returned until the last handler of the chain succeeds.
+func (ch *ChainHandler) Auth(r *http.Request,
+	c *types.Message, pid types.HexBytes, signType string, step int,
+) types.AuthResponse {
+	state := &chainState{}
+	if step > 0 {
+		if err := json.Unmarshal(c.SessionState, state); err != nil {
+			return types.AuthResponse{Response: []string{"auth session state not found"}}
+		}
+		if state.Handler < 0 || state.Handler >= len(ch.handlers) || step < state.Offset {
+			return types.AuthResponse{Response: []string{"invalid auth session state"}}
+		}
+	}
+
+	// Execute the current handler with its own authToken and step
+	handler := ch.handlers[state.Handler]
+	hmsg := *c
+	hmsg.AuthToken = state.Token
+	hmsg.SessionState = nil
+	resp := handler.Auth(r, &hmsg, pid, signType, step-state.Offset)
+	if !resp.Success {
+		// The CSP keeps the session so the client can retry the step
+		return resp
+	}
+
+	if resp.AuthToken != nil {
+		// The current handler requires more steps
+		state.Token = resp.AuthToken
+	} else {
+		if state.Handler == 0 || resp.Quota < state.Quota {
+			state.Quota = resp.Quota
+		}
+		if state.Handler == len(ch.handlers)-1 {
+			// All handlers succeeded, authentication finished
+			resp.Quota = state.Quota
+			return resp
+		}
+		log.Debugf("chain handler %s completed on step %d", handler.Name(), step)
+		state.Handler++
+		state.Offset = step + 1
+		state.Token = nil
+	}
+	sessionState, err := json.Marshal(state)
+	if err != nil {
+		return types.AuthResponse{Response: []string{"cannot encode auth session state"}}
+	}
+	token := uuid.New()
+	resp.AuthToken = &token
+	resp.SessionState = sessionState
+	return resp
+}
+
+// RequireCertificate returns true if any handler of the chain requires a client
+// TLS certificate.
+func (ch *ChainHandler) RequireCertificate() bool {
+	for _, h := range ch.handlers {
+		if h.RequireCertificate() {
+			return true
+		}
+	}
+	return false
+}
+
+// CertificateCheck returns true if all the handlers requiring a certificate accept
+// the subject (and at least one of them requires it).
+func (ch *ChainHandler) CertificateCheck(subject []byte) bool {
+	required := false
+	for _, h := range ch.handlers {
+		if !h.RequireCertificate() {
+			continue
+		}
+		if !h.CertificateCheck(subject) {
+			return false
+		}
+		required = true
+	}
+	return required
+}
+
+// Certificates returns the CA certificates of all the handlers of the chain.
+func (ch *ChainHandler) Certificates() [][]byte {
+	var certs [][]byte
+	for _, h := range ch.handlers {
+		certs = append(certs, h.Certificates()...)
+	}
+	return certs
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+func TestChainHandler(t *testing.T) {
+	_, err := NewChainHandler(&DummyHandler{})
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	_, err = NewChainHandler(&DummyHandler{}, &DummyHandler{})
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+
+	ch, err := NewChainHandler(&SimpleMathHandler{}, &DummyHandler{})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, ch.Init(nil, "/v1", t.TempDir()), qt.IsNil)
+	qt.Assert(t, ch.Name(), qt.Equals, "simpleMath+dummy")
+	qt.Assert(t, ch.Info().AuthSteps, qt.HasLen, 3)
+
+	r := httptest.NewRequest("POST", "/", nil)
+	pid := types.HexBytes{0x01, 0x02, 0x03}
+
+	// Step 0: simpleMath challenge
+	resp := ch.Auth(r, &types.Message{AuthData: []string{"John"}}, pid, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	qt.Assert(t, resp.AuthToken, qt.Not(qt.IsNil))
+	qt.Assert(t, resp.Response, qt.HasLen, 2)
+	r1, err := strconv.Atoi(resp.Response[0])
+	qt.Assert(t, err, qt.IsNil)
+	r2, err := strconv.Atoi(resp.Response[1])
+	qt.Assert(t, err, qt.IsNil)
+
+	// The chain state is provided by the CSP auth session
+	qt.Assert(t, resp.SessionState, qt.Not(qt.HasLen), 0)
+	resp2 := ch.Auth(r, &types.Message{AuthToken: resp.AuthToken, AuthData: []string{strconv.Itoa(r1 + r2)}},
+		pid, types.SignatureTypeBlind, 1)
+	qt.Assert(t, resp2.Success, qt.IsFalse)
+
+	// Step 1: a wrong solution can be retried with the same session state
+	token, state := resp.AuthToken, resp.SessionState
+	resp = ch.Auth(r, &types.Message{AuthToken: token, SessionState: state, AuthData: []string{"0"}},
+		pid, types.SignatureTypeBlind, 1)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+	resp = ch.Auth(r, &types.Message{AuthToken: token, SessionState: state, AuthData: []string{strconv.Itoa(r1 + r2)}},
+		pid, types.SignatureTypeBlind, 1)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+
+	// simpleMath finished but the chain is not, so a new authToken is returned
+	qt.Assert(t, resp.AuthToken, qt.Not(qt.IsNil))
+	qt.Assert(t, *resp.AuthToken, qt.Not(qt.Equals), *token)
+
+	// Step 2: dummy handler, the authentication is finished
+	resp = ch.Auth(r, &types.Message{AuthToken: resp.AuthToken, SessionState: resp.SessionState,
+		AuthData: []string{"John"}}, pid, types.SignatureTypeBlind, 2)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	qt.Assert(t, resp.AuthToken, qt.IsNil)
+	// simpleMath does not grant more than one blind signature
+	qt.Assert(t, resp.Quota, qt.Equals, 0)
+}
+
+func TestChainHandlerQuota(t *testing.T) {
+	ch, err := NewChainHandler(&DummyHandler{}, &quotaHandler{quota: 3})
+	qt.Assert(t, err, qt.IsNil)
+	r := httptest.NewRequest("POST", "/", nil)
+	pid := types.HexBytes{0x01, 0x02, 0x03}
+
+	resp := ch.Auth(r, &types.Message{}, pid, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	resp = ch.Auth(r, &types.Message{AuthToken: resp.AuthToken, SessionState: resp.SessionState},
+		pid, types.SignatureTypeBlind, 1)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	qt.Assert(t, resp.AuthToken, qt.IsNil)
+	// The smallest quota of the chain is granted
+	qt.Assert(t, resp.Quota, qt.Equals, 3)
+}
+
+// quotaHandler is a dummy handler granting a custom blind signature quota.
+type quotaHandler struct {
+	DummyHandler
+	quota int
+}
+
+func (qh *quotaHandler) Name() string {
+	return "quota"
+}
+
+func (qh *quotaHandler) Auth(r *http.Request,
+	ca *types.Message, pid types.HexBytes, signType string, step int,
+) types.AuthResponse {
+	return types.AuthResponse{Success: true, Quota: qh.quota}
+}
+
+func TestChainHandlerCertificate(t *testing.T) {
+	ch, err := NewChainHandler(&DummyHandler{}, &certHandler{name: "certA", subject: "alice"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, ch.RequireCertificate(), qt.IsTrue)
+	qt.Assert(t, ch.CertificateCheck([]byte("alice")), qt.IsTrue)
+	qt.Assert(t, ch.CertificateCheck([]byte("bob")), qt.IsFalse)
+
+	// All the handlers requiring a certificate must accept the subject
+	ch, err = NewChainHandler(&certHandler{name: "certA", subject: "alice"},
+		&DummyHandler{}, &certHandler{name: "certB", subject: "bob"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, ch.CertificateCheck([]byte("alice")), qt.IsFalse)
+	qt.Assert(t, ch.CertificateCheck([]byte("bob")), qt.IsFalse)
+
+	// A chain without any handler requiring a certificate does not accept any
+	ch, err = NewChainHandler(&DummyHandler{}, &quotaHandler{quota: 3})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, ch.RequireCertificate(), qt.IsFalse)
+	qt.Assert(t, ch.CertificateCheck([]byte("alice")), qt.IsFalse)
+}
+
+// certHandler is a dummy handler requiring a client certificate with a subject.
+type certHandler struct {
+	DummyHandler
+	name    string
+	subject string
+}
+
+func (ch *certHandler) Name() string {
+	return ch.name
+}
+
+func (ch *certHandler) RequireCertificate() bool {
+	return true
+}
+
+func (ch *certHandler) CertificateCheck(subject []byte) bool {
+	return string(subject) == ch.subject
+}
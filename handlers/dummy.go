@@ -10,6 +10,10 @@ import (
 	"go.vocdoni.io/dvote/log"
 )
 
+// DummyHandlerQuota is the number of blind signatures granted by the dummy handler
+// for a single authentication.
+const DummyHandlerQuota = 10
+
 // DummyHandler is a handler for testing that returns always true
 type DummyHandler struct{}
 
@@ -53,6 +57,7 @@ func (dh *DummyHandler) Auth(r *http.Request,
 		Success:   true,
 		Response:  []string{fmt.Sprintf("welcome to process %s!", pid)},
 		AuthToken: nil, // make authToken nil explicit, so the auth process is considered ended
+		Quota:     DummyHandlerQuota,
 	}
 }
 
@@ -0,0 +1,293 @@
+// Package emailhandler implements an authentication handler that sends a one time
+// code (OTP) to the user email, modelled on the smshandler.
+package emailhandler
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/httprouter"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultMaxEmailAttempts defines the default maximum number of email attempts.
+	DefaultMaxEmailAttempts = 5
+	// DefaultEmailCoolDownTime defines the default cool down time window for sending challenges.
+	DefaultEmailCoolDownTime = 2 * time.Minute
+	// DefaultEmailThrottleTime is the default throttle time between emails.
+	DefaultEmailThrottleTime = time.Millisecond * 200
+	// DefaultEmailQueueMaxRetries is how many times to retry delivering an email in case
+	// the SMTP server returns an error.
+	DefaultEmailQueueMaxRetries = 10
+)
+
+// SendChallengeFunc is the function that sends the challenge to an email address.
+type SendChallengeFunc func(email string, challenge int) error
+
+// EmailHandler is a handler that sends a challenge code to the user email.
+type EmailHandler struct {
+	stg        Storage
+	queue      *emailQueue
+	mathRandom *rand.Rand
+	// SendChallenge sends the challenges, if nil an SMTPSender configured from the
+	// environment is used (see NewSMTPSender).
+	SendChallenge SendChallengeFunc
+}
+
+// Name returns the name for the handler.
+func (eh *EmailHandler) Name() string {
+	return "emailHandler"
+}
+
+// Init initializes the handler.
+// First argument is the data directory (mandatory).
+// Second is the maximum email challenge attempts per user and election.
+// Third is the email cooldown time in milliseconds (optional).
+// Fourth is the email throttle time in milliseconds (optional).
+func (eh *EmailHandler) Init(r *httprouter.HTTProuter, baseURL string, opts ...string) error {
+	if len(opts) == 0 {
+		return fmt.Errorf("no data dir provided")
+	}
+	var err error
+	maxAttempts := DefaultMaxEmailAttempts
+	if len(opts) > 1 {
+		maxAttempts, err = strconv.Atoi(opts[1])
+		if err != nil {
+			return err
+		}
+	}
+	coolDownTime := DefaultEmailCoolDownTime
+	if len(opts) > 2 {
+		ms, err := strconv.Atoi(opts[2])
+		if err != nil {
+			return err
+		}
+		coolDownTime = time.Millisecond * time.Duration(ms)
+	}
+	throttle := DefaultEmailThrottleTime
+	if len(opts) > 3 {
+		ms, err := strconv.Atoi(opts[3])
+		if err != nil {
+			return err
+		}
+		throttle = time.Millisecond * time.Duration(ms)
+	}
+	if coolDownTime < throttle {
+		return fmt.Errorf("email cooldown time cannot be smaller than email throttle")
+	}
+
+	eh.stg = &JSONstorage{}
+	eh.mathRandom = rand.New(rand.NewSource(time.Now().UnixNano()))
+	if err := eh.stg.Init(filepath.Join(opts[0], "emailstorage"), maxAttempts, coolDownTime); err != nil {
+		return err
+	}
+
+	if eh.SendChallenge == nil {
+		sender, err := NewSMTPSender()
+		if err != nil {
+			return err
+		}
+		eh.SendChallenge = sender.SendChallenge
+	}
+
+	// check for files to import to the storage database
+	if importFile := os.Getenv("EMAIL_IMPORT_FILE"); importFile != "" {
+		if err := eh.importCSVfile(importFile); err != nil {
+			return err
+		}
+	}
+
+	eh.queue = newEmailQueue(coolDownTime, throttle, eh.SendChallenge)
+	go eh.queue.run()
+	go eh.queueController()
+	return nil
+}
+
+// queueController decreases the remaining attempts when the challenge is sent.
+func (eh *EmailHandler) queueController() {
+	for {
+		r := <-eh.queue.response
+		if r.success {
+			if err := eh.stg.SetAttempts(r.userID, r.electionID, -1); err != nil {
+				log.Warnf("challenge cannot be sent: %v", err)
+			} else {
+				log.Infof("%s: challenge successfully sent to user %s", r, r.userID)
+			}
+		} else {
+			log.Warnf("%s: challenge sending failed", r)
+		}
+	}
+}
+
+// CSV file must follow the format:
+// userId, email, extraInfo, electionID1, electionID2, ..., electionIDn
+func (eh *EmailHandler) importCSVfile(file string) error {
+	log.Infof("importing CSV file %s", file)
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return err
+	}
+	for i, line := range data {
+		if len(line) < 4 {
+			log.Warnf("wrong CSV entry (missing fields): %s", line)
+			continue
+		}
+		userID := types.HexBytes{}
+		if err := userID.FromString(line[0]); err != nil {
+			log.Warnf("wrong data field at line %d", i)
+			continue
+		}
+		electionIDs := []types.HexBytes{}
+		for _, eid := range line[3:] {
+			eidh := types.HexBytes{}
+			if err := eidh.FromString(eid); err != nil {
+				log.Warnf("wrong electionID at line %d", i)
+				continue
+			}
+			electionIDs = append(electionIDs, eidh)
+		}
+		if err := eh.stg.AddUser(userID, electionIDs, line[1], line[2]); err != nil {
+			log.Warnf("cannot add user from line %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Info returns the handler options and information.
+func (eh *EmailHandler) Info() *types.Message {
+	return &types.Message{
+		Title:    "Email code handler",
+		AuthType: "auth",
+		SignType: []string{types.SignatureTypeBlind},
+		AuthSteps: []*types.AuthField{
+			{Title: "UserId", Type: "text"},
+			{Title: "Code", Type: "int4"},
+		},
+	}
+}
+
+// Indexer takes a unique user identifier and returns the list of processIDs where
+// the user is elegible for participation, with the masked email as extraData.
+func (eh *EmailHandler) Indexer(userID types.HexBytes) []types.Election {
+	user, err := eh.stg.User(userID)
+	if err != nil {
+		log.Warnf("cannot get indexer elections: %v", err)
+		return nil
+	}
+	indexerElections := []types.Election{}
+	for _, e := range user.Elections {
+		indexerElections = append(indexerElections, types.Election{
+			RemainingAttempts: e.RemainingAttempts,
+			Consumed:          e.Consumed,
+			ElectionID:        e.ElectionID,
+			ExtraData:         []string{maskEmail(user.Email)},
+		})
+	}
+	return indexerElections
+}
+
+// Auth is the handler method for managing the email authentication challenge.
+func (eh *EmailHandler) Auth(r *http.Request, c *types.Message,
+	electionID types.HexBytes, signType string, step int,
+) types.AuthResponse {
+	if signType != types.SignatureTypeBlind {
+		return types.AuthResponse{Response: []string{"incorrect signature type, only blind supported"}}
+	}
+	switch step {
+	case 0:
+		if len(c.AuthData) != 1 {
+			return types.AuthResponse{Response: []string{"incorrect auth data fields"}}
+		}
+		var userID types.HexBytes
+		if err := userID.FromString(c.AuthData[0]); err != nil {
+			return types.AuthResponse{Response: []string{"incorrect format for userId"}}
+		}
+
+		// Generate challenge and authentication token
+		challenge := eh.mathRandom.Intn(900000) + 100000
+		atoken := uuid.New()
+
+		// Get the email. This methods checks for electionID and user verification status.
+		email, err := eh.stg.NewAttempt(userID, electionID, challenge, &atoken)
+		if err != nil {
+			log.Warnf("new attempt for user %s failed: %v", userID, err)
+			return types.AuthResponse{Response: []string{err.Error()}}
+		}
+		if email == "" {
+			log.Warnf("email is empty for user %s", userID)
+			return types.AuthResponse{Response: []string{"no email for this user data"}}
+		}
+		if err := eh.queue.add(userID, electionID, email, challenge); err != nil {
+			log.Errorf("cannot enqueue challenge: %v", err)
+			return types.AuthResponse{Response: []string{"problem with email challenge system"}}
+		}
+		log.Infof("user %s challenged at email %s", userID, maskEmail(email))
+		return types.AuthResponse{
+			Success:   true,
+			AuthToken: &atoken,
+			Response:  []string{maskEmail(email)},
+		}
+	case 1:
+		if c.AuthToken == nil || len(c.AuthData) != 1 {
+			return types.AuthResponse{Response: []string{"auth token not provided or missing auth data"}}
+		}
+		solution, err := strconv.Atoi(c.AuthData[0])
+		if err != nil {
+			return types.AuthResponse{Response: []string{"wrong format in challenge solution"}}
+		}
+		if err := eh.stg.VerifyChallenge(electionID, c.AuthToken, solution); err != nil {
+			log.Warnf("verify challenge failed: %v", err)
+			return types.AuthResponse{Response: []string{"challenge not completed"}}
+		}
+		log.Infof("new user registered, challenge resolved")
+		return types.AuthResponse{
+			Response: []string{"challenge resolved"},
+			Success:  true,
+		}
+	}
+	return types.AuthResponse{Response: []string{"invalid auth step"}}
+}
+
+// maskEmail returns the email with the local part hidden but its first character,
+// i.e j***@example.com
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return ""
+	}
+	return local[:1] + "***@" + domain
+}
+
+// RequireCertificate must return true if the auth handler requires some kind of client
+// TLS certificate. If true then CertificateCheck() and HardcodedCertificate() methods
+// must be correctly implemented. Else both function can just return true and nil.
+func (eh *EmailHandler) RequireCertificate() bool {
+	return false
+}
+
+// CertificateCheck is used by the Auth handler to ensure a specific certificate is
+// added to the CA cert pool on the HTTP/TLS layer (optional).
+func (eh *EmailHandler) CertificateCheck(subject []byte) bool {
+	return true
+}
+
+// Certificates returns a hardcoded CA certificated that will be added to the
+// CA cert pool by the handler (optional).
+func (eh *EmailHandler) Certificates() [][]byte {
+	return nil
+}
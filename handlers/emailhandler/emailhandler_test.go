@@ -0,0 +1,212 @@
+package emailhandler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/test"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+var (
+	testUser1     = test.StrToHex("6c0b6e1020b6354c714fc65aa198eb95e663f038e32026671c58677e0e0f8eac")
+	testUser2     = test.StrToHex("bf5b6a9c69a5abee870b3667e92c589ef9c13458be0fc0493b2ba5a9658c690b")
+	testElection1 = test.StrToHex("c3095ff57150285cccf880e712e353a16251de6670f7aa1b069e6416cb641f5a")
+	testElection2 = test.StrToHex("7ad9ef89d38a0e55cd8eb6b5f532d34c9ea8d4fe630e0d29247aa94e2e854402")
+)
+
+func TestEmailHandler(t *testing.T) {
+	challenge := test.NewChallengeMock()
+	eh := EmailHandler{SendChallenge: func(email string, c int) error {
+		challenge.Add(email, c)
+		return nil
+	}}
+	last := func(email string) int {
+		solution, err := challenge.Last(email, time.Second)
+		qt.Assert(t, err, qt.IsNil)
+		return solution
+	}
+	// MaxAttempts:2 CoolDown:200ms Throttle:5ms
+	qt.Assert(t, eh.Init(nil, "", t.TempDir(), "2", "200", "5"), qt.IsNil)
+	qt.Assert(t, eh.stg.AddUser(testUser1, []types.HexBytes{testElection1}, "john@example.com", ""), qt.IsNil)
+	qt.Assert(t, eh.stg.AddUser(testUser2, []types.HexBytes{testElection2}, "Jane <jane@example.com>", ""), qt.IsNil)
+	qt.Assert(t, eh.stg.AddUser(testUser2, nil, "not an email", ""), qt.Not(qt.IsNil))
+
+	// first attempt (should work), the masked email is returned
+	msg := types.Message{AuthData: []string{testUser1.String()}}
+	resp := eh.Auth(nil, &msg, testElection1, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	qt.Assert(t, resp.Response, qt.DeepEquals, []string{"j***@example.com"})
+
+	// attempt (should fail because of cooldown time)
+	resp = eh.Auth(nil, &msg, testElection1, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+
+	// wrong solution, the token is consumed
+	time.Sleep(200 * time.Millisecond)
+	resp = eh.Auth(nil, &msg, testElection1, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	solution := last("john@example.com")
+	msg.AuthToken = resp.AuthToken
+	msg.AuthData = []string{fmt.Sprintf("%d", solution+1)}
+	resp = eh.Auth(nil, &msg, testElection1, types.SignatureTypeBlind, 1)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+	msg.AuthData = []string{fmt.Sprintf("%d", solution)}
+	resp = eh.Auth(nil, &msg, testElection1, types.SignatureTypeBlind, 1)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+
+	// no attempts left
+	time.Sleep(200 * time.Millisecond)
+	msg = types.Message{AuthData: []string{testUser1.String()}}
+	resp = eh.Auth(nil, &msg, testElection1, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+	elections := eh.Indexer(testUser1)
+	qt.Assert(t, elections, qt.HasLen, 1)
+	qt.Assert(t, elections[0].RemainingAttempts, qt.Equals, 0)
+
+	// second user solves the challenge
+	msg = types.Message{AuthData: []string{testUser2.String()}}
+	resp = eh.Auth(nil, &msg, testElection1, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+	resp = eh.Auth(nil, &msg, testElection2, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsTrue)
+	msg.AuthToken = resp.AuthToken
+	msg.AuthData = []string{fmt.Sprintf("%d", last("jane@example.com"))}
+	resp = eh.Auth(nil, &msg, testElection2, types.SignatureTypeBlind, 1)
+	qt.Assert(t, resp.Success, qt.IsTrue, qt.Commentf("%s", resp.Response))
+	elections = eh.Indexer(testUser2)
+	qt.Assert(t, elections[0].Consumed, qt.IsTrue)
+	qt.Assert(t, elections[0].ExtraData, qt.DeepEquals, []string{"j***@example.com"})
+
+	// consumed, a new attempt fails
+	time.Sleep(200 * time.Millisecond)
+	msg = types.Message{AuthData: []string{testUser2.String()}}
+	resp = eh.Auth(nil, &msg, testElection2, types.SignatureTypeBlind, 0)
+	qt.Assert(t, resp.Success, qt.IsFalse)
+}
+
+// smtpStandIn is a minimal SMTP server that stores the received messages.
+type smtpStandIn struct {
+	listener net.Listener
+	messages chan []byte
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	s := &smtpStandIn{listener: l, messages: make(chan []byte, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			var data []byte
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data = append(data, strings.TrimPrefix(l, ".")...)
+			}
+			s.messages <- data
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	server := newSMTPStandIn(t)
+	t.Setenv("SMTP_SERVER", server.listener.Addr().String())
+	t.Setenv("SMTP_USERNAME", "")
+	t.Setenv("EMAIL_FROM", "Vocdoni <noreply@vocdoni.io>")
+	t.Setenv("EMAIL_SUBJECT", "Código de votación")
+	t.Setenv("EMAIL_TEMPLATE_HTML", "")
+	t.Setenv("EMAIL_TEMPLATE_TEXT", "")
+	sender, err := NewSMTPSender()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, sender.SendChallenge("john@example.com", 123456), qt.IsNil)
+
+	var data []byte
+	select {
+	case data = <-server.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, msg.Header.Get("To"), qt.Equals, "john@example.com")
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, subject, qt.Equals, "Código de votación")
+
+	// Both the plain-text and the HTML bodies include the code
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, mediaType, qt.Equals, "multipart/alternative")
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	bodies := map[string]string{}
+	for {
+		part, err := parts.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		qt.Assert(t, err, qt.IsNil)
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		qt.Assert(t, err, qt.IsNil)
+		contentType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		qt.Assert(t, err, qt.IsNil)
+		bodies[contentType] = string(body)
+	}
+	qt.Assert(t, bodies["text/plain"], qt.Equals, "Your authentication code is 123456\r\n")
+	qt.Assert(t, bodies["text/html"], qt.Contains, "<strong>123456</strong>")
+
+	// Invalid configurations are rejected
+	t.Setenv("EMAIL_FROM", "not an address")
+	_, err = NewSMTPSender()
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	t.Setenv("SMTP_SERVER", "")
+	_, err = NewSMTPSender()
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
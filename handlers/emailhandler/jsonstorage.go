@@ -0,0 +1,310 @@
+package emailhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/handlers/smshandler"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/db/metadb"
+	"go.vocdoni.io/dvote/db/prefixeddb"
+	"go.vocdoni.io/dvote/log"
+)
+
+var (
+	usersPrefix      = []byte("u_")
+	authTokensPrefix = []byte("a_")
+)
+
+// JSONstorage uses a local KV database (Pebble) for storing the emailhandler user data.
+// JSON is used for data serialization.
+type JSONstorage struct {
+	users            db.Database
+	authTokens       db.Database
+	keysLock         sync.RWMutex
+	maxEmailAttempts int
+	coolDownTime     time.Duration
+}
+
+func (js *JSONstorage) Init(dataDir string, maxAttempts int, coolDownTime time.Duration) error {
+	database, err := metadb.New(db.TypePebble, filepath.Clean(dataDir))
+	if err != nil {
+		return err
+	}
+	js.users = prefixeddb.NewPrefixedDatabase(database, usersPrefix)
+	js.authTokens = prefixeddb.NewPrefixedDatabase(database, authTokensPrefix)
+	js.maxEmailAttempts = maxAttempts
+	js.coolDownTime = coolDownTime
+	return nil
+}
+
+func (js *JSONstorage) Users() (*smshandler.Users, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	var us smshandler.Users
+	if err := js.users.Iterate(nil, func(key, value []byte) bool {
+		us.Users = append(us.Users, bytes.Clone(key))
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return &us, nil
+}
+
+func (js *JSONstorage) AddUser(userID types.HexBytes, processIDs []types.HexBytes,
+	email, extra string,
+) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return fmt.Errorf("invalid email %q: %w", email, err)
+	}
+	user := UserData{
+		UserID:    userID,
+		ExtraData: extra,
+		Email:     address.Address,
+	}
+	user.Elections = make(map[string]smshandler.UserElection, len(processIDs))
+	for _, e := range smshandler.HexBytesToElection(processIDs, js.maxEmailAttempts) {
+		user.Elections[e.ElectionID.String()] = e
+	}
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	return js.setUser(&user)
+}
+
+func (js *JSONstorage) MaxAttempts() int {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	return js.maxEmailAttempts
+}
+
+func (js *JSONstorage) User(userID types.HexBytes) (*UserData, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	return js.user(userID)
+}
+
+func (js *JSONstorage) UpdateUser(udata *UserData) error {
+	if udata.UserID == nil {
+		return smshandler.ErrUserUnknown
+	}
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	return js.setUser(udata)
+}
+
+func (js *JSONstorage) BelongsToElection(userID, electionID types.HexBytes) (bool, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	user, err := js.user(userID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := user.Elections[electionID.String()]
+	return ok, nil
+}
+
+func (js *JSONstorage) SetAttempts(userID, electionID types.HexBytes, delta int) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	user, err := js.user(userID)
+	if err != nil {
+		return err
+	}
+	election, ok := user.Elections[electionID.String()]
+	if !ok {
+		return smshandler.ErrUserNotBelongsToElection
+	}
+	election.RemainingAttempts += delta
+	user.Elections[electionID.String()] = election
+	return js.setUser(user)
+}
+
+func (js *JSONstorage) NewAttempt(userID, electionID types.HexBytes,
+	challenge int, token *uuid.UUID,
+) (string, error) {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	user, err := js.user(userID)
+	if err != nil {
+		return "", err
+	}
+	election, ok := user.Elections[electionID.String()]
+	if !ok {
+		return "", smshandler.ErrUserNotBelongsToElection
+	}
+	if err := election.NewAttempt(challenge, token, js.coolDownTime); err != nil {
+		return "", err
+	}
+	user.Elections[electionID.String()] = election
+	if err := js.setUser(user); err != nil {
+		return "", err
+	}
+	// Save the token as index for finding the userID
+	tx := js.authTokens.WriteTx()
+	defer tx.Discard()
+	if err := tx.Set([]byte(token.String()), userID); err != nil {
+		return "", err
+	}
+	return user.Email, tx.Commit()
+}
+
+func (js *JSONstorage) Exists(userID types.HexBytes) bool {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	_, err := js.users.Get(userID)
+	return err == nil
+}
+
+func (js *JSONstorage) Verified(userID, electionID types.HexBytes) (bool, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	user, err := js.user(userID)
+	if err != nil {
+		return false, err
+	}
+	election, ok := user.Elections[electionID.String()]
+	if !ok {
+		return false, smshandler.ErrUserNotBelongsToElection
+	}
+	return election.Consumed, nil
+}
+
+func (js *JSONstorage) VerifyChallenge(electionID types.HexBytes,
+	token *uuid.UUID, solution int,
+) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+
+	// fetch the user ID by token
+	userID, err := js.authTokens.Get([]byte(token.String()))
+	if err != nil {
+		return smshandler.ErrInvalidAuthToken
+	}
+	user, err := js.user(userID)
+	if err != nil {
+		return err
+	}
+
+	// find the election and check the solution
+	election, ok := user.Elections[electionID.String()]
+	if !ok {
+		return smshandler.ErrUserNotBelongsToElection
+	}
+	if err := election.CheckAuthToken(token); err != nil {
+		return err
+	}
+
+	// clean token data (we only allow 1 chance) and set consumed to true or
+	// false depending on the challenge solution
+	solveErr := election.Solve(solution)
+	tx := js.authTokens.WriteTx()
+	defer tx.Discard()
+	if err := tx.Delete([]byte(token.String())); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.Elections[electionID.String()] = election
+	if err := js.setUser(user); err != nil {
+		return err
+	}
+
+	// return error if the solution does not match the challenge
+	return solveErr
+}
+
+func (js *JSONstorage) DelUser(userID types.HexBytes) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	tx := js.users.WriteTx()
+	defer tx.Discard()
+	if err := tx.Delete(userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (js *JSONstorage) Search(term string) (*smshandler.Users, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	var users smshandler.Users
+	if err := js.users.Iterate(nil, func(key, value []byte) bool {
+		var user UserData
+		if err := json.Unmarshal(value, &user); err != nil {
+			return true
+		}
+		if !strings.Contains(user.Email, term) && !strings.Contains(user.ExtraData, term) {
+			return true
+		}
+		users.Users = append(users.Users, bytes.Clone(key))
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return &users, nil
+}
+
+func (js *JSONstorage) String() string {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	output := make(map[string]UserData)
+	if err := js.users.Iterate(nil, func(key, value []byte) bool {
+		var data UserData
+		if err := json.Unmarshal(value, &data); err != nil {
+			log.Warn(err)
+		}
+		output[types.HexBytes(key).String()] = data
+		return true
+	}); err != nil {
+		log.Warn(err)
+		return ""
+	}
+	outputData, err := json.MarshalIndent(output, "", " ")
+	if err != nil {
+		log.Warn(err)
+		return ""
+	}
+	return string(outputData)
+}
+
+// user returns the user data, the caller must hold the lock.
+func (js *JSONstorage) user(userID types.HexBytes) (*UserData, error) {
+	userData, err := js.users.Get(userID)
+	if err != nil {
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return nil, smshandler.ErrUserUnknown
+		}
+		return nil, err
+	}
+	var user UserData
+	if err := json.Unmarshal(userData, &user); err != nil {
+		return nil, err
+	}
+	user.UserID = userID
+	return &user, nil
+}
+
+// setUser stores the user data, the caller must hold the write lock.
+func (js *JSONstorage) setUser(user *UserData) error {
+	userData, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	tx := js.users.WriteTx()
+	defer tx.Discard()
+	if err := tx.Set(user.UserID, userData); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
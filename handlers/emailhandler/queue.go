@@ -0,0 +1,93 @@
+package emailhandler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/enriquebris/goconcurrentqueue"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/log"
+)
+
+type challengeData struct {
+	userID     types.HexBytes
+	electionID types.HexBytes
+	email      string
+	challenge  int
+	startTime  time.Time
+	retries    int
+	success    bool
+}
+
+// String returns the masked email of the challenge, the code is never logged.
+func (c challengeData) String() string {
+	return maskEmail(c.email)
+}
+
+// emailQueue sends the challenges one by one, waiting the throttle time between
+// them. The failed ones are retried until the TTL or the max retries are reached.
+type emailQueue struct {
+	queue         *goconcurrentqueue.FIFO
+	ttl           time.Duration
+	throttle      time.Duration
+	sendChallenge SendChallengeFunc
+	response      chan (challengeData)
+}
+
+func newEmailQueue(ttl, throttle time.Duration, sendChallenge SendChallengeFunc) *emailQueue {
+	return &emailQueue{
+		queue:         goconcurrentqueue.NewFIFO(),
+		response:      make(chan challengeData, 1),
+		sendChallenge: sendChallenge,
+		ttl:           ttl,
+		throttle:      throttle,
+	}
+}
+
+func (eq *emailQueue) add(userID, electionID types.HexBytes, email string, challenge int) error {
+	c := challengeData{
+		userID:     userID,
+		electionID: electionID,
+		email:      email,
+		challenge:  challenge,
+		startTime:  time.Now(),
+	}
+	defer log.Debugf("%s: enqueued new email with challenge", c)
+	return eq.queue.Enqueue(c)
+}
+
+func (eq *emailQueue) run() {
+	for {
+		time.Sleep(eq.throttle)
+		c, err := eq.queue.DequeueOrWaitForNextElement()
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		challenge := c.(challengeData)
+		if err := eq.sendChallenge(challenge.email, challenge.challenge); err != nil {
+			log.Warnf("%s: failed to send email: %v", challenge, err)
+			if err := eq.reenqueue(challenge); err != nil {
+				log.Warnf("%s: removed from email queue: %v", challenge, err)
+				challenge.success = false
+				eq.response <- challenge
+			}
+			continue
+		}
+		log.Debugf("%s: email with challenge successfully sent", challenge)
+		challenge.success = true
+		eq.response <- challenge
+	}
+}
+
+func (eq *emailQueue) reenqueue(challenge challengeData) error {
+	if challenge.retries >= DefaultEmailQueueMaxRetries || time.Now().After(challenge.startTime.Add(eq.ttl)) {
+		return fmt.Errorf("TTL or max retries reached")
+	}
+	challenge.retries++
+	if err := eq.queue.Enqueue(challenge); err != nil {
+		return fmt.Errorf("cannot enqueue email: %w", err)
+	}
+	log.Infof("%s: re-enqueued email, retry #%d", challenge, challenge.retries)
+	return nil
+}
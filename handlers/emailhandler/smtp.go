@@ -0,0 +1,163 @@
+package emailhandler
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	texttemplate "text/template"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultEmailSubject is the subject of the emails if EMAIL_SUBJECT is not defined.
+	DefaultEmailSubject = "Your authentication code"
+	// DefaultTextTemplate is the plain-text body of the emails if EMAIL_TEMPLATE_TEXT
+	// is not defined.
+	DefaultTextTemplate = "Your authentication code is {{.Code}}\n"
+	// DefaultHTMLTemplate is the HTML body of the emails if EMAIL_TEMPLATE_HTML is not
+	// defined.
+	DefaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<body>
+<p>Your authentication code is <strong>{{.Code}}</strong></p>
+</body>
+</html>
+`
+)
+
+// TemplateData is the data available to the email templates.
+type TemplateData struct {
+	Code  string
+	Email string
+}
+
+// SMTPSender sends the challenges by email through an SMTP server, with an HTML
+// and a plain-text body (multipart/alternative).
+type SMTPSender struct {
+	// Server is the SMTP server address (host:port). STARTTLS is used if supported.
+	Server string
+	// Auth is the SMTP authentication, none if nil.
+	Auth    smtp.Auth
+	From    *mail.Address
+	Subject string
+	HTML    *htmltemplate.Template
+	Text    *texttemplate.Template
+}
+
+// NewSMTPSender returns a sender configured from the environment: SMTP_SERVER
+// (host:port), SMTP_USERNAME and SMTP_PASSWORD (optional), EMAIL_FROM, EMAIL_SUBJECT
+// and the template files EMAIL_TEMPLATE_HTML and EMAIL_TEMPLATE_TEXT (optional).
+func NewSMTPSender() (*SMTPSender, error) {
+	server := os.Getenv("SMTP_SERVER")
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_SERVER %q: %w", server, err)
+	}
+	from, err := mail.ParseAddress(os.Getenv("EMAIL_FROM"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EMAIL_FROM: %w", err)
+	}
+	s := &SMTPSender{
+		Server:  server,
+		From:    from,
+		Subject: os.Getenv("EMAIL_SUBJECT"),
+	}
+	if s.Subject == "" {
+		s.Subject = DefaultEmailSubject
+	}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		s.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	html, text := DefaultHTMLTemplate, DefaultTextTemplate
+	if file := os.Getenv("EMAIL_TEMPLATE_HTML"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		html = string(data)
+	}
+	if file := os.Getenv("EMAIL_TEMPLATE_TEXT"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if s.HTML, err = htmltemplate.New("html").Parse(html); err != nil {
+		return nil, fmt.Errorf("invalid HTML template: %w", err)
+	}
+	if s.Text, err = texttemplate.New("text").Parse(text); err != nil {
+		return nil, fmt.Errorf("invalid text template: %w", err)
+	}
+	return s, nil
+}
+
+// SendChallenge sends the challenge to the email address.
+func (s *SMTPSender) SendChallenge(email string, challenge int) error {
+	msg, err := s.Message(email, challenge)
+	if err != nil {
+		return err
+	}
+	log.Debugf("sending challenge to %s", maskEmail(email))
+	return smtp.SendMail(s.Server, s.Auth, s.From.Address, []string{email}, msg)
+}
+
+// Message returns the email with the challenge for the email address (RFC 5322).
+func (s *SMTPSender) Message(email string, challenge int) ([]byte, error) {
+	data := TemplateData{Code: fmt.Sprintf("%d", challenge), Email: email}
+	var text, html bytes.Buffer
+	if err := s.Text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := s.HTML.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", s.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,55 @@
+package emailhandler
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/handlers/smshandler"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+// UserData represents a user of the email handler. The elections keep the same
+// attempts, cooldown and consumed state as the smshandler ones.
+type UserData struct {
+	UserID    types.HexBytes                     `json:"userID,omitempty"`
+	Elections map[string]smshandler.UserElection `json:"elections,omitempty"`
+	ExtraData string                             `json:"extraData,omitempty"`
+	Email     string                             `json:"email,omitempty"`
+}
+
+// Storage interface implements the storage layer for the emailhandler. It follows
+// the smshandler.Storage semantics and errors, with the user email instead of the phone.
+type Storage interface {
+	// Init initializes the storage, maxAttempts is used to set the default maximum email attempts.
+	// CoolDownTime is the time period on which attempts are allowed.
+	Init(dataDir string, maxAttempts int, coolDownTime time.Duration) (err error)
+	// AddUser adds a new user to the storage
+	AddUser(userID types.HexBytes, processIDs []types.HexBytes, email, extra string) (err error)
+	// Users returns the list of users
+	Users() (users *smshandler.Users, err error)
+	// User returns the full information of a user, including the election list.
+	User(userID types.HexBytes) (user *UserData, err error)
+	// UpdateUser updates a user
+	UpdateUser(udata *UserData) (err error)
+	// BelongsToElection returns true if the user belongs to the electionID
+	BelongsToElection(userID, electionID types.HexBytes) (belongs bool, err error)
+	// SetAttempts increment or decrement remaining challenge attempts by delta
+	SetAttempts(userID, electionID types.HexBytes, delta int) (err error)
+	// MaxAttempts returns the default max attempts
+	MaxAttempts() (attempts int)
+	// NewAttempt returns the email and sets the challenge and token of the attempt
+	NewAttempt(userID, electionID types.HexBytes, challenge int, token *uuid.UUID) (email string, err error)
+	// Exists returns true if the user exists in the database
+	Exists(userID types.HexBytes) (exists bool)
+	// Verified returns true if the user is verified
+	Verified(userID, electionID types.HexBytes) (verified bool, error error)
+	// VerifyChallenge returns nil if the challenge is solved correctly. Sets verified to true and removes the
+	// temporary auth token from the storage
+	VerifyChallenge(electionID types.HexBytes, token *uuid.UUID, solution int) (err error)
+	// DelUser removes an user from the storage
+	DelUser(userID types.HexBytes) (err error)
+	// Search for a term within the email and extraData user fields and returns the list of matching userIDs
+	Search(term string) (users *smshandler.Users, err error)
+	// String returns the string representation of the storage
+	String() string
+}
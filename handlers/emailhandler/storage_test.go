@@ -0,0 +1,75 @@
+package emailhandler
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/handlers/smshandler"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+func TestStorageJSON(t *testing.T) {
+	stg := &JSONstorage{}
+	qt.Assert(t, stg.Init(t.TempDir(), 2, 50*time.Millisecond), qt.IsNil)
+	qt.Assert(t, stg.AddUser(testUser1, []types.HexBytes{testElection1}, "John <John@Example.com>", "extra"), qt.IsNil)
+	qt.Assert(t, stg.AddUser(testUser2, []types.HexBytes{testElection1, testElection2}, "jane@example.com", ""), qt.IsNil)
+
+	users, err := stg.Users()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, users.Users, qt.HasLen, 2)
+	user, err := stg.User(testUser1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, user.Email, qt.Equals, "John@Example.com")
+	qt.Assert(t, user.ExtraData, qt.Equals, "extra")
+	_, err = stg.User(testElection1)
+	qt.Assert(t, err, qt.Equals, smshandler.ErrUserUnknown)
+
+	belongs, err := stg.BelongsToElection(testUser1, testElection1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, belongs, qt.IsTrue)
+	belongs, err = stg.BelongsToElection(testUser1, testElection2)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, belongs, qt.IsFalse)
+
+	// New attempt returns the email, the cooldown blocks the next one
+	token1 := uuid.New()
+	email, err := stg.NewAttempt(testUser1, testElection1, 1234, &token1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, email, qt.Equals, "John@Example.com")
+	token2 := uuid.New()
+	_, err = stg.NewAttempt(testUser1, testElection1, 1234, &token2)
+	qt.Assert(t, err, qt.Equals, smshandler.ErrAttemptCoolDownTime)
+	_, err = stg.NewAttempt(testUser1, testElection2, 1234, &token2)
+	qt.Assert(t, err, qt.Equals, smshandler.ErrUserNotBelongsToElection)
+
+	// The token is bound to the election, and consumed by a wrong solution
+	qt.Assert(t, stg.VerifyChallenge(testElection2, &token1, 1234), qt.Not(qt.IsNil))
+	qt.Assert(t, stg.VerifyChallenge(testElection1, &token1, 4321), qt.Equals, smshandler.ErrChallengeCodeFailure)
+	qt.Assert(t, stg.VerifyChallenge(testElection1, &token1, 1234), qt.Not(qt.IsNil))
+
+	// A new attempt after the cooldown succeeds
+	time.Sleep(50 * time.Millisecond)
+	email, err = stg.NewAttempt(testUser1, testElection1, 5678, &token2)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, email, qt.Equals, "John@Example.com")
+	qt.Assert(t, stg.VerifyChallenge(testElection1, &token2, 5678), qt.IsNil)
+	verified, err := stg.Verified(testUser1, testElection1)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, verified, qt.IsTrue)
+	time.Sleep(50 * time.Millisecond)
+	_, err = stg.NewAttempt(testUser1, testElection1, 5678, &token1)
+	qt.Assert(t, err, qt.Equals, smshandler.ErrUserAlreadyVerified)
+
+	// The attempts are limited
+	qt.Assert(t, stg.SetAttempts(testUser2, testElection2, -2), qt.IsNil)
+	_, err = stg.NewAttempt(testUser2, testElection2, 1234, &token1)
+	qt.Assert(t, err, qt.Equals, smshandler.ErrTooManyAttempts)
+
+	users, err = stg.Search("jane")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, users.Users, qt.DeepEquals, []types.HexBytes{testUser2})
+	qt.Assert(t, stg.DelUser(testUser2), qt.IsNil)
+	qt.Assert(t, stg.Exists(testUser2), qt.IsFalse)
+}
@@ -1,14 +1,18 @@
 package handlerlist
 
 import (
+	"fmt"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/vocdoni/blind-csp/handlers"
+	"github.com/vocdoni/blind-csp/handlers/emailhandler"
 	"github.com/vocdoni/blind-csp/handlers/idcathandler"
 	"github.com/vocdoni/blind-csp/handlers/oauthhandler"
 	"github.com/vocdoni/blind-csp/handlers/rsahandler"
 	"github.com/vocdoni/blind-csp/handlers/smshandler"
+	"go.vocdoni.io/dvote/httprouter"
 )
 
 // Handlers contains the list of available handlers
@@ -20,6 +24,7 @@ var Handlers = map[string]handlers.AuthHandler{
 	"idCatTesting": &idcathandler.IDcatHandler{ForTesting: true},
 	"rsa":          &rsahandler.RsaHandler{},
 	"sms":          &smshandler.SmsHandler{},
+	"email":        &emailhandler.EmailHandler{},
 	"oauth":        &oauthhandler.OauthHandler{},
 }
 
@@ -32,3 +37,51 @@ func HandlersList() string {
 	sort.Strings(hl)
 	return strings.Join(hl, ",")
 }
+
+var (
+	shared     = make(map[string]*sharedHandler)
+	sharedLock sync.Mutex
+)
+
+// sharedHandler wraps the instances of Handlers, which might be served alone and
+// inside a chain at the same time (i.e sms,sms+idCat). The instance is initialized
+// only once (with the options of the first Init), so it keeps a single state.
+type sharedHandler struct {
+	handlers.AuthHandler
+	once sync.Once
+	err  error
+}
+
+// Init initializes the wrapped handler on the first call, the next calls return
+// the same result.
+func (sh *sharedHandler) Init(r *httprouter.HTTProuter, baseURL string, opts ...string) error {
+	sh.once.Do(func() {
+		sh.err = sh.AuthHandler.Init(r, baseURL, opts...)
+	})
+	return sh.err
+}
+
+// Handler returns the handler identified by name. Several handler names joined by
+// handlers.ChainSeparator (i.e sms+idCat) return a chain handler that executes
+// all of them in order. A handler requested several times (alone or in chains) is
+// the same instance, initialized only once.
+func Handler(name string) (handlers.AuthHandler, error) {
+	names := strings.Split(name, handlers.ChainSeparator)
+	chain := []handlers.AuthHandler{}
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+	for _, n := range names {
+		h, ok := Handlers[n]
+		if !ok {
+			return nil, fmt.Errorf("handler %s is unknown", n)
+		}
+		if _, ok := shared[n]; !ok {
+			shared[n] = &sharedHandler{AuthHandler: h}
+		}
+		chain = append(chain, shared[n])
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return handlers.NewChainHandler(chain...)
+}
@@ -0,0 +1,44 @@
+package handlerlist
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/handlers"
+	"go.vocdoni.io/dvote/httprouter"
+)
+
+func TestHandlerSharedInit(t *testing.T) {
+	counter := &initCounter{}
+	Handlers["initCounter"] = counter
+	t.Cleanup(func() { delete(Handlers, "initCounter") })
+
+	// The same handler served alone and inside a chain is initialized only once
+	alone, err := Handler("initCounter")
+	qt.Assert(t, err, qt.IsNil)
+	chain, err := Handler("initCounter+dummy")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, alone.Init(nil, "/v1", t.TempDir()), qt.IsNil)
+	qt.Assert(t, chain.Init(nil, "/v1", t.TempDir()), qt.IsNil)
+	qt.Assert(t, counter.inits, qt.Equals, 1)
+	qt.Assert(t, alone.Name(), qt.Equals, "initCounter")
+	qt.Assert(t, chain.Name(), qt.Equals, "initCounter+dummy")
+
+	_, err = Handler("initCounter+unknown")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+// initCounter is a dummy handler counting how many times it is initialized.
+type initCounter struct {
+	handlers.DummyHandler
+	inits int
+}
+
+func (ic *initCounter) Name() string {
+	return "initCounter"
+}
+
+func (ic *initCounter) Init(r *httprouter.HTTProuter, baseURL string, opts ...string) error {
+	ic.inits++
+	return nil
+}
@@ -216,6 +216,51 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err := api.RegisterMethod(
+		"/electionTemplate/{electionid}",
+		"GET",
+		apirest.MethodAccessTypePrivate,
+		electionTemplate,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/electionTemplate/{electionid}",
+		"POST",
+		apirest.MethodAccessTypePrivate,
+		setElectionTemplate,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/delElectionTemplate/{electionid}",
+		"GET",
+		apirest.MethodAccessTypePrivate,
+		delElectionTemplate,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/deliveries/{userid}",
+		"GET",
+		apirest.MethodAccessTypePrivate,
+		deliveries,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/deadLetters",
+		"GET",
+		apirest.MethodAccessTypePrivate,
+		deadLetters,
+	); err != nil {
+		log.Fatal(err)
+	}
+
 	if err := api.RegisterMethod(
 		"/import",
 		"POST",
@@ -278,8 +323,9 @@ func user(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 }
 
 type userData struct {
-	Phone string `json:"phone"`
-	Extra string `json:"extra"`
+	Phone  string `json:"phone"`
+	Extra  string `json:"extra"`
+	Locale string `json:"locale"`
 }
 
 func newUser(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
@@ -297,6 +343,11 @@ func newUser(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	if err := storage.AddUser(userID, nil, newUser.Phone, newUser.Extra); err != nil {
 		return err
 	}
+	if newUser.Locale != "" {
+		if err := setLocale(userID, newUser.Locale); err != nil {
+			return err
+		}
+	}
 	return ctx.Send([]byte(respOK), apirest.HTTPstatusOK)
 }
 
@@ -407,6 +458,9 @@ func setUserData(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	if userData.Extra != "" {
 		user.ExtraData = userData.Extra
 	}
+	if userData.Locale != "" {
+		user.Locale = userData.Locale
+	}
 	if err := storage.UpdateUser(user); err != nil {
 		return err
 	}
@@ -468,6 +522,11 @@ func cloneUser(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	if err := storage.AddUser(newUserID, elections, phone, user.ExtraData); err != nil {
 		return err
 	}
+	if user.Locale != "" {
+		if err := setLocale(newUserID, user.Locale); err != nil {
+			return err
+		}
+	}
 	return ctx.Send([]byte(respOK), apirest.HTTPstatusOK)
 }
 
@@ -493,3 +552,87 @@ func search(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	}
 	return ctx.Send(data, apirest.HTTPstatusOK)
 }
+
+// setLocale sets the locale (language of the SMS messages) of a user.
+func setLocale(userID types.HexBytes, locale string) error {
+	user, err := storage.User(userID)
+	if err != nil {
+		return err
+	}
+	user.Locale = locale
+	return storage.UpdateUser(user)
+}
+
+func electionTemplate(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	var electionID types.HexBytes
+	if err := electionID.FromString(ctx.URLParam("electionid")); err != nil {
+		return err
+	}
+	tmpl, err := storage.ElectionTemplate(electionID)
+	if err != nil {
+		return err
+	}
+	resp, err := json.MarshalIndent(tmpl, "", " ")
+	if err != nil {
+		return err
+	}
+	return ctx.Send(resp, apirest.HTTPstatusOK)
+}
+
+func setElectionTemplate(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	var electionID types.HexBytes
+	if err := electionID.FromString(ctx.URLParam("electionid")); err != nil {
+		return err
+	}
+	tmpl := smshandler.ElectionTemplate{}
+	if err := json.Unmarshal(msg.Data, &tmpl); err != nil {
+		return err
+	}
+	tmpl.ElectionID = electionID
+	if err := tmpl.Validate(); err != nil {
+		return err
+	}
+	if err := storage.SetElectionTemplate(&tmpl); err != nil {
+		return err
+	}
+	return ctx.Send([]byte(respOK), apirest.HTTPstatusOK)
+}
+
+func delElectionTemplate(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	var electionID types.HexBytes
+	if err := electionID.FromString(ctx.URLParam("electionid")); err != nil {
+		return err
+	}
+	if err := storage.DelElectionTemplate(electionID); err != nil {
+		return err
+	}
+	return ctx.Send([]byte(respOK), apirest.HTTPstatusOK)
+}
+
+func deliveries(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	var userID types.HexBytes
+	if err := userID.FromString(ctx.URLParam("userid")); err != nil {
+		return err
+	}
+	deliveries, err := storage.Deliveries(userID)
+	if err != nil {
+		return err
+	}
+	resp, err := json.MarshalIndent(deliveries, "", " ")
+	if err != nil {
+		return err
+	}
+	return ctx.Send(resp, apirest.HTTPstatusOK)
+}
+
+func deadLetters(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	items, err := storage.DeadLetters()
+	if err != nil {
+		return err
+	}
+	resp, err := json.MarshalIndent(items, "", " ")
+	if err != nil {
+		return err
+	}
+	return ctx.Send(resp, apirest.HTTPstatusOK)
+}
@@ -1,8 +1,19 @@
 package smshandler
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	messagebird "github.com/messagebird/go-rest-api/v7"
 	mbsms "github.com/messagebird/go-rest-api/v7/sms"
@@ -13,23 +24,53 @@ import (
 	"go.vocdoni.io/dvote/log"
 )
 
+// smsHTTPTimeout is the timeout of the requests to the providers called over plain HTTP.
+const smsHTTPTimeout = 20 * time.Second
+
+// smsFrom returns the sender of the SMS challenges (SMS_FROM).
+func smsFrom() string {
+	if from := os.Getenv("SMS_FROM"); from != "" {
+		return from
+	}
+	return "vocdoni"
+}
+
+// smsStatusCallbackURL returns the public URL of the delivery status callbacks
+// (SMS_STATUS_CALLBACK_URL), which is served on {baseURL}/sms/status.
+func smsStatusCallbackURL() string {
+	return strings.TrimSuffix(os.Getenv("SMS_STATUS_CALLBACK_URL"), "/")
+}
+
+// getenv returns the value of the first environment variable defined.
+func getenv(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// phoneE164 returns the phone number in E.164 format (+34722000000).
+func phoneE164(phone *phonenumbers.PhoneNumber) string {
+	return fmt.Sprintf("+%d%d", phone.GetCountryCode(), phone.GetNationalNumber())
+}
+
 type TwilioSMS struct {
-	client *twilio.RestClient
-	from   string
-	body   string
+	client         *twilio.RestClient
+	from           string
+	statusCallback string
 }
 
+// NewTwilioSMS returns a Twilio provider. The credentials are read from TWILIO_ACCOUNT_SID
+// and TWILIO_AUTH_TOKEN (or SMS_PROVIDER_USERNAME and SMS_PROVIDER_AUTHTOKEN).
 func NewTwilioSMS() *TwilioSMS {
-	accountSid := os.Getenv("SMS_PROVIDER_USERNAME")
-	authToken := os.Getenv("SMS_PROVIDER_AUTHTOKEN")
+	accountSid := getenv("TWILIO_ACCOUNT_SID", "SMS_PROVIDER_USERNAME")
+	authToken := getenv("TWILIO_AUTH_TOKEN", "SMS_PROVIDER_AUTHTOKEN")
 	var tw TwilioSMS
-	tw.from = os.Getenv("SMS_FROM")
-	if tw.from == "" {
-		tw.from = "vocdoni"
-	}
-	tw.body = os.Getenv("SMS_BODY")
-	if tw.body == "" {
-		tw.body = "Your authentication code is"
+	tw.from = smsFrom()
+	if callbackURL := smsStatusCallbackURL(); callbackURL != "" {
+		tw.statusCallback = callbackURL + "/twilio"
 	}
 	tw.client = twilio.NewRestClientWithParams(twilio.ClientParams{
 		Username: accountSid,
@@ -38,43 +79,317 @@ func NewTwilioSMS() *TwilioSMS {
 	return &tw
 }
 
-func (tw *TwilioSMS) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int) error {
-	phoneStr := fmt.Sprintf("+%d%d", phone.GetCountryCode(), phone.GetNationalNumber())
+func (tw *TwilioSMS) Name() string {
+	return "twilio"
+}
+
+func (tw *TwilioSMS) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int, message string) (string, error) {
+	phoneStr := phoneE164(phone)
 	log.Infof("sending challenge to %s", phoneStr)
 	params := &openapi.CreateMessageParams{}
 	params.SetTo(phoneStr)
 	params.SetFrom(tw.from)
-	params.SetBody(fmt.Sprintf("%s %d", tw.body, challenge))
-	_, err := tw.client.Api.CreateMessage(params)
-	return err
+	params.SetBody(message)
+	if tw.statusCallback != "" {
+		params.SetStatusCallback(tw.statusCallback)
+	}
+	resp, err := tw.client.Api.CreateMessage(params)
+	if err != nil {
+		return "", err
+	}
+	if resp.Sid == nil {
+		return "", nil
+	}
+	return *resp.Sid, nil
 }
 
 type MessageBirdSMS struct {
-	client *messagebird.Client
-	from   string
-	body   string
+	client    *messagebird.Client
+	from      string
+	reportURL string
 }
 
+// NewMessageBirdSMS returns a MessageBird provider. The access key is read from
+// MESSAGEBIRD_ACCESS_KEY (or SMS_PROVIDER_AUTHTOKEN).
 func NewMessageBirdSMS() *MessageBirdSMS {
 	var sms MessageBirdSMS
-	sms.from = os.Getenv("SMS_FROM")
-	if sms.from == "" {
-		sms.from = "vocdoni"
-	}
-	sms.body = os.Getenv("SMS_BODY")
-	if sms.body == "" {
-		sms.body = "Your authentication code is"
+	sms.from = smsFrom()
+	if callbackURL := smsStatusCallbackURL(); callbackURL != "" {
+		sms.reportURL = callbackURL + "/messagebird"
 	}
-	accessKey := os.Getenv("SMS_PROVIDER_AUTHTOKEN")
+	accessKey := getenv("MESSAGEBIRD_ACCESS_KEY", "SMS_PROVIDER_AUTHTOKEN")
 	sms.client = messagebird.New(accessKey)
 	return &sms
 }
 
-func (sms *MessageBirdSMS) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int) error {
-	phoneStr := fmt.Sprintf("+%d%d", phone.GetCountryCode(), phone.GetNationalNumber())
-	body := fmt.Sprintf("%s %d", sms.body, challenge)
+func (sms *MessageBirdSMS) Name() string {
+	return "messagebird"
+}
+
+func (sms *MessageBirdSMS) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int, message string) (string, error) {
+	phoneStr := phoneE164(phone)
 	log.Infof("sending challenge to %s", phoneStr)
-	_, err := mbsms.Create(sms.client, sms.from, []string{phoneStr}, body, nil)
+	var params *mbsms.Params
+	if sms.reportURL != "" {
+		params = &mbsms.Params{ReportURL: sms.reportURL}
+	}
+	msg, err := mbsms.Create(sms.client, sms.from, []string{phoneStr}, message, params)
+	if err != nil {
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+// VonageSMS sends the challenges with the Vonage (Nexmo) SMS API.
+type VonageSMS struct {
+	client    *http.Client
+	url       string
+	apiKey    string
+	apiSecret string
+	from      string
+}
+
+// NewVonageSMS returns a Vonage provider. The credentials are read from VONAGE_API_KEY
+// and VONAGE_API_SECRET.
+func NewVonageSMS() (*VonageSMS, error) {
+	sms := &VonageSMS{
+		client:    &http.Client{Timeout: smsHTTPTimeout},
+		url:       "https://rest.nexmo.com/sms/json",
+		apiKey:    os.Getenv("VONAGE_API_KEY"),
+		apiSecret: os.Getenv("VONAGE_API_SECRET"),
+		from:      smsFrom(),
+	}
+	if sms.apiKey == "" || sms.apiSecret == "" {
+		return nil, fmt.Errorf("VONAGE_API_KEY and VONAGE_API_SECRET must be defined")
+	}
+	return sms, nil
+}
+
+func (sms *VonageSMS) Name() string {
+	return "vonage"
+}
+
+func (sms *VonageSMS) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int, message string) (string, error) {
+	log.Infof("sending challenge to %s", phoneE164(phone))
+	form := url.Values{
+		"api_key":    {sms.apiKey},
+		"api_secret": {sms.apiSecret},
+		"from":       {sms.from},
+		// Vonage expects the number without the leading +
+		"to":   {strings.TrimPrefix(phoneE164(phone), "+")},
+		"text": {message},
+	}
+	resp, err := sms.client.PostForm(sms.url, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vonage replied %s", resp.Status)
+	}
+	// The HTTP status is always 200, the delivery status is reported per message
+	var result struct {
+		Messages []struct {
+			Status    string `json:"status"`
+			ErrorText string `json:"error-text"`
+			MessageID string `json:"message-id"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("cannot decode vonage response: %w", err)
+	}
+	if len(result.Messages) == 0 {
+		return "", fmt.Errorf("vonage replied without messages")
+	}
+	for _, m := range result.Messages {
+		if m.Status != "0" {
+			return "", fmt.Errorf("vonage status %s: %s", m.Status, m.ErrorText)
+		}
+	}
+	return result.Messages[0].MessageID, nil
+}
 
-	return err
+// SNSSMS sends the challenges with the AWS Simple Notification Service (Publish action).
+type SNSSMS struct {
+	client       *http.Client
+	url          string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	from         string
+	now          func() time.Time
+}
+
+// NewSNSSMS returns an AWS SNS provider. The credentials are read from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN (optional) and AWS_REGION.
+func NewSNSSMS() (*SNSSMS, error) {
+	sms := &SNSSMS{
+		client:       &http.Client{Timeout: smsHTTPTimeout},
+		region:       getenv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		from:         smsFrom(),
+		now:          time.Now,
+	}
+	if sms.region == "" || sms.accessKey == "" || sms.secretKey == "" {
+		return nil, fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be defined")
+	}
+	sms.url = fmt.Sprintf("https://sns.%s.amazonaws.com/", sms.region)
+	return sms, nil
+}
+
+func (sms *SNSSMS) Name() string {
+	return "sns"
+}
+
+func (sms *SNSSMS) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int, message string) (string, error) {
+	log.Infof("sending challenge to %s", phoneE164(phone))
+	form := url.Values{
+		"Action":                         {"Publish"},
+		"Version":                        {"2010-03-31"},
+		"PhoneNumber":                    {phoneE164(phone)},
+		"Message":                        {message},
+		"MessageAttributes.entry.1.Name": {"AWS.SNS.SMS.SenderID"},
+		"MessageAttributes.entry.1.Value.DataType":    {"String"},
+		"MessageAttributes.entry.1.Value.StringValue": {sms.from},
+		"MessageAttributes.entry.2.Name":              {"AWS.SNS.SMS.SMSType"},
+		"MessageAttributes.entry.2.Value.DataType":    {"String"},
+		"MessageAttributes.entry.2.Value.StringValue": {"Transactional"},
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequest("POST", sms.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sms.sign(req, body)
+	resp, err := sms.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("sns replied %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var result struct {
+		MessageID string `xml:"PublishResult>MessageId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Warnf("cannot decode sns response: %v", err)
+	}
+	return result.MessageID, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (sms *SNSSMS) sign(req *http.Request, body []byte) {
+	now := sms.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := []string{"content-type", "host", "x-amz-date"}
+	if sms.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sms.sessionToken)
+		headers = append(headers, "x-amz-security-token")
+	}
+	canonicalHeaders := ""
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders += h + ":" + strings.TrimSpace(v) + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+	bodyHash := sha256.Sum256(body)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders, signedHeaders, hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/sns/aws4_request", date, sms.region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+sms.secretKey), date)
+	for _, s := range []string{sms.region, "sns", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		sms.accessKey, scope, signedHeaders, hmacSHA256(key, stringToSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// WebhookSMS sends the challenges to a generic HTTP webhook, as a JSON object with
+// the phone number (to), the sender (from), the text (body) and the challenge. The
+// webhook might reply with the message ID as a JSON object ({"id": "..."}).
+type WebhookSMS struct {
+	client    *http.Client
+	url       string
+	authToken string
+	from      string
+}
+
+// NewWebhookSMS returns a webhook provider for SMS_WEBHOOK_URL. If SMS_WEBHOOK_AUTHTOKEN
+// is defined, it is sent as bearer token.
+func NewWebhookSMS() (*WebhookSMS, error) {
+	sms := &WebhookSMS{
+		client:    &http.Client{Timeout: smsHTTPTimeout},
+		url:       os.Getenv("SMS_WEBHOOK_URL"),
+		authToken: os.Getenv("SMS_WEBHOOK_AUTHTOKEN"),
+		from:      smsFrom(),
+	}
+	if sms.url == "" {
+		return nil, fmt.Errorf("SMS_WEBHOOK_URL must be defined")
+	}
+	return sms, nil
+}
+
+func (sms *WebhookSMS) Name() string {
+	return "webhook"
+}
+
+func (sms *WebhookSMS) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int, message string) (string, error) {
+	log.Infof("sending challenge to %s", phoneE164(phone))
+	data, err := json.Marshal(map[string]interface{}{
+		"to":        phoneE164(phone),
+		"from":      sms.from,
+		"body":      message,
+		"challenge": challenge,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", sms.url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sms.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+sms.authToken)
+	}
+	resp, err := sms.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	// The webhook might reply with the message ID, for the delivery status
+	var result struct {
+		ID string `json:"id"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1024)).Decode(&result)
+	return result.ID, nil
 }
@@ -0,0 +1,230 @@
+package smshandler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/messagebird/go-rest-api/v7/signature_jwt"
+	twilioclient "github.com/twilio/twilio-go/client"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/httprouter"
+	"go.vocdoni.io/dvote/log"
+)
+
+// DeliveryStatus is the delivery state of an SMS challenge.
+type DeliveryStatus string
+
+const (
+	// DeliverySent is the state of an SMS accepted by the provider.
+	DeliverySent DeliveryStatus = "sent"
+	// DeliveryDelivered is the state of an SMS delivered to the phone.
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryFailed is the state of an SMS the provider could not deliver.
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Delivery is the delivery state of an SMS challenge, updated by the provider status
+// callbacks. When the delivery fails, the attempt is refunded to the user.
+type Delivery struct {
+	MessageID      string         `json:"messageId" bson:"_id"`
+	Provider       string         `json:"provider" bson:"provider"`
+	UserID         types.HexBytes `json:"userId,omitempty" bson:"userid,omitempty"`
+	ElectionID     types.HexBytes `json:"electionId,omitempty" bson:"electionid,omitempty"`
+	Status         DeliveryStatus `json:"status" bson:"status"`
+	ProviderStatus string         `json:"providerStatus,omitempty" bson:"providerstatus,omitempty"`
+	Error          string         `json:"error,omitempty" bson:"error,omitempty"`
+	Refunded       bool           `json:"refunded" bson:"refunded"`
+	SentAt         *time.Time     `json:"sentAt,omitempty" bson:"sentat,omitempty"`
+	UpdatedAt      time.Time      `json:"updatedAt" bson:"updatedat"`
+}
+
+// Final returns true if the delivery state can no longer change.
+func (d *Delivery) Final() bool {
+	return d.Status == DeliveryDelivered || d.Status == DeliveryFailed
+}
+
+// twilioDeliveryStatus returns the delivery status of a Twilio message status.
+func twilioDeliveryStatus(status string) DeliveryStatus {
+	switch status {
+	case "delivered", "read":
+		return DeliveryDelivered
+	case "undelivered", "failed", "canceled":
+		return DeliveryFailed
+	default: // accepted, queued, sending, sent...
+		return DeliverySent
+	}
+}
+
+// messageBirdDeliveryStatus returns the delivery status of a MessageBird message status.
+func messageBirdDeliveryStatus(status string) DeliveryStatus {
+	switch status {
+	case "delivered":
+		return DeliveryDelivered
+	case "delivery_failed", "expired":
+		return DeliveryFailed
+	default: // scheduled, sent, buffered...
+		return DeliverySent
+	}
+}
+
+// initStatusCallbacks configures the provider status callbacks, served on
+// {baseURL}/sms/status/{provider} if SMS_STATUS_CALLBACK_URL is defined. The Twilio
+// callbacks are signed with the account auth token, and the MessageBird ones with
+// MESSAGEBIRD_SIGNING_KEY. If the router is nil, the routes are not registered.
+func (sh *SmsHandler) initStatusCallbacks(r *httprouter.HTTProuter, baseURL string) {
+	sh.callbackURL = smsStatusCallbackURL()
+	if sh.callbackURL == "" {
+		return
+	}
+	if authToken := getenv("TWILIO_AUTH_TOKEN", "SMS_PROVIDER_AUTHTOKEN"); authToken != "" {
+		validator := twilioclient.NewRequestValidator(authToken)
+		sh.twilioValidator = &validator
+		if r != nil {
+			r.AddRawHTTPHandler(baseURL+"/sms/status/twilio", "POST", sh.twilioStatusCallback)
+		}
+	}
+	if signingKey := os.Getenv("MESSAGEBIRD_SIGNING_KEY"); signingKey != "" {
+		sh.messageBirdValidator = signature_jwt.NewValidator(signingKey)
+		if r != nil {
+			r.AddRawHTTPHandler(baseURL+"/sms/status/messagebird", "GET", sh.messageBirdStatusCallback)
+			r.AddRawHTTPHandler(baseURL+"/sms/status/messagebird", "POST", sh.messageBirdStatusCallback)
+		}
+	}
+}
+
+// twilioStatusCallback handles the Twilio message status callbacks, a form with the
+// MessageSid, MessageStatus and ErrorCode.
+func (sh *SmsHandler) twilioStatusCallback(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	params := make(map[string]string, len(r.PostForm))
+	for k := range r.PostForm {
+		params[k] = r.PostForm.Get(k)
+	}
+	if !sh.twilioValidator.Validate(sh.callbackURL+"/twilio", params, r.Header.Get("X-Twilio-Signature")) {
+		log.Warnf("invalid twilio status callback signature from %s", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	messageID, status := params["MessageSid"], params["MessageStatus"]
+	if messageID == "" || status == "" {
+		http.Error(w, "missing message sid or status", http.StatusBadRequest)
+		return
+	}
+	errorText := ""
+	if code := params["ErrorCode"]; code != "" {
+		errorText = fmt.Sprintf("twilio error %s", code)
+	}
+	if err := sh.updateDelivery("twilio", messageID, twilioDeliveryStatus(status), status, errorText); err != nil {
+		log.Warnf("cannot update delivery %s: %v", messageID, err)
+		http.Error(w, "cannot update delivery", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// messageBirdStatusCallback handles the MessageBird status reports, with the id,
+// status, statusReason and statusErrorCode query parameters.
+func (sh *SmsHandler) messageBirdStatusCallback(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	url := sh.callbackURL + "/messagebird"
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+	if _, err := sh.messageBirdValidator.ValidateSignature(
+		r.Header.Get("MessageBird-Signature-JWT"), url, body); err != nil {
+		log.Warnf("invalid messagebird status callback from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	messageID, status := query.Get("id"), query.Get("status")
+	if messageID == "" || status == "" {
+		http.Error(w, "missing id or status", http.StatusBadRequest)
+		return
+	}
+	errorText := query.Get("statusReason")
+	if code := query.Get("statusErrorCode"); code != "" {
+		errorText = fmt.Sprintf("%s (error %s)", errorText, code)
+	}
+	if err := sh.updateDelivery("messagebird", messageID,
+		messageBirdDeliveryStatus(status), status, errorText); err != nil {
+		log.Warnf("cannot update delivery %s: %v", messageID, err)
+		http.Error(w, "cannot update delivery", http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
+
+// recordSent records the delivery of a challenge accepted by the provider. The status
+// callback might arrive first, so an existing delivery keeps its status.
+func (sh *SmsHandler) recordSent(c challengeData) error {
+	if c.messageID == "" {
+		return nil
+	}
+	sh.deliveryLock.Lock()
+	defer sh.deliveryLock.Unlock()
+	d, err := sh.stg.Delivery(c.messageID)
+	if errors.Is(err, ErrDeliveryUnknown) {
+		d = &Delivery{MessageID: c.messageID, Status: DeliverySent}
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	d.Provider = c.providerName
+	d.UserID = c.userID
+	d.ElectionID = c.electionID
+	d.SentAt = &now
+	d.UpdatedAt = now
+	sh.refund(d)
+	return sh.stg.SetDelivery(d)
+}
+
+// updateDelivery updates the delivery status of a message, and refunds the attempt
+// if the delivery failed. The final states are never changed.
+func (sh *SmsHandler) updateDelivery(provider, messageID string, status DeliveryStatus,
+	providerStatus, errorText string,
+) error {
+	sh.deliveryLock.Lock()
+	defer sh.deliveryLock.Unlock()
+	d, err := sh.stg.Delivery(messageID)
+	if errors.Is(err, ErrDeliveryUnknown) {
+		d = &Delivery{MessageID: messageID, Provider: provider, Status: DeliverySent}
+	} else if err != nil {
+		return err
+	}
+	if d.Final() {
+		log.Debugf("delivery %s is %s, ignoring status %s", messageID, d.Status, providerStatus)
+		return nil
+	}
+	d.Status = status
+	d.ProviderStatus = providerStatus
+	d.Error = errorText
+	d.UpdatedAt = time.Now()
+	log.Infof("%s delivery %s of user %s: %s %s", provider, messageID, d.UserID, providerStatus, errorText)
+	sh.refund(d)
+	return sh.stg.SetDelivery(d)
+}
+
+// refund gives the attempt back to the user if the delivery failed, once.
+func (sh *SmsHandler) refund(d *Delivery) {
+	if d.Status != DeliveryFailed || d.Refunded || d.UserID == nil {
+		return
+	}
+	if err := sh.stg.SetAttempts(d.UserID, d.ElectionID, 1); err != nil {
+		log.Warnf("cannot refund the attempt of user %s: %v", d.UserID, err)
+		return
+	}
+	d.Refunded = true
+	log.Infof("delivery %s failed, attempt refunded to user %s", d.MessageID, d.UserID)
+}
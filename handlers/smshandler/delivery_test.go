@@ -0,0 +1,159 @@
+package smshandler
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/uuid"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+const testCallbackURL = "https://csp.example.com/v1/auth/elections/sms/status"
+
+func TestDeliveryStatus(t *testing.T) {
+	provider := &testProvider{name: "delivery"}
+	RegisterSMSProvider("delivery", func() (SMSProvider, error) { return provider, nil })
+	t.Setenv("SMS_PROVIDER", "delivery")
+	t.Setenv("SMS_STATUS_CALLBACK_URL", testCallbackURL+"/")
+	t.Setenv("TWILIO_AUTH_TOKEN", "twilio-secret")
+	t.Setenv("MESSAGEBIRD_SIGNING_KEY", "messagebird-secret")
+	sh := SmsHandler{}
+	qt.Assert(t, sh.Init(nil, "", t.TempDir(), "2", "100", "5"), qt.IsNil)
+
+	user, election := usersMockData[0].userID, usersMockData[0].elections[0]
+	qt.Assert(t, sh.stg.AddUser(user, []types.HexBytes{election}, "+34655111222", ""), qt.IsNil)
+	attempts := func() int {
+		u, err := sh.stg.User(user)
+		qt.Assert(t, err, qt.IsNil)
+		return u.Elections[election.String()].RemainingAttempts
+	}
+	// challenge sends the SMS and returns its delivery, once recorded as sent
+	challenge := func(messageID string) *Delivery {
+		time.Sleep(100 * time.Millisecond) // cooldown time
+		msg := types.Message{AuthData: []string{user.String()}}
+		resp := sh.Auth(nil, &msg, election, types.SignatureTypeBlind, 0)
+		qt.Assert(t, resp.Success, qt.IsTrue, qt.Commentf("%s", resp.Response))
+		for i := 0; i < 100; i++ {
+			if d, err := sh.stg.Delivery(messageID); err == nil && d.SentAt != nil {
+				return d
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("delivery %s not recorded", messageID)
+		return nil
+	}
+
+	d := challenge("delivery-1")
+	qt.Assert(t, d.Status, qt.Equals, DeliverySent)
+	qt.Assert(t, d.Provider, qt.Equals, "delivery")
+	qt.Assert(t, d.UserID, qt.DeepEquals, user)
+	qt.Assert(t, attempts(), qt.Equals, 1)
+
+	// An invalid signature is rejected
+	form := url.Values{"MessageSid": {"delivery-1"}, "MessageStatus": {"undelivered"}, "ErrorCode": {"30003"}}
+	w := testTwilioCallback(&sh, form, "wrong-secret")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusUnauthorized)
+	qt.Assert(t, attempts(), qt.Equals, 1)
+
+	// A failed delivery refunds the attempt, only once
+	for i := 0; i < 2; i++ {
+		w = testTwilioCallback(&sh, form, "twilio-secret")
+		qt.Assert(t, w.Code, qt.Equals, http.StatusNoContent)
+		qt.Assert(t, attempts(), qt.Equals, 2)
+	}
+	d, err := sh.stg.Delivery("delivery-1")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, d.Status, qt.Equals, DeliveryFailed)
+	qt.Assert(t, d.ProviderStatus, qt.Equals, "undelivered")
+	qt.Assert(t, d.Error, qt.Equals, "twilio error 30003")
+	qt.Assert(t, d.Refunded, qt.IsTrue)
+
+	// A delivered message is final and keeps the attempt consumed
+	challenge("delivery-2")
+	query := url.Values{"id": {"delivery-2"}, "status": {"delivered"}}
+	w = testMessageBirdCallback(&sh, query, "messagebird-secret")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusOK)
+	query.Set("status", "delivery_failed")
+	w = testMessageBirdCallback(&sh, query, "wrong-secret")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusUnauthorized)
+	w = testMessageBirdCallback(&sh, query, "messagebird-secret")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusOK)
+	d, err = sh.stg.Delivery("delivery-2")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, d.Status, qt.Equals, DeliveryDelivered)
+	qt.Assert(t, attempts(), qt.Equals, 1)
+
+	// The status callback might arrive before the delivery is recorded
+	w = testMessageBirdCallback(&sh, url.Values{
+		"id": {"delivery-3"}, "status": {"expired"}, "statusReason": {"unknown subscriber"},
+	}, "messagebird-secret")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusOK)
+	d = challenge("delivery-3")
+	qt.Assert(t, d.Status, qt.Equals, DeliveryFailed)
+	qt.Assert(t, d.Refunded, qt.IsTrue)
+	qt.Assert(t, d.UserID, qt.DeepEquals, user)
+	qt.Assert(t, attempts(), qt.Equals, 1)
+
+	deliveries, err := sh.stg.Deliveries(user)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, deliveries, qt.HasLen, 3)
+	users, err := sh.stg.Users()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, users.Users, qt.HasLen, 1)
+}
+
+// testTwilioCallback sends a Twilio status callback signed with authToken.
+func testTwilioCallback(sh *SmsHandler, form url.Values, authToken string) *httptest.ResponseRecorder {
+	params := []string{}
+	for k := range form {
+		params = append(params, k+form.Get(k))
+	}
+	sort.Strings(params)
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(testCallbackURL + "/twilio" + strings.Join(params, "")))
+
+	req := httptest.NewRequest("POST", "/v1/auth/elections/sms/status/twilio", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	sh.twilioStatusCallback(w, req)
+	return w
+}
+
+// testMessageBirdCallback sends a MessageBird status report signed (JWT) with signingKey.
+func testMessageBirdCallback(sh *SmsHandler, query url.Values, signingKey string) *httptest.ResponseRecorder {
+	urlHash := sha256.Sum256([]byte(testCallbackURL + "/messagebird?" + query.Encode()))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":      "MessageBird",
+		"nbf":      time.Now().Unix(),
+		"exp":      time.Now().Add(time.Minute).Unix(),
+		"jti":      uuid.New().String(),
+		"url_hash": hex.EncodeToString(urlHash[:]),
+	})
+	if err != nil {
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(token))
+	token += "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	req := httptest.NewRequest("GET", "/v1/auth/elections/sms/status/messagebird?"+query.Encode(), nil)
+	req.Header.Set("MessageBird-Signature-JWT", token)
+	w := httptest.NewRecorder()
+	sh.messageBirdStatusCallback(w, req)
+	return w
+}
@@ -1,9 +1,12 @@
 package smshandler
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,8 +20,12 @@ import (
 )
 
 const (
-	userPrefix           = "u_"
-	authTokenIndexPrefix = "a_"
+	userPrefix             = "u_"
+	authTokenIndexPrefix   = "a_"
+	electionTemplatePrefix = "e_"
+	deliveryPrefix         = "d_"
+	queueItemPrefix        = "q_"
+	deadLetterPrefix       = "f_"
 )
 
 // JSONstorage uses a local KV database (Pebble) for storing the smshandler user data.
@@ -49,6 +56,9 @@ func (js *JSONstorage) Reset() error {
 func (js *JSONstorage) Users() (*Users, error) {
 	var us Users
 	if err := js.kv.Iterate(nil, func(key, value []byte) bool {
+		if !isUserKey(key) {
+			return true
+		}
 		us.Users = append(us.Users, key2userID(key))
 		return true
 	}); err != nil {
@@ -61,6 +71,11 @@ func userIDkey(u types.HexBytes) []byte {
 	return append([]byte(userPrefix), u...)
 }
 
+// isUserKey returns true if the key is a user data key (not an index or template).
+func isUserKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(userPrefix))
+}
+
 func key2userID(key []byte) (u types.HexBytes) {
 	_ = u.FromString(fmt.Sprintf("%x", key[len(userPrefix):]))
 	return u
@@ -204,21 +219,9 @@ func (js *JSONstorage) NewAttempt(userID, electionID types.HexBytes,
 	if !ok {
 		return nil, ErrUserNotBelongsToElection
 	}
-	if election.Consumed {
-		return nil, ErrUserAlreadyVerified
-	}
-	if election.LastAttempt != nil {
-		if time.Now().Before(election.LastAttempt.Add(js.coolDownTime)) {
-			return nil, ErrAttemptCoolDownTime
-		}
-	}
-	if election.RemainingAttempts < 1 {
-		return nil, ErrTooManyAttempts
+	if err := election.NewAttempt(challenge, token, js.coolDownTime); err != nil {
+		return nil, err
 	}
-	election.AuthToken = token
-	election.Challenge = challenge
-	t := time.Now()
-	election.LastAttempt = &t
 	user.Elections[electionID.String()] = election
 	userData, err = json.Marshal(user)
 	if err != nil {
@@ -290,25 +293,17 @@ func (js *JSONstorage) VerifyChallenge(electionID types.HexBytes,
 	if !ok {
 		return ErrUserNotBelongsToElection
 	}
-	if election.Consumed {
-		return ErrUserAlreadyVerified
-	}
-	if election.AuthToken == nil {
-		return fmt.Errorf("no auth token available for this election")
-	}
-	if election.AuthToken.String() != token.String() {
-		return ErrInvalidAuthToken
+	if err := election.CheckAuthToken(token); err != nil {
+		return err
 	}
 
-	// clean token data (we only allow 1 chance)
-	election.AuthToken = nil
+	// clean token data (we only allow 1 chance) and set consumed to true or
+	// false depending on the challenge solution
+	solveErr := election.Solve(solution)
 	if err := tx.Delete([]byte(authTokenIndexPrefix + token.String())); err != nil {
 		return err
 	}
 
-	// set consumed to true or false depending on the challenge solution
-	election.Consumed = election.Challenge == solution
-
 	// save the user data
 	user.Elections[electionID.String()] = election
 	userData, err = json.Marshal(user)
@@ -323,10 +318,7 @@ func (js *JSONstorage) VerifyChallenge(electionID types.HexBytes,
 	}
 
 	// return error if the solution does not match the challenge
-	if election.Challenge != solution {
-		return ErrChallengeCodeFailure
-	}
-	return nil
+	return solveErr
 }
 
 func (js *JSONstorage) DelUser(userID types.HexBytes) error {
@@ -343,7 +335,7 @@ func (js *JSONstorage) DelUser(userID types.HexBytes) error {
 func (js *JSONstorage) Search(term string) (*Users, error) {
 	var users Users
 	if err := js.kv.Iterate(nil, func(key, value []byte) bool {
-		if !strings.Contains(string(value), term) {
+		if !isUserKey(key) || !strings.Contains(string(value), term) {
 			return true
 		}
 		users.Users = append(users.Users, key2userID(key))
@@ -360,6 +352,9 @@ func (js *JSONstorage) String() string {
 	defer js.keysLock.RUnlock()
 	output := make(map[string]UserData)
 	if err := js.kv.Iterate(nil, func(key, value []byte) bool {
+		if !isUserKey(key) {
+			return true
+		}
 		var data UserData
 
 		err := json.Unmarshal(value, &data)
@@ -385,3 +380,195 @@ func (js *JSONstorage) String() string {
 func (js *JSONstorage) Import(data []byte) error {
 	return nil
 }
+
+func electionTemplateKey(electionID types.HexBytes) []byte {
+	return append([]byte(electionTemplatePrefix), electionID...)
+}
+
+func (js *JSONstorage) SetElectionTemplate(tmpl *ElectionTemplate) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	tx := js.kv.WriteTx()
+	defer tx.Discard()
+	data, err := json.Marshal(tmpl)
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(electionTemplateKey(tmpl.ElectionID), data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (js *JSONstorage) ElectionTemplate(electionID types.HexBytes) (*ElectionTemplate, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	data, err := js.kv.Get(electionTemplateKey(electionID))
+	if err != nil {
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return nil, ErrElectionTemplateUnknown
+		}
+		return nil, err
+	}
+	var tmpl ElectionTemplate
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return nil, err
+	}
+	return &tmpl, nil
+}
+
+func (js *JSONstorage) DelElectionTemplate(electionID types.HexBytes) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	tx := js.kv.WriteTx()
+	defer tx.Discard()
+	if err := tx.Delete(electionTemplateKey(electionID)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deliveryKey(messageID string) []byte {
+	return []byte(deliveryPrefix + messageID)
+}
+
+func (js *JSONstorage) SetDelivery(delivery *Delivery) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	tx := js.kv.WriteTx()
+	defer tx.Discard()
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(deliveryKey(delivery.MessageID), data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (js *JSONstorage) Delivery(messageID string) (*Delivery, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	data, err := js.kv.Get(deliveryKey(messageID))
+	if err != nil {
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return nil, ErrDeliveryUnknown
+		}
+		return nil, err
+	}
+	var delivery Delivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (js *JSONstorage) Deliveries(userID types.HexBytes) ([]Delivery, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	deliveries := []Delivery{}
+	if err := js.kv.Iterate([]byte(deliveryPrefix), func(key, value []byte) bool {
+		var delivery Delivery
+		if err := json.Unmarshal(value, &delivery); err != nil {
+			log.Warn(err)
+			return true
+		}
+		if bytes.Equal(delivery.UserID, userID) {
+			deliveries = append(deliveries, delivery)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (js *JSONstorage) setItem(key []byte, item *QueueItem) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	tx := js.kv.WriteTx()
+	defer tx.Discard()
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(key, data); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (js *JSONstorage) items(prefix string) ([]QueueItem, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	items := []QueueItem{}
+	if err := js.kv.Iterate([]byte(prefix), func(key, value []byte) bool {
+		var item QueueItem
+		if err := json.Unmarshal(value, &item); err != nil {
+			log.Warn(err)
+			return true
+		}
+		items = append(items, item)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (js *JSONstorage) SetQueueItem(item *QueueItem) error {
+	return js.setItem([]byte(queueItemPrefix+item.ID), item)
+}
+
+func (js *JSONstorage) QueueItem(id string) (*QueueItem, error) {
+	js.keysLock.RLock()
+	defer js.keysLock.RUnlock()
+	data, err := js.kv.Get([]byte(queueItemPrefix + id))
+	if err != nil {
+		if errors.Is(err, db.ErrKeyNotFound) {
+			return nil, ErrQueueItemUnknown
+		}
+		return nil, err
+	}
+	var item QueueItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (js *JSONstorage) QueueItems() ([]QueueItem, error) {
+	items, err := js.items(queueItemPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].StartTime.Before(items[j].StartTime) })
+	return items, nil
+}
+
+func (js *JSONstorage) DelQueueItem(id string) error {
+	js.keysLock.Lock()
+	defer js.keysLock.Unlock()
+	tx := js.kv.WriteTx()
+	defer tx.Discard()
+	if err := tx.Delete([]byte(queueItemPrefix + id)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (js *JSONstorage) AddDeadLetter(item *QueueItem) error {
+	return js.setItem([]byte(deadLetterPrefix+item.ID), item)
+}
+
+func (js *JSONstorage) DeadLetters() ([]QueueItem, error) {
+	items, err := js.items(deadLetterPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].FailedAt != nil && items[j].FailedAt != nil && items[i].FailedAt.Before(*items[j].FailedAt)
+	})
+	return items, nil
+}
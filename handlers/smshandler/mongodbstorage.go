@@ -3,6 +3,7 @@ package smshandler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -28,6 +29,10 @@ import (
 type MongoStorage struct {
 	users          *mongo.Collection
 	tokenIndex     *mongo.Collection
+	elections      *mongo.Collection
+	deliveries     *mongo.Collection
+	queue          *mongo.Collection
+	deadLetters    *mongo.Collection
 	keysLock       sync.RWMutex
 	maxSmsAttempts int
 	coolDownTime   time.Duration
@@ -78,6 +83,10 @@ func (ms *MongoStorage) Init(dataDir string, maxAttempts int, coolDownTime time.
 
 	ms.users = client.Database(database).Collection("users")
 	ms.tokenIndex = client.Database(database).Collection("tokenindex")
+	ms.elections = client.Database(database).Collection("electiontemplates")
+	ms.deliveries = client.Database(database).Collection("deliveries")
+	ms.queue = client.Database(database).Collection("smsqueue")
+	ms.deadLetters = client.Database(database).Collection("deadletters")
 	ms.maxSmsAttempts = maxAttempts
 	ms.coolDownTime = coolDownTime
 
@@ -111,6 +120,15 @@ func (ms *MongoStorage) createIndexes() error {
 	if err != nil {
 		return err
 	}
+	// Create index on the deliveries `userid` for the user delivery status
+	index = mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "userid", Value: 1},
+		},
+	}
+	if _, err := ms.deliveries.Indexes().CreateOne(ctx, index); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -121,6 +139,18 @@ func (ms *MongoStorage) Reset() error {
 	if err := ms.users.Drop(ctx); err != nil {
 		return err
 	}
+	if err := ms.elections.Drop(ctx); err != nil {
+		return err
+	}
+	if err := ms.deliveries.Drop(ctx); err != nil {
+		return err
+	}
+	if err := ms.queue.Drop(ctx); err != nil {
+		return err
+	}
+	if err := ms.deadLetters.Drop(ctx); err != nil {
+		return err
+	}
 	if err := ms.createIndexes(); err != nil {
 		return err
 	}
@@ -280,25 +310,11 @@ func (ms *MongoStorage) NewAttempt(userID, electionID types.HexBytes,
 		return nil, ErrUserNotBelongsToElection
 	}
 
-	// Check if the CSP signature is already consumed for the user/election
-	if election.Consumed {
-		return nil, ErrUserAlreadyVerified
-	}
-	// Check cool down time
-	if election.LastAttempt != nil {
-		if time.Now().Before(election.LastAttempt.Add(ms.coolDownTime)) {
-			return nil, ErrAttemptCoolDownTime
-		}
-	}
-	// Check remaining attempts
-	if election.RemainingAttempts < 1 {
-		return nil, ErrTooManyAttempts
+	// Check the consumed state, cool down time and remaining attempts and
+	// save the new data
+	if err := election.NewAttempt(challenge, token, ms.coolDownTime); err != nil {
+		return nil, err
 	}
-	// Save new data
-	election.AuthToken = token
-	election.Challenge = challenge
-	t := time.Now()
-	election.LastAttempt = &t
 	user.Elections[electionID.String()] = election
 	if err := ms.updateUser(user); err != nil {
 		return nil, err
@@ -368,27 +384,19 @@ func (ms *MongoStorage) VerifyChallenge(electionID types.HexBytes,
 	if !ok {
 		return ErrUserNotBelongsToElection
 	}
-	if election.Consumed {
-		return ErrUserAlreadyVerified
-	}
-	if election.AuthToken == nil {
-		return fmt.Errorf("no auth token available for this election")
-	}
-	if election.AuthToken.String() != token.String() {
-		return ErrInvalidAuthToken
+	if err := election.CheckAuthToken(token); err != nil {
+		return err
 	}
 
-	// clean token data (we only allow 1 chance)
-	election.AuthToken = nil
+	// clean token data (we only allow 1 chance) and set consumed to true or
+	// false depending on the challenge solution
+	solveErr := election.Solve(solution)
 	ctx, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel2()
 	if _, err := ms.tokenIndex.DeleteOne(ctx, bson.M{"_id": token}); err != nil {
 		return err
 	}
 
-	// set consumed to true or false depending on the challenge solution
-	election.Consumed = election.Challenge == solution
-
 	// save the user data
 	user.Elections[electionID.String()] = election
 	if err := ms.updateUser(user); err != nil {
@@ -396,11 +404,7 @@ func (ms *MongoStorage) VerifyChallenge(electionID types.HexBytes,
 	}
 
 	// return error if the solution does not match the challenge
-	if election.Challenge != solution {
-		return ErrChallengeCodeFailure
-	}
-
-	return nil
+	return solveErr
 }
 
 func (ms *MongoStorage) DelUser(userID types.HexBytes) error {
@@ -482,3 +486,157 @@ func (ms *MongoStorage) String() string {
 	}
 	return string(data)
 }
+
+func (ms *MongoStorage) SetElectionTemplate(tmpl *ElectionTemplate) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.ReplaceOptions{}
+	opts.Upsert = new(bool)
+	*opts.Upsert = true
+	if _, err := ms.elections.ReplaceOne(ctx, bson.M{"_id": tmpl.ElectionID}, tmpl, &opts); err != nil {
+		return fmt.Errorf("cannot update object: %w", err)
+	}
+	return nil
+}
+
+func (ms *MongoStorage) ElectionTemplate(electionID types.HexBytes) (*ElectionTemplate, error) {
+	ms.keysLock.RLock()
+	defer ms.keysLock.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var tmpl ElectionTemplate
+	if err := ms.elections.FindOne(ctx, bson.M{"_id": electionID}).Decode(&tmpl); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrElectionTemplateUnknown
+		}
+		return nil, err
+	}
+	return &tmpl, nil
+}
+
+func (ms *MongoStorage) DelElectionTemplate(electionID types.HexBytes) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := ms.elections.DeleteOne(ctx, bson.M{"_id": electionID})
+	return err
+}
+
+func (ms *MongoStorage) SetDelivery(delivery *Delivery) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.ReplaceOptions{}
+	opts.Upsert = new(bool)
+	*opts.Upsert = true
+	if _, err := ms.deliveries.ReplaceOne(ctx, bson.M{"_id": delivery.MessageID}, delivery, &opts); err != nil {
+		return fmt.Errorf("cannot update object: %w", err)
+	}
+	return nil
+}
+
+func (ms *MongoStorage) Delivery(messageID string) (*Delivery, error) {
+	ms.keysLock.RLock()
+	defer ms.keysLock.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var delivery Delivery
+	if err := ms.deliveries.FindOne(ctx, bson.M{"_id": messageID}).Decode(&delivery); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrDeliveryUnknown
+		}
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (ms *MongoStorage) Deliveries(userID types.HexBytes) ([]Delivery, error) {
+	ms.keysLock.RLock()
+	defer ms.keysLock.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := ms.deliveries.Find(ctx, bson.M{"userid": userID})
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []Delivery{}
+	if err := cur.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (ms *MongoStorage) setItem(collection *mongo.Collection, item *QueueItem) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	opts := options.ReplaceOptions{}
+	opts.Upsert = new(bool)
+	*opts.Upsert = true
+	if _, err := collection.ReplaceOne(ctx, bson.M{"_id": item.ID}, item, &opts); err != nil {
+		return fmt.Errorf("cannot update object: %w", err)
+	}
+	return nil
+}
+
+func (ms *MongoStorage) items(collection *mongo.Collection, sortKey string) ([]QueueItem, error) {
+	ms.keysLock.RLock()
+	defer ms.keysLock.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.Find().SetSort(bson.D{{Key: sortKey, Value: 1}})
+	cur, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	items := []QueueItem{}
+	if err := cur.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (ms *MongoStorage) SetQueueItem(item *QueueItem) error {
+	return ms.setItem(ms.queue, item)
+}
+
+func (ms *MongoStorage) QueueItem(id string) (*QueueItem, error) {
+	ms.keysLock.RLock()
+	defer ms.keysLock.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var item QueueItem
+	if err := ms.queue.FindOne(ctx, bson.M{"_id": id}).Decode(&item); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrQueueItemUnknown
+		}
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (ms *MongoStorage) QueueItems() ([]QueueItem, error) {
+	return ms.items(ms.queue, "starttime")
+}
+
+func (ms *MongoStorage) DelQueueItem(id string) error {
+	ms.keysLock.Lock()
+	defer ms.keysLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := ms.queue.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (ms *MongoStorage) AddDeadLetter(item *QueueItem) error {
+	return ms.setItem(ms.deadLetters, item)
+}
+
+func (ms *MongoStorage) DeadLetters() ([]QueueItem, error) {
+	return ms.items(ms.deadLetters, "failedat")
+}
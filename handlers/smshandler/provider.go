@@ -0,0 +1,269 @@
+package smshandler
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/phonenumbers"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultSMSProvider is the provider used if SMS_PROVIDER is not defined.
+	DefaultSMSProvider = "twilio"
+	// DefaultSMSProviderMaxFailures is the number of consecutive failures after which
+	// a provider is considered unhealthy.
+	DefaultSMSProviderMaxFailures = 3
+	// DefaultSMSProviderCooldown is how long an unhealthy provider is skipped before
+	// trying it again.
+	DefaultSMSProviderCooldown = time.Minute
+)
+
+// SMSProvider is an upstream service able to deliver the SMS challenges.
+type SMSProvider interface {
+	// Name returns the provider name, used for logging.
+	Name() string
+	// SendChallenge sends the SMS message with the challenge to the phone number, and
+	// returns the provider message ID (empty if unknown) for the delivery status.
+	SendChallenge(phone *phonenumbers.PhoneNumber, challenge int, message string) (string, error)
+}
+
+// SMSProviderFactory returns a new provider, configured from the environment.
+type SMSProviderFactory func() (SMSProvider, error)
+
+var (
+	smsProviders     = make(map[string]SMSProviderFactory)
+	smsProvidersLock sync.RWMutex
+)
+
+func init() {
+	RegisterSMSProvider("twilio", func() (SMSProvider, error) { return NewTwilioSMS(), nil })
+	RegisterSMSProvider("messagebird", func() (SMSProvider, error) { return NewMessageBirdSMS(), nil })
+	RegisterSMSProvider("vonage", func() (SMSProvider, error) { return NewVonageSMS() })
+	RegisterSMSProvider("sns", func() (SMSProvider, error) { return NewSNSSMS() })
+	RegisterSMSProvider("webhook", func() (SMSProvider, error) { return NewWebhookSMS() })
+}
+
+// RegisterSMSProvider makes the provider available by name on SMS_PROVIDER. If a
+// provider with the same name is registered, it is replaced.
+func RegisterSMSProvider(name string, factory SMSProviderFactory) {
+	smsProvidersLock.Lock()
+	defer smsProvidersLock.Unlock()
+	smsProviders[name] = factory
+}
+
+// SMSProviders returns the names of the registered providers, sorted.
+func SMSProviders() []string {
+	smsProvidersLock.RLock()
+	defer smsProvidersLock.RUnlock()
+	names := make([]string, 0, len(smsProviders))
+	for name := range smsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSMSProvider returns a new provider of the registered name.
+func NewSMSProvider(name string) (SMSProvider, error) {
+	smsProvidersLock.RLock()
+	factory, ok := smsProviders[name]
+	smsProvidersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown SMS provider %q, available: %v", name, SMSProviders())
+	}
+	return factory()
+}
+
+// WeightedSMSProvider is a provider of a chain, with its weight.
+type WeightedSMSProvider struct {
+	SMSProvider
+	Weight int
+}
+
+// ParseSMSProviders returns the providers of the config, an ordered comma separated
+// list of registered provider names with an optional weight, i.e
+// "twilio:3,messagebird:1,webhook". A provider without weight is only used as
+// fallback, except the first one which has weight 1.
+func ParseSMSProviders(config string) ([]WeightedSMSProvider, error) {
+	providers := []WeightedSMSProvider{}
+	for i, entry := range strings.Split(config, ",") {
+		name, weight, hasWeight := strings.Cut(strings.TrimSpace(entry), ":")
+		p := WeightedSMSProvider{}
+		if i == 0 {
+			p.Weight = 1
+		}
+		if hasWeight {
+			var err error
+			if p.Weight, err = strconv.Atoi(weight); err != nil || p.Weight < 0 {
+				return nil, fmt.Errorf("invalid weight %q for SMS provider %s", weight, name)
+			}
+		}
+		var err error
+		if p.SMSProvider, err = NewSMSProvider(name); err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// funcSMSProvider is a provider that calls a SendChallengeFunc.
+type funcSMSProvider struct {
+	name string
+	fn   SendChallengeFunc
+}
+
+func (p *funcSMSProvider) Name() string {
+	return p.name
+}
+
+func (p *funcSMSProvider) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int,
+	message string,
+) (string, error) {
+	return "", p.fn(phone, challenge, message)
+}
+
+// chainProvider is a provider of the chain with its health status.
+type chainProvider struct {
+	WeightedSMSProvider
+	failures       int
+	unhealthyUntil time.Time
+}
+
+func (p *chainProvider) healthy(now time.Time) bool {
+	return !now.Before(p.unhealthyUntil)
+}
+
+// SMSProviderChain is an ordered list of providers with failover. The first attempt
+// of each SMS picks a healthy provider with a probability proportional to its weight,
+// and the retries walk the chain in order from the previous provider. A provider is
+// unhealthy after MaxFailures consecutive failures, and skipped until the Cooldown
+// time passes (unless all the providers are unhealthy).
+type SMSProviderChain struct {
+	MaxFailures int
+	Cooldown    time.Duration
+	providers   []*chainProvider
+	random      *rand.Rand
+	lock        sync.Mutex
+}
+
+// NewSMSProviderChain returns a chain of the providers, in order.
+func NewSMSProviderChain(providers ...WeightedSMSProvider) (*SMSProviderChain, error) {
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no SMS providers defined")
+	}
+	c := &SMSProviderChain{
+		MaxFailures: DefaultSMSProviderMaxFailures,
+		Cooldown:    DefaultSMSProviderCooldown,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, p := range providers {
+		if p.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d for SMS provider %s", p.Weight, p.Name())
+		}
+		c.providers = append(c.providers, &chainProvider{WeightedSMSProvider: p})
+	}
+	return c, nil
+}
+
+// Len returns the number of providers of the chain.
+func (c *SMSProviderChain) Len() int {
+	return len(c.providers)
+}
+
+// Healthy returns the names of the healthy providers, in order.
+func (c *SMSProviderChain) Healthy() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	names := []string{}
+	for _, p := range c.providers {
+		if p.healthy(now) {
+			names = append(names, p.Name())
+		}
+	}
+	return names
+}
+
+// Send sends the challenge message with the provider that follows prev on the chain (a
+// negative prev for the first attempt), and records the result on its health
+// status. It returns the index of the provider used and the message ID.
+func (c *SMSProviderChain) Send(prev int, phone *phonenumbers.PhoneNumber, challenge int,
+	message string,
+) (int, string, error) {
+	index := c.pick(prev, time.Now())
+	p := c.providers[index]
+	id, err := p.SendChallenge(phone, challenge, message)
+	c.report(index, err, time.Now())
+	if err != nil {
+		return index, "", fmt.Errorf("%s: %w", p.Name(), err)
+	}
+	return index, id, nil
+}
+
+// Name returns the name of the provider at index.
+func (c *SMSProviderChain) Name(index int) string {
+	if index < 0 || index >= len(c.providers) {
+		return ""
+	}
+	return c.providers[index].Name()
+}
+
+// pick returns the index of the provider to use after prev.
+func (c *SMSProviderChain) pick(prev int, now time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := len(c.providers)
+	if prev < 0 || prev >= n {
+		total := 0
+		for _, p := range c.providers {
+			if p.healthy(now) {
+				total += p.Weight
+			}
+		}
+		if total > 0 {
+			r := c.random.Intn(total)
+			for i, p := range c.providers {
+				if !p.healthy(now) {
+					continue
+				}
+				if r < p.Weight {
+					return i
+				}
+				r -= p.Weight
+			}
+		}
+		// No healthy weighted provider, walk the chain from the beginning
+		prev = n - 1
+	}
+	for i := 1; i <= n; i++ {
+		if j := (prev + i) % n; c.providers[j].healthy(now) {
+			return j
+		}
+	}
+	return (prev + 1) % n
+}
+
+// report updates the health status of the provider at index with the result of a send.
+func (c *SMSProviderChain) report(index int, err error, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := c.providers[index]
+	if err == nil {
+		p.failures = 0
+		p.unhealthyUntil = time.Time{}
+		return
+	}
+	p.failures++
+	if p.failures >= c.MaxFailures {
+		p.unhealthyUntil = now.Add(c.Cooldown)
+		log.Warnf("SMS provider %s is unhealthy after %d failures, skipped for %s",
+			p.Name(), p.failures, c.Cooldown)
+	}
+}
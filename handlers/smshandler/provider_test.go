@@ -0,0 +1,230 @@
+package smshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/nyaruka/phonenumbers"
+)
+
+// testProvider is a provider that fails while failing is set, counting the calls.
+type testProvider struct {
+	name    string
+	lock    sync.Mutex
+	failing bool
+	calls   int
+}
+
+func (p *testProvider) Name() string {
+	return p.name
+}
+
+func (p *testProvider) SendChallenge(phone *phonenumbers.PhoneNumber, challenge int,
+	message string,
+) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.calls++
+	if p.failing {
+		return "", fmt.Errorf("provider down")
+	}
+	return fmt.Sprintf("%s-%d", p.name, p.calls), nil
+}
+
+func TestSMSProviderChain(t *testing.T) {
+	phone := mockPhone()
+
+	// A single provider is used for all the retries
+	single := &testProvider{name: "single", failing: true}
+	chain, err := NewSMSProviderChain(WeightedSMSProvider{SMSProvider: single, Weight: 1})
+	qt.Assert(t, err, qt.IsNil)
+	prev := -1
+	for i := 0; i < 5; i++ {
+		prev, _, err = chain.Send(prev, phone, 123456, "Code 123456")
+		qt.Assert(t, err, qt.ErrorMatches, "single: provider down")
+		qt.Assert(t, prev, qt.Equals, 0)
+	}
+	qt.Assert(t, single.calls, qt.Equals, 5)
+
+	// The retries walk the chain, skipping the unhealthy providers
+	p1, p2, p3 := &testProvider{name: "p1", failing: true}, &testProvider{name: "p2", failing: true},
+		&testProvider{name: "p3"}
+	chain, err = NewSMSProviderChain(
+		WeightedSMSProvider{SMSProvider: p1, Weight: 1},
+		WeightedSMSProvider{SMSProvider: p2},
+		WeightedSMSProvider{SMSProvider: p3},
+	)
+	qt.Assert(t, err, qt.IsNil)
+	chain.MaxFailures = 2
+	chain.Cooldown = 200 * time.Millisecond
+	used := []int{}
+	prev = -1
+	for {
+		prev, _, err = chain.Send(prev, phone, 123456, "Code 123456")
+		used = append(used, prev)
+		if err == nil {
+			break
+		}
+	}
+	qt.Assert(t, used, qt.DeepEquals, []int{0, 1, 2})
+	qt.Assert(t, chain.Healthy(), qt.DeepEquals, []string{"p1", "p2", "p3"})
+	_, _, err = chain.Send(-1, phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	qt.Assert(t, chain.Healthy(), qt.DeepEquals, []string{"p2", "p3"})
+
+	// The first attempt skips the unhealthy p1, the retry skips p1 too
+	index, _, err := chain.Send(-1, phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	qt.Assert(t, index, qt.Equals, 1)
+	qt.Assert(t, chain.Healthy(), qt.DeepEquals, []string{"p3"})
+	index, id, err := chain.Send(2, phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, index, qt.Equals, 2)
+	qt.Assert(t, id, qt.Equals, "p3-2")
+	qt.Assert(t, chain.Name(index), qt.Equals, "p3")
+	calls := p1.calls
+
+	// After the cooldown the providers are tried again, and recover on success
+	time.Sleep(chain.Cooldown)
+	p1.failing = false
+	index, _, err = chain.Send(-1, phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, index, qt.Equals, 0)
+	qt.Assert(t, p1.calls, qt.Equals, calls+1)
+	qt.Assert(t, chain.Healthy(), qt.DeepEquals, []string{"p1", "p2", "p3"})
+
+	// The first attempts are distributed by weight
+	a, b, c := &testProvider{name: "a"}, &testProvider{name: "b"}, &testProvider{name: "c"}
+	chain, err = NewSMSProviderChain(
+		WeightedSMSProvider{SMSProvider: a, Weight: 3},
+		WeightedSMSProvider{SMSProvider: b, Weight: 1},
+		WeightedSMSProvider{SMSProvider: c},
+	)
+	qt.Assert(t, err, qt.IsNil)
+	for i := 0; i < 400; i++ {
+		_, _, err := chain.Send(-1, phone, 123456, "Code 123456")
+		qt.Assert(t, err, qt.IsNil)
+	}
+	qt.Assert(t, a.calls > 2*b.calls, qt.IsTrue, qt.Commentf("a:%d b:%d", a.calls, b.calls))
+	qt.Assert(t, b.calls > 0, qt.IsTrue)
+	qt.Assert(t, c.calls, qt.Equals, 0)
+
+	_, err = NewSMSProviderChain()
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+func TestParseSMSProviders(t *testing.T) {
+	RegisterSMSProvider("test", func() (SMSProvider, error) { return &testProvider{name: "test"}, nil })
+	qt.Assert(t, SMSProviders(), qt.Contains, "test")
+	qt.Assert(t, SMSProviders(), qt.Contains, "twilio")
+
+	providers, err := ParseSMSProviders("test, test:3,test")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, providers, qt.HasLen, 3)
+	for i, weight := range []int{1, 3, 0} {
+		qt.Assert(t, providers[i].Weight, qt.Equals, weight)
+	}
+	providers, err = ParseSMSProviders("test:0,test:2")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, providers[0].Weight, qt.Equals, 0)
+
+	_, err = ParseSMSProviders("test,unknown")
+	qt.Assert(t, err, qt.ErrorMatches, "unknown SMS provider.*")
+	_, err = ParseSMSProviders("test:-1")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	t.Setenv("SMS_WEBHOOK_URL", "")
+	_, err = ParseSMSProviders("webhook")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+func TestHTTPSMSProviders(t *testing.T) {
+	phone, err := phonenumbers.Parse("+34722000001", "ES")
+	qt.Assert(t, err, qt.IsNil)
+	t.Setenv("SMS_FROM", "csp")
+
+	// Webhook
+	var received map[string]interface{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		qt.Check(t, json.NewDecoder(r.Body).Decode(&received), qt.IsNil)
+		fmt.Fprint(w, `{"id":"webhook-1"}`)
+	}))
+	defer webhook.Close()
+	t.Setenv("SMS_WEBHOOK_URL", webhook.URL)
+	t.Setenv("SMS_WEBHOOK_AUTHTOKEN", "secret")
+	p, err := NewSMSProvider("webhook")
+	qt.Assert(t, err, qt.IsNil)
+	id, err := p.SendChallenge(phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, id, qt.Equals, "webhook-1")
+	qt.Assert(t, received["to"], qt.Equals, "+34722000001")
+	qt.Assert(t, received["body"], qt.Equals, "Code 123456")
+	qt.Assert(t, received["from"], qt.Equals, "csp")
+	t.Setenv("SMS_WEBHOOK_AUTHTOKEN", "other")
+	p, err = NewSMSProvider("webhook")
+	qt.Assert(t, err, qt.IsNil)
+	_, err = p.SendChallenge(phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+
+	// Vonage reports the delivery status per message
+	status := "0"
+	vonage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qt.Check(t, r.ParseForm(), qt.IsNil)
+		qt.Check(t, r.Form.Get("api_key"), qt.Equals, "key")
+		qt.Check(t, r.Form.Get("to"), qt.Equals, "34722000001")
+		qt.Check(t, r.Form.Get("text"), qt.Equals, "Code 123456")
+		fmt.Fprintf(w, `{"messages":[{"status":%q,"error-text":"Throttled","message-id":"vonage-1"}]}`, status)
+	}))
+	defer vonage.Close()
+	t.Setenv("VONAGE_API_KEY", "key")
+	t.Setenv("VONAGE_API_SECRET", "secret")
+	vp, err := NewVonageSMS()
+	qt.Assert(t, err, qt.IsNil)
+	vp.url = vonage.URL
+	id, err = vp.SendChallenge(phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, id, qt.Equals, "vonage-1")
+	status = "1"
+	_, err = vp.SendChallenge(phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.ErrorMatches, "vonage status 1: Throttled")
+
+	// AWS SNS requests are signed (SigV4)
+	sns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qt.Check(t, r.ParseForm(), qt.IsNil)
+		qt.Check(t, r.Form.Get("Action"), qt.Equals, "Publish")
+		qt.Check(t, r.Form.Get("PhoneNumber"), qt.Equals, "+34722000001")
+		qt.Check(t, r.Header.Get("X-Amz-Date"), qt.Equals, "20240102T030405Z")
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20240102/eu-west-1/sns/aws4_request, "+
+			"SignedHeaders=content-type;host;x-amz-date, Signature=") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `<PublishResponse><PublishResult><MessageId>sns-1</MessageId></PublishResult></PublishResponse>`)
+	}))
+	defer sns.Close()
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	sp, err := NewSNSSMS()
+	qt.Assert(t, err, qt.IsNil)
+	sp.url = sns.URL + "/"
+	sp.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	id, err = sp.SendChallenge(phone, 123456, "Code 123456")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, id, qt.Equals, "sns-1")
+	t.Setenv("AWS_REGION", "")
+	_, err = NewSNSSMS()
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
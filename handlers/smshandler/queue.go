@@ -5,51 +5,184 @@ import (
 	"time"
 
 	"github.com/enriquebris/goconcurrentqueue"
+	"github.com/google/uuid"
 	"github.com/nyaruka/phonenumbers"
 	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/log"
 )
 
+// QueueItem is a challenge of the SMS queue. The queue items are persisted on the
+// storage until the challenge is sent and acknowledged, so the pending challenges
+// survive a restart (at-least-once delivery). The challenges that cannot be sent are
+// kept as dead letters. The code and the message are never persisted, on recovery
+// they are taken from the pending attempt of the user election.
+type QueueItem struct {
+	ID         string                    `json:"id" bson:"_id"`
+	UserID     types.HexBytes            `json:"userId" bson:"userid"`
+	ElectionID types.HexBytes            `json:"electionId" bson:"electionid"`
+	Phone      *phonenumbers.PhoneNumber `json:"phone,omitempty" bson:"phone,omitempty"`
+	StartTime  time.Time                 `json:"startTime" bson:"starttime"`
+	Retries    int                       `json:"retries" bson:"retries"`
+	Provider   int                       `json:"provider" bson:"provider"`
+	// Sent is set when the provider accepts the message, until the queue acknowledges it
+	Sent         bool       `json:"sent,omitempty" bson:"sent,omitempty"`
+	ProviderName string     `json:"providerName,omitempty" bson:"providername,omitempty"`
+	MessageID    string     `json:"messageId,omitempty" bson:"messageid,omitempty"`
+	LastError    string     `json:"lastError,omitempty" bson:"lasterror,omitempty"`
+	FailedAt     *time.Time `json:"failedAt,omitempty" bson:"failedat,omitempty"`
+}
+
 type challengeData struct {
+	id         string
 	userID     types.HexBytes
 	electionID types.HexBytes
 	phone      *phonenumbers.PhoneNumber
 	challenge  int
+	message    string
 	startTime  time.Time
 	retries    int
+	provider   int // index of the provider of the last attempt, -1 if none
+	sent       bool
 	success    bool
+	lastError  string
+	// set on success, for the delivery status
+	providerName string
+	messageID    string
 }
 
+// String returns the phone and the ID of the challenge, the code is never logged.
 func (c challengeData) String() string {
-	return fmt.Sprintf("%d[%d]", c.phone.GetNationalNumber(), c.challenge)
+	return fmt.Sprintf("%d[%s]", c.phone.GetNationalNumber(), c.id)
+}
+
+// item returns the queue item of the challenge.
+func (c challengeData) item() *QueueItem {
+	return &QueueItem{
+		ID:           c.id,
+		UserID:       c.userID,
+		ElectionID:   c.electionID,
+		Phone:        c.phone,
+		StartTime:    c.startTime,
+		Retries:      c.retries,
+		Provider:     c.provider,
+		Sent:         c.sent,
+		ProviderName: c.providerName,
+		MessageID:    c.messageID,
+		LastError:    c.lastError,
+	}
 }
 
+// newChallengeData returns the challenge of a queue item, without the code and the message.
+func newChallengeData(item *QueueItem) challengeData {
+	return challengeData{
+		id:           item.ID,
+		userID:       item.UserID,
+		electionID:   item.ElectionID,
+		phone:        item.Phone,
+		startTime:    item.StartTime,
+		retries:      item.Retries,
+		provider:     item.Provider,
+		sent:         item.Sent,
+		providerName: item.ProviderName,
+		messageID:    item.MessageID,
+		lastError:    item.LastError,
+	}
+}
+
+// messageFunc returns the SMS message of a challenge.
+type messageFunc func(userID, electionID types.HexBytes, challenge int) string
+
 type smsQueue struct {
-	queue         *goconcurrentqueue.FIFO
-	ttl           time.Duration
-	throttle      time.Duration
-	sendChallenge []SendChallengeFunc
-	response      chan (challengeData)
+	queue     *goconcurrentqueue.FIFO
+	ttl       time.Duration
+	throttle  time.Duration
+	providers *SMSProviderChain
+	stg       Storage
+	message   messageFunc
+	response  chan (challengeData)
 }
 
-func newSmsQueue(ttl, throttle time.Duration, sChFns []SendChallengeFunc) *smsQueue {
+func newSmsQueue(ttl, throttle time.Duration, providers *SMSProviderChain, stg Storage,
+	message messageFunc,
+) *smsQueue {
 	return &smsQueue{
-		queue:         goconcurrentqueue.NewFIFO(),
-		response:      make(chan challengeData, 1),
-		sendChallenge: sChFns,
-		ttl:           ttl,
-		throttle:      throttle,
+		queue:     goconcurrentqueue.NewFIFO(),
+		response:  make(chan challengeData, 1),
+		providers: providers,
+		stg:       stg,
+		message:   message,
+		ttl:       ttl,
+		throttle:  throttle,
+	}
+}
+
+// recover enqueues the challenges persisted before a restart. The challenges with the
+// TTL reached are moved to the dead letters, since the user can already request a new
+// one. The code of the challenges not sent yet is taken from the user election, if the
+// attempt is no longer pending they are moved to the dead letters too. Must be called
+// before run.
+func (sq *smsQueue) recover() error {
+	items, err := sq.stg.QueueItems()
+	if err != nil {
+		return fmt.Errorf("cannot load the sms queue: %w", err)
+	}
+	for i := range items {
+		c := newChallengeData(&items[i])
+		if !c.sent && time.Now().After(c.startTime.Add(sq.ttl)) {
+			sq.deadLetter(c, "TTL reached before restart")
+			continue
+		}
+		if !c.sent {
+			if c.challenge, err = sq.pendingChallenge(c); err != nil {
+				sq.deadLetter(c, err.Error())
+				continue
+			}
+			c.message = sq.message(c.userID, c.electionID, c.challenge)
+		}
+		if err := sq.queue.Enqueue(c); err != nil {
+			return fmt.Errorf("cannot enqueue sms: %w", err)
+		}
 	}
+	if len(items) > 0 {
+		log.Infof("recovered %d sms from the queue", len(items))
+	}
+	return nil
 }
 
-func (sq *smsQueue) add(userID, electionID types.HexBytes, phone *phonenumbers.PhoneNumber, challenge int) error {
+// pendingChallenge returns the code of the attempt of a challenge. The attempt must be
+// still pending and not replaced by a newer one, started after the challenge.
+func (sq *smsQueue) pendingChallenge(c challengeData) (int, error) {
+	user, err := sq.stg.User(c.userID)
+	if err != nil {
+		return 0, fmt.Errorf("cannot get the user: %w", err)
+	}
+	election, ok := user.Elections[c.electionID.String()]
+	if !ok {
+		return 0, ErrUserNotBelongsToElection
+	}
+	if election.Consumed || election.AuthToken == nil || election.LastAttempt == nil ||
+		election.LastAttempt.After(c.startTime) {
+		return 0, fmt.Errorf("challenge attempt no longer pending")
+	}
+	return election.Challenge, nil
+}
+
+func (sq *smsQueue) add(userID, electionID types.HexBytes, phone *phonenumbers.PhoneNumber,
+	challenge int, message string,
+) error {
 	c := challengeData{
+		id:         uuid.New().String(),
 		userID:     userID,
 		electionID: electionID,
 		phone:      phone,
 		challenge:  challenge,
+		message:    message,
 		startTime:  time.Now(),
 		retries:    0,
+		provider:   -1,
+	}
+	if err := sq.stg.SetQueueItem(c.item()); err != nil {
+		return fmt.Errorf("cannot persist sms: %w", err)
 	}
 	defer log.Debugf("%s: enqueued new sms with challenge", c)
 	return sq.queue.Enqueue(c)
@@ -64,21 +197,31 @@ func (sq *smsQueue) run() {
 			continue
 		}
 		challenge := c.(challengeData)
-		// if multiple providers are defined, use them in round-robin
-		// (try #0 will use first provider, retry #1 second provider, retry #2 first provider again)
-		sendChallenge := sq.sendChallenge[challenge.retries%2]
-		if err := sendChallenge(challenge.phone, challenge.challenge); err != nil {
-			// Fail
-			log.Warnf("%s: failed to send sms: %v", challenge, err)
-			if err := sq.reenqueue(challenge); err != nil {
-				log.Warnf("%s: removed from sms queue: %v", challenge, err)
-				// Send a signal (channel) to let the caller know we are removing this element
-				challenge.success = false
-				sq.response <- challenge
+		// a recovered challenge already sent is only pending of the acknowledge
+		if !challenge.sent {
+			// the retries use the next healthy provider of the chain
+			challenge.provider, challenge.messageID, err = sq.providers.Send(challenge.provider,
+				challenge.phone, challenge.challenge, challenge.message)
+			if err != nil {
+				// Fail
+				log.Warnf("%s: failed to send sms: %v", challenge, err)
+				challenge.lastError = err.Error()
+				if err := sq.reenqueue(challenge); err != nil {
+					log.Warnf("%s: removed from sms queue: %v", challenge, err)
+					sq.deadLetter(challenge, err.Error())
+					// Send a signal (channel) to let the caller know we are removing this element
+					challenge.success = false
+					sq.response <- challenge
+				}
+				continue
+			}
+			// Success, persisted so a restart before the acknowledge does not send it again
+			challenge.providerName = sq.providers.Name(challenge.provider)
+			challenge.sent = true
+			if err := sq.stg.SetQueueItem(challenge.item()); err != nil {
+				log.Warnf("%s: cannot persist sms: %v", challenge, err)
 			}
-			continue
 		}
-		// Success
 		log.Debugf("%s: sms with challenge successfully sent", challenge)
 		// Send a signal (channel) to let the caller know we succeed
 		challenge.success = true
@@ -93,9 +236,36 @@ func (sq *smsQueue) reenqueue(challenge challengeData) error {
 	}
 	// enqueue it again
 	challenge.retries++
+	if err := sq.stg.SetQueueItem(challenge.item()); err != nil {
+		log.Warnf("%s: cannot persist sms: %v", challenge, err)
+	}
 	if err := sq.queue.Enqueue(challenge); err != nil {
 		return fmt.Errorf("cannot enqueue sms: %w", err)
 	}
 	log.Infof("%s: re-enqueued sms, retry #%d", challenge, challenge.retries)
 	return nil
 }
+
+// ack removes a processed challenge from the persisted queue. It must be called before
+// charging the attempt of the user, so a restart never charges the same challenge twice.
+func (sq *smsQueue) ack(challenge challengeData) {
+	if err := sq.stg.DelQueueItem(challenge.id); err != nil {
+		log.Warnf("%s: cannot remove sms from the queue: %v", challenge, err)
+	}
+}
+
+// deadLetter moves a challenge that cannot be sent from the persisted queue to the dead
+// letters, the user has to request a new one.
+func (sq *smsQueue) deadLetter(challenge challengeData, reason string) {
+	item := challenge.item()
+	item.LastError = reason
+	if challenge.lastError != "" && challenge.lastError != reason {
+		item.LastError = fmt.Sprintf("%s: %s", reason, challenge.lastError)
+	}
+	now := time.Now()
+	item.FailedAt = &now
+	if err := sq.stg.AddDeadLetter(item); err != nil {
+		log.Warnf("%s: cannot store the dead letter: %v", challenge, err)
+	}
+	sq.ack(challenge)
+}
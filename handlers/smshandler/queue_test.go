@@ -0,0 +1,133 @@
+package smshandler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/uuid"
+	"github.com/nyaruka/phonenumbers"
+	"github.com/vocdoni/blind-csp/test"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+func TestSmsQueueRecovery(t *testing.T) {
+	stg := &JSONstorage{}
+	qt.Assert(t, stg.Init(t.TempDir(), 2, time.Minute), qt.IsNil)
+
+	// the queue items persisted before a restart
+	phone := func(number string) *phonenumbers.PhoneNumber {
+		p, err := phonenumbers.Parse(number, DefaultPhoneCountry)
+		qt.Assert(t, err, qt.IsNil)
+		return p
+	}
+	userID := test.StrToHex(testStorageUser1)
+	electionID := test.StrToHex(testStorageProcess1)
+	qt.Assert(t, stg.AddUser(userID, []types.HexBytes{electionID}, "+34655111222", ""), qt.IsNil)
+	token := uuid.New()
+	_, err := stg.NewAttempt(userID, electionID, 111111, &token)
+	qt.Assert(t, err, qt.IsNil)
+	now := time.Now()
+	items := []*QueueItem{
+		{ID: "pending", Phone: phone("+34655111222"), StartTime: now, Provider: -1},
+		{
+			ID: "sent", Phone: phone("+34655333444"), StartTime: now.Add(-time.Second),
+			Provider: 0, Sent: true, ProviderName: "func0", MessageID: "SM1",
+		},
+		{ID: "replaced", Phone: phone("+34655111222"), StartTime: now.Add(-30 * time.Second), Provider: -1},
+		{ID: "expired", Phone: phone("+34655555666"), StartTime: now.Add(-2 * time.Minute)},
+	}
+	for _, item := range items {
+		item.UserID, item.ElectionID = userID, electionID
+		qt.Assert(t, stg.SetQueueItem(item), qt.IsNil)
+	}
+
+	challenge := newChallengeMock()
+	providers, err := NewSMSProviderChain(WeightedSMSProvider{
+		SMSProvider: &funcSMSProvider{name: "func0", fn: challenge.sendChallenge},
+		Weight:      1,
+	})
+	qt.Assert(t, err, qt.IsNil)
+	sq := newSmsQueue(time.Minute, time.Millisecond, providers, stg, testMessage)
+	qt.Assert(t, sq.recover(), qt.IsNil)
+	go sq.run()
+
+	// the pending item is sent with the code of the attempt, the sent one is only acknowledged
+	responses := map[string]challengeData{}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-sq.response:
+			qt.Assert(t, r.success, qt.IsTrue)
+			responses[r.id] = r
+			sq.ack(r)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the recovered sms")
+		}
+	}
+	qt.Assert(t, responses["pending"].providerName, qt.Equals, "func0")
+	qt.Assert(t, challenge.getSolution(items[0].Phone, 0), qt.Equals, 111111)
+	qt.Assert(t, responses["sent"].messageID, qt.Equals, "SM1")
+	qt.Assert(t, challenge.Recipients(), qt.Equals, 1)
+	pending, err := stg.QueueItems()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, pending, qt.HasLen, 0)
+
+	// the expired item and the one replaced by a newer attempt are dead letters
+	deadLetters, err := stg.DeadLetters()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, deadLetters, qt.HasLen, 2)
+	reasons := map[string]string{}
+	for _, item := range deadLetters {
+		qt.Assert(t, item.FailedAt, qt.IsNotNil)
+		reasons[item.ID] = item.LastError
+	}
+	qt.Assert(t, reasons["expired"], qt.Contains, "TTL reached")
+	qt.Assert(t, reasons["replaced"], qt.Contains, "no longer pending")
+}
+
+func testMessage(userID, electionID types.HexBytes, challenge int) string {
+	return fmt.Sprintf("code %d", challenge)
+}
+
+func TestSmsQueueDeadLetter(t *testing.T) {
+	stg := &JSONstorage{}
+	qt.Assert(t, stg.Init(t.TempDir(), 2, time.Minute), qt.IsNil)
+
+	providers, err := NewSMSProviderChain(WeightedSMSProvider{
+		SMSProvider: &funcSMSProvider{
+			name: "func0",
+			fn: func(phone *phonenumbers.PhoneNumber, challenge int, message string) error {
+				return fmt.Errorf("provider is down")
+			},
+		},
+		Weight: 1,
+	})
+	qt.Assert(t, err, qt.IsNil)
+	sq := newSmsQueue(time.Minute, time.Millisecond, providers, stg, testMessage)
+	go sq.run()
+
+	phone, err := phonenumbers.Parse("+34655111222", DefaultPhoneCountry)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, sq.add(test.StrToHex(testStorageUser1), test.StrToHex(testStorageProcess1),
+		phone, 111111, "code 111111"), qt.IsNil)
+	items, err := stg.QueueItems()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, items, qt.HasLen, 1)
+
+	select {
+	case r := <-sq.response:
+		qt.Assert(t, r.success, qt.IsFalse)
+		qt.Assert(t, r.retries, qt.Equals, DefaultSMSqueueMaxRetries)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the failed sms")
+	}
+	items, err = stg.QueueItems()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, items, qt.HasLen, 0)
+	deadLetters, err := stg.DeadLetters()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, deadLetters, qt.HasLen, 1)
+	qt.Assert(t, deadLetters[0].Retries, qt.Equals, DefaultSMSqueueMaxRetries)
+	qt.Assert(t, deadLetters[0].LastError, qt.Contains, "provider is down")
+}
@@ -2,16 +2,20 @@ package smshandler
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/messagebird/go-rest-api/v7/signature_jwt"
 	"github.com/nyaruka/phonenumbers"
+	twilioclient "github.com/twilio/twilio-go/client"
 	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/httprouter"
 	"go.vocdoni.io/dvote/log"
@@ -31,15 +35,27 @@ const (
 )
 
 // SmsHandler is a handler that requires a simple math operation to be resolved.
+// The SMS are sent with the SendChallenge functions if defined (in order, as
+// fallbacks), else with the providers of SMS_PROVIDER (see ParseSMSProviders).
+// The messages are rendered with Messages if defined, else with the templates of
+// the environment (see NewSMSMessagesFromEnv). The delivery status callbacks of the
+// providers refund the attempts of the failed deliveries (see Delivery).
 type SmsHandler struct {
-	stg           Storage
-	smsQueue      *smsQueue
-	mathRandom    *rand.Rand
-	SendChallenge []SendChallengeFunc
+	stg                  Storage
+	smsQueue             *smsQueue
+	mathRandom           *rand.Rand
+	SendChallenge        []SendChallengeFunc
+	Messages             *SMSMessages
+	providers            *SMSProviderChain
+	callbackURL          string
+	twilioValidator      *twilioclient.RequestValidator
+	messageBirdValidator *signature_jwt.Validator
+	deliveryLock         sync.Mutex
 }
 
-// SendChallengeFunc is the function that sends the SMS challenge to a phone number.
-type SendChallengeFunc func(phone *phonenumbers.PhoneNumber, challenge int) error
+// SendChallengeFunc is the function that sends the SMS message with the challenge
+// to a phone number.
+type SendChallengeFunc func(phone *phonenumbers.PhoneNumber, challenge int, message string) error
 
 // Name returns the name for the handler.
 func (sh *SmsHandler) Name() string {
@@ -103,26 +119,39 @@ func (sh *SmsHandler) Init(r *httprouter.HTTProuter, baseURL string, opts ...str
 		return err
 	}
 
-	// set challenge function (if not defined, use Twilio)
-	if sh.SendChallenge == nil {
-		switch os.Getenv("SMS_PROVIDER") {
-		case "messagebird":
-			sh.SendChallenge = []SendChallengeFunc{NewMessageBirdSMS().SendChallenge}
-		case "messagebird,twilio":
-			sh.SendChallenge = []SendChallengeFunc{
-				NewMessageBirdSMS().SendChallenge,
-				NewTwilioSMS().SendChallenge,
+	// set the SMS providers (if not defined, use Twilio)
+	var providers []WeightedSMSProvider
+	if sh.SendChallenge != nil {
+		for i, fn := range sh.SendChallenge {
+			p := WeightedSMSProvider{SMSProvider: &funcSMSProvider{name: fmt.Sprintf("func%d", i), fn: fn}}
+			if i == 0 {
+				p.Weight = 1
 			}
-		case "twilio,messagebird":
-			sh.SendChallenge = []SendChallengeFunc{
-				NewTwilioSMS().SendChallenge,
-				NewMessageBirdSMS().SendChallenge,
-			}
-		default:
-			sh.SendChallenge = []SendChallengeFunc{NewTwilioSMS().SendChallenge}
+			providers = append(providers, p)
+		}
+	} else {
+		config := os.Getenv("SMS_PROVIDER")
+		if config == "" {
+			config = DefaultSMSProvider
+		}
+		if providers, err = ParseSMSProviders(config); err != nil {
+			return err
+		}
+	}
+	if sh.providers, err = NewSMSProviderChain(providers...); err != nil {
+		return err
+	}
+
+	// set the SMS message templates
+	if sh.Messages == nil {
+		if sh.Messages, err = NewSMSMessagesFromEnv(smsCoolDownTime); err != nil {
+			return err
 		}
 	}
 
+	// set the delivery status callbacks of the providers
+	sh.initStatusCallbacks(r, baseURL)
+
 	// check for files to import to the storage database
 	importFile := os.Getenv("CSP_IMPORT_FILE")
 	if importFile != "" {
@@ -133,8 +162,16 @@ func (sh *SmsHandler) Init(r *httprouter.HTTProuter, baseURL string, opts ...str
 	sh.smsQueue = newSmsQueue(
 		smsCoolDownTime,
 		smsThrottle,
-		sh.SendChallenge,
+		sh.providers,
+		sh.stg,
+		func(userID, electionID types.HexBytes, challenge int) string {
+			message, _ := sh.message(userID, electionID, challenge)
+			return message
+		},
 	)
+	if err := sh.smsQueue.recover(); err != nil {
+		return err
+	}
 	go sh.smsQueue.run()
 	go sh.smsQueueController()
 	return nil
@@ -144,11 +181,16 @@ func (sh *SmsHandler) smsQueueController() {
 	for {
 		r := <-sh.smsQueue.response
 		if r.success {
+			// acknowledged first, a restart after the ack must not charge the attempt again
+			sh.smsQueue.ack(r)
 			if err := sh.stg.SetAttempts(r.userID, r.electionID, -1); err != nil {
 				log.Warnf("challenge cannot be sent: %v", err)
 			} else {
 				log.Infof("%s: challenge successfully sent to user %s", r, r.userID)
 			}
+			if err := sh.recordSent(r); err != nil {
+				log.Warnf("%s: cannot record the delivery: %v", r, err)
+			}
 		} else {
 			log.Warnf("%s: challenge sending failed", r)
 		}
@@ -280,12 +322,14 @@ func (sh *SmsHandler) Auth(r *http.Request, c *types.Message,
 			log.Warnf("phone is nil for user %s", userID)
 			return types.AuthResponse{Response: []string{"no phone for this user data"}}
 		}
-		// Enqueue to send the SMS challenge
-		if err := sh.smsQueue.add(userID, electionID, phone, challenge); err != nil {
+		// Enqueue to send the SMS challenge, localized for the user and election
+		message, lang := sh.message(userID, electionID, challenge)
+		log.Debugf("user %s challenge message language: %s", userID, lang)
+		if err := sh.smsQueue.add(userID, electionID, phone, challenge, message); err != nil {
 			log.Errorf("cannot enqueue challenge: %v", err)
 			return types.AuthResponse{Response: []string{"problem with SMS challenge system"}}
 		}
-		log.Infof("user %s challenged with %d at phone %d", userID.String(), challenge, phone.GetNationalNumber())
+		log.Infof("user %s challenged at phone %d", userID.String(), phone.GetNationalNumber())
 
 		// Build success reply
 		phoneStr := strconv.FormatUint(phone.GetNationalNumber(), 10)
@@ -308,11 +352,11 @@ func (sh *SmsHandler) Auth(r *http.Request, c *types.Message,
 		}
 		// Verify the challenge solution
 		if err := sh.stg.VerifyChallenge(electionID, c.AuthToken, solution); err != nil {
-			log.Warnf("verify challenge %d failed: %v", solution, err)
+			log.Warnf("verify challenge failed: %v", err)
 			return types.AuthResponse{Response: []string{"challenge not completed"}}
 		}
 
-		log.Infof("new user registered, challenge resolved %s", c.AuthData[0])
+		log.Infof("new user registered, challenge resolved")
 		return types.AuthResponse{
 			Response: []string{"challenge resolved"},
 			Success:  true,
@@ -322,6 +366,22 @@ func (sh *SmsHandler) Auth(r *http.Request, c *types.Message,
 	return types.AuthResponse{Response: []string{"invalid auth step"}}
 }
 
+// message returns the SMS message with the challenge for the user and election, and
+// its language.
+func (sh *SmsHandler) message(userID, electionID types.HexBytes, challenge int) (string, string) {
+	user, err := sh.stg.User(userID)
+	if err != nil {
+		log.Warnf("cannot get user %s for the SMS message: %v", userID, err)
+	}
+	election, err := sh.stg.ElectionTemplate(electionID)
+	if err != nil {
+		if !errors.Is(err, ErrElectionTemplateUnknown) {
+			log.Warnf("cannot get election %s SMS template: %v", electionID, err)
+		}
+	}
+	return sh.Messages.Message(user, election, challenge)
+}
+
 // RequireCertificate must return true if the auth handler requires some kind of client
 // TLS certificate. If true then CertificateCheck() and HardcodedCertificate() methods
 // must be correctly implemented. Else both function can just return true and nil.
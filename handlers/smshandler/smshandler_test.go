@@ -8,6 +8,7 @@ import (
 
 	qt "github.com/frankban/quicktest"
 	"github.com/nyaruka/phonenumbers"
+	"github.com/vocdoni/blind-csp/test"
 	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/log"
 )
@@ -92,13 +93,13 @@ type usersMock struct {
 
 var usersMockData = []usersMock{
 	{
-		userID:    testStrToHex("6c0b6e1020b6354c714fc65aa198eb95e663f038e32026671c58677e0e0f8eac"),
-		elections: []types.HexBytes{testStrToHex("c3095ff57150285cccf880e712e353a16251de6670f7aa1b069e6416cb641f5a")},
+		userID:    test.StrToHex("6c0b6e1020b6354c714fc65aa198eb95e663f038e32026671c58677e0e0f8eac"),
+		elections: []types.HexBytes{test.StrToHex("c3095ff57150285cccf880e712e353a16251de6670f7aa1b069e6416cb641f5a")},
 		phone:     mockPhone(),
 	},
 	{
-		userID:    testStrToHex("bf5b6a9c69a5abee870b3667e92c589ef9c13458be0fc0493b2ba5a9658c690b"),
-		elections: []types.HexBytes{testStrToHex("7ad9ef89d38a0e55cd8eb6b5f532d34c9ea8d4fe630e0d29247aa94e2e854402")},
+		userID:    test.StrToHex("bf5b6a9c69a5abee870b3667e92c589ef9c13458be0fc0493b2ba5a9658c690b"),
+		elections: []types.HexBytes{test.StrToHex("7ad9ef89d38a0e55cd8eb6b5f532d34c9ea8d4fe630e0d29247aa94e2e854402")},
 		phone:     mockPhone(),
 	},
 }
@@ -110,11 +111,3 @@ func mockPhone() *phonenumbers.PhoneNumber {
 	ph, _ := phonenumbers.Parse(fmt.Sprintf("%d", n), "ES")
 	return ph
 }
-
-func testStrToHex(payload string) types.HexBytes {
-	h := types.HexBytes{}
-	if err := h.FromString(payload); err != nil {
-		panic(err)
-	}
-	return h
-}
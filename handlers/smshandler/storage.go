@@ -10,8 +10,8 @@ import (
 )
 
 var (
-	// ErrTooManyAttempts is returned when no more SMS attempts available for a user.
-	ErrTooManyAttempts = fmt.Errorf("too many SMS attempts")
+	// ErrTooManyAttempts is returned when no more challenge attempts available for a user.
+	ErrTooManyAttempts = fmt.Errorf("too many challenge attempts")
 	// ErrUserUnknown is returned if the userID is not found in the database.
 	ErrUserUnknown = fmt.Errorf("user is unknown")
 	// ErrUserAlreadyVerified is returned if the user is already verified when trying to verify it.
@@ -24,6 +24,12 @@ var (
 	ErrChallengeCodeFailure = fmt.Errorf("challenge code do not match")
 	// ErrAttemptCoolDownTime is returned if the cooldown time for a challenge attempt is not reached.
 	ErrAttemptCoolDownTime = fmt.Errorf("attempt cooldown time not reached")
+	// ErrElectionTemplateUnknown is returned if the election has no SMS template.
+	ErrElectionTemplateUnknown = fmt.Errorf("election template is unknown")
+	// ErrDeliveryUnknown is returned if the SMS message ID is not found in the database.
+	ErrDeliveryUnknown = fmt.Errorf("delivery is unknown")
+	// ErrQueueItemUnknown is returned if the SMS queue item is not found in the database.
+	ErrQueueItemUnknown = fmt.Errorf("queue item is unknown")
 )
 
 // Users is the list of smshandler users.
@@ -37,6 +43,7 @@ type UserData struct {
 	Elections map[string]UserElection   `json:"elections,omitempty" bson:"elections,omitempty"`
 	ExtraData string                    `json:"extraData,omitempty" bson:"extradata,omitempty"`
 	Phone     *phonenumbers.PhoneNumber `json:"phone,omitempty" bson:"phone,omitempty"`
+	Locale    string                    `json:"locale,omitempty" bson:"locale,omitempty"`
 }
 
 // UserElection represents an election and its details owned by a user (UserData).
@@ -49,6 +56,54 @@ type UserElection struct {
 	Challenge         int            `json:"challenge,omitempty" bson:"challenge,omitempty"`
 }
 
+// NewAttempt checks that a new challenge attempt is allowed for the election
+// (not consumed, cooldown time reached and remaining attempts available) and
+// sets the challenge, the auth token and the attempt time.
+func (e *UserElection) NewAttempt(challenge int, token *uuid.UUID, coolDownTime time.Duration) error {
+	if e.Consumed {
+		return ErrUserAlreadyVerified
+	}
+	if e.LastAttempt != nil {
+		if time.Now().Before(e.LastAttempt.Add(coolDownTime)) {
+			return ErrAttemptCoolDownTime
+		}
+	}
+	if e.RemainingAttempts < 1 {
+		return ErrTooManyAttempts
+	}
+	e.AuthToken = token
+	e.Challenge = challenge
+	t := time.Now()
+	e.LastAttempt = &t
+	return nil
+}
+
+// CheckAuthToken returns nil if the token matches the pending challenge of the election.
+func (e *UserElection) CheckAuthToken(token *uuid.UUID) error {
+	if e.Consumed {
+		return ErrUserAlreadyVerified
+	}
+	if e.AuthToken == nil {
+		return fmt.Errorf("no auth token available for this election")
+	}
+	if e.AuthToken.String() != token.String() {
+		return ErrInvalidAuthToken
+	}
+	return nil
+}
+
+// Solve cleans the auth token (only 1 chance is allowed) and sets the election
+// as consumed if the solution matches the challenge. ErrChallengeCodeFailure is
+// returned otherwise, the caller must still persist the election.
+func (e *UserElection) Solve(solution int) error {
+	e.AuthToken = nil
+	e.Consumed = e.Challenge == solution
+	if !e.Consumed {
+		return ErrChallengeCodeFailure
+	}
+	return nil
+}
+
 // AuthTokenIndex is used by the storage to index a token with its userID (from UserData).
 type AuthTokenIndex struct {
 	AuthToken *uuid.UUID     `json:"authToken" bson:"_id"`
@@ -113,4 +168,28 @@ type Storage interface {
 	String() string
 	// Import insert or update a collection of users. Follows the Dump() syntax
 	Import(data []byte) (err error)
+	// SetElectionTemplate adds or replaces the SMS template of an election
+	SetElectionTemplate(tmpl *ElectionTemplate) (err error)
+	// ElectionTemplate returns the SMS template of an election
+	ElectionTemplate(electionID types.HexBytes) (tmpl *ElectionTemplate, err error)
+	// DelElectionTemplate removes the SMS template of an election
+	DelElectionTemplate(electionID types.HexBytes) (err error)
+	// SetDelivery adds or replaces the delivery status of an SMS message
+	SetDelivery(delivery *Delivery) (err error)
+	// Delivery returns the delivery status of an SMS message
+	Delivery(messageID string) (delivery *Delivery, err error)
+	// Deliveries returns the delivery status of the SMS messages sent to a user
+	Deliveries(userID types.HexBytes) (deliveries []Delivery, err error)
+	// SetQueueItem adds or replaces a pending challenge of the SMS queue
+	SetQueueItem(item *QueueItem) (err error)
+	// QueueItem returns a pending challenge of the SMS queue
+	QueueItem(id string) (item *QueueItem, err error)
+	// QueueItems returns the pending challenges of the SMS queue, the oldest first
+	QueueItems() (items []QueueItem, err error)
+	// DelQueueItem removes a challenge from the SMS queue
+	DelQueueItem(id string) (err error)
+	// AddDeadLetter stores a challenge that could not be sent
+	AddDeadLetter(item *QueueItem) (err error)
+	// DeadLetters returns the challenges that could not be sent, the oldest first
+	DeadLetters() (items []QueueItem, err error)
 }
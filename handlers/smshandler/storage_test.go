@@ -55,111 +55,111 @@ func testStorage(t *testing.T, stg Storage) {
 
 	// Check user 1 with process 1 (should be valid)
 	valid, err := stg.BelongsToElection(
-		testStrToHex(testStorageUser1),
-		testStrToHex(testStorageProcess1),
+		test.StrToHex(testStorageUser1),
+		test.StrToHex(testStorageProcess1),
 	)
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, valid, qt.IsTrue)
 
 	// Check user 1 with process 2 (should be invalid)
 	valid, err = stg.BelongsToElection(
-		testStrToHex(testStorageUser1),
-		testStrToHex(testStorageProcess2),
+		test.StrToHex(testStorageUser1),
+		test.StrToHex(testStorageProcess2),
 	)
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, valid, qt.IsFalse)
 
 	// Check user 3 with process 1 (should be valid)
 	valid, err = stg.BelongsToElection(
-		testStrToHex(testStorageUser3),
-		testStrToHex(testStorageProcess1),
+		test.StrToHex(testStorageUser3),
+		test.StrToHex(testStorageProcess1),
 	)
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, valid, qt.IsTrue)
 
 	// Check user 3 with process 2 (should be valid)
 	valid, err = stg.BelongsToElection(
-		testStrToHex(testStorageUser3),
-		testStrToHex(testStorageProcess2),
+		test.StrToHex(testStorageUser3),
+		test.StrToHex(testStorageProcess2),
 	)
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, valid, qt.IsTrue)
 
 	// Test exists
-	valid = stg.Exists(testStrToHex(testStorageUser1))
+	valid = stg.Exists(test.StrToHex(testStorageUser1))
 	qt.Assert(t, valid, qt.IsTrue)
-	valid = stg.Exists(testStrToHex(testStorageUserNonExists))
+	valid = stg.Exists(test.StrToHex(testStorageUserNonExists))
 	qt.Assert(t, valid, qt.IsFalse)
 
 	// Test get elections
-	user, err := stg.User(testStrToHex(testStorageUser3))
+	user, err := stg.User(test.StrToHex(testStorageUser3))
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, user.Elections, qt.HasLen, 2)
 
 	// Test verified
-	valid, err = stg.Verified(testStrToHex(testStorageUser1), testStrToHex(testStorageProcess1))
+	valid, err = stg.Verified(test.StrToHex(testStorageUser1), test.StrToHex(testStorageProcess1))
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, valid, qt.IsFalse)
 
 	// Test attempts
 	token1 := uuid.New()
 	challenge1 := 1987
-	phoneN, err := stg.NewAttempt(testStrToHex(testStorageUser1),
-		testStrToHex(testStorageProcess1), challenge1, &token1)
+	phoneN, err := stg.NewAttempt(test.StrToHex(testStorageUser1),
+		test.StrToHex(testStorageProcess1), challenge1, &token1)
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, int(*phoneN.CountryCode), qt.Equals, 34)
 
 	// try wrong process
-	err = stg.VerifyChallenge(testStrToHex(testStorageProcess2), &token1, challenge1)
+	err = stg.VerifyChallenge(test.StrToHex(testStorageProcess2), &token1, challenge1)
 	qt.Assert(t, err, qt.ErrorIs, ErrUserNotBelongsToElection)
 
 	// try wrong solution
-	err = stg.VerifyChallenge(testStrToHex(testStorageProcess1), &token1, 1234)
+	err = stg.VerifyChallenge(test.StrToHex(testStorageProcess1), &token1, 1234)
 	qt.Assert(t, err, qt.ErrorIs, ErrChallengeCodeFailure)
 
 	// try valid solution but should not be allowed (already tried before)
-	err = stg.VerifyChallenge(testStrToHex(testStorageProcess1), &token1, challenge1)
+	err = stg.VerifyChallenge(test.StrToHex(testStorageProcess1), &token1, challenge1)
 	qt.Assert(t, err, qt.ErrorIs, ErrInvalidAuthToken)
 
 	// try another attempt
 	challenge1 = 1989
 	token1 = uuid.New()
 	time.Sleep(time.Millisecond * 50) // cooldown time
-	_, err = stg.NewAttempt(testStrToHex(testStorageUser1),
-		testStrToHex(testStorageProcess1), challenge1, &token1)
+	_, err = stg.NewAttempt(test.StrToHex(testStorageUser1),
+		test.StrToHex(testStorageProcess1), challenge1, &token1)
 	qt.Assert(t, err, qt.IsNil)
 
 	// try valid solution, should work
-	err = stg.VerifyChallenge(testStrToHex(testStorageProcess1), &token1, challenge1)
+	err = stg.VerifyChallenge(test.StrToHex(testStorageProcess1), &token1, challenge1)
 	qt.Assert(t, err, qt.IsNil)
 
 	// now user is verified, we should not be able to ask for more challenges
 	token1 = uuid.New()
 	time.Sleep(time.Millisecond * 50) // cooldown time
-	_, err = stg.NewAttempt(testStrToHex(testStorageUser1),
-		testStrToHex(testStorageProcess1), challenge1, &token1)
+	_, err = stg.NewAttempt(test.StrToHex(testStorageUser1),
+		test.StrToHex(testStorageProcess1), challenge1, &token1)
 	qt.Assert(t, err, qt.ErrorIs, ErrUserAlreadyVerified)
 
 	// try to consume all attempts for user2
-	err = stg.SetAttempts(testStrToHex(testStorageUser2),
-		testStrToHex(testStorageProcess2), -1)
+	err = stg.SetAttempts(test.StrToHex(testStorageUser2),
+		test.StrToHex(testStorageProcess2), -1)
 	qt.Assert(t, err, qt.IsNil)
 
-	err = stg.SetAttempts(testStrToHex(testStorageUser2),
-		testStrToHex(testStorageProcess2), -1)
+	err = stg.SetAttempts(test.StrToHex(testStorageUser2),
+		test.StrToHex(testStorageProcess2), -1)
 	qt.Assert(t, err, qt.IsNil)
 
 	token1 = uuid.New()
-	_, err = stg.NewAttempt(testStrToHex(testStorageUser2),
-		testStrToHex(testStorageProcess2), challenge1, &token1)
+	_, err = stg.NewAttempt(test.StrToHex(testStorageUser2),
+		test.StrToHex(testStorageProcess2), challenge1, &token1)
 	qt.Assert(t, err, qt.ErrorIs, ErrTooManyAttempts)
 
 	// test verified
-	valid, err = stg.Verified(testStrToHex(testStorageUser1), testStrToHex(testStorageProcess1))
+	valid, err = stg.Verified(test.StrToHex(testStorageUser1), test.StrToHex(testStorageProcess1))
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, valid, qt.IsTrue)
 
-	valid, err = stg.Verified(testStrToHex(testStorageUser2), testStrToHex(testStorageProcess2))
+	valid, err = stg.Verified(test.StrToHex(testStorageUser2), test.StrToHex(testStorageProcess2))
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, valid, qt.IsFalse)
 
@@ -176,6 +176,93 @@ func testStorage(t *testing.T, stg Storage) {
 	users, err = stg.Search("1940")
 	qt.Assert(t, err, qt.IsNil)
 	qt.Assert(t, users.Users, qt.HasLen, 1)
+
+	// election templates (not listed as users)
+	_, err = stg.ElectionTemplate(test.StrToHex(testStorageProcess1))
+	qt.Assert(t, err, qt.ErrorIs, ErrElectionTemplateUnknown)
+	tmpl := &ElectionTemplate{
+		ElectionID: test.StrToHex(testStorageProcess1),
+		Name:       "Smith election",
+		Templates:  map[string]string{"ca": "El teu codi és {{.Code}}"},
+	}
+	qt.Assert(t, stg.SetElectionTemplate(tmpl), qt.IsNil)
+	stored, err := stg.ElectionTemplate(test.StrToHex(testStorageProcess1))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, stored, qt.DeepEquals, tmpl)
+	users, err = stg.Users()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, users.Users, qt.HasLen, 3)
+	users, err = stg.Search("Smith")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, users.Users, qt.HasLen, 2)
+	qt.Assert(t, stg.DelElectionTemplate(test.StrToHex(testStorageProcess1)), qt.IsNil)
+	_, err = stg.ElectionTemplate(test.StrToHex(testStorageProcess1))
+	qt.Assert(t, err, qt.ErrorIs, ErrElectionTemplateUnknown)
+
+	// deliveries
+	_, err = stg.Delivery("SM1")
+	qt.Assert(t, err, qt.ErrorIs, ErrDeliveryUnknown)
+	for _, id := range []string{"SM1", "SM2"} {
+		qt.Assert(t, stg.SetDelivery(&Delivery{
+			MessageID:  id,
+			Provider:   "twilio",
+			UserID:     test.StrToHex(testStorageUser1),
+			ElectionID: test.StrToHex(testStorageProcess1),
+			Status:     DeliverySent,
+		}), qt.IsNil)
+	}
+	qt.Assert(t, stg.SetDelivery(&Delivery{MessageID: "SM3", Status: DeliveryFailed}), qt.IsNil)
+	delivery, err := stg.Delivery("SM1")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, delivery.Status, qt.Equals, DeliverySent)
+	delivery.Status = DeliveryDelivered
+	qt.Assert(t, stg.SetDelivery(delivery), qt.IsNil)
+	deliveries, err := stg.Deliveries(test.StrToHex(testStorageUser1))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, deliveries, qt.HasLen, 2)
+	deliveries, err = stg.Deliveries(test.StrToHex(testStorageUser2))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, deliveries, qt.HasLen, 0)
+
+	// sms queue and dead letters
+	_, err = stg.QueueItem("q1")
+	qt.Assert(t, err, qt.ErrorIs, ErrQueueItemUnknown)
+	now := time.Now()
+	for i, id := range []string{"q2", "q1", "q3"} {
+		qt.Assert(t, stg.SetQueueItem(&QueueItem{
+			ID:         id,
+			UserID:     test.StrToHex(testStorageUser1),
+			ElectionID: test.StrToHex(testStorageProcess1),
+			StartTime:  now.Add(time.Duration(i) * time.Second),
+			Provider:   -1,
+		}), qt.IsNil)
+	}
+	item, err := stg.QueueItem("q1")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, item.Provider, qt.Equals, -1)
+	item.Retries, item.Sent = 1, true
+	qt.Assert(t, stg.SetQueueItem(item), qt.IsNil)
+	items, err := stg.QueueItems()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, items, qt.HasLen, 3)
+	qt.Assert(t, []string{items[0].ID, items[1].ID, items[2].ID}, qt.DeepEquals, []string{"q2", "q1", "q3"})
+	qt.Assert(t, items[1].Sent, qt.IsTrue)
+	qt.Assert(t, stg.DelQueueItem("q1"), qt.IsNil)
+	items, err = stg.QueueItems()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, items, qt.HasLen, 2)
+	failedAt := now.Add(time.Minute)
+	qt.Assert(t, stg.AddDeadLetter(&QueueItem{ID: "q4", FailedAt: &failedAt, LastError: "failed"}), qt.IsNil)
+	failedAt = now
+	qt.Assert(t, stg.AddDeadLetter(&QueueItem{ID: "q5", FailedAt: &failedAt}), qt.IsNil)
+	items, err = stg.DeadLetters()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, items, qt.HasLen, 2)
+	qt.Assert(t, items[0].ID, qt.Equals, "q5")
+	qt.Assert(t, items[1].LastError, qt.Equals, "failed")
+	users, err = stg.Users()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, users.Users, qt.HasLen, 3)
 }
 
 func testStorageToHex(t *testing.T, user string, pids []string) (types.HexBytes, []types.HexBytes) {
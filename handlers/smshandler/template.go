@@ -0,0 +1,221 @@
+package smshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nyaruka/phonenumbers"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/log"
+)
+
+// DefaultSMSLanguage is the language of the SMS messages if SMS_LANGUAGE is not defined.
+const DefaultSMSLanguage = "en"
+
+// smsTestChallenge is the challenge used for validating the templates.
+const smsTestChallenge = 987654
+
+// phoneRegionLanguages is the language used for the phone numbers of a region, if the
+// user has no locale.
+var phoneRegionLanguages = map[string]string{
+	"AD": "ca", "AR": "es", "AT": "de", "AU": "en", "BE": "fr", "BO": "es", "BR": "pt",
+	"CA": "en", "CH": "de", "CL": "es", "CO": "es", "CR": "es", "CU": "es", "DE": "de",
+	"DO": "es", "EC": "es", "ES": "es", "FR": "fr", "GB": "en", "GT": "es", "HN": "es",
+	"IE": "en", "IT": "it", "LU": "fr", "MX": "es", "NI": "es", "NL": "nl", "NZ": "en",
+	"PA": "es", "PE": "es", "PT": "pt", "PY": "es", "SV": "es", "US": "en", "UY": "es",
+	"VE": "es",
+}
+
+// smsBody returns the text preceding the challenge on the default SMS message (SMS_BODY).
+func smsBody() string {
+	if body := os.Getenv("SMS_BODY"); body != "" {
+		return body
+	}
+	return "Your authentication code is"
+}
+
+// SMSTemplateData are the placeholders available on the SMS message templates, i.e
+// "{{.Organization}}: your code for {{.ElectionName}} is {{.Code}}".
+type SMSTemplateData struct {
+	// Code is the challenge.
+	Code int
+	// ElectionName is the name of the election (election template).
+	ElectionName string
+	// Organization is the organization of the election (election template or SMS_ORGANIZATION).
+	Organization string
+	// Expiry is the validity of the code in minutes (the cooldown time, a new attempt
+	// replaces the code).
+	Expiry int
+	// Language is the language of the template.
+	Language string
+}
+
+// ElectionTemplate is the SMS message configuration of an election, which overrides
+// the handler templates of the same language. It is stored by the admin API.
+type ElectionTemplate struct {
+	ElectionID   types.HexBytes    `json:"electionId" bson:"_id"`
+	Name         string            `json:"name,omitempty" bson:"name,omitempty"`
+	Organization string            `json:"organization,omitempty" bson:"organization,omitempty"`
+	Templates    map[string]string `json:"templates,omitempty" bson:"templates,omitempty"`
+}
+
+// Validate checks the templates of the election are valid and include the code.
+func (et *ElectionTemplate) Validate() error {
+	if len(et.ElectionID) == 0 {
+		return fmt.Errorf("missing election ID")
+	}
+	_, err := parseSMSTemplates(et.Templates)
+	return err
+}
+
+// SMSMessages renders the SMS challenge messages. The language of each message is the
+// first one with a template of: the user locale (i.e ca-ES or ca), the language of the
+// phone number region and the default Language. On each language, the election
+// template takes precedence over the handler one.
+type SMSMessages struct {
+	Language     string
+	Organization string
+	Expiry       time.Duration
+	templates    map[string]*template.Template
+}
+
+// NewSMSMessages returns the SMS messages of the templates (text/template by language,
+// see SMSTemplateData). If no template is defined for the default language, the
+// message is SMS_BODY followed by the code.
+func NewSMSMessages(templates map[string]string, language string,
+	organization string, expiry time.Duration,
+) (*SMSMessages, error) {
+	parsed, err := parseSMSTemplates(templates)
+	if err != nil {
+		return nil, err
+	}
+	language = normalizeLanguage(language)
+	if language == "" {
+		language = DefaultSMSLanguage
+	}
+	if _, ok := parsed[language]; !ok {
+		if parsed[language], err = template.New(language).Parse(smsBody() + " {{.Code}}"); err != nil {
+			return nil, fmt.Errorf("invalid SMS_BODY: %w", err)
+		}
+	}
+	return &SMSMessages{
+		Language:     language,
+		Organization: organization,
+		Expiry:       expiry,
+		templates:    parsed,
+	}, nil
+}
+
+// NewSMSMessagesFromEnv returns the SMS messages configured on the environment:
+// SMS_TEMPLATES (JSON file with the templates by language), SMS_LANGUAGE and
+// SMS_ORGANIZATION.
+func NewSMSMessagesFromEnv(expiry time.Duration) (*SMSMessages, error) {
+	templates := map[string]string{}
+	if file := os.Getenv("SMS_TEMPLATES"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return nil, fmt.Errorf("cannot parse SMS templates %s: %w", file, err)
+		}
+	}
+	return NewSMSMessages(templates, os.Getenv("SMS_LANGUAGE"), os.Getenv("SMS_ORGANIZATION"), expiry)
+}
+
+// Message returns the challenge message for the user (optional) and election
+// template (optional), and its language.
+func (sm *SMSMessages) Message(user *UserData, election *ElectionTemplate, challenge int) (string, string) {
+	data := SMSTemplateData{
+		Code:         challenge,
+		Organization: sm.Organization,
+		Expiry:       int((sm.Expiry + time.Minute - 1) / time.Minute),
+	}
+	var electionTemplates map[string]*template.Template
+	if election != nil {
+		data.ElectionName = election.Name
+		if election.Organization != "" {
+			data.Organization = election.Organization
+		}
+		var err error
+		if electionTemplates, err = parseSMSTemplates(election.Templates); err != nil {
+			log.Warnf("invalid SMS templates for election %s: %v", election.ElectionID, err)
+		}
+	}
+	for _, lang := range sm.languages(user) {
+		for _, templates := range []map[string]*template.Template{electionTemplates, sm.templates} {
+			tmpl, ok := templates[lang]
+			if !ok {
+				continue
+			}
+			data.Language = lang
+			message, err := renderSMSTemplate(tmpl, &data)
+			if err != nil {
+				log.Warnf("cannot render SMS template %s: %v", lang, err)
+				continue
+			}
+			return message, lang
+		}
+	}
+	return fmt.Sprintf("%s %d", smsBody(), challenge), sm.Language
+}
+
+// languages returns the candidate languages for the user, in order of preference.
+func (sm *SMSMessages) languages(user *UserData) []string {
+	languages := []string{}
+	if user != nil {
+		if locale := normalizeLanguage(user.Locale); locale != "" {
+			languages = append(languages, locale)
+			if base, _, ok := strings.Cut(locale, "-"); ok {
+				languages = append(languages, base)
+			}
+		}
+		if user.Phone != nil {
+			if lang, ok := phoneRegionLanguages[phonenumbers.GetRegionCodeForNumber(user.Phone)]; ok {
+				languages = append(languages, lang)
+			}
+		}
+	}
+	return append(languages, sm.Language)
+}
+
+// normalizeLanguage returns the lowercase language tag, with - as separator (ca-es).
+func normalizeLanguage(language string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(language), "_", "-"))
+}
+
+// parseSMSTemplates parses the templates by language, and checks they include the code.
+func parseSMSTemplates(templates map[string]string) (map[string]*template.Template, error) {
+	parsed := make(map[string]*template.Template, len(templates))
+	for lang, text := range templates {
+		lang = normalizeLanguage(lang)
+		if lang == "" {
+			return nil, fmt.Errorf("missing SMS template language")
+		}
+		tmpl, err := template.New(lang).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMS template %s: %w", lang, err)
+		}
+		message, err := renderSMSTemplate(tmpl, &SMSTemplateData{Code: smsTestChallenge, Language: lang})
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMS template %s: %w", lang, err)
+		}
+		if !strings.Contains(message, fmt.Sprint(smsTestChallenge)) {
+			return nil, fmt.Errorf("SMS template %s does not include the code", lang)
+		}
+		parsed[lang] = tmpl
+	}
+	return parsed, nil
+}
+
+func renderSMSTemplate(tmpl *template.Template, data *SMSTemplateData) (string, error) {
+	var message strings.Builder
+	if err := tmpl.Execute(&message, data); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
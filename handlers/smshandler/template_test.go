@@ -0,0 +1,87 @@
+package smshandler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/nyaruka/phonenumbers"
+	"github.com/vocdoni/blind-csp/test"
+)
+
+func TestSMSMessages(t *testing.T) {
+	t.Setenv("SMS_BODY", "Code")
+	messages, err := NewSMSMessages(map[string]string{
+		"es":    "{{.Organization}}: tu código es {{.Code}}, válido {{.Expiry}} min",
+		"ca":    "{{.Organization}}: el teu codi és {{.Code}}",
+		"en_GB": "{{.Organization}}: your code is {{.Code}}",
+	}, "es", "Vocdoni", 90*time.Second)
+	qt.Assert(t, err, qt.IsNil)
+
+	phone := func(number string) *phonenumbers.PhoneNumber {
+		p, err := phonenumbers.Parse(number, DefaultPhoneCountry)
+		qt.Assert(t, err, qt.IsNil)
+		return p
+	}
+	spanish, french := phone("+34655111222"), phone("+33612345678")
+
+	// The user locale takes precedence over the phone region
+	message, lang := messages.Message(&UserData{Phone: spanish, Locale: "ca_ES"}, nil, 123456)
+	qt.Assert(t, message, qt.Equals, "Vocdoni: el teu codi és 123456")
+	qt.Assert(t, lang, qt.Equals, "ca")
+	message, lang = messages.Message(&UserData{Phone: spanish, Locale: "en-GB"}, nil, 123456)
+	qt.Assert(t, message, qt.Equals, "Vocdoni: your code is 123456")
+	qt.Assert(t, lang, qt.Equals, "en-gb")
+	message, _ = messages.Message(&UserData{Phone: spanish}, nil, 123456)
+	qt.Assert(t, message, qt.Equals, "Vocdoni: tu código es 123456, válido 2 min")
+	// No template for the user languages, the default one is used
+	message, lang = messages.Message(&UserData{Phone: french, Locale: "fr"}, nil, 123456)
+	qt.Assert(t, message, qt.Equals, "Vocdoni: tu código es 123456, válido 2 min")
+	qt.Assert(t, lang, qt.Equals, "es")
+
+	// The election template overrides the same language, and sets the placeholders
+	election := &ElectionTemplate{
+		ElectionID:   test.StrToHex(testStorageProcess1),
+		Name:         "Pressupostos 2024",
+		Organization: "Ajuntament",
+		Templates:    map[string]string{"ca": "{{.Organization}} - {{.ElectionName}}: {{.Code}}"},
+	}
+	qt.Assert(t, election.Validate(), qt.IsNil)
+	message, _ = messages.Message(&UserData{Phone: spanish, Locale: "ca"}, election, 123456)
+	qt.Assert(t, message, qt.Equals, "Ajuntament - Pressupostos 2024: 123456")
+	message, _ = messages.Message(&UserData{Phone: spanish}, election, 123456)
+	qt.Assert(t, message, qt.Equals, "Ajuntament: tu código es 123456, válido 2 min")
+
+	// The templates must be valid and include the code
+	election.Templates["es"] = "{{.Organization}}"
+	qt.Assert(t, election.Validate(), qt.ErrorMatches, ".*does not include the code")
+	election.Templates["es"] = "{{.Unknown}} {{.Code}}"
+	qt.Assert(t, election.Validate(), qt.Not(qt.IsNil))
+	election.Templates["es"] = "{{.Code"
+	qt.Assert(t, election.Validate(), qt.Not(qt.IsNil))
+	// An invalid stored template is skipped
+	message, _ = messages.Message(&UserData{Phone: spanish, Locale: "ca"}, election, 123456)
+	qt.Assert(t, message, qt.Equals, "Ajuntament: el teu codi és 123456")
+
+	// Without templates, the message is SMS_BODY and the code
+	messages, err = NewSMSMessages(nil, "", "", time.Minute)
+	qt.Assert(t, err, qt.IsNil)
+	message, lang = messages.Message(&UserData{Phone: spanish}, nil, 123456)
+	qt.Assert(t, message, qt.Equals, "Code 123456")
+	qt.Assert(t, lang, qt.Equals, DefaultSMSLanguage)
+
+	// Templates from the environment
+	file := filepath.Join(t.TempDir(), "templates.json")
+	qt.Assert(t, os.WriteFile(file, []byte(`{"ca":"Codi {{.Code}}"}`), 0o600), qt.IsNil)
+	t.Setenv("SMS_TEMPLATES", file)
+	t.Setenv("SMS_LANGUAGE", "ca")
+	messages, err = NewSMSMessagesFromEnv(time.Minute)
+	qt.Assert(t, err, qt.IsNil)
+	message, _ = messages.Message(nil, nil, 123456)
+	qt.Assert(t, message, qt.Equals, "Codi 123456")
+	qt.Assert(t, os.WriteFile(file, []byte(`{"ca":"Codi"}`), 0o600), qt.IsNil)
+	_, err = NewSMSMessagesFromEnv(time.Minute)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
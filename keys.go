@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// defaultRootKeyID is the ID of the root key provided with --key.
+	defaultRootKeyID = "default"
+	// keyStoreDir is the data dir subdirectory where the encrypted root keys are stored.
+	keyStoreDir = "keystore"
+	// thresholdDir is the data dir subdirectory where the shares of the root key are written.
+	thresholdDir = "threshold"
+	// thresholdKeyFile is the file name of the public threshold key.
+	thresholdKeyFile = "threshold.json"
+)
+
+// rootKeyConfig is the csp.yml representation of a root key. The private key is
+// either in plain text (Key) or encrypted on a keystore file (KeyStore).
+// NotBefore and NotAfter are RFC3339 timestamps (empty means no limit).
+type rootKeyConfig struct {
+	ID        string `mapstructure:"id"`
+	Key       string `mapstructure:"key"`
+	KeyStore  string `mapstructure:"keystore"`
+	NotBefore string `mapstructure:"notBefore"`
+	NotAfter  string `mapstructure:"notAfter"`
+}
+
+// keyPassphrase returns the passphrase of the root keys, read from passphraseFile
+// or from the CSP_KEYPASSPHRASE env var. An empty passphrase means the root keys
+// are not encrypted.
+func keyPassphrase(passphraseFile string) (string, error) {
+	if passphraseFile == "" {
+		return os.Getenv("CSP_KEYPASSPHRASE"), nil
+	}
+	data, err := os.ReadFile(passphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read passphrase file: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", passphraseFile)
+	}
+	return passphrase, nil
+}
+
+// loadKeyRing builds the key ring with the default key (--key) and the keys of the
+// configuration. If a passphrase is provided, the plain text keys are moved to
+// encrypted keystore files and removed from the configuration.
+func loadKeyRing(v *viper.Viper, dataDir, privKey, passphrase string) (*saltedkey.KeyRing, error) {
+	defaultKey, err := defaultRootKey(v, dataDir, privKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := saltedkey.NewKeyRing(defaultKey)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := rootKeysConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := false
+	for i, k := range keys {
+		if passphrase != "" && k.Key != "" {
+			if keys[i].KeyStore, err = writeKeyStore(dataDir, k.ID, k.Key, passphrase); err != nil {
+				return nil, err
+			}
+			keys[i].Key = ""
+			encrypted = true
+		}
+		var notBefore, notAfter time.Time
+		if k.NotBefore != "" {
+			if notBefore, err = time.Parse(time.RFC3339, k.NotBefore); err != nil {
+				return nil, fmt.Errorf("invalid notBefore for root key %s: %w", k.ID, err)
+			}
+		}
+		if k.NotAfter != "" {
+			if notAfter, err = time.Parse(time.RFC3339, k.NotAfter); err != nil {
+				return nil, fmt.Errorf("invalid notAfter for root key %s: %w", k.ID, err)
+			}
+		}
+		var signer saltedkey.Signer
+		switch {
+		case keys[i].Key != "":
+			signer, err = saltedkey.NewSaltedKey(keys[i].Key)
+		case keys[i].KeyStore != "":
+			signer, err = readKeyStore(keys[i].KeyStore, passphrase)
+		default:
+			err = fmt.Errorf("no private key found")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("root key %s: %w", k.ID, err)
+		}
+		rk, err := saltedkey.NewRootKeyWithSigner(k.ID, signer, notBefore, notAfter)
+		if err != nil {
+			return nil, err
+		}
+		if err := keyring.Add(rk); err != nil {
+			return nil, err
+		}
+	}
+	if encrypted {
+		setRootKeysConfig(v, keys)
+		return keyring, v.WriteConfig()
+	}
+	return keyring, nil
+}
+
+// defaultRootKey returns the root key provided with --key (or autogenerated). If
+// a passphrase is provided, the key is stored encrypted on the keystore directory.
+func defaultRootKey(v *viper.Viper, dataDir, privKey, passphrase string) (*saltedkey.RootKey, error) {
+	keyStoreFile := filepath.Join(dataDir, keyStoreDir, defaultRootKeyID+".json")
+	_, err := os.Stat(keyStoreFile)
+	keyStoreExists := err == nil
+	if keyStoreExists {
+		if passphrase == "" {
+			return nil, fmt.Errorf("root key is encrypted on %s, a passphrase is required", keyStoreFile)
+		}
+		if privKey != "" {
+			return nil, fmt.Errorf("root key is already encrypted on %s, remove the plain text key", keyStoreFile)
+		}
+		signer, err := readKeyStore(keyStoreFile, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return saltedkey.NewRootKeyWithSigner(defaultRootKeyID, signer, time.Time{}, time.Time{})
+	}
+
+	if privKey == "" {
+		signer := ethereum.SignKeys{}
+		if err := signer.Generate(); err != nil {
+			return nil, err
+		}
+		_, privKey = signer.HexString()
+		v.Set("pubKey", fmt.Sprintf("%x", signer.PublicKey()))
+		if passphrase == "" {
+			log.Infof("new private key generated: %s", privKey)
+			v.Set("key", privKey)
+		} else {
+			log.Infof("new private key generated with public key %x", signer.PublicKey())
+		}
+		if err := v.WriteConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if passphrase != "" {
+		if _, err := writeKeyStore(dataDir, defaultRootKeyID, privKey, passphrase); err != nil {
+			return nil, err
+		}
+		// Remove the plain text key from the configuration
+		v.Set("key", "")
+		if err := v.WriteConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return saltedkey.NewRootKey(defaultRootKeyID, privKey, time.Time{}, time.Time{})
+}
+
+// rotateRootKey generates a new root key, valid from now, and stores it on the
+// configuration file (encrypted if a passphrase is provided). Returns the new key ID.
+func rotateRootKey(v *viper.Viper, dataDir, passphrase string) (string, error) {
+	keys, err := rootKeysConfig(v)
+	if err != nil {
+		return "", err
+	}
+	signer := ethereum.SignKeys{}
+	if err := signer.Generate(); err != nil {
+		return "", err
+	}
+	_, priv := signer.HexString()
+	now := time.Now().UTC()
+	key := rootKeyConfig{
+		ID:        now.Format("20060102150405"),
+		Key:       priv,
+		NotBefore: now.Format(time.RFC3339),
+	}
+	if passphrase != "" {
+		if key.KeyStore, err = writeKeyStore(dataDir, key.ID, priv, passphrase); err != nil {
+			return "", err
+		}
+		key.Key = ""
+	}
+	setRootKeysConfig(v, append(keys, key))
+	// Do not rotate again on the next start
+	v.Set("rotateKey", false)
+	return key.ID, v.WriteConfig()
+}
+
+func rootKeysConfig(v *viper.Viper) ([]rootKeyConfig, error) {
+	keys := []rootKeyConfig{}
+	if err := v.UnmarshalKey("keys", &keys); err != nil {
+		return nil, fmt.Errorf("cannot read root keys: %w", err)
+	}
+	return keys, nil
+}
+
+func setRootKeysConfig(v *viper.Viper, keys []rootKeyConfig) {
+	config := []map[string]string{}
+	for _, k := range keys {
+		config = append(config, map[string]string{
+			"id":        k.ID,
+			"key":       k.Key,
+			"keystore":  k.KeyStore,
+			"notBefore": k.NotBefore,
+			"notAfter":  k.NotAfter,
+		})
+	}
+	v.Set("keys", config)
+}
+
+// writeKeyStore encrypts privKey with passphrase and stores it on the keystore
+// directory. Existing keystore files are never overwritten. Returns the file path.
+func writeKeyStore(dataDir, id, privKey, passphrase string) (string, error) {
+	dir := filepath.Join(dataDir, keyStoreDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	keyJSON, err := saltedkey.EncryptKey(privKey, passphrase,
+		saltedkey.KeyStoreScryptN, saltedkey.KeyStoreScryptP)
+	if err != nil {
+		return "", fmt.Errorf("cannot encrypt root key %s: %w", id, err)
+	}
+	file := filepath.Join(dir, id+".json")
+	if err := writeNewFile(file, keyJSON); err != nil {
+		return "", err
+	}
+	log.Infof("root key %s encrypted on %s", id, file)
+	return file, nil
+}
+
+func readKeyStore(file, passphrase string) (*saltedkey.SaltedKey, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("root key is encrypted on %s, a passphrase is required", file)
+	}
+	keyJSON, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return saltedkey.NewSaltedKeyFromKeyStore(keyJSON, passphrase)
+}
+
+// splitRootKey splits the active root key into n shares, any t of them required
+// for signing. The shares (encrypted if a passphrase is provided) and the public
+// threshold key are written to the threshold directory. Each share must be
+// delivered to a different CSP node and used as its root key.
+func splitRootKey(keyring *saltedkey.KeyRing, dataDir, passphrase string, t, n int) (string, error) {
+	rk, err := keyring.Active(time.Now())
+	if err != nil {
+		return "", err
+	}
+	sk, ok := rk.Signer.(*saltedkey.SaltedKey)
+	if !ok {
+		return "", fmt.Errorf("root key %s cannot be split, the private key is not available", rk.ID)
+	}
+	shares, tk, err := saltedkey.SplitKey(sk, t, n)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(dataDir, thresholdDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	tkJSON, err := json.MarshalIndent(tk, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeNewFile(filepath.Join(dir, thresholdKeyFile), tkJSON); err != nil {
+		return "", err
+	}
+	for _, share := range shares {
+		file := filepath.Join(dir, fmt.Sprintf("share-%d.hex", share.Index))
+		data := []byte(share.Hex())
+		if passphrase != "" {
+			file = filepath.Join(dir, fmt.Sprintf("share-%d.json", share.Index))
+			if data, err = saltedkey.EncryptKey(share.Hex(), passphrase,
+				saltedkey.KeyStoreScryptN, saltedkey.KeyStoreScryptP); err != nil {
+				return "", fmt.Errorf("cannot encrypt share %d: %w", share.Index, err)
+			}
+		}
+		if err := writeNewFile(file, data); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// loadThresholdKey reads the public threshold key from file and checks the active
+// root key is one of its shares. Returns the key and the share index.
+func loadThresholdKey(keyring *saltedkey.KeyRing, file string) (*saltedkey.ThresholdKey, int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read threshold key: %w", err)
+	}
+	tk := &saltedkey.ThresholdKey{}
+	if err := json.Unmarshal(data, tk); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode threshold key: %w", err)
+	}
+	rk, err := keyring.Active(time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+	index, err := tk.ShareIndex(rk.BlindPubKey())
+	if err != nil {
+		return nil, 0, fmt.Errorf("root key %s: %w", rk.ID, err)
+	}
+	return tk, index, nil
+}
+
+// writeNewFile writes data to a new file readable only by the owner. Existing
+// files are never overwritten.
+func writeNewFile(file string, data []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("file %s already exists", file)
+		}
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
@@ -3,24 +3,45 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/vocdoni/blind-csp/csp"
+	"github.com/vocdoni/blind-csp/handlers"
 	"github.com/vocdoni/blind-csp/handlers/handlerlist"
-	"go.vocdoni.io/dvote/crypto/ethereum"
+	"github.com/vocdoni/blind-csp/model"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
 	"go.vocdoni.io/dvote/httprouter"
 	"go.vocdoni.io/dvote/log"
 )
 
+// thresholdURL is the base URL path of the threshold coordinator API.
+const thresholdURL = "/v1/threshold"
+
+const (
+	// electionCacheTTL is the time an election configuration is cached by the resolvers.
+	electionCacheTTL = time.Minute
+	// electionUnknownCacheTTL is the time an election not found on the model store is cached.
+	electionUnknownCacheTTL = 10 * time.Second
+	// electionCacheSize is the maximum number of elections cached.
+	electionCacheSize = 10000
+)
+
+// errElectionNotConfigured is returned by the resolvers for the elections not found
+// on the model store, if no default handler is set.
+var errElectionNotConfigured = fmt.Errorf("election is not configured")
+
 func main() {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -37,10 +58,36 @@ func main() {
 	flag.String("logLevel", "info",
 		"log level {debug,info,warn,error}")
 	flag.String("handler", "dummy",
-		fmt.Sprintf("the authentication handler to use, available: {%s}",
-			handlerlist.HandlersList()))
+		fmt.Sprintf("the authentication handler to use, available: {%s}. "+
+			"Several handlers can be chained with %s (i.e sms%sidCat). "+
+			"Several handlers can be served with a comma separated list, the election configuration selects which one is used",
+			handlerlist.HandlersList(), handlers.ChainSeparator, handlers.ChainSeparator))
 	flag.StringSlice("handlerOpts", []string{}, "options that will be passed to the handler")
+	flag.String("defaultHandler", "",
+		"handler of the elections not configured on the model store, if several handlers are served "+
+			"(the elections not configured are rejected if empty)")
 	flag.Int("port", 5000, "port to listen")
+	flag.Duration("keysTTL", csp.DefaultKeysTTL,
+		"time a request key (R point or ECDSA token) remains valid after being issued")
+	flag.String("keysStore", csp.TokenStorePebble,
+		fmt.Sprintf("storage backend for the request keys, available: {%s}",
+			strings.Join(csp.TokenStores, ",")))
+	flag.Duration("sessionTTL", csp.DefaultSessionTTL,
+		"time an authentication session remains valid between two consecutive steps")
+	flag.Bool("rotateKey", false,
+		"generate a new root key that becomes active for new elections (ongoing elections keep their key)")
+	flag.String("keyPassphraseFile", "",
+		"file with the passphrase for encrypting the root keys (the CSP_KEYPASSPHRASE env var can be used instead)")
+	flag.String("splitKey", "",
+		"split the active root key into shares for threshold signing (i.e 3/5 for 5 shares, 3 of them required) and exit")
+	flag.String("thresholdKey", "",
+		fmt.Sprintf("public threshold key file, the root key must be one of its shares and the coordinator API is served on %s",
+			thresholdURL))
+	flag.Int("saltVersion", int(saltedkey.DefaultSaltVersion),
+		fmt.Sprintf("salt derivation of the elections without a salt version configured, available: %v "+
+			"(the elections keep the version bound on their first use)", saltedkey.SaltVersions))
+	flag.String("adminToken", "",
+		"bearer token of the CSP admin endpoints (i.e signature revocations), not served if empty")
 	flag.Parse()
 
 	// Setting up viper
@@ -79,6 +126,33 @@ func main() {
 	if err := viper.BindPFlag("handlerOpts", flag.Lookup("handlerOpts")); err != nil {
 		panic(err)
 	}
+	if err := viper.BindPFlag("keysTTL", flag.Lookup("keysTTL")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("keysStore", flag.Lookup("keysStore")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("sessionTTL", flag.Lookup("sessionTTL")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("rotateKey", flag.Lookup("rotateKey")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("keyPassphraseFile", flag.Lookup("keyPassphraseFile")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("thresholdKey", flag.Lookup("thresholdKey")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("saltVersion", flag.Lookup("saltVersion")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("adminToken", flag.Lookup("adminToken")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("defaultHandler", flag.Lookup("defaultHandler")); err != nil {
+		panic(err)
+	}
 
 	// check if config file exists
 	_, err = os.Stat(path.Join(dataDir, "csp.yml"))
@@ -113,6 +187,20 @@ func main() {
 	loglevel := viper.GetString("logLevel")
 	handler := viper.GetString("handler")
 	port := viper.GetInt("port")
+	keysTTL := viper.GetDuration("keysTTL")
+	keysStore := viper.GetString("keysStore")
+	sessionTTL := viper.GetDuration("sessionTTL")
+	rotateKey := viper.GetBool("rotateKey")
+	keyPassphraseFile := viper.GetString("keyPassphraseFile")
+	thresholdKeyFile := viper.GetString("thresholdKey")
+	adminToken := viper.GetString("adminToken")
+	defaultHandler := viper.GetString("defaultHandler")
+	saltVersion, err := saltedkey.ParseSaltVersion(viper.GetInt("saltVersion"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// splitKey is a one time operation, so it is not stored on the config file
+	splitKey, _ := flag.CommandLine.GetString("splitKey")
 	handlerOpts := []string{dataDir}
 	for _, h := range viper.GetStringSlice("handlerOpts") {
 		if !strings.Contains(h, "[") && len(h) > 0 {
@@ -122,24 +210,37 @@ func main() {
 
 	// Start
 	log.Init(loglevel, "stdout", nil)
-	signer := ethereum.SignKeys{}
-	if privKey == "" {
-		if err := signer.Generate(); err != nil {
+	passphrase, err := keyPassphrase(keyPassphraseFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if passphrase == "" {
+		log.Warnf("root keys are stored in plain text, use --keyPassphraseFile or " +
+			"CSP_KEYPASSPHRASE for encrypting them")
+	}
+	if rotateKey {
+		id, err := rotateRootKey(viper, dataDir, passphrase)
+		if err != nil {
 			log.Fatal(err)
 		}
-		_, privKey = signer.HexString()
-		log.Infof("new private key generated: %s", privKey)
-		viper.Set("key", privKey)
-		viper.Set("pubKey", fmt.Sprintf("%x", signer.PublicKey()))
-		if err := viper.WriteConfig(); err != nil {
-			log.Fatal(err)
+		log.Infof("new root key %s generated", id)
+	}
+	keyring, err := loadKeyRing(viper, dataDir, privKey, passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if splitKey != "" {
+		var t, n int
+		if _, err := fmt.Sscanf(splitKey, "%d/%d", &t, &n); err != nil {
+			log.Fatalf("invalid splitKey %q, expected threshold/shares", splitKey)
 		}
-	} else {
-		if err := signer.AddHexKey(privKey); err != nil {
+		dir, err := splitRootKey(keyring, dataDir, passphrase, t, n)
+		if err != nil {
 			log.Fatal(err)
 		}
+		log.Infof("root key split into %d shares (%d required) on %s", n, t, dir)
+		return
 	}
-	log.Infof("using ECDSA signer with address %s", signer.Address().Hex())
 
 	// Create the HTTP router
 	router := httprouter.HTTProuter{}
@@ -151,64 +252,273 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Create the auth handler (currently a dummy one that only checks the IP)
-	authHandler := handlerlist.Handlers[handler]
-	if authHandler == nil {
-		log.Fatalf("handler %s is unknown", handler)
-	}
-	if err := authHandler.Init(&router, baseURL, handlerOpts...); err != nil {
-		log.Fatal(err)
+	// Create the auth handlers. If several handlers are enabled, each one gets
+	// its own data directory and the election configuration selects which one is used.
+	handlerNames := strings.Split(handler, ",")
+	authHandlers := []handlers.AuthHandler{}
+	for _, name := range handlerNames {
+		authHandler, err := handlerlist.Handler(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := handlerOpts
+		if len(handlerNames) > 1 {
+			opts = append([]string{path.Join(dataDir, name)}, handlerOpts[1:]...)
+		}
+		if err := authHandler.Init(&router, baseURL, opts...); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("using handler %s", name)
+		authHandlers = append(authHandlers, authHandler)
 	}
-	log.Infof("using handler %s", handler)
 
-	// Create the TLS configuration with the certificates (if required by the handler)
-	if authHandler.RequireCertificate() {
-		tls, err := tlsConfig(authHandler.Certificates())
+	// Create the TLS configuration with the certificates (if required by any handler)
+	certificates := [][]byte{}
+	for _, authHandler := range authHandlers {
+		if authHandler.RequireCertificate() {
+			certificates = append(certificates, authHandler.Certificates()...)
+		}
+	}
+	if len(certificates) > 0 {
+		tls, err := tlsConfig(certificates)
 		if err != nil {
 			log.Fatalf("cannot import tls certificate %v", err)
 		}
 		router.TLSconfig = tls
-		// Check that the requiered certificate has been included (if any)
-		certFound := false
-		// nolint:staticcheck // ignoring tlsCert.RootCAs.Subjects is deprecated ERR because cert does not come from SystemCertPool.
-		for _, cert := range tls.ClientCAs.Subjects() {
-			certFound = authHandler.CertificateCheck(cert)
-			if certFound {
-				break
+		// Check that the requiered certificates have been included (if any)
+		for i, authHandler := range authHandlers {
+			if !authHandler.RequireCertificate() {
+				continue
+			}
+			certFound := false
+			// nolint:staticcheck // ignoring tlsCert.RootCAs.Subjects is deprecated ERR because cert does not come from SystemCertPool.
+			for _, cert := range tls.ClientCAs.Subjects() {
+				certFound = authHandler.CertificateCheck(cert)
+				if certFound {
+					break
+				}
+			}
+			if !certFound {
+				log.Fatalf("handler %s requires a TLS CA valid certificate", handlerNames[i])
 			}
-		}
-		if !certFound {
-			log.Fatalf("handler %s requires a TLS CA valid certificate", handler)
 		}
 	}
 
-	// Create the blind CSP API and assign the auth function
-	pub, priv := signer.HexString()
-	log.Infof("CSP root public key: %s", pub)
+	// Create the blind CSP API and assign the auth functions
+	for _, rk := range keyring.Keys(time.Now()) {
+		log.Infof("CSP root public key %s: %x", rk.ID, rk.BlindPubKey().Bytes())
+	}
+	keysDir := path.Join(dataDir, authHandlers[0].Name())
+	if len(authHandlers) > 1 {
+		keysDir = path.Join(dataDir, "keys")
+	}
+	keys, err := csp.NewTokenStore(keysStore, keysDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("using %s token store", keysStore)
 	cs, err := csp.NewBlindCSP(
-		priv,
-		path.Join(dataDir, authHandler.Name()),
+		keyring,
+		keys,
 		csp.BlindCSPcallbacks{
-			Auth:    authHandler.Auth,
-			Info:    authHandler.Info,
-			Indexer: authHandler.Indexer,
+			Name:    handlerNames[0],
+			Auth:    authHandlers[0].Auth,
+			Info:    authHandlers[0].Info,
+			Indexer: authHandlers[0].Indexer,
 		},
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// The election configurations are read from the model store if it is required
+	// (several handlers) or configured
+	var elections model.ElectionStore
+	if len(authHandlers) > 1 || os.Getenv("CSP_MONGODB_URL") != "" {
+		storage := &model.MongoStorage{}
+		if err := storage.Init(); err != nil {
+			log.Fatal(err)
+		}
+		elections = newElectionCache(model.NewElectionStore(storage))
+	}
+	saltVersions := csp.FixedSaltVersion(saltVersion)
+	if elections != nil {
+		saltVersions = saltVersionResolver(elections, saltVersion,
+			len(authHandlers) == 1 || defaultHandler != "")
+	}
+	if len(authHandlers) > 1 {
+		for i, authHandler := range authHandlers[1:] {
+			if err := cs.AddHandler(csp.BlindCSPcallbacks{
+				Name:    handlerNames[i+1],
+				Auth:    authHandler.Auth,
+				Info:    authHandler.Info,
+				Indexer: authHandler.Indexer,
+			}); err != nil {
+				log.Fatal(err)
+			}
+		}
+		// The handler of each election is taken from its configuration in the model store
+		if defaultHandler != "" {
+			served := false
+			for _, name := range handlerNames {
+				served = served || name == defaultHandler
+			}
+			if !served {
+				log.Fatalf("default handler %s is not served", defaultHandler)
+			}
+		}
+		cs.SetElectionResolver(electionResolver(elections, defaultHandler))
+	}
+	cs.SetSaltVersionResolver(saltVersions)
+	cs.SetAdminToken(adminToken)
+	if err := cs.SetKeysTTL(keysTTL); err != nil {
+		log.Fatal(err)
+	}
+	if err := cs.SetSessionTTL(sessionTTL); err != nil {
+		log.Fatal(err)
+	}
 	if err := cs.ServeAPI(&router, baseURL); err != nil {
 		log.Fatal(err)
 	}
+	if thresholdKeyFile != "" {
+		tk, index, err := loadThresholdKey(keyring, thresholdKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tc, err := csp.NewThresholdCoordinator(tk)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The coordinator uses the salt versions bound to the elections by this node
+		tc.SetSaltVersionResolver(func(electionID types.HexBytes) (saltedkey.SaltVersion, error) {
+			return cs.SaltVersion(electionID)
+		})
+		if err := tc.ServeAPI(&router, thresholdURL); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("threshold node with share %d of %d (%d required), threshold public key %x",
+			index, tk.Shares, tk.Threshold(), tk.PubKey().Bytes())
+	}
 
 	// Wait for SIGTERM
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 	log.Warnf("received SIGTERM, exiting at %s", time.Now().Format(time.RFC850))
+	cs.Close()
 	os.Exit(0)
 }
 
+// electionResolver returns the handlers configured for an election on the model
+// store. The elections not found on the store use the defaultHandler, or are rejected
+// if it is empty.
+func electionResolver(elections model.ElectionStore, defaultHandler string) csp.ElectionResolverFunc {
+	return func(electionID types.HexBytes) ([]string, error) {
+		election, err := elections.Election(electionID)
+		if err != nil {
+			if errors.Is(err, model.ErrElectionUnknown) {
+				if defaultHandler == "" {
+					return nil, fmt.Errorf("%w: %x", errElectionNotConfigured, electionID)
+				}
+				return []string{defaultHandler}, nil
+			}
+			return nil, err
+		}
+		names := []string{}
+		for _, h := range election.Handlers {
+			names = append(names, h.Handler)
+		}
+		return names, nil
+	}
+}
+
+// saltVersionResolver returns the salt version of the election configuration, or
+// defaultVersion if the election has no salt version configured. The elections not
+// found on the store use defaultVersion only if allowUnknown is true (a single handler
+// or a default handler), else they are rejected.
+func saltVersionResolver(elections model.ElectionStore,
+	defaultVersion saltedkey.SaltVersion, allowUnknown bool,
+) csp.SaltVersionResolverFunc {
+	return func(electionID types.HexBytes) (saltedkey.SaltVersion, error) {
+		election, err := elections.Election(electionID)
+		if err != nil {
+			if errors.Is(err, model.ErrElectionUnknown) {
+				if !allowUnknown {
+					return 0, fmt.Errorf("%w: %x", errElectionNotConfigured, electionID)
+				}
+				return defaultVersion, nil
+			}
+			return 0, err
+		}
+		if election.SaltVersion == 0 {
+			return defaultVersion, nil
+		}
+		return saltedkey.ParseSaltVersion(int(election.SaltVersion))
+	}
+}
+
+// electionCache is a model.ElectionStore caching the election configurations (and the
+// elections not found), so the resolvers do not query the model store on every request.
+type electionCache struct {
+	model.ElectionStore
+	cache map[string]cachedElection
+	lock  sync.Mutex
+}
+
+type cachedElection struct {
+	election *model.Election
+	expiry   time.Time
+}
+
+func newElectionCache(elections model.ElectionStore) *electionCache {
+	return &electionCache{
+		ElectionStore: elections,
+		cache:         make(map[string]cachedElection),
+	}
+}
+
+// Election returns the cached election, or looks it up on the model store. The errors
+// other than model.ErrElectionUnknown are not cached.
+func (ec *electionCache) Election(id types.HexBytes) (*model.Election, error) {
+	now := time.Now()
+	ec.lock.Lock()
+	cached, ok := ec.cache[string(id)]
+	ec.lock.Unlock()
+	if ok && now.Before(cached.expiry) {
+		if cached.election == nil {
+			return nil, model.ErrElectionUnknown
+		}
+		return cached.election, nil
+	}
+	election, err := ec.ElectionStore.Election(id)
+	ttl := electionCacheTTL
+	if errors.Is(err, model.ErrElectionUnknown) {
+		ttl = electionUnknownCacheTTL
+	} else if err != nil {
+		return nil, err
+	}
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if len(ec.cache) >= electionCacheSize {
+		for key, c := range ec.cache {
+			if now.After(c.expiry) {
+				delete(ec.cache, key)
+			}
+		}
+	}
+	if len(ec.cache) < electionCacheSize {
+		ec.cache[string(id)] = cachedElection{election: election, expiry: now.Add(ttl)}
+	}
+	return election, err
+}
+
+// DeleteElection removes the election from the model store and the cache.
+func (ec *electionCache) DeleteElection(id types.HexBytes) error {
+	ec.lock.Lock()
+	delete(ec.cache, string(id))
+	ec.lock.Unlock()
+	return ec.ElectionStore.DeleteElection(id)
+}
+
 func tlsConfig(x509certificates [][]byte) (*tls.Config, error) {
 	caCertPool := x509.NewCertPool()
 	for _, cert := range x509certificates {
@@ -31,6 +31,8 @@ type HandlerConfig struct {
 type Election struct {
 	ID       types.HexBytes  `json:"electionId" bson:"_id"`
 	Handlers []HandlerConfig `json:"handlers" bson:"handlers"` // List of handlers that will use this census
+	// SaltVersion is the salt derivation of the election keys (zero for the CSP default)
+	SaltVersion uint8 `json:"saltVersion,omitempty" bson:"saltversion,omitempty"`
 }
 
 // ElectionStore is the interface to manage elections
@@ -0,0 +1,151 @@
+// Package receipt verifies the CSP proof receipts (types.Receipt). It can be
+// imported by third party auditors for checking that a proof was issued by the
+// CSP for an election, without re-implementing the salted keys derivation.
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+	"github.com/cloudflare/circl/ecc/bls12381"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// SaltedPubKey returns the public key used by the CSP for the signatures of signType
+// on electionID, derived from the root key published by the CSP (info endpoint) with
+// the election salt version. The ECDSA and blind public keys are compressed.
+func SaltedPubKey(rootKey *types.RootKey, saltVersion saltedkey.SaltVersion,
+	electionID []byte, signType string,
+) ([]byte, error) {
+	if rootKey == nil {
+		return nil, fmt.Errorf("root key is nil")
+	}
+	salt, err := saltedkey.ElectionSalt(saltVersion, electionID)
+	if err != nil {
+		return nil, err
+	}
+	switch signType {
+	case types.SignatureTypeEthereum, types.SignatureTypeSharedKey:
+		pk, err := ethcrypto.DecompressPubkey(rootKey.ECDSAPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root ECDSA public key: %w", err)
+		}
+		salted, err := saltedkey.ECDSAPubKeyWithSalt(pk, salt)
+		if err != nil {
+			return nil, err
+		}
+		if pk, err = ethcrypto.UnmarshalPubkey(salted); err != nil {
+			return nil, err
+		}
+		return ethcrypto.CompressPubkey(pk), nil
+	case types.SignatureTypeBlind:
+		pk, err := blind.NewPublicKeyFromBytes(rootKey.BlindPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root blind public key: %w", err)
+		}
+		salted, err := saltedkey.BlindPubKeyWithSalt(pk, salt)
+		if err != nil {
+			return nil, err
+		}
+		return salted.Bytes(), nil
+	case types.SignatureTypeBlindBLS:
+		pk := new(bls12381.G2)
+		if err := pk.SetBytes(rootKey.BLSPubKey); err != nil {
+			return nil, fmt.Errorf("invalid root BLS public key: %w", err)
+		}
+		salted, err := saltedkey.SaltBLSPubKey(pk, salt)
+		if err != nil {
+			return nil, err
+		}
+		return salted.BytesCompressed(), nil
+	default:
+		return nil, fmt.Errorf("signature type %q does not support receipts", signType)
+	}
+}
+
+// VerifyReceipt checks that the receipt signature is valid for its payload, and
+// that it was produced by the election salted key derived from rootKey, which
+// must be the CSP root key identified by the receipt KeyID. The saltVersion is the
+// salt version of the election known by the verifier (i.e from the election config
+// or the info endpoint), receipts of any other version are rejected.
+//
+// The payload of the ecdsa signatures is the signed message (Ethereum signature),
+// the payload of the sharedkey is the electionId, the payload of the blind signatures
+// is the signed hash and the signature the unblinded one (65 bytes compressed), and
+// the payload of the blindbls signatures is the signed message and the signature
+// the unblinded one (48 bytes compressed G1 point).
+func VerifyReceipt(r *types.Receipt, rootKey *types.RootKey, saltVersion saltedkey.SaltVersion) error {
+	if r == nil {
+		return fmt.Errorf("receipt is nil")
+	}
+	if r.Version != types.ReceiptVersion {
+		return fmt.Errorf("unsupported receipt version %d", r.Version)
+	}
+	if rootKey == nil || r.KeyID != rootKey.ID {
+		return fmt.Errorf("receipt issued with root key %q", r.KeyID)
+	}
+	if err := checkSaltVersion(r.SaltVersion, saltVersion); err != nil {
+		return err
+	}
+	pubKey, err := SaltedPubKey(rootKey, saltVersion, r.ElectionID, r.SignatureType)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pubKey, r.PubKey) {
+		return fmt.Errorf("public key does not match the election salted key")
+	}
+	switch r.SignatureType {
+	case types.SignatureTypeEthereum, types.SignatureTypeSharedKey:
+		if r.SignatureType == types.SignatureTypeSharedKey && !bytes.Equal(r.Payload, r.ElectionID) {
+			return fmt.Errorf("shared key payload must be the election id")
+		}
+		// PubKeyFromSignature might modify the signature recovery byte
+		signature := append([]byte{}, r.Signature...)
+		signer, err := ethereum.PubKeyFromSignature(r.Payload, signature)
+		if err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+		if !bytes.Equal(signer, pubKey) {
+			return fmt.Errorf("invalid signature")
+		}
+	case types.SignatureTypeBlind:
+		pk, err := blind.NewPublicKeyFromBytes(pubKey)
+		if err != nil {
+			return err
+		}
+		signature, err := blind.NewSignatureFromBytes(r.Signature)
+		if err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+		if !blind.Verify(new(big.Int).SetBytes(r.Payload), signature, pk) {
+			return fmt.Errorf("invalid signature")
+		}
+	case types.SignatureTypeBlindBLS:
+		pk := new(bls12381.G2)
+		if err := pk.SetBytes(pubKey); err != nil {
+			return err
+		}
+		if !saltedkey.VerifyBLS(pk, r.Payload, r.Signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	}
+	return nil
+}
+
+// checkSaltVersion checks that version, the salt version of a signed object (zero
+// means version 1), is the expected one. The salt version is never taken from the
+// object, so a signature cannot be verified with a downgraded salt derivation.
+func checkSaltVersion(version uint32, expected saltedkey.SaltVersion) error {
+	if version == 0 {
+		version = uint32(saltedkey.SaltVersion1)
+	}
+	if version != uint32(expected) {
+		return fmt.Errorf("salt version %d does not match the election salt version %d", version, expected)
+	}
+	return nil
+}
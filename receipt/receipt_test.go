@@ -0,0 +1,280 @@
+package receipt
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	qt "github.com/frankban/quicktest"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/translog"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestVerifyReceipt(t *testing.T) {
+	sk, err := saltedkey.NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+	ecdsaPubKey, err := sk.ECDSAPubKey()
+	qt.Assert(t, err, qt.IsNil)
+	rootKey := &types.RootKey{
+		ID:          "key-1",
+		BlindPubKey: sk.BlindPubKey().Bytes(),
+		ECDSAPubKey: ethcrypto.CompressPubkey(ecdsaPubKey),
+		BLSPubKey:   sk.BLSPubKey().BytesCompressed(),
+	}
+	electionID := types.HexBytes(randomBytes(32))
+	salt, err := saltedkey.ElectionSalt(saltedkey.DefaultSaltVersion, electionID)
+	qt.Assert(t, err, qt.IsNil)
+
+	newReceipt := func(signType string, payload, signature []byte) *types.Receipt {
+		pubKey, err := SaltedPubKey(rootKey, saltedkey.SaltVersion1, electionID, signType)
+		qt.Assert(t, err, qt.IsNil)
+		return &types.Receipt{
+			Version:       types.ReceiptVersion,
+			ElectionID:    electionID,
+			SignatureType: signType,
+			KeyID:         rootKey.ID,
+			PubKey:        pubKey,
+			Payload:       payload,
+			Signature:     signature,
+		}
+	}
+
+	// ecdsa
+	payload := randomBytes(32)
+	signature, err := sk.SignECDSAWithSalt(salt, payload)
+	qt.Assert(t, err, qt.IsNil)
+	ecdsaReceipt := newReceipt(types.SignatureTypeEthereum, payload, signature)
+	qt.Assert(t, VerifyReceipt(ecdsaReceipt, rootKey, saltedkey.SaltVersion1), qt.IsNil)
+
+	// sharedkey
+	signature, err = sk.SignECDSAWithSalt(salt, electionID)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, VerifyReceipt(newReceipt(types.SignatureTypeSharedKey, electionID, signature), rootKey, saltedkey.SaltVersion1), qt.IsNil)
+	qt.Assert(t, VerifyReceipt(newReceipt(types.SignatureTypeSharedKey, payload, ecdsaReceipt.Signature), rootKey, saltedkey.SaltVersion1),
+		qt.Not(qt.IsNil))
+
+	// blind
+	hash := ethereum.HashRaw(randomBytes(32))
+	k, signerR, err := blind.NewRequestParameters()
+	qt.Assert(t, err, qt.IsNil)
+	msgBlinded, userSecretData, err := blind.Blind(new(big.Int).SetBytes(hash), signerR)
+	qt.Assert(t, err, qt.IsNil)
+	blindSignature, err := sk.SignBlindWithSalt(salt, msgBlinded.Bytes(), k)
+	qt.Assert(t, err, qt.IsNil)
+	signature = blind.Unblind(new(big.Int).SetBytes(blindSignature), userSecretData).Bytes()
+	qt.Assert(t, VerifyReceipt(newReceipt(types.SignatureTypeBlind, hash, signature), rootKey, saltedkey.SaltVersion1), qt.IsNil)
+
+	// blindbls
+	msgBlinded2, r, err := saltedkey.BlindBLS(payload)
+	qt.Assert(t, err, qt.IsNil)
+	blindSignature, err = sk.SignBlindBLS(salt, msgBlinded2)
+	qt.Assert(t, err, qt.IsNil)
+	signature, err = saltedkey.UnblindBLS(blindSignature, r)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, VerifyReceipt(newReceipt(types.SignatureTypeBlindBLS, payload, signature), rootKey, saltedkey.SaltVersion1), qt.IsNil)
+
+	// salt version 2
+	salt2, err := saltedkey.ElectionSalt(saltedkey.SaltVersion2, electionID)
+	qt.Assert(t, err, qt.IsNil)
+	v2Receipt := newReceipt(types.SignatureTypeEthereum, payload, nil)
+	v2Receipt.SaltVersion = uint32(saltedkey.SaltVersion2)
+	v2Receipt.PubKey, err = SaltedPubKey(rootKey, saltedkey.SaltVersion2, electionID, types.SignatureTypeEthereum)
+	qt.Assert(t, err, qt.IsNil)
+	v2Receipt.Signature, err = sk.SignECDSAWithSalt(salt2, payload)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, VerifyReceipt(v2Receipt, rootKey, saltedkey.SaltVersion2), qt.IsNil)
+	tampered := *v2Receipt
+	tampered.SaltVersion = uint32(saltedkey.SaltVersion1)
+	qt.Assert(t, VerifyReceipt(&tampered, rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+
+	// The salt version is the one expected by the verifier, it cannot be downgraded
+	// by the receipt (zero means version 1)
+	qt.Assert(t, VerifyReceipt(v2Receipt, rootKey, saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+	qt.Assert(t, VerifyReceipt(ecdsaReceipt, rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	tampered = *ecdsaReceipt
+	tampered.SaltVersion = uint32(saltedkey.SaltVersion1)
+	qt.Assert(t, VerifyReceipt(&tampered, rootKey, saltedkey.SaltVersion1), qt.IsNil)
+
+	// The receipts can be serialized as JSON and protobuf
+	for version, r := range map[saltedkey.SaltVersion]*types.Receipt{
+		saltedkey.SaltVersion1: ecdsaReceipt,
+		saltedkey.SaltVersion2: v2Receipt,
+	} {
+		data, err := json.Marshal(r)
+		qt.Assert(t, err, qt.IsNil)
+		decoded := &types.Receipt{}
+		qt.Assert(t, json.Unmarshal(data, decoded), qt.IsNil)
+		qt.Assert(t, decoded, qt.DeepEquals, r)
+		decoded = &types.Receipt{}
+		data, err = r.MarshalProto()
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, decoded.UnmarshalProto(data), qt.IsNil)
+		qt.Assert(t, decoded, qt.DeepEquals, r)
+		qt.Assert(t, VerifyReceipt(decoded, rootKey, version), qt.IsNil)
+	}
+
+	// Tampered receipts are rejected
+	tampered = *ecdsaReceipt
+	tampered.Payload = randomBytes(32)
+	qt.Assert(t, VerifyReceipt(&tampered, rootKey, saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+	tampered = *ecdsaReceipt
+	tampered.ElectionID = randomBytes(32)
+	qt.Assert(t, VerifyReceipt(&tampered, rootKey, saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+	tampered = *ecdsaReceipt
+	tampered.KeyID = "key-2"
+	qt.Assert(t, VerifyReceipt(&tampered, rootKey, saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+	tampered = *ecdsaReceipt
+	tampered.Version = 2
+	qt.Assert(t, VerifyReceipt(&tampered, rootKey, saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+
+	// A signature of other key is rejected, even if the receipt public key is its own
+	other, err := ethcrypto.GenerateKey()
+	qt.Assert(t, err, qt.IsNil)
+	tampered = *ecdsaReceipt
+	tampered.Signature, err = ethcrypto.Sign(ethereum.Hash(tampered.Payload), other)
+	qt.Assert(t, err, qt.IsNil)
+	tampered.PubKey = ethcrypto.CompressPubkey(&other.PublicKey)
+	qt.Assert(t, VerifyReceipt(&tampered, rootKey, saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+}
+
+func TestVerifyRevocationList(t *testing.T) {
+	sk, err := saltedkey.NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+	ecdsaPubKey, err := sk.ECDSAPubKey()
+	qt.Assert(t, err, qt.IsNil)
+	rootKey := &types.RootKey{ID: "key-1", ECDSAPubKey: ethcrypto.CompressPubkey(ecdsaPubKey)}
+	electionID := types.HexBytes(randomBytes(32))
+	salt, err := saltedkey.ElectionSalt(saltedkey.SaltVersion2, electionID)
+	qt.Assert(t, err, qt.IsNil)
+	pubKey, err := SaltedPubKey(rootKey, saltedkey.SaltVersion2, electionID, types.SignatureTypeEthereum)
+	qt.Assert(t, err, qt.IsNil)
+
+	revoked1, revoked2 := RevocationHash([]byte("voter-1")), RevocationHash([]byte("voter-2"))
+	if string(revoked1) > string(revoked2) {
+		revoked1, revoked2 = revoked2, revoked1
+	}
+	sign := func(l *types.RevocationList) *types.RevocationList {
+		l.Signature, err = sk.SignECDSAWithSalt(salt, l.SignedData())
+		qt.Assert(t, err, qt.IsNil)
+		return l
+	}
+	newList := func(revoked ...types.HexBytes) *types.RevocationList {
+		return sign(&types.RevocationList{
+			ElectionID:  electionID,
+			KeyID:       rootKey.ID,
+			SaltVersion: uint32(saltedkey.SaltVersion2),
+			PubKey:      pubKey,
+			Revoked:     revoked,
+			Timestamp:   1700000000,
+		})
+	}
+	list := newList(revoked1, revoked2)
+	qt.Assert(t, VerifyRevocationList(list, rootKey, saltedkey.SaltVersion2), qt.IsNil)
+	qt.Assert(t, IsRevoked(list, []byte("voter-1")), qt.IsTrue)
+	qt.Assert(t, IsRevoked(list, []byte("voter-3")), qt.IsFalse)
+
+	// Unsorted, repeated or invalid hashes are rejected, even if signed
+	qt.Assert(t, VerifyRevocationList(newList(revoked2, revoked1), rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	qt.Assert(t, VerifyRevocationList(newList(revoked1, revoked1), rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	qt.Assert(t, VerifyRevocationList(newList(randomBytes(20)), rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+
+	// Tampered lists are rejected
+	tampered := *list
+	tampered.Revoked = tampered.Revoked[1:]
+	qt.Assert(t, VerifyRevocationList(&tampered, rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	tampered = *list
+	tampered.Timestamp++
+	qt.Assert(t, VerifyRevocationList(&tampered, rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	qt.Assert(t, VerifyRevocationList(list, rootKey, saltedkey.SaltVersion1), qt.Not(qt.IsNil))
+	tampered = *list
+	tampered.SaltVersion = uint32(saltedkey.SaltVersion1)
+	qt.Assert(t, VerifyRevocationList(&tampered, rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	tampered = *list
+	tampered.ElectionID = randomBytes(32)
+	qt.Assert(t, VerifyRevocationList(sign(&tampered), rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	tampered = *list
+	tampered.KeyID = "key-2"
+	qt.Assert(t, VerifyRevocationList(&tampered, rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+}
+
+func TestVerifyTreeHead(t *testing.T) {
+	sk, err := saltedkey.NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+	ecdsaPubKey, err := sk.ECDSAPubKey()
+	qt.Assert(t, err, qt.IsNil)
+	rootKey := &types.RootKey{ID: "key-1", ECDSAPubKey: ethcrypto.CompressPubkey(ecdsaPubKey)}
+	electionID := types.HexBytes(randomBytes(32))
+	salt, err := saltedkey.ElectionSalt(saltedkey.DefaultSaltVersion, electionID)
+	qt.Assert(t, err, qt.IsNil)
+	pubKey, err := SaltedPubKey(rootKey, saltedkey.DefaultSaltVersion, electionID, types.SignatureTypeEthereum)
+	qt.Assert(t, err, qt.IsNil)
+
+	payloads := [][]byte{randomBytes(32), randomBytes(32), randomBytes(32)}
+	leaves := [][]byte{}
+	for _, p := range payloads {
+		leaves = append(leaves, translog.LeafHash(types.SignatureTypeBlind, p))
+	}
+	newHead := func(size int) *types.TreeHead {
+		th := &types.TreeHead{
+			ElectionID: electionID,
+			KeyID:      rootKey.ID,
+			PubKey:     pubKey,
+			Size:       uint64(size),
+			RootHash:   translog.RootHash(leaves[:size]),
+			Timestamp:  1700000000,
+		}
+		th.Signature, err = sk.SignECDSAWithSalt(salt, th.SignedData())
+		qt.Assert(t, err, qt.IsNil)
+		return th
+	}
+	prev, head := newHead(2), newHead(3)
+	qt.Assert(t, VerifyTreeHead(prev, rootKey, saltedkey.DefaultSaltVersion), qt.IsNil)
+	qt.Assert(t, VerifyTreeHead(head, rootKey, saltedkey.DefaultSaltVersion), qt.IsNil)
+
+	path, err := translog.InclusionProof(leaves, 1)
+	qt.Assert(t, err, qt.IsNil)
+	proof := &types.LogProof{TreeSize: 3, LeafIndex: 1, Path: hexPath(path)}
+	qt.Assert(t, VerifyLogInclusion(head, proof, types.SignatureTypeBlind, payloads[1]), qt.IsNil)
+	qt.Assert(t, VerifyLogInclusion(head, proof, types.SignatureTypeBlind, payloads[2]), qt.Not(qt.IsNil))
+	qt.Assert(t, VerifyLogInclusion(prev, proof, types.SignatureTypeBlind, payloads[1]), qt.Not(qt.IsNil))
+
+	path, err = translog.ConsistencyProof(leaves, 2)
+	qt.Assert(t, err, qt.IsNil)
+	proof = &types.LogProof{TreeSize: 3, FromSize: 2, Path: hexPath(path)}
+	qt.Assert(t, VerifyLogConsistency(prev, head, proof), qt.IsNil)
+	qt.Assert(t, VerifyLogConsistency(head, prev, proof), qt.Not(qt.IsNil))
+
+	// Tampered tree heads are rejected
+	qt.Assert(t, VerifyTreeHead(head, rootKey, saltedkey.SaltVersion2), qt.Not(qt.IsNil))
+	tampered := *head
+	tampered.Size--
+	qt.Assert(t, VerifyTreeHead(&tampered, rootKey, saltedkey.DefaultSaltVersion), qt.Not(qt.IsNil))
+	tampered = *head
+	tampered.RootHash = prev.RootHash
+	qt.Assert(t, VerifyTreeHead(&tampered, rootKey, saltedkey.DefaultSaltVersion), qt.Not(qt.IsNil))
+	tampered = *head
+	tampered.KeyID = "key-2"
+	qt.Assert(t, VerifyTreeHead(&tampered, rootKey, saltedkey.DefaultSaltVersion), qt.Not(qt.IsNil))
+}
+
+func hexPath(path [][]byte) []types.HexBytes {
+	h := make([]types.HexBytes, len(path))
+	for i := range path {
+		h[i] = path[i]
+	}
+	return h
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,77 @@
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/types"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// RevocationHash returns the hash identifying the ecdsa signature of payload on the
+// revocation lists (keccak256).
+func RevocationHash(payload []byte) []byte {
+	return ethereum.HashRaw(payload)
+}
+
+// IsRevoked returns true if the ecdsa signature of payload is on the revocation list.
+// The list must be verified first (see VerifyRevocationList).
+func IsRevoked(l *types.RevocationList, payload []byte) bool {
+	hash := RevocationHash(payload)
+	for _, h := range l.Revoked {
+		if bytes.Equal(h, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyRevocationList checks that the revocation list is signed by the election
+// salted ECDSA key derived from rootKey, which must be the CSP root key identified
+// by the list KeyID, with the election saltVersion (see VerifyReceipt).
+func VerifyRevocationList(l *types.RevocationList, rootKey *types.RootKey, saltVersion saltedkey.SaltVersion) error {
+	if l == nil {
+		return fmt.Errorf("revocation list is nil")
+	}
+	if rootKey == nil || l.KeyID != rootKey.ID {
+		return fmt.Errorf("revocation list signed with root key %q", l.KeyID)
+	}
+	for i, h := range l.Revoked {
+		if len(h) != ethcrypto.DigestLength {
+			return fmt.Errorf("invalid revoked hash %d", i)
+		}
+		if i > 0 && bytes.Compare(l.Revoked[i-1], h) >= 0 {
+			return fmt.Errorf("revoked hashes must be sorted and unique")
+		}
+	}
+	return verifyElectionSignature(rootKey, saltVersion, l.SaltVersion, l.ElectionID, l.PubKey, l.SignedData(), l.Signature)
+}
+
+// verifyElectionSignature checks that signature of data is issued by the election
+// salted ECDSA key pubKey, derived from rootKey with the expected saltVersion. The
+// version is the salt version of the signed object (see checkSaltVersion).
+func verifyElectionSignature(rootKey *types.RootKey, saltVersion saltedkey.SaltVersion, version uint32,
+	electionID, pubKey, data, signature []byte,
+) error {
+	if err := checkSaltVersion(version, saltVersion); err != nil {
+		return err
+	}
+	saltedPubKey, err := SaltedPubKey(rootKey, saltVersion, electionID, types.SignatureTypeEthereum)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(saltedPubKey, pubKey) {
+		return fmt.Errorf("public key does not match the election salted key")
+	}
+	// PubKeyFromSignature might modify the signature recovery byte
+	signer, err := ethereum.PubKeyFromSignature(data, append([]byte{}, signature...))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if !bytes.Equal(signer, pubKey) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
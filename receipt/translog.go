@@ -0,0 +1,58 @@
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/vocdoni/blind-csp/saltedkey"
+	"github.com/vocdoni/blind-csp/translog"
+	"github.com/vocdoni/blind-csp/types"
+)
+
+// VerifyTreeHead checks that the transparency log tree head is signed by the election
+// salted ECDSA key derived from rootKey, which must be the CSP root key identified by
+// the tree head KeyID, with the election saltVersion (see VerifyReceipt).
+func VerifyTreeHead(th *types.TreeHead, rootKey *types.RootKey, saltVersion saltedkey.SaltVersion) error {
+	if th == nil {
+		return fmt.Errorf("tree head is nil")
+	}
+	if rootKey == nil || th.KeyID != rootKey.ID {
+		return fmt.Errorf("tree head signed with root key %q", th.KeyID)
+	}
+	if len(th.RootHash) != translog.HashSize {
+		return fmt.Errorf("invalid root hash")
+	}
+	return verifyElectionSignature(rootKey, saltVersion, th.SaltVersion, th.ElectionID, th.PubKey, th.SignedData(), th.Signature)
+}
+
+// VerifyLogInclusion checks that the proof includes the leaf of the signature of
+// signType over data (see translog.LeafHash) in the log of the tree head, which must
+// be verified first (see VerifyTreeHead).
+func VerifyLogInclusion(th *types.TreeHead, proof *types.LogProof, signType string, data []byte) error {
+	if proof == nil || proof.TreeSize != th.Size {
+		return fmt.Errorf("inclusion proof is not for the tree head")
+	}
+	return translog.VerifyInclusion(translog.LeafHash(signType, data), proof.LeafIndex,
+		proof.TreeSize, hashes(proof.Path), th.RootHash)
+}
+
+// VerifyLogConsistency checks that the log of the tree head prev is a prefix of the
+// log of th, so no issued signature has been removed or rewritten. Both tree heads
+// must be verified first (see VerifyTreeHead).
+func VerifyLogConsistency(prev, th *types.TreeHead, proof *types.LogProof) error {
+	if !bytes.Equal(prev.ElectionID, th.ElectionID) {
+		return fmt.Errorf("tree heads of different elections")
+	}
+	if proof == nil || proof.TreeSize != th.Size || proof.FromSize != prev.Size {
+		return fmt.Errorf("consistency proof is not for the tree heads")
+	}
+	return translog.VerifyConsistency(prev.Size, th.Size, prev.RootHash, th.RootHash, hashes(proof.Path))
+}
+
+func hashes(path []types.HexBytes) [][]byte {
+	h := make([][]byte, len(path))
+	for i := range path {
+		h[i] = path[i]
+	}
+	return h
+}
@@ -0,0 +1,37 @@
+package saltedkey
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"fmt"
+)
+
+// BlindRSAPrefixSize is the size of the random prefix of the messages prepared for
+// a blind RSA signature (RFC 9474, RSABSSA-SHA384-PSS-Randomized).
+const BlindRSAPrefixSize = 32
+
+// PrepareBlindRSA returns the message to blind for requesting a blind RSA signature
+// of msg, prefixed with random bytes as required by the randomized variant
+// (RFC 9474, RSABSSA-SHA384-PSS-Randomized). The signature is verified over the
+// prepared message, so the client must keep it.
+func PrepareBlindRSA(msg []byte) ([]byte, error) {
+	prepared := make([]byte, BlindRSAPrefixSize, BlindRSAPrefixSize+len(msg))
+	if _, err := rand.Read(prepared); err != nil {
+		return nil, err
+	}
+	return append(prepared, msg...), nil
+}
+
+// VerifyBlindRSA returns nil if signature is a valid blind RSA signature of the
+// prepared message (see PrepareBlindRSA) for pubKey. The signatures are standard
+// RSA-PSS signatures (SHA-384, 48 bytes salt).
+func VerifyBlindRSA(pubKey *rsa.PublicKey, prepared, signature []byte) error {
+	if len(prepared) < BlindRSAPrefixSize {
+		return fmt.Errorf("prepared message is too short")
+	}
+	digest := sha512.Sum384(prepared)
+	return rsa.VerifyPSS(pubKey, crypto.SHA384, digest[:], signature,
+		&rsa.PSSOptions{SaltLength: sha512.Size384, Hash: crypto.SHA384})
+}
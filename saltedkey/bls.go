@@ -0,0 +1,206 @@
+package saltedkey
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+
+	"github.com/cloudflare/circl/ecc/bls12381"
+)
+
+const (
+	// BLSPubKeySize is the size of a compressed BLS12-381 public key (G2 point)
+	BLSPubKeySize = 96
+	// BLSSignatureSize is the size of a compressed BLS12-381 signature (G1 point)
+	BLSSignatureSize = 48
+)
+
+var (
+	// blsDST is the domain separation tag used for hashing the messages to G1
+	blsDST = []byte("BLIND-CSP-V01-CS01-with-BLS12381G1_XMD:SHA-256_SSWU_RO_")
+	// blsKeyDST is the domain separation tag used for deriving the BLS key from the root key
+	blsKeyDST = []byte("BLIND-CSP-V01-BLS12381-KEY")
+)
+
+// BLSSigner is implemented by the signers supporting BLS12-381 blind signatures.
+// BLS signatures of the same key can be verified in batch, so a tally verifier
+// can check all the CSP proofs of an election at once.
+type BLSSigner interface {
+	// SignBlindBLS returns the blind signature of a blinded message (compressed
+	// G1 point, see BlindBLS) using the provided Salt.
+	SignBlindBLS(salt Salt, msgBlinded []byte) ([]byte, error)
+	// BLSPubKey returns the root BLS public key.
+	BLSPubKey() *bls12381.G2
+}
+
+var _ BLSSigner = (*SaltedKey)(nil)
+
+// SignBlindBLS returns the blind BLS signature of msgBlinded using the provided Salt.
+// The BLS private key is derived from the root key, and salted by adding the salt.
+func (sk *SaltedKey) SignBlindBLS(salt Salt, msgBlinded []byte) ([]byte, error) {
+	m := new(bls12381.G1)
+	if err := m.SetBytes(msgBlinded); err != nil {
+		return nil, fmt.Errorf("invalid blinded message: %w", err)
+	}
+	if m.IsIdentity() {
+		return nil, fmt.Errorf("blinded message can not be the identity")
+	}
+	key := sk.blsKey()
+	key.Add(key, blsSalt(salt))
+	signature := new(bls12381.G1)
+	signature.ScalarMult(key, m)
+	return signature.BytesCompressed(), nil
+}
+
+// BLSPubKey returns the root BLS public key.
+func (sk *SaltedKey) BLSPubKey() *bls12381.G2 {
+	pk := new(bls12381.G2)
+	pk.ScalarMult(sk.blsKey(), bls12381.G2Generator())
+	return pk
+}
+
+// blsKey derives the BLS private key from the root key.
+func (sk *SaltedKey) blsKey() *bls12381.Scalar {
+	h := sha512.New()
+	h.Write(blsKeyDST)
+	h.Write(sk.rootKey.FillBytes(make([]byte, 32)))
+	key := new(bls12381.Scalar)
+	key.SetBytes(h.Sum(nil))
+	return key
+}
+
+// SaltBLSPubKey returns the salted BLS public key of pubKey applying the salt.
+func SaltBLSPubKey(pubKey *bls12381.G2, salt Salt) (*bls12381.G2, error) {
+	if pubKey == nil {
+		return nil, fmt.Errorf("public key is nil")
+	}
+	s := new(bls12381.G2)
+	s.ScalarMult(blsSalt(salt), bls12381.G2Generator())
+	s.Add(s, pubKey)
+	return s, nil
+}
+
+// BlindBLS blinds msg for requesting a blind BLS signature. Returns the blinded
+// message and the secret blinding factor required for unblinding the signature.
+func BlindBLS(msg []byte) ([]byte, *bls12381.Scalar, error) {
+	r := new(bls12381.Scalar)
+	for r.IsZero() == 1 {
+		if err := r.Random(rand.Reader); err != nil {
+			return nil, nil, err
+		}
+	}
+	return blindBLS(msg, r), r, nil
+}
+
+// blindBLS blinds msg with the blinding factor r.
+func blindBLS(msg []byte, r *bls12381.Scalar) []byte {
+	m := blsHash(msg)
+	m.ScalarMult(r, m)
+	return m.BytesCompressed()
+}
+
+// UnblindBLS returns the BLS signature of the message, given the blind signature
+// and the blinding factor returned by BlindBLS.
+func UnblindBLS(blindSignature []byte, r *bls12381.Scalar) ([]byte, error) {
+	if r == nil || r.IsZero() == 1 {
+		return nil, fmt.Errorf("invalid blinding factor")
+	}
+	s := new(bls12381.G1)
+	if err := s.SetBytes(blindSignature); err != nil {
+		return nil, fmt.Errorf("invalid blind signature: %w", err)
+	}
+	rInv := new(bls12381.Scalar)
+	rInv.Inv(r)
+	s.ScalarMult(rInv, s)
+	return s.BytesCompressed(), nil
+}
+
+// VerifyBLS returns true if signature is a valid BLS signature of msg for pubKey.
+func VerifyBLS(pubKey *bls12381.G2, msg, signature []byte) bool {
+	return VerifyBLSBatch([]*bls12381.G2{pubKey}, [][]byte{msg}, [][]byte{signature}) == nil
+}
+
+// VerifyBLSBatch verifies several BLS signatures at once, each signature i is
+// verified for msgs[i] and pubKeys[i]. The signatures are combined with random
+// coefficients, so an invalid signature cannot be compensated by another one.
+// Only one pairing per distinct public key (plus one) is computed, so verifying
+// all the signatures of the same election is almost as cheap as verifying one.
+func VerifyBLSBatch(pubKeys []*bls12381.G2, msgs, signatures [][]byte) error {
+	if len(pubKeys) != len(msgs) || len(msgs) != len(signatures) {
+		return fmt.Errorf("public keys, messages and signatures count mismatch")
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("no signatures to verify")
+	}
+	// e(sum(c_i*s_i), G2) == prod(e(sum(c_i*H(m_i)), pk)) for each distinct pk
+	aggSignature := new(bls12381.G1)
+	aggSignature.SetIdentity()
+	keys := []*bls12381.G2{}
+	hashes := []*bls12381.G1{}
+	keyIndex := make(map[string]int)
+	for i := range msgs {
+		if pubKeys[i] == nil || !pubKeys[i].IsOnG2() {
+			return fmt.Errorf("invalid public key %d", i)
+		}
+		s := new(bls12381.G1)
+		if err := s.SetBytes(signatures[i]); err != nil {
+			return fmt.Errorf("invalid signature %d: %w", i, err)
+		}
+		c, err := blsRandomCoefficient()
+		if err != nil {
+			return err
+		}
+		s.ScalarMult(c, s)
+		aggSignature.Add(aggSignature, s)
+
+		h := blsHash(msgs[i])
+		h.ScalarMult(c, h)
+		pk := string(pubKeys[i].BytesCompressed())
+		j, ok := keyIndex[pk]
+		if !ok {
+			j = len(keys)
+			keyIndex[pk] = j
+			keys = append(keys, pubKeys[i])
+			hashes = append(hashes, new(bls12381.G1))
+			hashes[j].SetIdentity()
+		}
+		hashes[j].Add(hashes[j], h)
+	}
+	points := append([]*bls12381.G1{aggSignature}, hashes...)
+	keys = append([]*bls12381.G2{bls12381.G2Generator()}, keys...)
+	signs := []int{1}
+	for range hashes {
+		signs = append(signs, -1)
+	}
+	if !bls12381.ProdPairFrac(points, keys, signs).IsIdentity() {
+		return fmt.Errorf("invalid BLS signature")
+	}
+	return nil
+}
+
+// blsHash hashes msg to a G1 point.
+func blsHash(msg []byte) *bls12381.G1 {
+	h := new(bls12381.G1)
+	h.Hash(msg, blsDST)
+	return h
+}
+
+// blsSalt returns the salt as a BLS scalar.
+func blsSalt(salt Salt) *bls12381.Scalar {
+	s := new(bls12381.Scalar)
+	s.SetBytes(salt[:])
+	return s
+}
+
+// blsRandomCoefficient returns a random non zero 128 bits scalar for batch verification.
+func blsRandomCoefficient() (*bls12381.Scalar, error) {
+	b := make([]byte, 16)
+	c := new(bls12381.Scalar)
+	for c.IsZero() == 1 {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c.SetBytes(b)
+	}
+	return c, nil
+}
@@ -0,0 +1,125 @@
+package saltedkey
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/cloudflare/circl/ecc/bls12381"
+	qt "github.com/frankban/quicktest"
+)
+
+// blsTestVectors are the BLS blind signatures for fixed keys, salts, messages and
+// blinding factors. Clients implementing the scheme can use them for testing.
+var blsTestVectors = []struct {
+	rootKey, salt, msg, r                                       string
+	pubKey, saltedPubKey, msgBlinded, blindSignature, signature string
+}{
+	{
+		rootKey:        "0000000000000000000000000000000000000000000000000000000000000001",
+		salt:           "0000000000000000000000000000000000000000",
+		msg:            "",
+		r:              "01",
+		pubKey:         "89367df8cff45d9f1307f1df9859aa139f1bf770230637b3a0d51586cbde81c2a37d13117741e327ab8d14f7a55224de096a8f370cf6268f5b19445f625a1d2a7c13c09f5feb1e5cf4e6fe621f3be229d3495c02e94d811bd6e50727d5cd922c",
+		saltedPubKey:   "89367df8cff45d9f1307f1df9859aa139f1bf770230637b3a0d51586cbde81c2a37d13117741e327ab8d14f7a55224de096a8f370cf6268f5b19445f625a1d2a7c13c09f5feb1e5cf4e6fe621f3be229d3495c02e94d811bd6e50727d5cd922c",
+		msgBlinded:     "8944fb5a1c4983a383c0d6818ce559b7601c74893bcf00dc517b6ed220eac65637541a865974d637c6c6b84167cb3f32",
+		blindSignature: "b07c8ba564494de6184bf07d579ab543b47b1b9609c6d104a6fe87438ed0c073f85f56ee23c75f6c6d64604f92a300ee",
+		signature:      "b07c8ba564494de6184bf07d579ab543b47b1b9609c6d104a6fe87438ed0c073f85f56ee23c75f6c6d64604f92a300ee",
+	},
+	{
+		rootKey:        "9218505c1133fb55e6ae6ca7cc47cb590f9bf2a1d70a841eff275a978e5a420c",
+		salt:           "a9893a41fc7046d66d39fdc073ed901af6bec66e",
+		msg:            "68656c6c6f20776f726c6421",
+		r:              "3f1c2a5b8d7e6f9a0b1c2d3e4f5a6b7c8d9e0fa1b2c3d4e5f60718293a4b5c6d",
+		pubKey:         "8a6b4d23152af861cd06509eeaaf07ad5eeb18361668f334d57c7643b54d91259eeeaee73c9548efa418bec73c402f9f029e9a8581ad57391e29543269edde67503e47ac0e7b82fffd36c18220424778a24b94a2623dbe4b1ba05a59487d3bf5",
+		saltedPubKey:   "b612122892deef02e732a589c2932111b076d07ce61b8d6d1124efbd5a219d3a1639baf3132183a92b768b4b446b02d614a4c0e37d36c0a15172586e02fb25c50aba67d0e36599a5e0fa7a9424c98ebcaf108095a7a5a17ac5dea1b10f765c16",
+		msgBlinded:     "b9a2f2bed9ebd85840dae5462196051a7a75f40b4b5ecf41760d1e418b39b8234584f73c4bb20aa2a7f0aa9ed6582db2",
+		blindSignature: "939b5bb727cf0519312f44257f39e7b11704d70398f65240a23b8b94ce8d97e16c94896c6237caf24ce51195c4148bd8",
+		signature:      "8c949592d74dbd50d4a3c4021023d14fb77289258cf548d06ae0879759f292be2c22a62952c5e39fdcf7dabf87e28da9",
+	},
+}
+
+func TestBLSTestVectors(t *testing.T) {
+	for i, v := range blsTestVectors {
+		sk, err := NewSaltedKey(v.rootKey)
+		qt.Assert(t, err, qt.IsNil)
+		var salt Salt
+		// the salts are big-endian scalars
+		s := testHex(t, v.salt)
+		copy(salt[ScalarSaltSize-len(s):], s)
+		msg := testHex(t, v.msg)
+		r := new(bls12381.Scalar)
+		r.SetBytes(testHex(t, v.r))
+
+		qt.Assert(t, hex.EncodeToString(sk.BLSPubKey().BytesCompressed()), qt.Equals, v.pubKey, qt.Commentf("vector %d", i))
+		saltedPubKey, err := SaltBLSPubKey(sk.BLSPubKey(), salt)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, hex.EncodeToString(saltedPubKey.BytesCompressed()), qt.Equals, v.saltedPubKey)
+		msgBlinded := blindBLS(msg, r)
+		qt.Assert(t, hex.EncodeToString(msgBlinded), qt.Equals, v.msgBlinded)
+		blindSignature, err := sk.SignBlindBLS(salt, msgBlinded)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, hex.EncodeToString(blindSignature), qt.Equals, v.blindSignature)
+		signature, err := UnblindBLS(blindSignature, r)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, hex.EncodeToString(signature), qt.Equals, v.signature)
+		qt.Assert(t, VerifyBLS(saltedPubKey, msg, signature), qt.IsTrue)
+	}
+}
+
+func TestBLSBlindSignatureBatch(t *testing.T) {
+	sk, err := NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+
+	// Sign several messages for two elections
+	pubKeys := []*bls12381.G2{}
+	msgs := [][]byte{}
+	signatures := [][]byte{}
+	for e := 0; e < 2; e++ {
+		var salt Salt
+		copy(salt[:], randomBytes(ScalarSaltSize))
+		saltedPubKey, err := SaltBLSPubKey(sk.BLSPubKey(), salt)
+		qt.Assert(t, err, qt.IsNil)
+		for i := 0; i < 5; i++ {
+			msg := randomBytes(32)
+			msgBlinded, r, err := BlindBLS(msg)
+			qt.Assert(t, err, qt.IsNil)
+			blindSignature, err := sk.SignBlindBLS(salt, msgBlinded)
+			qt.Assert(t, err, qt.IsNil)
+			signature, err := UnblindBLS(blindSignature, r)
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, signature, qt.HasLen, BLSSignatureSize)
+			qt.Assert(t, VerifyBLS(saltedPubKey, msg, signature), qt.IsTrue)
+			pubKeys = append(pubKeys, saltedPubKey)
+			msgs = append(msgs, msg)
+			signatures = append(signatures, signature)
+		}
+	}
+	qt.Assert(t, VerifyBLSBatch(pubKeys, msgs, signatures), qt.IsNil)
+
+	// The signatures are not valid for the other election
+	qt.Assert(t, VerifyBLS(pubKeys[9], msgs[0], signatures[0]), qt.IsFalse)
+
+	// Swapped signatures invalidate the batch
+	signatures[0], signatures[1] = signatures[1], signatures[0]
+	qt.Assert(t, VerifyBLSBatch(pubKeys, msgs, signatures), qt.Not(qt.IsNil))
+	signatures[0], signatures[1] = signatures[1], signatures[0]
+
+	// Two invalid signatures that compensate each other invalidate the batch
+	delta := new(bls12381.G1)
+	delta.Hash(randomBytes(32), nil)
+	s0, s1 := new(bls12381.G1), new(bls12381.G1)
+	qt.Assert(t, s0.SetBytes(signatures[0]), qt.IsNil)
+	qt.Assert(t, s1.SetBytes(signatures[1]), qt.IsNil)
+	s0.Add(s0, delta)
+	delta.Neg()
+	s1.Add(s1, delta)
+	signatures[0], signatures[1] = s0.BytesCompressed(), s1.BytesCompressed()
+	qt.Assert(t, VerifyBLSBatch(pubKeys, msgs, signatures), qt.Not(qt.IsNil))
+}
+
+func testHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	qt.Assert(t, err, qt.IsNil)
+	return b
+}
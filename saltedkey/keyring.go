@@ -0,0 +1,146 @@
+package saltedkey
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRootKeyUnknown is returned when the key ID is not found on the key ring.
+	ErrRootKeyUnknown = fmt.Errorf("root key not found")
+	// ErrRootKeyExpired is returned when the root key is used out of its validity window.
+	ErrRootKeyExpired = fmt.Errorf("root key not valid")
+	// ErrNoActiveRootKey is returned when no root key of the key ring is valid.
+	ErrNoActiveRootKey = fmt.Errorf("no active root key")
+)
+
+// RootKey is a salted key signer identified by an ID and only valid within a time window.
+type RootKey struct {
+	Signer
+	ID string
+	// NotBefore is the time from which the key can be used
+	NotBefore time.Time
+	// NotAfter is the time from which the key cannot be used anymore.
+	// If zero, the key does not expire.
+	NotAfter time.Time
+}
+
+// NewRootKey returns a root key using the private key provided in hex format.
+func NewRootKey(id, privKey string, notBefore, notAfter time.Time) (*RootKey, error) {
+	sk, err := NewSaltedKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("root key %s: %w", id, err)
+	}
+	return NewRootKeyWithSigner(id, sk, notBefore, notAfter)
+}
+
+// NewRootKeyWithSigner returns a root key whose signatures are performed by signer.
+func NewRootKeyWithSigner(id string, signer Signer, notBefore, notAfter time.Time) (*RootKey, error) {
+	if id == "" {
+		return nil, fmt.Errorf("root key ID is empty")
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("root key %s signer is nil", id)
+	}
+	if !notAfter.IsZero() && !notAfter.After(notBefore) {
+		return nil, fmt.Errorf("root key %s notAfter must be later than notBefore", id)
+	}
+	return &RootKey{
+		Signer:    signer,
+		ID:        id,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	}, nil
+}
+
+// ValidAt returns true if t is within the key validity window.
+func (rk *RootKey) ValidAt(t time.Time) bool {
+	if t.Before(rk.NotBefore) {
+		return false
+	}
+	return rk.NotAfter.IsZero() || t.Before(rk.NotAfter)
+}
+
+// KeyRing holds several root keys. The active key (the valid one most recently
+// enabled) is used for new elections, while the rest of valid keys are kept for
+// the elections already using them. This allows rotating the root key without
+// breaking the ongoing elections.
+type KeyRing struct {
+	keys []*RootKey
+	lock sync.RWMutex
+}
+
+// NewKeyRing returns a key ring with the given root keys.
+func NewKeyRing(keys ...*RootKey) (*KeyRing, error) {
+	kr := &KeyRing{}
+	for _, rk := range keys {
+		if err := kr.Add(rk); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// Add adds a new root key to the key ring. The key ID must be unique.
+func (kr *KeyRing) Add(rk *RootKey) error {
+	if rk == nil {
+		return fmt.Errorf("root key is nil")
+	}
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	for _, k := range kr.keys {
+		if k.ID == rk.ID {
+			return fmt.Errorf("root key %s already exists", rk.ID)
+		}
+	}
+	kr.keys = append(kr.keys, rk)
+	// Keep the keys sorted by NotBefore, so the last valid one is the active
+	sort.SliceStable(kr.keys, func(i, j int) bool {
+		return kr.keys[i].NotBefore.Before(kr.keys[j].NotBefore)
+	})
+	return nil
+}
+
+// Key returns the root key identified by id, if it is valid at the current time.
+func (kr *KeyRing) Key(id string) (*RootKey, error) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	for _, rk := range kr.keys {
+		if rk.ID != id {
+			continue
+		}
+		if !rk.ValidAt(time.Now()) {
+			return nil, fmt.Errorf("%w: %s", ErrRootKeyExpired, id)
+		}
+		return rk, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrRootKeyUnknown, id)
+}
+
+// Active returns the root key that must be used for new elections at time t.
+// It is the valid key with the most recent NotBefore.
+func (kr *KeyRing) Active(t time.Time) (*RootKey, error) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if kr.keys[i].ValidAt(t) {
+			return kr.keys[i], nil
+		}
+	}
+	return nil, ErrNoActiveRootKey
+}
+
+// Keys returns the root keys that are valid at time t.
+func (kr *KeyRing) Keys(t time.Time) []*RootKey {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	keys := []*RootKey{}
+	for _, rk := range kr.keys {
+		if rk.ValidAt(t) {
+			keys = append(keys, rk)
+		}
+	}
+	return keys
+}
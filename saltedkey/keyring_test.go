@@ -0,0 +1,58 @@
+package saltedkey
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestKeyRing(t *testing.T) {
+	now := time.Now()
+	oldKey, err := NewRootKey("old", fmt.Sprintf("%x", randomBytes(32)), now.Add(-time.Hour), time.Time{})
+	qt.Assert(t, err, qt.IsNil)
+	newKey, err := NewRootKey("new", fmt.Sprintf("%x", randomBytes(32)), now, time.Time{})
+	qt.Assert(t, err, qt.IsNil)
+	nextKey, err := NewRootKey("next", fmt.Sprintf("%x", randomBytes(32)), now.Add(time.Hour), time.Time{})
+	qt.Assert(t, err, qt.IsNil)
+	expiredKey, err := NewRootKey("expired", fmt.Sprintf("%x", randomBytes(32)),
+		now.Add(-2*time.Hour), now.Add(-time.Minute))
+	qt.Assert(t, err, qt.IsNil)
+	_, err = NewRootKey("invalid", fmt.Sprintf("%x", randomBytes(32)), now, now.Add(-time.Minute))
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+
+	kr, err := NewKeyRing(nextKey, newKey, expiredKey, oldKey)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, kr.Add(oldKey), qt.Not(qt.IsNil))
+
+	// The active key is the valid one most recently enabled
+	active, err := kr.Active(now)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, active.ID, qt.Equals, "new")
+	active, err = kr.Active(now.Add(2 * time.Hour))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, active.ID, qt.Equals, "next")
+
+	// Previous keys remain available
+	rk, err := kr.Key("old")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, rk.ID, qt.Equals, "old")
+	_, err = kr.Key("expired")
+	qt.Assert(t, err, qt.ErrorIs, ErrRootKeyExpired)
+	_, err = kr.Key("next")
+	qt.Assert(t, err, qt.ErrorIs, ErrRootKeyExpired)
+	_, err = kr.Key("unknown")
+	qt.Assert(t, err, qt.ErrorIs, ErrRootKeyUnknown)
+
+	keys := kr.Keys(now)
+	qt.Assert(t, keys, qt.HasLen, 2)
+	qt.Assert(t, keys[0].ID, qt.Equals, "old")
+	qt.Assert(t, keys[1].ID, qt.Equals, "new")
+
+	// No key valid
+	kr, err = NewKeyRing(expiredKey)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = kr.Active(now)
+	qt.Assert(t, err, qt.ErrorIs, ErrNoActiveRootKey)
+}
@@ -0,0 +1,55 @@
+package saltedkey
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+const (
+	// KeyStoreScryptN is the scrypt N parameter used for encrypting the root keys.
+	KeyStoreScryptN = keystore.StandardScryptN
+	// KeyStoreScryptP is the scrypt P parameter used for encrypting the root keys.
+	KeyStoreScryptP = keystore.StandardScryptP
+)
+
+// EncryptKey encrypts the private key provided in hex format with passphrase,
+// using the Ethereum keystore JSON format (scrypt + aes-128-ctr).
+func EncryptKey(privKey, passphrase string, scryptN, scryptP int) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if len(privKey) != PrivKeyHexSize {
+		return nil, fmt.Errorf("private key size is incorrect %d", len(privKey))
+	}
+	pkb, err := hex.DecodeString(privKey)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ethcrypto.ToECDSA(pkb)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	return keystore.EncryptKey(&keystore.Key{
+		Id:         id,
+		Address:    ethcrypto.PubkeyToAddress(pk.PublicKey),
+		PrivateKey: pk,
+	}, passphrase, scryptN, scryptP)
+}
+
+// NewSaltedKeyFromKeyStore returns a SaltedKey using the private key of the
+// Ethereum keystore JSON keyJSON, decrypted with passphrase.
+func NewSaltedKeyFromKeyStore(keyJSON []byte, passphrase string) (*SaltedKey, error) {
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt key: %w", err)
+	}
+	return NewSaltedKey(fmt.Sprintf("%x", ethcrypto.FromECDSA(key.PrivateKey)))
+}
@@ -0,0 +1,29 @@
+package saltedkey
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestKeyStore(t *testing.T) {
+	privHex := fmt.Sprintf("%x", randomBytes(32))
+	sk, err := NewSaltedKey(privHex)
+	qt.Assert(t, err, qt.IsNil)
+
+	_, err = EncryptKey(privHex, "", keystore.LightScryptN, keystore.LightScryptP)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	keyJSON, err := EncryptKey(privHex, "secret", keystore.LightScryptN, keystore.LightScryptP)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(keyJSON), qt.Not(qt.Contains), privHex)
+
+	// The decrypted key is the same
+	sk2, err := NewSaltedKeyFromKeyStore(keyJSON, "secret")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, sk2.BlindPubKey().Bytes(), qt.DeepEquals, sk.BlindPubKey().Bytes())
+
+	_, err = NewSaltedKeyFromKeyStore(keyJSON, "wrong")
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
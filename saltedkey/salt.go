@@ -0,0 +1,83 @@
+package saltedkey
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+)
+
+// SaltVersion identifies how the salt of an election is derived from its ID.
+type SaltVersion uint8
+
+const (
+	// SaltVersion1 uses the first SaltSize bytes of the election ID as salt.
+	// Elections whose IDs share that prefix share the salted keys, so it is only
+	// kept for the elections created before SaltVersion2.
+	SaltVersion1 SaltVersion = 1
+	// SaltVersion2 uses H(SaltDomain || electionID) mod n as salt, where H is
+	// SHA-256 and n the secp256k1 order, so the whole election ID is bound.
+	SaltVersion2 SaltVersion = 2
+
+	// DefaultSaltVersion is the salt version used if none is configured for an election.
+	DefaultSaltVersion = SaltVersion1
+	// ScalarSaltSize is the size of the salts of any derivation version (see Salt).
+	ScalarSaltSize = 32
+)
+
+// Salt is the salt of an election, a big-endian scalar of ScalarSaltSize bytes.
+type Salt [ScalarSaltSize]byte
+
+// LegacySalt returns the SaltVersion1 salt of SaltSize bytes as a Salt. It is left
+// padded with zeros, so the salted keys are the same.
+func LegacySalt(salt [SaltSize]byte) Salt {
+	var s Salt
+	copy(s[ScalarSaltSize-SaltSize:], salt[:])
+	return s
+}
+
+// SaltDomain is the domain separation prefix of the SaltVersion2 derivation.
+var SaltDomain = []byte("vocdoni/blind-csp/salt/v2")
+
+// SaltVersions is a helper list that includes all the supported salt versions.
+var SaltVersions = []SaltVersion{SaltVersion1, SaltVersion2}
+
+// ElectionSalt returns the salt of electionID for the given derivation version
+// (SaltVersion1 salts are padded with LegacySalt, so the salted keys match the
+// ones of previous releases).
+func ElectionSalt(version SaltVersion, electionID []byte) (Salt, error) {
+	var salt Salt
+	switch version {
+	case SaltVersion1:
+		if len(electionID) < SaltSize {
+			return salt, fmt.Errorf("wrong election id: %x", electionID)
+		}
+		var legacy [SaltSize]byte
+		copy(legacy[:], electionID)
+		salt = LegacySalt(legacy)
+	case SaltVersion2:
+		if len(electionID) == 0 {
+			return salt, fmt.Errorf("election id is empty")
+		}
+		h := sha256.New()
+		h.Write(SaltDomain)
+		h.Write(electionID)
+		s := new(big.Int).SetBytes(h.Sum(nil))
+		s.Mod(s, blind.N)
+		s.FillBytes(salt[:])
+	default:
+		return salt, fmt.Errorf("unknown salt version %d, available: %v", version, SaltVersions)
+	}
+	return salt, nil
+}
+
+// ParseSaltVersion returns the salt version v, if supported.
+func ParseSaltVersion(v int) (SaltVersion, error) {
+	for _, version := range SaltVersions {
+		if int(version) == v {
+			return version, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown salt version %d, available: %v", v, SaltVersions)
+}
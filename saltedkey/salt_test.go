@@ -0,0 +1,133 @@
+package saltedkey
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	qt "github.com/frankban/quicktest"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// saltTestVectors are the salted public keys of a root key for both salt versions.
+// The SaltVersion1 ones were generated with the previous (20 bytes salt) releases.
+// The two election IDs share the first SaltSize bytes.
+var saltTestVectors = []struct {
+	version     SaltVersion
+	electionID  string
+	salt        string
+	blindPubKey string
+	ecdsaPubKey string
+	blsPubKey   string
+}{
+	{
+		version:     SaltVersion1,
+		electionID:  "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470",
+		salt:        "000000000000000000000000c5d2460186f7233c927e7db2dcc703c0e500b653",
+		blindPubKey: "d9fbe673656a8d8f819cb076e89aa0556bcf28828a4179d344646aa27e964d0901",
+		ecdsaPubKey: "03d9fbe673656a8d8f819cb076e89aa0556bcf28828a4179d344646aa27e964d09",
+		blsPubKey:   "b8397970a33d3f48dab89e46fd4a4eb1e2979a5f52f39bb9bf27f7e9b7400a848da5ded5ca80d7f581084c42f991909500cef8da577bc438e059a1e1e565ec9d8f38b184d8fcf267cc003bd5652c5317badf6c911f799be7b26cc398d90aa483",
+	},
+	{
+		version:     SaltVersion1,
+		electionID:  "c5d2460186f7233c927e7db2dcc703c0e500b653000000000000000000000001",
+		salt:        "000000000000000000000000c5d2460186f7233c927e7db2dcc703c0e500b653",
+		blindPubKey: "d9fbe673656a8d8f819cb076e89aa0556bcf28828a4179d344646aa27e964d0901",
+		ecdsaPubKey: "03d9fbe673656a8d8f819cb076e89aa0556bcf28828a4179d344646aa27e964d09",
+		blsPubKey:   "b8397970a33d3f48dab89e46fd4a4eb1e2979a5f52f39bb9bf27f7e9b7400a848da5ded5ca80d7f581084c42f991909500cef8da577bc438e059a1e1e565ec9d8f38b184d8fcf267cc003bd5652c5317badf6c911f799be7b26cc398d90aa483",
+	},
+	{
+		version:     SaltVersion2,
+		electionID:  "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470",
+		salt:        "94ff470f37e3256fdc16bc13ffc653de1332030eeb157ab28e512d891a4dd209",
+		blindPubKey: "b4d43b77fa5c4ffff567e9ed76cd3f61ffe89e2b29ed240e237dceaaa7e36b8700",
+		ecdsaPubKey: "02b4d43b77fa5c4ffff567e9ed76cd3f61ffe89e2b29ed240e237dceaaa7e36b87",
+		blsPubKey:   "85d3b0eaae014ce51afe80501889254fc6e892da57420c4a118239be4fd377f7d0063e23d8c32dfd6d5f8d6c968de55107ef74ed2b4f81000b0235c1630d901d1b420323973ab918cb757d81040b7f3023f58f17f5ddb6d050146da558aa904e",
+	},
+	{
+		version:     SaltVersion2,
+		electionID:  "c5d2460186f7233c927e7db2dcc703c0e500b653000000000000000000000001",
+		salt:        "eac8f8ff96c95501ace2bf9272d1db8fb4fb252bcfa9164c5088ebe827779a00",
+		blindPubKey: "b3a6633c9a4711bec2b4c49e938b66e06e14ae60589eae393dd4ca2e11589f3000",
+		ecdsaPubKey: "02b3a6633c9a4711bec2b4c49e938b66e06e14ae60589eae393dd4ca2e11589f30",
+		blsPubKey:   "b74b41b139e266e375a950622d8d02d86733f3f8a66d85ab38e3f75241331f3f38db87e05ddda3cefe409ad9676a6f780e00860c59c5a15a6257aea459c16463cacb16e0fcb855e09c39f054c1bee7a99f120db122a73ad0896bf985d9e0b3bb",
+	},
+}
+
+func TestSaltTestVectors(t *testing.T) {
+	sk, err := NewSaltedKey("9b3bd1b6e3a8ba5ae9a1c6c1c7f5d1a6e0dbd1d7ab5c4f6a3e2d1c0b9a8f7e6d")
+	qt.Assert(t, err, qt.IsNil)
+	for i, v := range saltTestVectors {
+		salt, err := ElectionSalt(v.version, testHex(t, v.electionID))
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, hex.EncodeToString(salt[:]), qt.Equals, v.salt, qt.Commentf("vector %d", i))
+
+		blindPubKey, err := BlindPubKeyWithSalt(sk.BlindPubKey(), salt)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, hex.EncodeToString(blindPubKey.Bytes()), qt.Equals, v.blindPubKey)
+
+		pk, err := sk.ECDSAPubKey()
+		qt.Assert(t, err, qt.IsNil)
+		salted, err := ECDSAPubKeyWithSalt(pk, salt)
+		qt.Assert(t, err, qt.IsNil)
+		pk, err = ethcrypto.UnmarshalPubkey(salted)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, hex.EncodeToString(ethcrypto.CompressPubkey(pk)), qt.Equals, v.ecdsaPubKey)
+
+		blsPubKey, err := SaltBLSPubKey(sk.BLSPubKey(), salt)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, hex.EncodeToString(blsPubKey.BytesCompressed()), qt.Equals, v.blsPubKey)
+	}
+}
+
+func TestElectionSalt(t *testing.T) {
+	electionID := randomBytes(32)
+	_, err := ElectionSalt(SaltVersion1, electionID[:SaltSize-1])
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	_, err = ElectionSalt(SaltVersion2, nil)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	_, err = ElectionSalt(SaltVersion(0), electionID)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+
+	// The version 2 salt binds the whole election ID
+	other := append([]byte{}, electionID...)
+	other[31] ^= 1
+	salt1, err := ElectionSalt(SaltVersion1, electionID)
+	qt.Assert(t, err, qt.IsNil)
+	salt2, err := ElectionSalt(SaltVersion1, other)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, salt1, qt.Equals, salt2)
+	salt1, err = ElectionSalt(SaltVersion2, electionID)
+	qt.Assert(t, err, qt.IsNil)
+	salt2, err = ElectionSalt(SaltVersion2, other)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, salt1, qt.Not(qt.Equals), salt2)
+
+	// The salted private key is reduced, so the signatures always match the salted
+	// public key even if root key + salt overflows the curve order
+	for i := 0; i < 16; i++ {
+		sk, err := NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+		qt.Assert(t, err, qt.IsNil)
+		salt, err := ElectionSalt(SaltVersion2, randomBytes(32))
+		qt.Assert(t, err, qt.IsNil)
+		msg := randomBytes(32)
+		signature, err := sk.SignECDSAWithSalt(salt, msg)
+		qt.Assert(t, err, qt.IsNil)
+		signer, err := ethereum.PubKeyFromSignature(msg, signature)
+		qt.Assert(t, err, qt.IsNil)
+		pk, err := sk.ECDSAPubKey()
+		qt.Assert(t, err, qt.IsNil)
+		salted, err := ECDSAPubKeyWithSalt(pk, salt)
+		qt.Assert(t, err, qt.IsNil)
+		pk, err = ethcrypto.UnmarshalPubkey(salted)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, signer, qt.DeepEquals, ethcrypto.CompressPubkey(pk))
+	}
+
+	version, err := ParseSaltVersion(2)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, version, qt.Equals, SaltVersion2)
+	_, err = ParseSaltVersion(3)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
@@ -9,13 +9,13 @@ import (
 	blind "github.com/arnaucube/go-blindsecp256k1"
 	ethcrypto "github.com/ethereum/go-ethereum/crypto"
 	vocdonicrypto "go.vocdoni.io/dvote/crypto/ethereum"
-	"go.vocdoni.io/dvote/crypto/saltedkey"
 )
 
 const (
 	// PrivKeyHexSize is the hexadecimal length of a private key
 	PrivKeyHexSize = 64
-	// SaltSize is the size of the salt used for derive the new key
+	// SaltSize is the size of the salt used for derive the new key. The salts of
+	// any derivation version are handled as Salt (see ElectionSalt).
 	SaltSize = 20
 )
 
@@ -54,14 +54,21 @@ func NewSaltedKey(privKey string) (*SaltedKey, error) {
 func (sk *SaltedKey) SignECDSA(salt [SaltSize]byte,
 	msg []byte,
 ) ([]byte, error) {
+	return sk.SignECDSAWithSalt(LegacySalt(salt), msg)
+}
+
+// SignECDSAWithSalt is SignECDSA for a salt of any derivation version.
+func (sk *SaltedKey) SignECDSAWithSalt(salt Salt, msg []byte) ([]byte, error) {
 	esk := new(vocdonicrypto.SignKeys)
-	if err := esk.AddHexKey(fmt.Sprintf("%x", sk.rootKey.Bytes())); err != nil {
+	// the key is zero padded, big.Int.Bytes() drops the leading zeros
+	if err := esk.AddHexKey(fmt.Sprintf("%064x", sk.rootKey)); err != nil {
 		return nil, fmt.Errorf("cannot sign ECDSA salted: %w", err)
 	}
 	// get the bigNumber from salt
 	s := new(big.Int).SetBytes(salt[:])
 	// add it to the current key, so now we have a new private key (currentPrivKey + n)
 	esk.Private.D.Add(esk.Private.D, s)
+	esk.Private.D.Mod(esk.Private.D, blind.N)
 	// return the signature
 	return esk.SignEthereum(msg)
 }
@@ -70,12 +77,20 @@ func (sk *SaltedKey) SignECDSA(salt [SaltSize]byte,
 // The Secretk number needs to be also provided.
 func (sk *SaltedKey) SignBlind(salt [SaltSize]byte, msgBlinded []byte,
 	secretK *big.Int,
+) ([]byte, error) {
+	return sk.SignBlindWithSalt(LegacySalt(salt), msgBlinded, secretK)
+}
+
+// SignBlindWithSalt is SignBlind for a salt of any derivation version.
+func (sk *SaltedKey) SignBlindWithSalt(salt Salt, msgBlinded []byte,
+	secretK *big.Int,
 ) ([]byte, error) {
 	if secretK == nil {
 		return nil, fmt.Errorf("secretK is nil")
 	}
 	s := new(big.Int).SetBytes(salt[:])
 	privKey := s.Add(s, sk.rootKey)
+	privKey.Mod(privKey, blind.N)
 	blindPrivKey := blind.PrivateKey(*privKey)
 	m := new(big.Int).SetBytes(msgBlinded)
 	signature, err := blindPrivKey.BlindSign(m, secretK)
@@ -93,7 +108,7 @@ func (sk *SaltedKey) BlindPubKey() *blind.PublicKey {
 
 // ECDSAPubKey returns the root ecdsa public key for plain signatures
 func (sk *SaltedKey) ECDSAPubKey() (*ecdsa.PublicKey, error) {
-	privK, err := ethcrypto.ToECDSA(sk.rootKey.Bytes())
+	privK, err := ethcrypto.ToECDSA(sk.rootKey.FillBytes(make([]byte, PrivKeyHexSize/2)))
 	if err != nil {
 		return nil, err
 	}
@@ -102,8 +117,13 @@ func (sk *SaltedKey) ECDSAPubKey() (*ecdsa.PublicKey, error) {
 
 // SaltBlindPubKey returns the salted blind public key of pubKey applying the salt.
 func SaltBlindPubKey(pubKey *blind.PublicKey,
-	salt [saltedkey.SaltSize]byte,
+	salt [SaltSize]byte,
 ) (*blind.PublicKey, error) {
+	return BlindPubKeyWithSalt(pubKey, LegacySalt(salt))
+}
+
+// BlindPubKeyWithSalt is SaltBlindPubKey for a salt of any derivation version.
+func BlindPubKeyWithSalt(pubKey *blind.PublicKey, salt Salt) (*blind.PublicKey, error) {
 	if pubKey == nil {
 		return nil, fmt.Errorf("public key is nil")
 	}
@@ -116,7 +136,12 @@ func SaltBlindPubKey(pubKey *blind.PublicKey,
 }
 
 // SaltECDSAPubKey returns the salted plain public key of pubKey applying the salt.
-func SaltECDSAPubKey(pubKey *ecdsa.PublicKey, salt [saltedkey.SaltSize]byte) ([]byte, error) {
+func SaltECDSAPubKey(pubKey *ecdsa.PublicKey, salt [SaltSize]byte) ([]byte, error) {
+	return ECDSAPubKeyWithSalt(pubKey, LegacySalt(salt))
+}
+
+// ECDSAPubKeyWithSalt is SaltECDSAPubKey for a salt of any derivation version.
+func ECDSAPubKeyWithSalt(pubKey *ecdsa.PublicKey, salt Salt) ([]byte, error) {
 	if pubKey == nil {
 		return nil, fmt.Errorf("public key is nil")
 	}
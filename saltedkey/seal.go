@@ -0,0 +1,67 @@
+package saltedkey
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// sealKeyDST is the domain separation tag used for deriving the sealing keys from the root key
+var sealKeyDST = []byte("BLIND-CSP-V01-SEAL-KEY")
+
+// SecretSealer is implemented by the signers able to encrypt the election secrets
+// (i.e the blind RSA keys) with a key derived from the root key and the salt, so
+// they are never stored in plaintext.
+type SecretSealer interface {
+	// SealSecret encrypts secret with the sealing key of salt.
+	SealSecret(salt Salt, secret []byte) ([]byte, error)
+	// OpenSecret decrypts a secret sealed by SealSecret with the same salt.
+	OpenSecret(salt Salt, sealed []byte) ([]byte, error)
+}
+
+var _ SecretSealer = (*SaltedKey)(nil)
+
+// SealSecret encrypts secret (AES-256-GCM) with the sealing key of salt. The random
+// nonce is prepended to the sealed secret.
+func (sk *SaltedKey) SealSecret(salt Salt, secret []byte) ([]byte, error) {
+	aead, err := sk.sealKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(secret)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+// OpenSecret decrypts a secret sealed by SealSecret with the same salt.
+func (sk *SaltedKey) OpenSecret(salt Salt, sealed []byte) ([]byte, error) {
+	aead, err := sk.sealKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed secret is too short")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open sealed secret: %w", err)
+	}
+	return secret, nil
+}
+
+// sealKey derives the sealing key of salt from the root key.
+func (sk *SaltedKey) sealKey(salt Salt) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(sealKeyDST)
+	h.Write(sk.rootKey.FillBytes(make([]byte, 32)))
+	h.Write(salt[:])
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
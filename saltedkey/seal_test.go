@@ -0,0 +1,42 @@
+package saltedkey
+
+import (
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSealSecret(t *testing.T) {
+	sk, err := NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+	var salt, salt2 Salt
+	copy(salt[:], randomBytes(ScalarSaltSize))
+	copy(salt2[:], randomBytes(ScalarSaltSize))
+	secret := randomBytes(64)
+
+	sealed, err := sk.SealSecret(salt, secret)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, sealed, qt.Not(qt.DeepEquals), secret)
+	opened, err := sk.OpenSecret(salt, sealed)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, opened, qt.DeepEquals, secret)
+
+	// The nonce is random, the same secret is never sealed twice the same way
+	sealed2, err := sk.SealSecret(salt, secret)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, sealed2, qt.Not(qt.DeepEquals), sealed)
+
+	// Only the same root key and salt open the secret, and tampering is detected
+	_, err = sk.OpenSecret(salt2, sealed)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	sk2, err := NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+	_, err = sk2.OpenSecret(salt, sealed)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	sealed[len(sealed)-1] ^= 1
+	_, err = sk.OpenSecret(salt, sealed)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	_, err = sk.OpenSecret(salt, sealed[:4])
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
@@ -0,0 +1,27 @@
+package saltedkey
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+)
+
+// Signer performs the salted signatures of a root key. The private key might not
+// be accessible by the CSP process, so the signatures can be delegated to an
+// external service (i.e a KMS holding the key). SaltedKey is the local implementation.
+type Signer interface {
+	// SignECDSAWithSalt returns the signature of message (which will be hashed) using
+	// the root key salted with salt.
+	SignECDSAWithSalt(salt Salt, msg []byte) ([]byte, error)
+	// SignBlindWithSalt returns the blind signature of msgBlinded using the root key
+	// salted with salt and the secretK of the R point provided to the client.
+	SignBlindWithSalt(salt Salt, msgBlinded []byte, secretK *big.Int) ([]byte, error)
+	// BlindPubKey returns the root public key for blind signatures.
+	BlindPubKey() *blind.PublicKey
+	// ECDSAPubKey returns the root public key for plain signatures.
+	ECDSAPubKey() (*ecdsa.PublicKey, error)
+}
+
+// SaltedKey must implement Signer
+var _ Signer = (*SaltedKey)(nil)
@@ -0,0 +1,292 @@
+package saltedkey
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+)
+
+// KeyShare is the share of a threshold root key held by a CSP node. The share
+// is used as the node root key, so its partial blind signatures are produced by
+// the usual SaltedKey.SignBlind method.
+type KeyShare struct {
+	// Index is the evaluation point of the share polynomial (starting at 1)
+	Index int
+	Key   *big.Int
+}
+
+// Hex returns the share private key in hex format, as expected by NewSaltedKey.
+func (ks *KeyShare) Hex() string {
+	return fmt.Sprintf("%064x", ks.Key)
+}
+
+// ThresholdKey is the public part of a root key split with Feldman VSS. It holds
+// the commitments to the coefficients of the sharing polynomial, so anyone can
+// verify the shares, the partial signatures of each node and get the root public key.
+// Any set of Threshold nodes can produce a blind signature valid for the root key,
+// while fewer nodes cannot.
+type ThresholdKey struct {
+	// Commitments are the points a_j·G for each coefficient a_j of the polynomial.
+	// The first one is the root public key.
+	Commitments []*blind.Point
+	// Shares is the number of shares the key was split into
+	Shares int
+}
+
+// SplitKey splits the salted key into n shares, so that any t of them can sign on
+// behalf of the key. Returns the shares and the public threshold key. The original
+// private key should be destroyed once the shares are delivered.
+func SplitKey(sk *SaltedKey, t, n int) ([]*KeyShare, *ThresholdKey, error) {
+	if sk == nil {
+		return nil, nil, fmt.Errorf("salted key is nil")
+	}
+	if t < 1 || n < t {
+		return nil, nil, fmt.Errorf("invalid threshold %d of %d", t, n)
+	}
+	for {
+		coefs := []*big.Int{sk.rootKey}
+		for len(coefs) < t {
+			a, err := randScalar()
+			if err != nil {
+				return nil, nil, err
+			}
+			coefs = append(coefs, a)
+		}
+		tk := &ThresholdKey{Shares: n}
+		for _, a := range coefs {
+			tk.Commitments = append(tk.Commitments, blind.G.Mul(a))
+		}
+		shares := []*KeyShare{}
+		for i := 1; i <= n; i++ {
+			share := evalPolynomial(coefs, i)
+			if share.Sign() == 0 {
+				// Zero is not a valid private key, use a different polynomial
+				break
+			}
+			shares = append(shares, &KeyShare{Index: i, Key: share})
+		}
+		if len(shares) == n {
+			return shares, tk, nil
+		}
+	}
+}
+
+// Threshold returns the number of shares required for signing.
+func (tk *ThresholdKey) Threshold() int {
+	return len(tk.Commitments)
+}
+
+// PubKey returns the root blind public key. The combined signatures are verified
+// against it once salted, as any regular CSP signature.
+func (tk *ThresholdKey) PubKey() *blind.PublicKey {
+	return (*blind.PublicKey)(tk.Commitments[0])
+}
+
+// SharePubKey returns the blind public key of the share with index.
+func (tk *ThresholdKey) SharePubKey(index int) *blind.PublicKey {
+	// D_i = sum(C_j * i^j)
+	x := big.NewInt(int64(index))
+	xj := big.NewInt(1)
+	pk := tk.Commitments[0]
+	for _, c := range tk.Commitments[1:] {
+		xj = new(big.Int).Mod(new(big.Int).Mul(xj, x), blind.N)
+		pk = pk.Add(c.Mul(xj))
+	}
+	return (*blind.PublicKey)(pk)
+}
+
+// ShareIndex returns the index of the share whose public key is pubKey.
+func (tk *ThresholdKey) ShareIndex(pubKey *blind.PublicKey) (int, error) {
+	for i := 1; i <= tk.Shares; i++ {
+		if equalPoints(tk.SharePubKey(i).Point(), pubKey.Point()) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("public key is not a share of the threshold key")
+}
+
+// VerifyShare checks the share against the polynomial commitments.
+func (tk *ThresholdKey) VerifyShare(share *KeyShare) error {
+	if share == nil || share.Index < 1 {
+		return fmt.Errorf("invalid share")
+	}
+	if !equalPoints(blind.G.Mul(share.Key), tk.SharePubKey(share.Index).Point()) {
+		return fmt.Errorf("share %d does not match the threshold key", share.Index)
+	}
+	return nil
+}
+
+// CombineSignerR returns the R point the client must use for blinding, given the
+// R points issued by each node (by share index). The same set of nodes must be
+// used later for combining the partial signatures.
+func (tk *ThresholdKey) CombineSignerR(points map[int]*blind.Point) (*blind.Point, error) {
+	indexes := shareIndexes(points)
+	if err := tk.checkSigners(indexes); err != nil {
+		return nil, err
+	}
+	var r *blind.Point
+	for _, i := range indexes {
+		p := points[i].Mul(lagrangeCoefficient(i, indexes))
+		if r == nil {
+			r = p
+			continue
+		}
+		r = r.Add(p)
+	}
+	return r, nil
+}
+
+// VerifyPartialBlindSignature checks the partial blind signature produced by the
+// node with share index over msgBlinded, using the salt and its R point.
+func (tk *ThresholdKey) VerifyPartialBlindSignature(index int, salt Salt,
+	msgBlinded []byte, signerR *blind.Point, signature []byte,
+) error {
+	if index < 1 || signerR == nil {
+		return fmt.Errorf("invalid partial signature")
+	}
+	m := new(big.Int).SetBytes(msgBlinded)
+	if m.Sign() == 0 || m.Cmp(blind.N) >= 0 {
+		return fmt.Errorf("invalid blinded message")
+	}
+	pk, err := BlindPubKeyWithSalt(tk.SharePubKey(index), salt)
+	if err != nil {
+		return err
+	}
+	// s_i·G == m'·(D_i + salt·G) + R_i
+	s := new(big.Int).SetBytes(signature)
+	if !equalPoints(blind.G.Mul(s), pk.Point().Mul(m).Add(signerR)) {
+		return fmt.Errorf("invalid partial signature of share %d", index)
+	}
+	return nil
+}
+
+// CombineBlindSignatures combines the partial blind signatures of the nodes (by
+// share index) into the blind signature of the root key.
+func (tk *ThresholdKey) CombineBlindSignatures(signatures map[int][]byte) ([]byte, error) {
+	indexes := shareIndexes(signatures)
+	if err := tk.checkSigners(indexes); err != nil {
+		return nil, err
+	}
+	s := new(big.Int)
+	for _, i := range indexes {
+		si := new(big.Int).SetBytes(signatures[i])
+		s.Add(s, si.Mul(si, lagrangeCoefficient(i, indexes)))
+	}
+	return s.Mod(s, blind.N).Bytes(), nil
+}
+
+// checkSigners checks there are enough valid share indexes for signing.
+func (tk *ThresholdKey) checkSigners(indexes []int) error {
+	if len(indexes) < tk.Threshold() {
+		return fmt.Errorf("%d shares provided, %d required", len(indexes), tk.Threshold())
+	}
+	for _, i := range indexes {
+		if i < 1 {
+			return fmt.Errorf("invalid share index %d", i)
+		}
+	}
+	return nil
+}
+
+// shareIndexes returns the sorted keys of a map indexed by share.
+func shareIndexes[T any](m map[int]T) []int {
+	indexes := []int{}
+	for i := range m {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// MarshalJSON encodes the threshold key with the list of compressed commitments.
+func (tk ThresholdKey) MarshalJSON() ([]byte, error) {
+	commitments := []string{}
+	for _, c := range tk.Commitments {
+		commitments = append(commitments, hex.EncodeToString(c.Bytes()))
+	}
+	return json.Marshal(map[string]any{
+		"threshold":   len(commitments),
+		"shares":      tk.Shares,
+		"commitments": commitments,
+	})
+}
+
+// UnmarshalJSON decodes a threshold key encoded by MarshalJSON.
+func (tk *ThresholdKey) UnmarshalJSON(data []byte) error {
+	var key struct {
+		Shares      int      `json:"shares"`
+		Commitments []string `json:"commitments"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return err
+	}
+	if len(key.Commitments) == 0 {
+		return fmt.Errorf("threshold key without commitments")
+	}
+	if key.Shares < len(key.Commitments) {
+		return fmt.Errorf("threshold key with %d shares, %d required", key.Shares, len(key.Commitments))
+	}
+	tk.Shares = key.Shares
+	tk.Commitments = nil
+	for _, c := range key.Commitments {
+		b, err := hex.DecodeString(c)
+		if err != nil {
+			return fmt.Errorf("cannot decode commitment: %w", err)
+		}
+		p, err := blind.NewPointFromBytes(b)
+		if err != nil {
+			return fmt.Errorf("invalid commitment: %w", err)
+		}
+		tk.Commitments = append(tk.Commitments, p)
+	}
+	return nil
+}
+
+// evalPolynomial returns the polynomial value at x, modulo the curve order.
+func evalPolynomial(coefs []*big.Int, x int) *big.Int {
+	bx := big.NewInt(int64(x))
+	y := new(big.Int)
+	for i := len(coefs) - 1; i >= 0; i-- {
+		y.Mul(y, bx)
+		y.Add(y, coefs[i])
+		y.Mod(y, blind.N)
+	}
+	return y
+}
+
+// lagrangeCoefficient returns the Lagrange coefficient at 0 of index for the set
+// of share indexes, modulo the curve order.
+func lagrangeCoefficient(index int, indexes []int) *big.Int {
+	num, den := big.NewInt(1), big.NewInt(1)
+	for _, j := range indexes {
+		if j == index {
+			continue
+		}
+		num.Mul(num, big.NewInt(int64(j)))
+		den.Mul(den, big.NewInt(int64(j-index)))
+	}
+	den.Mod(den, blind.N)
+	num.Mul(num, den.ModInverse(den, blind.N))
+	return num.Mod(num, blind.N)
+}
+
+func randScalar() (*big.Int, error) {
+	for {
+		k, err := rand.Int(rand.Reader, blind.N)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() != 0 {
+			return k, nil
+		}
+	}
+}
+
+func equalPoints(a, b *blind.Point) bool {
+	return a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+}
@@ -0,0 +1,92 @@
+package saltedkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	blind "github.com/arnaucube/go-blindsecp256k1"
+	qt "github.com/frankban/quicktest"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestThresholdBlindSignature(t *testing.T) {
+	privHex := fmt.Sprintf("%x", randomBytes(32))
+	root, err := NewSaltedKey(privHex)
+	qt.Assert(t, err, qt.IsNil)
+	_, _, err = SplitKey(root, 4, 3)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+
+	shares, tk, err := SplitKey(root, 3, 5)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, shares, qt.HasLen, 5)
+	qt.Assert(t, tk.Threshold(), qt.Equals, 3)
+	qt.Assert(t, tk.PubKey().Bytes(), qt.DeepEquals, root.BlindPubKey().Bytes())
+
+	// Each node verifies its share and uses it as root key
+	nodes := map[int]*SaltedKey{}
+	for _, share := range shares {
+		qt.Assert(t, tk.VerifyShare(share), qt.IsNil)
+		nodes[share.Index], err = NewSaltedKey(share.Hex())
+		qt.Assert(t, err, qt.IsNil)
+		index, err := tk.ShareIndex(nodes[share.Index].BlindPubKey())
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, index, qt.Equals, share.Index)
+	}
+	badShare := &KeyShare{Index: 1, Key: shares[1].Key}
+	qt.Assert(t, tk.VerifyShare(badShare), qt.Not(qt.IsNil))
+
+	// The public threshold key can be shared as JSON
+	data, err := json.Marshal(tk)
+	qt.Assert(t, err, qt.IsNil)
+	tk = &ThresholdKey{}
+	qt.Assert(t, json.Unmarshal(data, tk), qt.IsNil)
+	qt.Assert(t, tk.Threshold(), qt.Equals, 3)
+	qt.Assert(t, tk.Shares, qt.Equals, 5)
+
+	salt, err := ElectionSalt(SaltVersion2, randomBytes(32))
+	qt.Assert(t, err, qt.IsNil)
+	msgHash := ethereum.HashRaw([]byte("hello world!"))
+
+	// Nodes 1, 3 and 5 issue their R points, combined for the client
+	signers := []int{1, 3, 5}
+	secretK := map[int]*big.Int{}
+	points := map[int]*blind.Point{}
+	for _, i := range signers {
+		secretK[i], points[i], err = blind.NewRequestParameters()
+		qt.Assert(t, err, qt.IsNil)
+	}
+	_, err = tk.CombineSignerR(map[int]*blind.Point{1: points[1], 3: points[3]})
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	signerR, err := tk.CombineSignerR(points)
+	qt.Assert(t, err, qt.IsNil)
+
+	// Client: blinds the message with the combined R
+	msgBlinded, userSecretData, err := blind.Blind(new(big.Int).SetBytes(msgHash), signerR)
+	qt.Assert(t, err, qt.IsNil)
+
+	// Nodes: partial signatures over the same blinded message
+	partials := map[int][]byte{}
+	for _, i := range signers {
+		partials[i], err = nodes[i].SignBlindWithSalt(salt, msgBlinded.Bytes(), secretK[i])
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, tk.VerifyPartialBlindSignature(i, salt, msgBlinded.Bytes(), points[i], partials[i]),
+			qt.IsNil)
+	}
+	// A partial signature does not verify for a different share
+	qt.Assert(t, tk.VerifyPartialBlindSignature(2, salt, msgBlinded.Bytes(), points[1], partials[1]),
+		qt.Not(qt.IsNil))
+
+	// Coordinator: combines the partial signatures
+	_, err = tk.CombineBlindSignatures(map[int][]byte{1: partials[1], 5: partials[5]})
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	blindedSignature, err := tk.CombineBlindSignatures(partials)
+	qt.Assert(t, err, qt.IsNil)
+
+	// Any: verifies the signature with the usual salted root public key
+	signature := blind.Unblind(new(big.Int).SetBytes(blindedSignature), userSecretData)
+	saltedPubKey, err := BlindPubKeyWithSalt(root.BlindPubKey(), salt)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, blind.Verify(new(big.Int).SetBytes(msgHash), signature, saltedPubKey), qt.IsTrue)
+}
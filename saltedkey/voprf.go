@@ -0,0 +1,101 @@
+package saltedkey
+
+import (
+	"crypto/sha512"
+	"fmt"
+
+	"github.com/cloudflare/circl/group"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/circl/zk/dleq"
+)
+
+// VOPRFSuite is the RFC 9497 suite used for the privately verifiable tokens.
+var VOPRFSuite = oprf.SuiteRistretto255
+
+// voprfKeyDST is the domain separation tag used for deriving the VOPRF seed from the root key
+var voprfKeyDST = []byte("BLIND-CSP-V01-VOPRF-KEY")
+
+// VOPRFSigner is implemented by the signers supporting the VOPRF token issuance
+// (RFC 9497, verifiable mode). Each election uses a different VOPRF key, derived
+// from the root key and the salt.
+type VOPRFSigner interface {
+	// EvaluateVOPRF evaluates the blinded elements of req with the VOPRF key of salt.
+	// The evaluation includes the proof of the key used.
+	EvaluateVOPRF(salt Salt, req *oprf.EvaluationRequest) (*oprf.Evaluation, error)
+	// VerifyVOPRF returns true if output is the VOPRF output of input for the key of salt.
+	VerifyVOPRF(salt Salt, input, output []byte) bool
+	// VOPRFPubKey returns the VOPRF public key of salt.
+	VOPRFPubKey(salt Salt) (*oprf.PublicKey, error)
+}
+
+var _ VOPRFSigner = (*SaltedKey)(nil)
+
+// EvaluateVOPRF evaluates the blinded elements of req with the VOPRF key of salt.
+func (sk *SaltedKey) EvaluateVOPRF(salt Salt,
+	req *oprf.EvaluationRequest,
+) (*oprf.Evaluation, error) {
+	key, err := sk.voprfKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return oprf.NewVerifiableServer(VOPRFSuite, key).Evaluate(req)
+}
+
+// VerifyVOPRF returns true if output is the VOPRF output of input for the key of salt.
+func (sk *SaltedKey) VerifyVOPRF(salt Salt, input, output []byte) bool {
+	key, err := sk.voprfKey(salt)
+	if err != nil {
+		return false
+	}
+	return oprf.NewVerifiableServer(VOPRFSuite, key).VerifyFinalize(input, output)
+}
+
+// VOPRFPubKey returns the VOPRF public key of salt.
+func (sk *SaltedKey) VOPRFPubKey(salt Salt) (*oprf.PublicKey, error) {
+	key, err := sk.voprfKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public(), nil
+}
+
+// voprfKey derives the VOPRF private key of salt from the root key.
+func (sk *SaltedKey) voprfKey(salt Salt) (*oprf.PrivateKey, error) {
+	h := sha512.New()
+	h.Write(voprfKeyDST)
+	h.Write(sk.rootKey.FillBytes(make([]byte, 32)))
+	return oprf.DeriveKey(VOPRFSuite, oprf.VerifiableMode, h.Sum(nil), salt[:])
+}
+
+// MarshalVOPRFElements returns the serialized (compressed) VOPRF group elements.
+func MarshalVOPRFElements(elements []group.Element) ([][]byte, error) {
+	data := make([][]byte, len(elements))
+	for i, e := range elements {
+		var err error
+		if data[i], err = e.MarshalBinaryCompress(); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// UnmarshalVOPRFElements returns the VOPRF group elements serialized on data.
+func UnmarshalVOPRFElements(data [][]byte) ([]group.Element, error) {
+	elements := make([]group.Element, len(data))
+	for i, d := range data {
+		elements[i] = VOPRFSuite.Group().NewElement()
+		if err := elements[i].UnmarshalBinary(d); err != nil {
+			return nil, fmt.Errorf("invalid element %d: %w", i, err)
+		}
+	}
+	return elements, nil
+}
+
+// UnmarshalVOPRFProof returns the VOPRF evaluation proof serialized on data.
+func UnmarshalVOPRFProof(data []byte) (*dleq.Proof, error) {
+	proof := new(dleq.Proof)
+	if err := proof.UnmarshalBinary(VOPRFSuite.Group(), data); err != nil {
+		return nil, fmt.Errorf("invalid proof: %w", err)
+	}
+	return proof, nil
+}
@@ -0,0 +1,59 @@
+package saltedkey
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestVOPRFTokens(t *testing.T) {
+	sk, err := NewSaltedKey(fmt.Sprintf("%x", randomBytes(32)))
+	qt.Assert(t, err, qt.IsNil)
+	var salt, salt2 Salt
+	copy(salt[:], randomBytes(ScalarSaltSize))
+	copy(salt2[:], randomBytes(ScalarSaltSize))
+	pubKey, err := sk.VOPRFPubKey(salt)
+	qt.Assert(t, err, qt.IsNil)
+
+	// Client: blinds a batch of random token inputs
+	inputs := [][]byte{randomBytes(32), randomBytes(32), randomBytes(32)}
+	client := oprf.NewVerifiableClient(VOPRFSuite, pubKey)
+	finData, evalReq, err := client.Blind(inputs)
+	qt.Assert(t, err, qt.IsNil)
+	blinded, err := MarshalVOPRFElements(evalReq.Elements)
+	qt.Assert(t, err, qt.IsNil)
+
+	// Server: evaluates the batch
+	elements, err := UnmarshalVOPRFElements(blinded)
+	qt.Assert(t, err, qt.IsNil)
+	eval, err := sk.EvaluateVOPRF(salt, &oprf.EvaluationRequest{Elements: elements})
+	qt.Assert(t, err, qt.IsNil)
+	evaluated, err := MarshalVOPRFElements(eval.Elements)
+	qt.Assert(t, err, qt.IsNil)
+	proof, err := eval.Proof.MarshalBinary()
+	qt.Assert(t, err, qt.IsNil)
+
+	// Client: verifies the proof and gets the token outputs
+	elements, err = UnmarshalVOPRFElements(evaluated)
+	qt.Assert(t, err, qt.IsNil)
+	p, err := UnmarshalVOPRFProof(proof)
+	qt.Assert(t, err, qt.IsNil)
+	outputs, err := client.Finalize(finData, &oprf.Evaluation{Elements: elements, Proof: p})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, outputs, qt.HasLen, len(inputs))
+
+	// Server: the tokens are only valid for the election key
+	for i := range inputs {
+		qt.Assert(t, sk.VerifyVOPRF(salt, inputs[i], outputs[i]), qt.IsTrue)
+		qt.Assert(t, sk.VerifyVOPRF(salt2, inputs[i], outputs[i]), qt.IsFalse)
+	}
+	qt.Assert(t, sk.VerifyVOPRF(salt, inputs[0], outputs[1]), qt.IsFalse)
+
+	// The evaluation of other election key does not verify for the client
+	eval, err = sk.EvaluateVOPRF(salt2, evalReq)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = client.Finalize(finData, eval)
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/blind-csp/types"
+)
+
+// ChallengeMock records the challenges sent to each recipient (phone or email), it
+// stands in for the providers of the OTP handlers.
+type ChallengeMock struct {
+	lock       sync.RWMutex
+	challenges map[string][]int
+}
+
+// NewChallengeMock returns an empty ChallengeMock.
+func NewChallengeMock() *ChallengeMock {
+	return &ChallengeMock{challenges: make(map[string][]int)}
+}
+
+// Add records a challenge sent to the recipient.
+func (cm *ChallengeMock) Add(recipient string, challenge int) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.challenges[recipient] = append(cm.challenges[recipient], challenge)
+}
+
+// Solution returns the challenge sent to the recipient with the index (0 is the
+// first one). It panics if there is no such challenge.
+func (cm *ChallengeMock) Solution(recipient string, index int) int {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	c := cm.challenges[recipient]
+	if index >= len(c) {
+		panic("no challenge solution for recipient with index")
+	}
+	return c[index]
+}
+
+// Last waits until a challenge is sent to the recipient and returns the last one.
+func (cm *ChallengeMock) Last(recipient string, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		cm.lock.RLock()
+		c := cm.challenges[recipient]
+		cm.lock.RUnlock()
+		if len(c) > 0 {
+			return c[len(c)-1], nil
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("no challenge sent to %s", recipient)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Recipients returns the number of recipients with some challenge sent.
+func (cm *ChallengeMock) Recipients() int {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	return len(cm.challenges)
+}
+
+// StrToHex returns the HexBytes of a hex string, it panics if the string is not valid.
+func StrToHex(payload string) types.HexBytes {
+	h := types.HexBytes{}
+	if err := h.FromString(payload); err != nil {
+		panic(err)
+	}
+	return h
+}
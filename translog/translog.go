@@ -0,0 +1,195 @@
+// Package translog implements the Merkle tree of the CSP issuance transparency log
+// (RFC 9162 hashing, SHA-256). Every signature issued by the CSP for an election
+// appends a leaf to the election log, so auditors can compare the number of issued
+// proofs with the number of votes, check that a signature is included (inclusion
+// proof) and that the log is never rewritten (consistency proof).
+package translog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+)
+
+// HashSize is the size of the tree hashes.
+const HashSize = sha256.Size
+
+// HashLeaf returns the hash of the raw leaf data: SHA-256(0x00 || data).
+func HashLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// LeafHash returns the hash of the log leaf of a signature of signType over data
+// (the blinded message for the blind signature types, else the payload), which is
+// HashLeaf(signType || 0x00 || data).
+func LeafHash(signType string, data []byte) []byte {
+	leaf := append([]byte(signType), 0x00)
+	return HashLeaf(append(leaf, data...))
+}
+
+// hashChildren returns the hash of an interior node: SHA-256(0x01 || left || right).
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n (n > 1).
+func split(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+// RootHash returns the root hash of the tree with the given leaf hashes. The root
+// of the empty tree is SHA-256 of the empty string.
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := split(len(leaves))
+	return hashChildren(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// InclusionProof returns the audit path of the leaf at index in the tree with the
+// given leaf hashes.
+func InclusionProof(leaves [][]byte, index uint64) ([][]byte, error) {
+	if index >= uint64(len(leaves)) {
+		return nil, fmt.Errorf("leaf %d not in a tree of size %d", index, len(leaves))
+	}
+	return inclusionPath(int(index), leaves), nil
+}
+
+func inclusionPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+	k := split(len(leaves))
+	if m < k {
+		return append(inclusionPath(m, leaves[:k]), RootHash(leaves[k:]))
+	}
+	return append(inclusionPath(m-k, leaves[k:]), RootHash(leaves[:k]))
+}
+
+// ConsistencyProof returns the proof that the tree of the first size leaves is a
+// prefix of the tree with the given leaf hashes.
+func ConsistencyProof(leaves [][]byte, size uint64) ([][]byte, error) {
+	if size > uint64(len(leaves)) {
+		return nil, fmt.Errorf("size %d is larger than the tree size %d", size, len(leaves))
+	}
+	if size == 0 || size == uint64(len(leaves)) {
+		return [][]byte{}, nil
+	}
+	return subproof(int(size), leaves, true), nil
+}
+
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), RootHash(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion checks the audit path of leafHash at index in the tree of the given
+// size and root hash.
+func VerifyInclusion(leafHash []byte, index, size uint64, path [][]byte, root []byte) error {
+	if index >= size {
+		return fmt.Errorf("leaf %d not in a tree of size %d", index, size)
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return fmt.Errorf("inclusion proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = hashChildren(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hashChildren(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return fmt.Errorf("inclusion proof is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return fmt.Errorf("inclusion proof does not match the root hash")
+	}
+	return nil
+}
+
+// VerifyConsistency checks the proof that the tree of size1 leaves and root1 is a
+// prefix of the tree of size2 leaves and root2.
+func VerifyConsistency(size1, size2 uint64, root1, root2 []byte, proof [][]byte) error {
+	switch {
+	case size1 > size2:
+		return fmt.Errorf("size %d is larger than %d", size1, size2)
+	case size1 == size2:
+		if len(proof) != 0 || !bytes.Equal(root1, root2) {
+			return fmt.Errorf("trees of the same size must have the same root and an empty proof")
+		}
+		return nil
+	case size1 == 0:
+		if len(proof) != 0 {
+			return fmt.Errorf("consistency proof of the empty tree must be empty")
+		}
+		return nil
+	case len(proof) == 0:
+		return fmt.Errorf("consistency proof is empty")
+	}
+	// If size1 is a power of two, its root is the first node of the proof
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+	fn, sn := size1-1, size2-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return fmt.Errorf("consistency proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = hashChildren(c, fr)
+			sr = hashChildren(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = hashChildren(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return fmt.Errorf("consistency proof is too short")
+	}
+	if !bytes.Equal(fr, root1) || !bytes.Equal(sr, root2) {
+		return fmt.Errorf("consistency proof does not match the root hashes")
+	}
+	return nil
+}
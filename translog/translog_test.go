@@ -0,0 +1,97 @@
+package translog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// rfcLeaves are the leaves of the certificate transparency (RFC 6962) reference tests.
+var rfcLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+// rfcRoots are the root hashes of the trees of the first i+1 rfcLeaves.
+var rfcRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func TestRootHashVectors(t *testing.T) {
+	leaves := [][]byte{}
+	for i, l := range rfcLeaves {
+		data, err := hex.DecodeString(l)
+		qt.Assert(t, err, qt.IsNil)
+		leaves = append(leaves, HashLeaf(data))
+		qt.Assert(t, hex.EncodeToString(RootHash(leaves)), qt.Equals, rfcRoots[i], qt.Commentf("size %d", i+1))
+	}
+	qt.Assert(t, hex.EncodeToString(RootHash(nil)), qt.Equals,
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+}
+
+func TestProofs(t *testing.T) {
+	leaves := [][]byte{}
+	for i := 0; i < 33; i++ {
+		leaves = append(leaves, LeafHash("blind", randomBytes(32)))
+	}
+	for n := 1; n <= len(leaves); n++ {
+		tree := leaves[:n]
+		root := RootHash(tree)
+		for i := range tree {
+			path, err := InclusionProof(tree, uint64(i))
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, VerifyInclusion(tree[i], uint64(i), uint64(n), path, root), qt.IsNil,
+				qt.Commentf("leaf %d of %d", i, n))
+			// Wrong leaf or index
+			qt.Assert(t, VerifyInclusion(randomBytes(HashSize), uint64(i), uint64(n), path, root), qt.Not(qt.IsNil))
+			if n > 1 {
+				qt.Assert(t, VerifyInclusion(tree[i], uint64((i+1)%n), uint64(n), path, root), qt.Not(qt.IsNil))
+			}
+			qt.Assert(t, VerifyInclusion(tree[i], uint64(n), uint64(n), path, root), qt.Not(qt.IsNil))
+		}
+		for m := 0; m <= n; m++ {
+			proof, err := ConsistencyProof(tree, uint64(m))
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, VerifyConsistency(uint64(m), uint64(n), RootHash(tree[:m]), root, proof), qt.IsNil,
+				qt.Commentf("consistency %d to %d", m, n))
+			if m > 0 && m < n {
+				// A rewritten log is detected
+				qt.Assert(t, VerifyConsistency(uint64(m), uint64(n), randomBytes(HashSize), root, proof),
+					qt.Not(qt.IsNil))
+				qt.Assert(t, VerifyConsistency(uint64(m), uint64(n), RootHash(tree[:m]), randomBytes(HashSize), proof),
+					qt.Not(qt.IsNil))
+			}
+		}
+	}
+	_, err := InclusionProof(leaves, uint64(len(leaves)))
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+	_, err = ConsistencyProof(leaves, uint64(len(leaves)+1))
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+
+	// The leaf hash binds the signature type
+	data := randomBytes(32)
+	qt.Assert(t, LeafHash("blind", data), qt.Not(qt.DeepEquals), LeafHash("ecdsa", data))
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"go.vocdoni.io/dvote/log"
@@ -12,19 +13,40 @@ import (
 
 // Message is the JSON API body message used by the CSP and the client
 type Message struct {
-	Error     string       `json:"error,omitempty"`
-	TokenR    HexBytes     `json:"token,omitempty"`
-	AuthToken *uuid.UUID   `json:"authToken,omitempty"`
-	Payload   HexBytes     `json:"payload,omitempty"`
-	Signature HexBytes     `json:"signature,omitempty"`
-	SharedKey HexBytes     `json:"sharedkey,omitempty"`
-	Title     string       `json:"title,omitempty"`         // reserved for the info handler
-	SignType  []string     `json:"signatureType,omitempty"` // reserver for the info handler
-	AuthType  string       `json:"authType,omitempty"`      // reserved for the info handler
-	AuthSteps []*AuthField `json:"authSteps,omitempty"`     // reserved for the info handler
-	AuthData  []string     `json:"authData,omitempty"`      // reserved for the auth handler
-	Response  []string     `json:"response,omitempty"`      // reserved for the handlers
-	Elections []Election   `json:"elections,omitempty"`     // reserved for the indexer handler
+	Error       string             `json:"error,omitempty"`
+	TokenR      HexBytes           `json:"token,omitempty"`
+	AuthToken   *uuid.UUID         `json:"authToken,omitempty"`
+	Payload     HexBytes           `json:"payload,omitempty"`
+	Signature   HexBytes           `json:"signature,omitempty"`
+	SharedKey   HexBytes           `json:"sharedkey,omitempty"`
+	Title       string             `json:"title,omitempty"`         // reserved for the info handler
+	SignType    []string           `json:"signatureType,omitempty"` // reserver for the info handler
+	AuthType    string             `json:"authType,omitempty"`      // reserved for the info handler
+	AuthSteps   []*AuthField       `json:"authSteps,omitempty"`     // reserved for the info handler
+	AuthData    []string           `json:"authData,omitempty"`      // reserved for the auth handler
+	Response    []string           `json:"response,omitempty"`      // reserved for the handlers
+	Elections   []Election         `json:"elections,omitempty"`     // reserved for the indexer handler
+	Keys        []RootKey          `json:"keys,omitempty"`          // reserved for the info handler
+	RSAPubKey   HexBytes           `json:"rsaPubKey,omitempty"`     // reserved for the blindrsa signature type
+	Partials    []PartialSignature `json:"partials,omitempty"`      // reserved for the threshold coordinator
+	Threshold   *ThresholdKey      `json:"threshold,omitempty"`     // reserved for the threshold coordinator
+	VOPRFPubKey HexBytes           `json:"voprfPubKey,omitempty"`   // reserved for the voprf signature type
+	Elements    []HexBytes         `json:"elements,omitempty"`      // reserved for the voprf signature type
+	Proof       HexBytes           `json:"proof,omitempty"`         // reserved for the voprf signature type
+	Count       int                `json:"count,omitempty"`         // reserved for the blind signature batch and the log handler
+	Tokens      []HexBytes         `json:"tokens,omitempty"`        // reserved for the blind signature batch
+	Payloads    []HexBytes         `json:"payloads,omitempty"`      // reserved for the blind signature batch
+	Signatures  []HexBytes         `json:"signatures,omitempty"`    // reserved for the blind signature batch
+	Receipt     *Receipt           `json:"receipt,omitempty"`       // reserved for the signature handlers
+	PubKey      *ElectionKey       `json:"pubKey,omitempty"`        // reserved for the pubkey handler
+	SaltVersion uint8              `json:"saltVersion,omitempty"`   // reserved for the info handler
+	Revocations *RevocationList    `json:"revocations,omitempty"`   // reserved for the revocations handler
+	TreeHead    *TreeHead          `json:"treeHead,omitempty"`      // reserved for the log handler
+	LogProof    *LogProof          `json:"logProof,omitempty"`      // reserved for the log handler
+	// SessionState is set by the CSP with the state returned by the handler on the
+	// previous step of the auth session (see AuthResponse.SessionState). It is never
+	// read from (or sent to) the client.
+	SessionState []byte `json:"-"`
 }
 
 func (m *Message) Marshal() []byte {
@@ -91,6 +113,49 @@ type Election struct {
 	ExtraData         []string `json:"extra"`
 }
 
+// RootKey is the type used by the Info method for publishing the CSP root public keys.
+// Each election is signed with the key that was active when the CSP registered it.
+type RootKey struct {
+	ID          string     `json:"id"`
+	BlindPubKey HexBytes   `json:"blindPubKey"`
+	ECDSAPubKey HexBytes   `json:"ecdsaPubKey"`
+	BLSPubKey   HexBytes   `json:"blsPubKey,omitempty"`
+	NotBefore   time.Time  `json:"notBefore"`
+	NotAfter    *time.Time `json:"notAfter,omitempty"`
+	Active      bool       `json:"active"`
+}
+
+// ElectionKey is the type used by the pubkey handler for publishing the salted public
+// keys of an election (or the root public keys), so the election organizers do not
+// need to derive them. The ECDSA and blind public keys are compressed, and Address is
+// the Ethereum address of the ECDSA public key. SaltVersion is the salt derivation
+// used for the election (not set for the root public keys).
+type ElectionKey struct {
+	KeyID       string   `json:"keyId"`
+	BlindPubKey HexBytes `json:"blindPubKey"`
+	ECDSAPubKey HexBytes `json:"ecdsaPubKey"`
+	Address     string   `json:"address"`
+	BLSPubKey   HexBytes `json:"blsPubKey,omitempty"`
+	SaltVersion uint8    `json:"saltVersion,omitempty"`
+}
+
+// PartialSignature is the R point (and the partial blind signature, once signed)
+// issued by a CSP node holding the share Index of a threshold root key.
+type PartialSignature struct {
+	Index     int      `json:"index"`
+	TokenR    HexBytes `json:"token"`
+	Signature HexBytes `json:"signature,omitempty"`
+}
+
+// ThresholdKey is the public information of a root key split among several CSP
+// nodes. Threshold nodes are required for producing a signature valid for PubKey.
+type ThresholdKey struct {
+	Threshold   int        `json:"threshold"`
+	Shares      int        `json:"shares"`
+	PubKey      HexBytes   `json:"pubKey"`
+	Commitments []HexBytes `json:"commitments"`
+}
+
 // AuthField is the type used by the Info method for returning the description of the
 // authentication steps for the CSP implementation.
 type AuthField struct {
@@ -105,6 +170,13 @@ type AuthResponse struct {
 	Success   bool       // Either the authentication step is success or not
 	Response  []string   // Response can be used by the handler to provide arbitrary data to the client
 	AuthToken *uuid.UUID // Only if there is a next step
+	// Quota is the number of blind signatures the client can get with a single
+	// authentication (see Message.Count). Zero means one.
+	Quota int
+	// SessionState is an opaque handler state stored on the CSP auth session, so it is
+	// available on the next step (Message.SessionState) on any CSP replica. Only kept
+	// if a new AuthToken is returned.
+	SessionState []byte
 }
 
 func (a *AuthResponse) String() string {
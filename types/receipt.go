@@ -0,0 +1,63 @@
+package types
+
+import (
+	"fmt"
+
+	"github.com/vocdoni/blind-csp/types/receiptpb"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative receiptpb/receipt.proto
+
+// ReceiptVersion is the current version of the CSP proof receipts.
+const ReceiptVersion = 1
+
+// Receipt is a self-contained CSP proof: it includes everything required for
+// verifying that the CSP signed Payload for the election (see receipt.VerifyReceipt).
+// PubKey is the election salted public key of the signature type, derived from the
+// root key KeyID with the salt derivation SaltVersion (zero means version 1, the
+// only one available before the field was introduced). The protobuf representation
+// is receiptpb.Receipt.
+type Receipt struct {
+	Version       uint32   `json:"version"`
+	ElectionID    HexBytes `json:"electionId"`
+	SignatureType string   `json:"signatureType"`
+	KeyID         string   `json:"keyId"`
+	PubKey        HexBytes `json:"pubKey"`
+	Payload       HexBytes `json:"payload"`
+	Signature     HexBytes `json:"signature"`
+	SaltVersion   uint32   `json:"saltVersion,omitempty"`
+}
+
+// MarshalProto returns the protobuf encoding of the receipt (see receiptpb.Receipt).
+func (r *Receipt) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&receiptpb.Receipt{
+		Version:       r.Version,
+		ElectionId:    r.ElectionID,
+		SignatureType: r.SignatureType,
+		KeyId:         r.KeyID,
+		PubKey:        r.PubKey,
+		Payload:       r.Payload,
+		Signature:     r.Signature,
+		SaltVersion:   r.SaltVersion,
+	})
+}
+
+// UnmarshalProto decodes the protobuf encoded receipt. Unknown fields are ignored.
+func (r *Receipt) UnmarshalProto(b []byte) error {
+	pb := &receiptpb.Receipt{}
+	if err := proto.Unmarshal(b, pb); err != nil {
+		return fmt.Errorf("invalid receipt: %w", err)
+	}
+	*r = Receipt{
+		Version:       pb.Version,
+		ElectionID:    pb.ElectionId,
+		SignatureType: pb.SignatureType,
+		KeyID:         pb.KeyId,
+		PubKey:        pb.PubKey,
+		Payload:       pb.Payload,
+		Signature:     pb.Signature,
+		SaltVersion:   pb.SaltVersion,
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package types
+
+import "encoding/binary"
+
+// revocationDomain is the domain separation prefix of the revocation lists signed data.
+var revocationDomain = []byte("vocdoni/blind-csp/revocations")
+
+// RevocationList is the list of the ecdsa signatures revoked by the CSP for an election,
+// identified by the keccak256 hash of their payload (sorted). It is signed with the
+// election salted ECDSA key (PubKey, compressed) derived from the root key KeyID, so
+// tally verifiers can check it (see receipt.VerifyRevocationList). Signature is the
+// Ethereum signature of SignedData.
+type RevocationList struct {
+	ElectionID  HexBytes   `json:"electionId"`
+	KeyID       string     `json:"keyId"`
+	SaltVersion uint32     `json:"saltVersion,omitempty"`
+	PubKey      HexBytes   `json:"pubKey"`
+	Revoked     []HexBytes `json:"revoked"`
+	Timestamp   int64      `json:"timestamp"`
+	Signature   HexBytes   `json:"signature"`
+}
+
+// SignedData returns the data signed by the CSP: the domain prefix, the election ID,
+// the timestamp (8 bytes big-endian), the number of revoked hashes (4 bytes big-endian)
+// and the revoked hashes.
+func (l *RevocationList) SignedData() []byte {
+	data := append([]byte{}, revocationDomain...)
+	data = append(data, l.ElectionID...)
+	data = binary.BigEndian.AppendUint64(data, uint64(l.Timestamp))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(l.Revoked)))
+	for _, h := range l.Revoked {
+		data = append(data, h...)
+	}
+	return data
+}
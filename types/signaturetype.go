@@ -7,7 +7,16 @@ const (
 	SignatureTypeEthereum = "ecdsa"
 	// SignatureTypeSharedKey identifier the shared key (common for all users on the same processId)
 	SignatureTypeSharedKey = "sharedkey"
+	// SignatureTypeBlindRSA is a RSA blind signature (RFC 9474, RSABSSA-SHA384-PSS-Randomized)
+	SignatureTypeBlindRSA = "blindrsa"
+	// SignatureTypeBlindBLS is a BLS12-381 blind signature, verifiable in batch
+	SignatureTypeBlindBLS = "blindbls"
+	// SignatureTypeVOPRF issues privately verifiable tokens (RFC 9497 VOPRF, ristretto255-SHA512)
+	SignatureTypeVOPRF = "voprf"
 )
 
 // AllSignatures is a helper list that includes all available CSP signature schemes.
-var AllSignatures = []string{SignatureTypeBlind, SignatureTypeEthereum, SignatureTypeSharedKey}
+var AllSignatures = []string{
+	SignatureTypeBlind, SignatureTypeEthereum, SignatureTypeSharedKey, SignatureTypeBlindRSA,
+	SignatureTypeBlindBLS, SignatureTypeVOPRF,
+}
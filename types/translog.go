@@ -0,0 +1,43 @@
+package types
+
+import "encoding/binary"
+
+// treeHeadDomain is the domain separation prefix of the tree heads signed data.
+var treeHeadDomain = []byte("vocdoni/blind-csp/treehead")
+
+// TreeHead is the signed head of the issuance transparency log of an election: the
+// number of signatures issued (Size) and the Merkle root hash of their log leaves
+// (see the translog package). It is signed with the election salted ECDSA key (PubKey,
+// compressed) derived from the root key KeyID, so auditors can check it (see
+// receipt.VerifyTreeHead). Signature is the Ethereum signature of SignedData.
+type TreeHead struct {
+	ElectionID  HexBytes `json:"electionId"`
+	KeyID       string   `json:"keyId"`
+	SaltVersion uint32   `json:"saltVersion,omitempty"`
+	PubKey      HexBytes `json:"pubKey"`
+	Size        uint64   `json:"size"`
+	RootHash    HexBytes `json:"rootHash"`
+	Timestamp   int64    `json:"timestamp"`
+	Signature   HexBytes `json:"signature"`
+}
+
+// SignedData returns the data signed by the CSP: the domain prefix, the election ID,
+// the size (8 bytes big-endian), the root hash and the timestamp (8 bytes big-endian).
+func (th *TreeHead) SignedData() []byte {
+	data := append([]byte{}, treeHeadDomain...)
+	data = append(data, th.ElectionID...)
+	data = binary.BigEndian.AppendUint64(data, th.Size)
+	data = append(data, th.RootHash...)
+	return binary.BigEndian.AppendUint64(data, uint64(th.Timestamp))
+}
+
+// LogProof is a Merkle proof of the issuance transparency log, against the tree head
+// of TreeSize leaves. It is either the inclusion proof of LeafHash at LeafIndex, or
+// (if FromSize is set) the consistency proof of the tree of FromSize leaves.
+type LogProof struct {
+	TreeSize  uint64     `json:"treeSize"`
+	LeafIndex uint64     `json:"leafIndex"`
+	LeafHash  HexBytes   `json:"leafHash,omitempty"`
+	FromSize  uint64     `json:"fromSize,omitempty"`
+	Path      []HexBytes `json:"path"`
+}